@@ -3,7 +3,11 @@
 
 package apiparams
 
-import macaroon "gopkg.in/macaroon.v2"
+import (
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
 
 // Login holds parameters for making a login request.
 type Login struct {
@@ -16,12 +20,48 @@ type Login struct {
 	// authenticating as external users. An identity manager URL/token pair is
 	// usually provided.
 	Macaroons map[string]macaroon.Slice `json:"macaroons"`
+	// Controller optionally holds the name of the Juju controller to log
+	// into. It is required when the server is configured with more than one
+	// controller. If enabled by the server, the user is also logged into all
+	// the other controllers accepting the same credentials.
+	Controller string `json:"controller,omitempty"`
 }
 
 // Start holds parameters for making a start request.
 type Start struct {
 	// Operation holds the requested operation.
 	Operation Operation `json:"operation"`
+	// Flavour optionally holds the name of the environment to start, among
+	// the ones configured in the server, for instance providing a specific
+	// version of the Juju CLI. The default environment is used if empty. The
+	// container of the user must be stopped before choosing a different
+	// flavour.
+	Flavour string `json:"flavour,omitempty"`
+	// ResumeToken optionally holds the token returned by a previous start
+	// request, used for resuming the corresponding shell session after the
+	// client disconnected.
+	ResumeToken string `json:"resume-token,omitempty"`
+}
+
+// Stop holds parameters for making a stop or destroy request. These requests
+// can be sent after logging in and before starting the session. Stop requests
+// stop the container of the user, and destroy requests delete it, so that a
+// new one is created from scratch when the session is started. Destroying the
+// container does not reset the persistent home volume of the user, if any.
+type Stop struct {
+	// Operation holds the requested operation, either OpStop or OpDestroy.
+	Operation Operation `json:"operation"`
+}
+
+// Resize holds parameters for making a resize request. Resize requests can be
+// sent at any time after the session is started, in order to notify the
+// terminal about window size changes.
+type Resize struct {
+	// Operation holds the requested operation.
+	Operation Operation `json:"operation"`
+	// Rows and Cols hold the new terminal window size.
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
 }
 
 // Response holds a server response.
@@ -32,23 +72,62 @@ type Response struct {
 	Code ResponseCode `json:"code"`
 	// Message holds an optional response message.
 	Message string `json:"message"`
+	// Position holds the position of the request in the queue of container
+	// starts, starting from 1. It is only included in queued start responses.
+	Position int `json:"position,omitempty"`
+	// ResumeToken optionally holds the token that can be used for resuming the
+	// session. It is only included in successful start responses, and only if
+	// the server supports resuming sessions.
+	ResumeToken string `json:"resume-token,omitempty"`
+}
+
+// Session holds information about a user session, as returned by the admin
+// API when listing sessions.
+type Session struct {
+	// Container holds the name of the LXD container.
+	Container string `json:"container"`
+	// User holds the name of the user owning the container. It is empty if the
+	// container has not been used since the server started.
+	User string `json:"user"`
+	// Address holds the container address, if known.
+	Address string `json:"address"`
+	// StartTime holds the time at which the container was registered.
+	StartTime time.Time `json:"start-time"`
+	// LastActivity holds the time of the last activity on the container.
+	LastActivity time.Time `json:"last-activity"`
+}
+
+// Sessions holds the response to an admin API list sessions request.
+type Sessions struct {
+	// Sessions holds the current sessions.
+	Sessions []Session `json:"sessions"`
 }
 
 // Operation is a server operation.
 type Operation string
 
-// OpLogin, OpStart and OpStatus hold API request operations.
+// OpLogin, OpStart, OpStop, OpDestroy, OpResize, OpStatus and OpAdmin hold
+// API request operations. OpShutdown is used in the notice sent by the server
+// to live connections when shutting down.
 const (
-	OpLogin  Operation = "login"
-	OpStart  Operation = "start"
-	OpStatus Operation = "status"
+	OpLogin    Operation = "login"
+	OpStart    Operation = "start"
+	OpStop     Operation = "stop"
+	OpDestroy  Operation = "destroy"
+	OpResize   Operation = "resize"
+	OpStatus   Operation = "status"
+	OpAdmin    Operation = "admin"
+	OpShutdown Operation = "shutdown"
 )
 
 // ResponseCode is a server response code.
 type ResponseCode string
 
-// OK and Error hold the two possible response codes.
+// OK and Error hold the two possible final response codes. Queued is used in
+// interim start responses sent while the container start is waiting for
+// other containers to be stopped. A final response always follows.
 const (
-	OK    ResponseCode = "ok"
-	Error ResponseCode = "error"
+	OK     ResponseCode = "ok"
+	Error  ResponseCode = "error"
+	Queued ResponseCode = "queued"
 )
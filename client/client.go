@@ -0,0 +1,340 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package client implements a client for the jujushell WebSocket protocol.
+// The client logs into the server, starts the shell session and then exposes
+// the remote terminal as an io.ReadWriteCloser.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/errgo.v1"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/terminado"
+)
+
+// Params holds parameters for connecting to a jujushell server.
+type Params struct {
+	// Controller optionally holds the name of the Juju controller to log
+	// into. It is required when the server is configured with more than one
+	// controller.
+	Controller string
+	// Destroy optionally reports whether the existing container of the user
+	// must be destroyed before starting the session, so that the session
+	// runs in a new container created from scratch.
+	Destroy bool
+	// Dialer optionally holds the WebSocket dialer used to connect to the
+	// server, for instance for customizing the TLS configuration. If not
+	// provided, websocket.DefaultDialer is used.
+	Dialer *websocket.Dialer
+	// Flavour optionally holds the name of the environment to start, among
+	// the ones configured in the server.
+	Flavour string
+	// Header optionally holds headers included in the WebSocket handshake
+	// request, for instance the Origin header.
+	Header http.Header
+	// Macaroons, alternatively to Username and Password, maps cookie URLs to
+	// macaroons used for authenticating as external users.
+	Macaroons map[string]macaroon.Slice
+	// Queued optionally holds a function called with the position in the
+	// queue, starting from 1, while the server waits for other containers to
+	// be stopped before starting the session.
+	Queued func(position int)
+	// ResumeToken optionally holds the token returned when a previous session
+	// was started, used for resuming that session.
+	ResumeToken string
+	// URL holds the address of the jujushell server, for instance
+	// "wss://shell.example.com". HTTP URLs are also accepted, and converted
+	// to their WebSocket equivalents. The "/ws/" path is added automatically.
+	URL string
+	// Username and Password hold traditional Juju credentials for local users.
+	Username string
+	Password string
+}
+
+// Dial connects to the jujushell server, logs in and starts a shell session,
+// which is returned. The session must be closed after use.
+func Dial(p Params) (*Session, error) {
+	s, err := login(p)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if p.Destroy {
+		if _, err = s.call(apiparams.Stop{Operation: apiparams.OpDestroy}); err != nil {
+			s.conn.Close()
+			return nil, errgo.Notef(err, "cannot destroy container")
+		}
+	}
+	resp, err := s.call(apiparams.Start{
+		Operation:   apiparams.OpStart,
+		Flavour:     p.Flavour,
+		ResumeToken: p.ResumeToken,
+	})
+	if err != nil {
+		s.conn.Close()
+		return nil, errgo.Notef(err, "cannot start session")
+	}
+	s.WelcomeMessage = resp.Message
+	s.ResumeToken = resp.ResumeToken
+	return s, nil
+}
+
+// Stop connects to the jujushell server, logs in and stops the container of
+// the user, closing all its shell sessions.
+func Stop(p Params) error {
+	s, err := login(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer s.conn.Close()
+	if _, err = s.call(apiparams.Stop{Operation: apiparams.OpStop}); err != nil {
+		return errgo.Notef(err, "cannot stop container")
+	}
+	return nil
+}
+
+// login connects to the jujushell server and logs in. The returned session is
+// not started yet.
+func login(p Params) (*Session, error) {
+	u, err := wsURL(p.URL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, _, err := dialer.Dial(u, p.Header)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to %s", u)
+	}
+	s := &Session{
+		conn:   conn,
+		queued: p.Queued,
+	}
+	resp, err := s.call(apiparams.Login{
+		Operation:  apiparams.OpLogin,
+		Username:   p.Username,
+		Password:   p.Password,
+		Macaroons:  p.Macaroons,
+		Controller: p.Controller,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, errgo.Notef(err, "cannot log in")
+	}
+	s.LoginMessage = resp.Message
+	return s, nil
+}
+
+// ErrShutdown is returned by Session.Read when the server is shutting down.
+var ErrShutdown = errgo.New("server shutting down")
+
+// Session is a jujushell session. It implements io.ReadWriteCloser: data
+// written to the session is sent to the remote terminal as input, and data
+// read from the session is the terminal output. Read returns io.EOF when the
+// remote shell exits. It is safe to call Read concurrently with Write or
+// Resize, but concurrent calls to Read are not supported.
+type Session struct {
+	// LoginMessage holds the message returned by the server on login.
+	LoginMessage string
+	// WelcomeMessage holds the message returned by the server when the
+	// session is started.
+	WelcomeMessage string
+	// ResumeToken holds the token that can be used for resuming the session
+	// after disconnecting, or an empty string if the server does not support
+	// resuming sessions.
+	ResumeToken string
+
+	conn   *websocket.Conn
+	buf    []byte
+	queued func(position int)
+
+	// pending holds an incomplete UTF-8 encoded character left over by the
+	// last call to Write.
+	pending []byte
+
+	// mu protects writes to the WebSocket connection.
+	mu sync.Mutex
+}
+
+// Read implements io.Reader by reading the output of the remote terminal.
+func (s *Session) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if err := s.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// readMessage reads the next message from the server, storing terminal output
+// in the session buffer.
+func (s *Session) readMessage() error {
+	messageType, r, err := s.conn.NextReader()
+	if err != nil {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return io.EOF
+		}
+		return errgo.Notef(err, "cannot read message")
+	}
+	if messageType != websocket.TextMessage {
+		// Only text messages are used by the protocol.
+		return nil
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errgo.Notef(err, "cannot read message")
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) != 0 && trimmed[0] == '{' {
+		// This is a notice from the server rather than a Terminado message.
+		var resp apiparams.Response
+		if err = json.Unmarshal(data, &resp); err != nil {
+			return errgo.Notef(err, "cannot unmarshal server message")
+		}
+		if resp.Operation == apiparams.OpShutdown {
+			return ErrShutdown
+		}
+		return nil
+	}
+	typ, args, err := terminado.Decode(data)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	switch typ {
+	case terminado.Stdout:
+		if len(args) == 0 {
+			return nil
+		}
+		var out string
+		if err = json.Unmarshal(args[0], &out); err != nil {
+			return errgo.Notef(err, "cannot unmarshal terminal output")
+		}
+		s.buf = append(s.buf, out...)
+	case terminado.Disconnect:
+		return io.EOF
+	}
+	return nil
+}
+
+// Write implements io.Writer by sending the given data as input to the
+// remote terminal. Terminal input is sent as text, so an incomplete UTF-8
+// encoded character at the end of p is held back until the next call to
+// Write completes it.
+func (s *Session) Write(p []byte) (int, error) {
+	data := append(s.pending, p...)
+	n := len(data) - incompleteSuffix(data)
+	if n > 0 {
+		msg, err := terminado.Encode(terminado.Stdin, string(data[:n]))
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+		if err = s.write(msg); err != nil {
+			return 0, errgo.Mask(err)
+		}
+	}
+	s.pending = append([]byte(nil), data[n:]...)
+	return len(p), nil
+}
+
+// Resize notifies the remote terminal that the window size changed.
+func (s *Session) Resize(rows, cols int) error {
+	data, err := json.Marshal(apiparams.Resize{
+		Operation: apiparams.OpResize,
+		Rows:      rows,
+		Cols:      cols,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal resize request")
+	}
+	return errgo.Mask(s.write(data))
+}
+
+// Close implements io.Closer by closing the connection to the server. The
+// session can be resumed later using the resume token, if available.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	// Try to notify the server, ignoring errors as the connection is closed
+	// regardless.
+	s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// write sends the given text message to the server.
+func (s *Session) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return errgo.Notef(err, "cannot send message")
+	}
+	return nil
+}
+
+// incompleteSuffix returns the length of the incomplete UTF-8 encoded
+// character at the end of p, or 0 if p ends with a complete character.
+func incompleteSuffix(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// call sends the given request to the server and returns its response. An
+// error is returned if the server responds with an error. Interim queued
+// responses are reported to the queued function, if any.
+func (s *Session) call(req interface{}) (*apiparams.Response, error) {
+	if err := s.conn.WriteJSON(req); err != nil {
+		return nil, errgo.Notef(err, "cannot send request")
+	}
+	var resp apiparams.Response
+	for {
+		resp = apiparams.Response{}
+		if err := s.conn.ReadJSON(&resp); err != nil {
+			return nil, errgo.Notef(err, "cannot read response")
+		}
+		if resp.Code != apiparams.Queued {
+			break
+		}
+		if s.queued != nil {
+			s.queued(resp.Position)
+		}
+	}
+	if resp.Code != apiparams.OK {
+		return nil, errgo.New(resp.Message)
+	}
+	return &resp, nil
+}
+
+// wsURL returns the WebSocket URL of the jujushell API at the given server
+// address.
+func wsURL(addr string) (string, error) {
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		addr = "wss://" + strings.TrimPrefix(addr, "https://")
+	case strings.HasPrefix(addr, "http://"):
+		addr = "ws://" + strings.TrimPrefix(addr, "http://")
+	case strings.HasPrefix(addr, "wss://"), strings.HasPrefix(addr, "ws://"):
+	default:
+		return "", errgo.Newf("invalid server URL %q: scheme must be one of wss, ws, https or http", addr)
+	}
+	return strings.TrimSuffix(addr, "/") + "/ws/", nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package client_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/client"
+	"github.com/juju/jujushell/internal/terminado"
+)
+
+var dialTests = []struct {
+	about                  string
+	params                 client.Params
+	expectedLoginMessage   string
+	expectedWelcomeMessage string
+	expectedResumeToken    string
+	expectedError          string
+}{{
+	about: "userpass login",
+	params: client.Params{
+		Username: "who",
+		Password: "tardis",
+	},
+	expectedLoginMessage:   `logged in as "who"`,
+	expectedWelcomeMessage: "welcome",
+}, {
+	about: "session resumed",
+	params: client.Params{
+		Username:    "who",
+		Password:    "tardis",
+		ResumeToken: "resume-token",
+	},
+	expectedLoginMessage:   `logged in as "who"`,
+	expectedWelcomeMessage: "welcome back",
+	expectedResumeToken:    "resume-token",
+}, {
+	about: "session with flavour",
+	params: client.Params{
+		Username: "who",
+		Password: "tardis",
+		Flavour:  "juju3",
+	},
+	expectedLoginMessage:   `logged in as "who"`,
+	expectedWelcomeMessage: "welcome to juju3",
+}, {
+	about: "session in a new container",
+	params: client.Params{
+		Username: "who",
+		Password: "tardis",
+		Destroy:  true,
+	},
+	expectedLoginMessage:   `logged in as "who"`,
+	expectedWelcomeMessage: "welcome to a new container",
+}, {
+	about: "login failure",
+	params: client.Params{
+		Username: "who",
+		Password: "bad-wolf",
+	},
+	expectedError: "cannot log in: cannot log into juju: invalid credentials",
+}, {
+	about: "start failure",
+	params: client.Params{
+		Username:    "who",
+		Password:    "tardis",
+		ResumeToken: "bad-wolf",
+	},
+	expectedError: "cannot start session: invalid resume token",
+}, {
+	about: "destroy failure",
+	params: client.Params{
+		Controller: "broken",
+		Username:   "who",
+		Password:   "tardis",
+		Destroy:    true,
+	},
+	expectedError: "cannot destroy container: container not found",
+}}
+
+func TestDial(t *testing.T) {
+	c := qt.New(t)
+	server := httptest.NewServer(http.HandlerFunc(serveShell))
+	defer server.Close()
+
+	for _, test := range dialTests {
+		c.Run(test.about, func(c *qt.C) {
+			test.params.URL = server.URL
+			s, err := client.Dial(test.params)
+			if test.expectedError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectedError)
+				c.Assert(s, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			defer s.Close()
+			c.Assert(s.LoginMessage, qt.Equals, test.expectedLoginMessage)
+			c.Assert(s.WelcomeMessage, qt.Equals, test.expectedWelcomeMessage)
+			c.Assert(s.ResumeToken, qt.Equals, test.expectedResumeToken)
+		})
+	}
+}
+
+func TestDialQueued(t *testing.T) {
+	c := qt.New(t)
+	server := httptest.NewServer(http.HandlerFunc(serveShell))
+	defer server.Close()
+
+	var positions []int
+	s, err := client.Dial(client.Params{
+		Queued: func(position int) {
+			positions = append(positions, position)
+		},
+		ResumeToken: "queued",
+		URL:         server.URL,
+		Username:    "who",
+		Password:    "tardis",
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer s.Close()
+	c.Assert(positions, qt.DeepEquals, []int{2, 1})
+	c.Assert(s.WelcomeMessage, qt.Equals, "welcome")
+}
+
+func TestStop(t *testing.T) {
+	c := qt.New(t)
+	server := httptest.NewServer(http.HandlerFunc(serveShell))
+	defer server.Close()
+
+	err := client.Stop(client.Params{
+		URL:      server.URL,
+		Username: "who",
+		Password: "tardis",
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestStopFailure(t *testing.T) {
+	c := qt.New(t)
+	server := httptest.NewServer(http.HandlerFunc(serveShell))
+	defer server.Close()
+
+	err := client.Stop(client.Params{
+		Controller: "broken",
+		URL:        server.URL,
+		Username:   "who",
+		Password:   "tardis",
+	})
+	c.Assert(err, qt.ErrorMatches, "cannot stop container: container not found")
+}
+
+func TestDialInvalidURL(t *testing.T) {
+	c := qt.New(t)
+	s, err := client.Dial(client.Params{
+		URL: "ftp://1.2.3.4",
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid server URL "ftp://1.2.3.4": scheme must be one of wss, ws, https or http`)
+	c.Assert(s, qt.IsNil)
+}
+
+func TestSession(t *testing.T) {
+	c := qt.New(t)
+	server := httptest.NewServer(http.HandlerFunc(serveShell))
+	defer server.Close()
+	s, err := client.Dial(client.Params{
+		URL:      strings.Replace(server.URL, "http://", "ws://", 1) + "/",
+		Username: "who",
+		Password: "tardis",
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer s.Close()
+
+	// Input is echoed by the server.
+	_, err = io.WriteString(s, "ls\r")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(read(c, s, 5), qt.Equals, "ls\r\n")
+
+	// Output can be read in chunks.
+	_, err = io.WriteString(s, "hello\r")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(read(c, s, 2), qt.Equals, "he")
+	c.Assert(read(c, s, 10), qt.Equals, "llo\r\n")
+
+	// Multi-byte characters can be written one byte at a time.
+	for _, b := range []byte("€") {
+		n, err := s.Write([]byte{b})
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(n, qt.Equals, 1)
+	}
+	c.Assert(read(c, s, 10), qt.Equals, "€\n")
+
+	// Resize requests are sent to the server.
+	err = s.Resize(24, 80)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(read(c, s, 20), qt.Equals, "resized 24x80\r\n")
+
+	// EOF is returned when the shell exits.
+	_, err = io.WriteString(s, "exit\r")
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.Read(make([]byte, 10))
+	c.Assert(err, qt.Equals, io.EOF)
+}
+
+func TestSessionShutdown(t *testing.T) {
+	c := qt.New(t)
+	server := httptest.NewServer(http.HandlerFunc(serveShell))
+	defer server.Close()
+	s, err := client.Dial(client.Params{
+		URL:      server.URL,
+		Username: "who",
+		Password: "tardis",
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer s.Close()
+
+	_, err = io.WriteString(s, "shutdown\r")
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.Read(make([]byte, 10))
+	c.Assert(err, qt.Equals, client.ErrShutdown)
+}
+
+// read reads at most n bytes from the given reader.
+func read(c *qt.C, r io.Reader, n int) string {
+	buf := make([]byte, n)
+	n, err := r.Read(buf)
+	c.Assert(err, qt.Equals, nil)
+	return string(buf[:n])
+}
+
+// serveShell implements a fake jujushell server. Terminal input is echoed
+// back, except for the "exit" and "shutdown" commands, and resize requests
+// are acknowledged with a terminal output message. Stopping or destroying
+// the container fails when logged into the "broken" controller.
+func serveShell(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ws/" {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	respond := func(op apiparams.Operation, code apiparams.ResponseCode, msg, token string) {
+		conn.WriteJSON(apiparams.Response{
+			Operation:   op,
+			Code:        code,
+			Message:     msg,
+			ResumeToken: token,
+		})
+	}
+	var login apiparams.Login
+	if err := conn.ReadJSON(&login); err != nil || login.Operation != apiparams.OpLogin {
+		return
+	}
+	if login.Username != "who" || login.Password != "tardis" {
+		respond(apiparams.OpLogin, apiparams.Error, "cannot log into juju: invalid credentials", "")
+		return
+	}
+	respond(apiparams.OpLogin, apiparams.OK, fmt.Sprintf("logged in as %q", login.Username), "")
+	var start apiparams.Start
+	if err := conn.ReadJSON(&start); err != nil {
+		return
+	}
+	destroyed := false
+	switch start.Operation {
+	case apiparams.OpStop, apiparams.OpDestroy:
+		if login.Controller == "broken" {
+			respond(start.Operation, apiparams.Error, "container not found", "")
+			return
+		}
+		if start.Operation == apiparams.OpStop {
+			respond(apiparams.OpStop, apiparams.OK, "container stopped", "")
+			return
+		}
+		respond(apiparams.OpDestroy, apiparams.OK, "container destroyed", "")
+		destroyed = true
+		start = apiparams.Start{}
+		if err := conn.ReadJSON(&start); err != nil {
+			return
+		}
+	}
+	if start.Operation != apiparams.OpStart {
+		return
+	}
+	switch start.ResumeToken {
+	case "":
+		msg := "welcome"
+		if start.Flavour != "" {
+			msg += " to " + start.Flavour
+		}
+		if destroyed {
+			msg += " to a new container"
+		}
+		respond(apiparams.OpStart, apiparams.OK, msg, "")
+	case "resume-token":
+		respond(apiparams.OpStart, apiparams.OK, "welcome back", start.ResumeToken)
+	case "queued":
+		// Simulate waiting for other containers to be stopped.
+		for position := 2; position > 0; position-- {
+			conn.WriteJSON(apiparams.Response{
+				Operation: apiparams.OpStart,
+				Code:      apiparams.Queued,
+				Message:   "waiting",
+				Position:  position,
+			})
+		}
+		respond(apiparams.OpStart, apiparams.OK, "welcome", "")
+	default:
+		respond(apiparams.OpStart, apiparams.Error, "invalid resume token", "")
+		return
+	}
+	output := func(s string) {
+		data, _ := terminado.Encode(terminado.Stdout, s)
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var resize apiparams.Resize
+		if json.Unmarshal(data, &resize) == nil && resize.Operation == apiparams.OpResize {
+			output(fmt.Sprintf("resized %dx%d\r\n", resize.Rows, resize.Cols))
+			continue
+		}
+		typ, args, err := terminado.Decode(data)
+		if err != nil || typ != terminado.Stdin {
+			return
+		}
+		var in string
+		json.Unmarshal(args[0], &in)
+		switch in {
+		case "exit\r":
+			data, _ := terminado.Encode(terminado.Disconnect, 1)
+			conn.WriteMessage(websocket.TextMessage, data)
+		case "shutdown\r":
+			respond(apiparams.OpShutdown, apiparams.Error, "server shutting down", "")
+		default:
+			output(in + "\n")
+		}
+	}
+}
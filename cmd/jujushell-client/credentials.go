@@ -0,0 +1,124 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/juju/jujuclient"
+	cookiejar "github.com/juju/persistent-cookiejar"
+	"gopkg.in/errgo.v1"
+	macaroon "gopkg.in/macaroon.v2"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/jujushell/client"
+)
+
+// jujuDataDir returns the directory where Juju stores its local data,
+// following the same rules used by the Juju command line client.
+func jujuDataDir() (string, error) {
+	if dir := os.Getenv("JUJU_DATA"); dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "juju"), nil
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", errgo.New("cannot find Juju data directory: neither JUJU_DATA nor HOME are set")
+	}
+	return filepath.Join(home, ".local", "share", "juju"), nil
+}
+
+// currentController returns the name of the current Juju controller, as
+// stored in the controllers.yaml file in the given Juju data directory.
+func currentController(dir string) (string, error) {
+	var controllers jujuclient.Controllers
+	if err := readYAML(filepath.Join(dir, "controllers.yaml"), &controllers); err != nil {
+		return "", errgo.Mask(err)
+	}
+	if controllers.CurrentController == "" {
+		return "", errgo.New("no current controller, please specify a controller")
+	}
+	return controllers.CurrentController, nil
+}
+
+// setCredentials sets the credentials used for logging into the given Juju
+// controller in the given client parameters. Credentials are read from the
+// given Juju data directory: userpass credentials are taken from the
+// accounts.yaml file, and macaroons from the controller cookie jar otherwise.
+func setCredentials(p *client.Params, dir, controller string) error {
+	var accounts struct {
+		Controllers map[string]jujuclient.AccountDetails `yaml:"controllers"`
+	}
+	if err := readYAML(filepath.Join(dir, "accounts.yaml"), &accounts); err != nil {
+		return errgo.Mask(err)
+	}
+	account, ok := accounts.Controllers[controller]
+	if !ok {
+		return errgo.Newf("no credentials found for controller %q, please log in with juju", controller)
+	}
+	if account.Password != "" {
+		p.Username, p.Password = account.User, account.Password
+		return nil
+	}
+	ms, err := readMacaroons(filepath.Join(dir, "cookies", controller+".json"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(ms) == 0 {
+		return errgo.Newf("no credentials found for controller %q, please log in with juju", controller)
+	}
+	p.Macaroons = ms
+	return nil
+}
+
+// readMacaroons returns the macaroons stored in the cookie jar at the given
+// path, keyed by the URL they are associated with.
+func readMacaroons(path string) (map[string]macaroon.Slice, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{
+		Filename: path,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open cookie jar")
+	}
+	ms := make(map[string]macaroon.Slice)
+	for _, cookie := range jar.AllCookies() {
+		if !strings.HasPrefix(cookie.Name, "macaroon-") {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(cookie.Value)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decode cookie %q", cookie.Name)
+		}
+		var m macaroon.Slice
+		if err = json.Unmarshal(data, &m); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal macaroons in cookie %q", cookie.Name)
+		}
+		path := cookie.Path
+		if path == "" {
+			path = "/"
+		}
+		ms["https://"+cookie.Domain+path] = m
+	}
+	return ms, nil
+}
+
+// readYAML reads the YAML file at the given path into the value pointed to
+// by v.
+func readYAML(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errgo.Notef(err, "cannot read Juju data")
+	}
+	if err = yaml.Unmarshal(data, v); err != nil {
+		return errgo.Notef(err, "cannot unmarshal %q", path)
+	}
+	return nil
+}
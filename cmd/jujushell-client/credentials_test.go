@@ -0,0 +1,74 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/client"
+)
+
+func TestJujuDataDir(t *testing.T) {
+	c := qt.New(t)
+	c.Setenv("JUJU_DATA", "")
+	c.Setenv("XDG_DATA_HOME", "")
+	c.Setenv("HOME", "/home/who")
+	dir, err := jujuDataDir()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dir, qt.Equals, "/home/who/.local/share/juju")
+
+	c.Setenv("XDG_DATA_HOME", "/data")
+	dir, err = jujuDataDir()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dir, qt.Equals, "/data/juju")
+
+	c.Setenv("JUJU_DATA", "/juju")
+	dir, err = jujuDataDir()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(dir, qt.Equals, "/juju")
+}
+
+func TestCurrentController(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	_, err := currentController(dir)
+	c.Assert(err, qt.ErrorMatches, "cannot read Juju data: .*")
+
+	writeFile(c, dir, "controllers.yaml", "controllers: {}\n")
+	_, err = currentController(dir)
+	c.Assert(err, qt.ErrorMatches, "no current controller, please specify a controller")
+
+	writeFile(c, dir, "controllers.yaml", "controllers: {}\ncurrent-controller: ctrl\n")
+	name, err := currentController(dir)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(name, qt.Equals, "ctrl")
+}
+
+func TestSetCredentials(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	writeFile(c, dir, "accounts.yaml", `
+controllers:
+  ctrl:
+    user: who
+    password: tardis
+`)
+	var p client.Params
+	err := setCredentials(&p, dir, "ctrl")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Username, qt.Equals, "who")
+	c.Assert(p.Password, qt.Equals, "tardis")
+
+	err = setCredentials(&p, dir, "no-such")
+	c.Assert(err, qt.ErrorMatches, `no credentials found for controller "no-such", please log in with juju`)
+}
+
+func writeFile(c *qt.C, dir, name, content string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	c.Assert(err, qt.Equals, nil)
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/client"
+)
+
+var (
+	controller      = flag.String("controller", "", "name of the local Juju controller whose credentials are used (defaults to the current controller)")
+	destroy         = flag.Bool("destroy", false, "destroy the existing container before starting the session, so that it runs in a new one")
+	flavour         = flag.String("flavour", "", "name of the environment to start, among the ones configured in the server")
+	insecure        = flag.Bool("insecure", false, "skip verification of the server TLS certificate")
+	resumeToken     = flag.String("resume", "", "token for resuming a previous session")
+	shellController = flag.String("shell-controller", "", "name of the controller in the jujushell server, required if the server handles multiple controllers")
+	stop            = flag.Bool("stop", false, "stop the container in the jujushell server rather than starting a session")
+)
+
+// main connects the local terminal to a Juju Shell server.
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <server URL>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run starts a shell session on the Juju Shell server at the given URL, and
+// relays the local terminal to the remote one until the session ends. When
+// the -stop flag is provided, the container is stopped instead.
+func run(url string) error {
+	dir, err := jujuDataDir()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	name := *controller
+	if name == "" {
+		if name, err = currentController(dir); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	lastPosition := 0
+	p := client.Params{
+		Controller: *shellController,
+		Destroy:    *destroy,
+		Flavour:    *flavour,
+		Queued: func(position int) {
+			// The server also reports the position periodically.
+			if position != lastPosition {
+				fmt.Fprintf(os.Stderr, "waiting for a container to be available: position %d in queue\n", position)
+				lastPosition = position
+			}
+		},
+		ResumeToken: *resumeToken,
+		URL:         url,
+	}
+	if err = setCredentials(&p, dir, name); err != nil {
+		return errgo.Mask(err)
+	}
+	if *insecure {
+		dialer := *websocket.DefaultDialer
+		dialer.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+		p.Dialer = &dialer
+	}
+	if *stop {
+		if err = client.Stop(p); err != nil {
+			return errgo.Mask(err)
+		}
+		fmt.Fprintln(os.Stderr, "container stopped")
+		return nil
+	}
+	s, err := client.Dial(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer s.Close()
+	if s.WelcomeMessage != "" {
+		fmt.Fprintln(os.Stderr, s.WelcomeMessage)
+	}
+	if s.ResumeToken != "" {
+		fmt.Fprintf(os.Stderr, "resume this session with -resume %s\n", s.ResumeToken)
+	}
+
+	// Put the local terminal in raw mode, so that all input, including
+	// control sequences, is sent to the remote terminal.
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return errgo.Notef(err, "cannot set terminal in raw mode")
+		}
+		defer terminal.Restore(fd, state)
+		go relayResize(s, fd)
+	}
+
+	go func() {
+		// The session ends when the remote shell exits, so errors copying the
+		// input can be ignored.
+		io.Copy(s, os.Stdin)
+	}()
+	_, err = io.Copy(os.Stdout, s)
+	if errgo.Cause(err) == client.ErrShutdown {
+		return errgo.New("session interrupted: the server is shutting down")
+	}
+	if err != nil {
+		return errgo.Notef(err, "session interrupted")
+	}
+	return nil
+}
+
+// relayResize notifies the remote terminal of the local terminal window size,
+// both initially and every time the window is resized.
+func relayResize(s *client.Session, fd int) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+	for {
+		cols, rows, err := terminal.GetSize(fd)
+		if err == nil {
+			s.Resize(rows, cols)
+		}
+		<-sigCh
+	}
+}
@@ -4,14 +4,17 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
@@ -19,6 +22,7 @@ import (
 
 	"github.com/juju/jujushell"
 	"github.com/juju/jujushell/config"
+	"github.com/juju/jujushell/internal/audit"
 	"github.com/juju/jujushell/internal/logging"
 )
 
@@ -49,16 +53,13 @@ func serve(configPath string) error {
 	log.SetLevel(conf.LogLevel)
 	defer log.Sync()
 	log.Infow("starting the server", "log level", conf.LogLevel, "port", conf.Port)
-	handler, err := jujushell.NewServer(jujushell.Params{
-		AllowedUsers:    conf.AllowedUsers,
-		ImageName:       conf.ImageName,
-		JujuAddrs:       conf.JujuAddrs,
-		JujuCert:        conf.JujuCert,
-		LXDSocketPath:   conf.LXDSocketPath,
-		Profiles:        conf.Profiles,
-		SessionDuration: time.Duration(conf.SessionTimeout) * time.Minute,
-		WelcomeMessage:  conf.WelcomeMessage,
-	})
+	if conf.AuditLog != "" {
+		if err = audit.Open(conf.AuditLog); err != nil {
+			return errgo.Mask(err)
+		}
+		defer audit.Close()
+	}
+	handler, err := jujushell.NewServer(serverParams(conf))
 	if err != nil {
 		return errgo.Notef(err, "cannot create new server")
 	}
@@ -70,11 +71,167 @@ func serve(configPath string) error {
 		Addr:    ":" + strconv.Itoa(conf.Port),
 		Handler: handler,
 	}
-	if tlsConf != nil {
-		server.TLSConfig = tlsConf
-		return server.ListenAndServeTLS("", "")
+	errCh := make(chan error, 1)
+	go func() {
+		if tlsConf != nil {
+			server.TLSConfig = tlsConf
+			errCh <- server.ListenAndServeTLS("", "")
+			return
+		}
+		errCh <- server.ListenAndServe()
+	}()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case err = <-errCh:
+			return err
+		case sig = <-sigCh:
+		}
+		if sig == syscall.SIGHUP {
+			// Reload the configuration.
+			sig = nil
+			reload(configPath, handler)
+		}
+	}
+
+	// Gracefully shut down the server.
+	drainTimeout := time.Duration(conf.DrainTimeout) * time.Second
+	log.Infow("shutting down the server", "signal", sig.String(), "drain timeout", drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err = handler.Shutdown(ctx); err != nil {
+		log.Infow("cannot drain all connections", "err", err)
+	}
+	if err = server.Shutdown(ctx); err != nil {
+		log.Infow("cannot shut down the HTTP server", "err", err)
+	}
+	log.Infow("server stopped")
+	return nil
+}
+
+// reload reads the configuration file at the given path, and applies it to
+// the given running server. Errors are logged, in which case the current
+// configuration is preserved.
+func reload(configPath string, s *jujushell.Server) {
+	log := logging.Log()
+	log.Infow("reloading configuration", "path", configPath)
+	conf, err := config.Read(configPath)
+	if err != nil {
+		log.Errorw("cannot reload configuration", "err", err)
+		return
+	}
+	log.SetLevel(conf.LogLevel)
+	s.Reload(serverParams(conf))
+}
+
+// serverParams returns the server parameters from the given configuration.
+func serverParams(conf *config.Config) jujushell.Params {
+	return jujushell.Params{
+		AdminUsers:          conf.AdminUsers,
+		AllowedOrigins:      conf.AllowedOrigins,
+		AllowedUsers:        conf.AllowedUsers,
+		ContainerExpiry:     time.Duration(conf.ContainerExpiry) * time.Minute,
+		Controllers:         controllers(conf.Controllers),
+		Flavours:            flavours(conf.Flavours),
+		HomeVolumePool:      conf.HomeVolumePool,
+		ImageName:           conf.ImageName,
+		ImageRules:          imageRules(conf.ImageRules),
+		JujuAddrs:           conf.JujuAddrs,
+		JujuCert:            conf.JujuCert,
+		Limits:              limits(conf.Limits),
+		LockoutDuration:     time.Duration(conf.LockoutDuration) * time.Minute,
+		LockoutThreshold:    conf.LockoutThreshold,
+		LoginAllControllers: conf.LoginAllControllers,
+		LoginRateLimit:      conf.LoginRateLimit,
+		LXDSocketPath:       conf.LXDSocketPath,
+		MaxContainers:       conf.MaxContainers,
+		MaxSessionsPerAddr:  conf.MaxSessionsPerAddr,
+		MaxSessionsPerUser:  conf.MaxSessionsPerUser,
+		PoolSize:            conf.PoolSize,
+		PreservedFiles:      conf.PreservedFiles,
+		Profiles:            conf.Profiles,
+		RecordDir:           conf.RecordDir,
+		RecordInput:         conf.RecordInput,
+		RecordRetention:     time.Duration(conf.RecordRetention) * 24 * time.Hour,
+		ResumeDuration:      time.Duration(conf.ResumeTimeout) * time.Minute,
+		SessionDuration:     time.Duration(conf.SessionTimeout) * time.Minute,
+		StartQueueSize:      conf.StartQueueSize,
+		UserLimits:          userLimits(conf.UserLimits),
+		WelcomeMessage:      conf.WelcomeMessage,
+	}
+}
+
+// controllers returns the server controllers from the given configured ones.
+func controllers(ctrls map[string]config.Controller) map[string]jujushell.Controller {
+	if ctrls == nil {
+		return nil
+	}
+	result := make(map[string]jujushell.Controller, len(ctrls))
+	for name, ctrl := range ctrls {
+		result[name] = jujushell.Controller{
+			Addrs: ctrl.Addrs,
+			Cert:  ctrl.Cert,
+		}
+	}
+	return result
+}
+
+// flavours returns the server flavours from the given configured ones.
+func flavours(fs map[string]config.Flavour) map[string]jujushell.Flavour {
+	if fs == nil {
+		return nil
+	}
+	result := make(map[string]jujushell.Flavour, len(fs))
+	for name, f := range fs {
+		result[name] = jujushell.Flavour{
+			ImageName: f.ImageName,
+			Limits:    limits(f.Limits),
+			Profiles:  f.Profiles,
+			Users:     f.Users,
+		}
+	}
+	return result
+}
+
+// imageRules returns the server image rules from the given configured ones.
+func imageRules(rules []config.ImageRule) []jujushell.ImageRule {
+	if rules == nil {
+		return nil
+	}
+	result := make([]jujushell.ImageRule, len(rules))
+	for i, r := range rules {
+		result[i] = jujushell.ImageRule{
+			Users:     r.Users,
+			ImageName: r.ImageName,
+			Profiles:  r.Profiles,
+		}
+	}
+	return result
+}
+
+// userLimits returns the server per-user limits from the given configured
+// ones.
+func userLimits(ls map[string]config.Limits) map[string]jujushell.Limits {
+	if ls == nil {
+		return nil
+	}
+	result := make(map[string]jujushell.Limits, len(ls))
+	for user, l := range ls {
+		result[user] = limits(l)
+	}
+	return result
+}
+
+// limits returns the server resource limits from the given configured ones.
+func limits(l config.Limits) jujushell.Limits {
+	return jujushell.Limits{
+		CPU:       l.CPU,
+		Memory:    l.Memory,
+		Processes: l.Processes,
+		Disk:      l.Disk,
 	}
-	return server.ListenAndServe()
 }
 
 // tlsConfig returns a TLS configuration for the given keys and DNS name.
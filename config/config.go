@@ -6,6 +6,7 @@ package config
 import (
 	"io/ioutil"
 	"os"
+	"path"
 	"strings"
 
 	"go.uber.org/zap/zapcore"
@@ -15,40 +16,212 @@ import (
 
 // Config holds the server configuration.
 type Config struct {
+	// AdminUsers optionally holds a list of names of users allowed to use the
+	// admin API, for listing sessions and stopping or deleting containers. The
+	// admin API is disabled if the list is empty.
+	AdminUsers []string `yaml:"admin-users"`
+	// AllowedOrigins optionally holds patterns of origins allowed to open
+	// WebSocket connections, for instance "jujucharms.com" or
+	// "https://*.example.com". Patterns can include "*" wildcards. All
+	// origins are allowed if the list is empty.
+	AllowedOrigins []string `yaml:"allowed-origins"`
 	// AllowedUsers optionally holds a list of names of users allowed to use
 	// the service. An empty list means that all users who can authenticate
 	// against the controller are allowed. For external users, names must
 	// include the "@external" suffix.
 	AllowedUsers []string `yaml:"allowed-users"`
+	// AuditLog optionally holds the path to a file where audit events, like
+	// logins and the lifecycle of containers and sessions, are appended in
+	// JSON format, one event per line. Events are not audited if empty.
+	AuditLog string `yaml:"audit-log"`
+	// ContainerExpiry holds the number of minutes of inactivity to wait before
+	// deleting stopped containers, including the Juju data of their users. A
+	// zero value means that containers are never deleted.
+	ContainerExpiry int `yaml:"container-expiry"`
+	// Controllers optionally holds the Juju controllers users can log into,
+	// keyed by controller name. Alternatively, a single controller can be
+	// specified using JujuAddrs and JujuCert.
+	Controllers map[string]Controller `yaml:"controllers"`
 	// DNSName optionally holds the DNS name to use for Let's Encrypt.
 	DNSName string `yaml:"dns-name"`
+	// DrainTimeout holds the number of seconds to wait, when the server is
+	// shutting down, for live connections to be closed before forcibly closing
+	// them. Users are notified about the shutdown. It defaults to 30 seconds.
+	// A zero value means that connections are closed immediately.
+	DrainTimeout int `yaml:"drain-timeout"`
+	// Flavours optionally holds the environments users can choose from when
+	// starting a session, keyed by name, for instance to provide both Juju
+	// 2.x and Juju 3.x CLI environments. Each flavour can select a specific
+	// image, profiles and resource limits. Note that users have a single
+	// container: a stopped container is recreated when a different flavour
+	// is chosen, while running containers must be stopped first.
+	Flavours map[string]Flavour `yaml:"flavours"`
+	// HomeVolumePool optionally holds the name of the LXD storage pool where
+	// persistent per-user volumes are created and attached to new containers
+	// as the "persistent" directory in the users' home, so that files stored
+	// there survive the deletion of containers, for instance when they expire
+	// or when the image changes. The rest of the home directory is provided
+	// by the image. No files are persisted if empty. It cannot be used with
+	// the container pool.
+	HomeVolumePool string `yaml:"home-volume-pool"`
 	// ImageName holds the name of the LXD image to use to create containers.
 	ImageName string `yaml:"image-name"`
-	// JujuAddrs holds the addresses of the current Juju controller.
+	// ImageRules optionally holds rules selecting a specific image and
+	// profiles for some users, for instance to provide a richer image to
+	// administrators. Rules are checked in order, and the first one matching
+	// the user applies. Users not matching any rule get ImageName and
+	// Profiles.
+	ImageRules []ImageRule `yaml:"image-rules"`
+	// JujuAddrs holds the addresses of the Juju controller, when only one
+	// controller is used.
 	JujuAddrs []string `yaml:"juju-addrs"`
 	// JujuCert holds the CA certificate that will be used to validate the
 	// controller's certificate, in PEM format.
 	JujuCert string `yaml:"juju-cert"`
+	// Limits optionally holds the resource limits applied to containers when
+	// they are created. By default, only the limits defined in the LXD
+	// profiles apply.
+	Limits Limits `yaml:"limits"`
+	// LockoutDuration holds the number of minutes for which users and remote
+	// hosts are locked out after too many failed login attempts.
+	LockoutDuration int `yaml:"lockout-duration"`
+	// LockoutThreshold optionally holds the number of consecutive login
+	// attempts with invalid credentials, from the same remote host or for the
+	// same user from that host, after which further attempts are refused for
+	// LockoutDuration minutes. A zero value disables lockouts.
+	LockoutThreshold int `yaml:"lockout-threshold"`
+	// LoginAllControllers holds whether users logging into one of the
+	// Controllers are also logged into all the other ones, using the same
+	// credentials, so that all of them are available in the shell session.
+	// Note that this sends user credentials to all the controllers. By
+	// default, users are only logged into the controller they choose.
+	LoginAllControllers bool `yaml:"login-all-controllers"`
+	// LoginRateLimit optionally holds the maximum number of login attempts
+	// per minute allowed from the same remote host. Further attempts are
+	// refused before contacting the controller. A zero value means no limit.
+	LoginRateLimit int `yaml:"login-rate-limit"`
 	// LogLevel holds the logging level to use when running the server.
 	LogLevel zapcore.Level `yaml:"log-level"`
 	// LXDSocketPath holds the path to the LXD unix socket.
 	LXDSocketPath string `yaml:"lxd-socket-path"`
+	// MaxContainers optionally holds the maximum number of user containers
+	// running at the same time on the host. When the maximum is reached, new
+	// container starts are queued, and users are notified about their
+	// position in the queue. Pre-warmed containers in the pool are included.
+	// A zero value means no limit.
+	MaxContainers int `yaml:"max-containers"`
+	// MaxSessionsPerAddr optionally holds the maximum number of simultaneous
+	// WebSocket sessions allowed from the same remote host. A zero value
+	// means no limit.
+	MaxSessionsPerAddr int `yaml:"max-sessions-per-addr"`
+	// MaxSessionsPerUser optionally holds the maximum number of simultaneous
+	// WebSocket sessions allowed for the same user. A zero value means no
+	// limit.
+	MaxSessionsPerUser int `yaml:"max-sessions-per-user"`
+	// PoolSize optionally holds the number of pre-warmed containers to keep
+	// ready to be assigned to users without a container, in order to reduce
+	// session start latency. A zero value disables the pool.
+	PoolSize int `yaml:"pool-size"`
+	// PreservedFiles optionally holds the paths of user files, relative to
+	// the home directory, copied to the new container when a stopped
+	// container is recreated because ImageName now refers to a different
+	// image, for instance ".bash_history".
+	PreservedFiles []string `yaml:"preserved-files"`
 	// Port holds the port on which the server will start listening.
 	Port int `yaml:"port"`
 	// Profiles holds the LXD profiles to use when launching containers.
 	Profiles []string `yaml:"profiles"`
+	// RecordDir optionally holds the directory where shell sessions are
+	// recorded in the asciicast v2 format, so that they can be audited and
+	// replayed. Sessions are not recorded if empty.
+	RecordDir string `yaml:"record-dir"`
+	// RecordInput holds whether to also record the terminal input typed by
+	// users. Note that the input may include sensitive data like passwords.
+	RecordInput bool `yaml:"record-input"`
+	// RecordRetention holds the number of days session recordings are kept
+	// before being removed. A zero value means that recordings are never
+	// removed.
+	RecordRetention int `yaml:"record-retention"`
+	// ResumeTimeout holds the number of minutes to wait, after the client
+	// disconnects, before closing the shell session. During this time the
+	// same user can resume the session by reconnecting. A zero value means
+	// that sessions cannot be resumed.
+	ResumeTimeout int `yaml:"resume-timeout"`
 	// SessionTimeout holds the number of minutes of inactivity to wait before
 	// expiring a session and stopping the container instance. A zero value
 	// means that the session never expires.
 	SessionTimeout int `yaml:"session-timeout"`
+	// StartQueueSize holds the maximum number of container starts waiting in
+	// the queue when MaxContainers is reached. Further starts are refused. It
+	// defaults to 10. A zero value disables queuing: starts are refused as
+	// soon as MaxContainers is reached.
+	StartQueueSize int `yaml:"start-queue-size"`
 	// TLSCert and TLSKey optionally hold TLS info for running the server.
 	TLSCert string `yaml:"tls-cert"`
 	TLSKey  string `yaml:"tls-key"`
+	// UserLimits optionally holds resource limits for specific users, keyed
+	// by user name. Specified values override the global limits.
+	UserLimits map[string]Limits `yaml:"user-limits"`
 	// WelcomeMessage optionally holds a message to be displayed when users
 	// start the shell session.
 	WelcomeMessage string `yaml:"welcome-message"`
 }
 
+// Controller holds information about a Juju controller.
+type Controller struct {
+	// Addrs holds the addresses of the Juju controller.
+	Addrs []string `yaml:"addrs"`
+	// Cert optionally holds the CA certificate that will be used to validate
+	// the controller's certificate, in PEM format.
+	Cert string `yaml:"cert"`
+}
+
+// Flavour holds an environment users can choose when starting a session.
+type Flavour struct {
+	// ImageName optionally holds the name of the LXD image to use. The image
+	// otherwise selected for the user is used if empty.
+	ImageName string `yaml:"image-name"`
+	// Limits optionally holds resource limits overriding the ones otherwise
+	// applied to the user's container.
+	Limits Limits `yaml:"limits"`
+	// Profiles optionally holds the LXD profiles to use. The profiles
+	// otherwise selected for the user are used if empty.
+	Profiles []string `yaml:"profiles"`
+	// Users optionally holds the names of the users allowed to choose the
+	// flavour. Names can include "*" wildcards. All users are allowed if
+	// empty.
+	Users []string `yaml:"users"`
+}
+
+// ImageRule holds the image and profiles used to create containers for
+// specific users.
+type ImageRule struct {
+	// Users holds the names of the users the rule applies to. Names can
+	// include "*" wildcards, for instance "*@external" for all external
+	// users.
+	Users []string `yaml:"users"`
+	// ImageName optionally holds the name of the LXD image to use. The
+	// global image is used if empty.
+	ImageName string `yaml:"image-name"`
+	// Profiles optionally holds the LXD profiles to use. The global profiles
+	// are used if empty.
+	Profiles []string `yaml:"profiles"`
+}
+
+// Limits holds resource limits for containers. Empty values mean that no
+// limits are set.
+type Limits struct {
+	// CPU holds the number of CPUs or the CPU set available to containers,
+	// for instance "2" or "0-3".
+	CPU string `yaml:"cpu"`
+	// Memory holds the memory limit, for instance "2GB" or "50%".
+	Memory string `yaml:"memory"`
+	// Processes holds the maximum number of processes in containers.
+	Processes int `yaml:"processes"`
+	// Disk holds the size of the container root disk, for instance "10GB".
+	Disk string `yaml:"disk"`
+}
+
 // Read reads the configuration options from a file at the given path.
 func Read(path string) (*Config, error) {
 	f, err := os.Open(path)
@@ -60,7 +233,11 @@ func Read(path string) (*Config, error) {
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot read %q", path)
 	}
-	var config Config
+	// Options not specified in the file keep their default values.
+	config := Config{
+		DrainTimeout:   defaultDrainTimeout,
+		StartQueueSize: defaultStartQueueSize,
+	}
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot parse %q", path)
@@ -71,13 +248,22 @@ func Read(path string) (*Config, error) {
 	return &config, nil
 }
 
+const (
+	// defaultDrainTimeout holds the default number of seconds to wait for
+	// live connections to be closed when the server is shutting down.
+	defaultDrainTimeout = 30
+	// defaultStartQueueSize holds the default maximum number of container
+	// starts waiting in the queue.
+	defaultStartQueueSize = 10
+)
+
 // validate validates the configuration options.
 func validate(c Config) error {
 	var missing []string
 	if c.ImageName == "" {
 		missing = append(missing, "image-name")
 	}
-	if len(c.JujuAddrs) == 0 {
+	if len(c.JujuAddrs) == 0 && len(c.Controllers) == 0 {
 		missing = append(missing, "juju-addrs")
 	}
 	if c.LXDSocketPath == "" {
@@ -92,6 +278,16 @@ func validate(c Config) error {
 	if len(missing) != 0 {
 		return errgo.Newf("missing fields: %s", strings.Join(missing, ", "))
 	}
+	if len(c.Controllers) != 0 {
+		if len(c.JujuAddrs) != 0 || c.JujuCert != "" {
+			return errgo.New("cannot specify both controllers and juju-addrs or juju-cert")
+		}
+		for name, ctrl := range c.Controllers {
+			if len(ctrl.Addrs) == 0 {
+				return errgo.Newf("missing addrs for controller %q", name)
+			}
+		}
+	}
 	if c.DNSName != "" {
 		if c.TLSCert != "" || c.TLSKey != "" {
 			return errgo.New("cannot specify both DNS name for Let's Encrypt and TLS keys at the same time")
@@ -103,5 +299,84 @@ func validate(c Config) error {
 	if c.SessionTimeout < 0 {
 		return errgo.New("cannot specify a negative session timeout")
 	}
+	if c.ResumeTimeout < 0 {
+		return errgo.New("cannot specify a negative resume timeout")
+	}
+	if c.ContainerExpiry < 0 {
+		return errgo.New("cannot specify a negative container expiry")
+	}
+	if c.ContainerExpiry != 0 && c.ContainerExpiry <= c.SessionTimeout {
+		return errgo.New("cannot specify a container expiry not greater than the session timeout")
+	}
+	if c.DrainTimeout < 0 {
+		return errgo.New("cannot specify a negative drain timeout")
+	}
+	if c.PoolSize < 0 {
+		return errgo.New("cannot specify a negative pool size")
+	}
+	if c.PoolSize != 0 && c.HomeVolumePool != "" {
+		return errgo.New("cannot specify both pool size and home volume pool")
+	}
+	for i, r := range c.ImageRules {
+		if len(r.Users) == 0 {
+			return errgo.Newf("missing users for image rule %d", i)
+		}
+		if r.ImageName == "" && len(r.Profiles) == 0 {
+			return errgo.Newf("missing image name and profiles for image rule %d", i)
+		}
+		for _, u := range r.Users {
+			// Matching the pattern against itself reports syntax errors.
+			if _, err := path.Match(u, u); err != nil {
+				return errgo.Newf("invalid user pattern %q for image rule %d", u, i)
+			}
+		}
+	}
+	for name, f := range c.Flavours {
+		if name == "" {
+			return errgo.New("missing flavour name")
+		}
+		if f.Limits.Processes < 0 {
+			return errgo.Newf("cannot specify a negative processes limit for flavour %q", name)
+		}
+		for _, u := range f.Users {
+			if _, err := path.Match(u, u); err != nil {
+				return errgo.Newf("invalid user pattern %q for flavour %q", u, name)
+			}
+		}
+	}
+	for _, f := range c.PreservedFiles {
+		if path.IsAbs(f) || path.Clean(f) != f || f == "." || f == ".." || strings.HasPrefix(f, "../") {
+			return errgo.Newf("invalid preserved file %q: path must be relative to the home directory", f)
+		}
+	}
+	if c.LoginRateLimit < 0 {
+		return errgo.New("cannot specify a negative login rate limit")
+	}
+	if c.LockoutThreshold < 0 || c.LockoutDuration < 0 {
+		return errgo.New("cannot specify a negative lockout threshold or duration")
+	}
+	if c.LockoutThreshold != 0 && c.LockoutDuration == 0 {
+		return errgo.New("cannot specify a lockout threshold without a lockout duration")
+	}
+	if c.MaxSessionsPerAddr < 0 || c.MaxSessionsPerUser < 0 {
+		return errgo.New("cannot specify a negative maximum number of sessions")
+	}
+	if c.MaxContainers < 0 {
+		return errgo.New("cannot specify a negative maximum number of containers")
+	}
+	if c.StartQueueSize < 0 {
+		return errgo.New("cannot specify a negative start queue size")
+	}
+	if c.RecordRetention < 0 {
+		return errgo.New("cannot specify a negative record retention")
+	}
+	if c.Limits.Processes < 0 {
+		return errgo.New("cannot specify a negative processes limit")
+	}
+	for user, l := range c.UserLimits {
+		if l.Processes < 0 {
+			return errgo.Newf("cannot specify a negative processes limit for user %q", user)
+		}
+	}
 	return nil
 }
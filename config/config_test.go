@@ -23,27 +23,125 @@ var readTests = []struct {
 }{{
 	about: "valid config",
 	content: mustMarshalYAML(map[string]interface{}{
-		"allowed-users":   []string{"who", "dalek"},
-		"image-name":      "myimage",
-		"juju-addrs":      []string{"1.2.3.4", "4.3.2.1"},
-		"juju-cert":       "my Juju cert",
-		"log-level":       "debug",
-		"lxd-socket-path": "/var/snap/lxd/common/lxd/unix.socket",
-		"port":            8047,
-		"profiles":        []string{"default", "termserver"},
-		"session-timeout": 42,
+		"admin-users":      []string{"rose"},
+		"allowed-origins":  []string{"jujucharms.com", "*.example.com"},
+		"allowed-users":    []string{"who", "dalek"},
+		"audit-log":        "/var/log/jujushell/audit.log",
+		"container-expiry": 1440,
+		"drain-timeout":    30,
+		"flavours": map[string]interface{}{
+			"juju3": map[string]interface{}{
+				"image-name": "myimage-juju3",
+				"limits": map[string]interface{}{
+					"memory": "4GB",
+				},
+			},
+			"sre": map[string]interface{}{
+				"profiles": []string{"default", "sre"},
+				"users":    []string{"rose", "*@sre"},
+			},
+		},
+		"image-name": "myimage",
+		"image-rules": []map[string]interface{}{{
+			"users":      []string{"rose", "*@example"},
+			"image-name": "myimage-sre",
+			"profiles":   []string{"default", "sre"},
+		}, {
+			"users":    []string{"*@external"},
+			"profiles": []string{"default", "workshop"},
+		}},
+		"juju-addrs": []string{"1.2.3.4", "4.3.2.1"},
+		"juju-cert":  "my Juju cert",
+		"limits": map[string]interface{}{
+			"cpu":       "2",
+			"memory":    "2GB",
+			"processes": 500,
+			"disk":      "10GB",
+		},
+		"lockout-duration":      15,
+		"lockout-threshold":     5,
+		"log-level":             "debug",
+		"login-rate-limit":      10,
+		"lxd-socket-path":       "/var/snap/lxd/common/lxd/unix.socket",
+		"max-containers":        50,
+		"max-sessions-per-addr": 20,
+		"max-sessions-per-user": 2,
+		"pool-size":             3,
+		"port":                  8047,
+		"preserved-files":       []string{".bash_history", ".config/app.conf"},
+		"profiles":              []string{"default", "termserver"},
+		"record-dir":            "/var/log/jujushell/sessions",
+		"record-input":          true,
+		"record-retention":      30,
+		"resume-timeout":        5,
+		"session-timeout":       42,
+		"start-queue-size":      100,
+		"user-limits": map[string]interface{}{
+			"who": map[string]interface{}{
+				"memory": "4GB",
+			},
+		},
 		"welcome-message": "exterminate!",
 	}),
 	expectedConfig: &config.Config{
-		AllowedUsers:   []string{"who", "dalek"},
-		ImageName:      "myimage",
-		JujuAddrs:      []string{"1.2.3.4", "4.3.2.1"},
-		JujuCert:       "my Juju cert",
-		LogLevel:       zapcore.DebugLevel,
-		LXDSocketPath:  "/var/snap/lxd/common/lxd/unix.socket",
-		Port:           8047,
-		Profiles:       []string{"default", "termserver"},
-		SessionTimeout: 42,
+		AdminUsers:      []string{"rose"},
+		AllowedOrigins:  []string{"jujucharms.com", "*.example.com"},
+		AllowedUsers:    []string{"who", "dalek"},
+		AuditLog:        "/var/log/jujushell/audit.log",
+		ContainerExpiry: 1440,
+		DrainTimeout:    30,
+		Flavours: map[string]config.Flavour{
+			"juju3": {
+				ImageName: "myimage-juju3",
+				Limits: config.Limits{
+					Memory: "4GB",
+				},
+			},
+			"sre": {
+				Profiles: []string{"default", "sre"},
+				Users:    []string{"rose", "*@sre"},
+			},
+		},
+		ImageName: "myimage",
+		ImageRules: []config.ImageRule{{
+			Users:     []string{"rose", "*@example"},
+			ImageName: "myimage-sre",
+			Profiles:  []string{"default", "sre"},
+		}, {
+			Users:    []string{"*@external"},
+			Profiles: []string{"default", "workshop"},
+		}},
+		JujuAddrs: []string{"1.2.3.4", "4.3.2.1"},
+		JujuCert:  "my Juju cert",
+		Limits: config.Limits{
+			CPU:       "2",
+			Memory:    "2GB",
+			Processes: 500,
+			Disk:      "10GB",
+		},
+		LockoutDuration:    15,
+		LockoutThreshold:   5,
+		LogLevel:           zapcore.DebugLevel,
+		LoginRateLimit:     10,
+		LXDSocketPath:      "/var/snap/lxd/common/lxd/unix.socket",
+		MaxContainers:      50,
+		MaxSessionsPerAddr: 20,
+		MaxSessionsPerUser: 2,
+		PoolSize:           3,
+		Port:               8047,
+		PreservedFiles:     []string{".bash_history", ".config/app.conf"},
+		Profiles:           []string{"default", "termserver"},
+		RecordDir:          "/var/log/jujushell/sessions",
+		RecordInput:        true,
+		RecordRetention:    30,
+		ResumeTimeout:      5,
+		SessionTimeout:     42,
+		StartQueueSize:     100,
+		UserLimits: map[string]config.Limits{
+			"who": {
+				Memory: "4GB",
+			},
+		},
 		WelcomeMessage: "exterminate!",
 	},
 }, {
@@ -56,11 +154,13 @@ var readTests = []struct {
 		"profiles":        []string{"default", "termserver"},
 	}),
 	expectedConfig: &config.Config{
-		ImageName:     "myimage",
-		JujuAddrs:     []string{"1.2.3.4", "4.3.2.1"},
-		LXDSocketPath: "/var/snap/lxd/common/lxd/unix.socket",
-		Port:          8047,
-		Profiles:      []string{"default", "termserver"},
+		DrainTimeout:   30,
+		ImageName:      "myimage",
+		JujuAddrs:      []string{"1.2.3.4", "4.3.2.1"},
+		LXDSocketPath:  "/var/snap/lxd/common/lxd/unix.socket",
+		Port:           8047,
+		Profiles:       []string{"default", "termserver"},
+		StartQueueSize: 10,
 	},
 }, {
 	about: "valid jaas config",
@@ -73,12 +173,70 @@ var readTests = []struct {
 		"profiles":        []string{"default"},
 	}),
 	expectedConfig: &config.Config{
-		ImageName:     "myimage",
-		JujuAddrs:     []string{"jimm.jujucharms.com:443"},
-		LogLevel:      zapcore.DebugLevel,
-		LXDSocketPath: "/var/lib/lxd/unix.socket",
-		Port:          8047,
-		Profiles:      []string{"default"},
+		DrainTimeout:   30,
+		ImageName:      "myimage",
+		JujuAddrs:      []string{"jimm.jujucharms.com:443"},
+		LogLevel:       zapcore.DebugLevel,
+		LXDSocketPath:  "/var/lib/lxd/unix.socket",
+		Port:           8047,
+		Profiles:       []string{"default"},
+		StartQueueSize: 10,
+	},
+}, {
+	about: "valid home volumes config",
+	content: mustMarshalYAML(map[string]interface{}{
+		"home-volume-pool": "default",
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4"},
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"port":             8047,
+		"profiles":         []string{"default"},
+	}),
+	expectedConfig: &config.Config{
+		DrainTimeout:   30,
+		HomeVolumePool: "default",
+		ImageName:      "myimage",
+		JujuAddrs:      []string{"1.2.3.4"},
+		LXDSocketPath:  "/var/lib/lxd/unix.socket",
+		Port:           8047,
+		Profiles:       []string{"default"},
+		StartQueueSize: 10,
+	},
+}, {
+	about: "valid multiple controllers config",
+	content: mustMarshalYAML(map[string]interface{}{
+		"controllers": map[string]interface{}{
+			"production": map[string]interface{}{
+				"addrs": []string{"1.2.3.4", "4.3.2.1"},
+				"cert":  "production cert",
+			},
+			"staging": map[string]interface{}{
+				"addrs": []string{"1.2.3.5"},
+			},
+		},
+		"image-name":            "myimage",
+		"login-all-controllers": true,
+		"lxd-socket-path":       "/var/lib/lxd/unix.socket",
+		"port":                  8047,
+		"profiles":              []string{"default"},
+	}),
+	expectedConfig: &config.Config{
+		Controllers: map[string]config.Controller{
+			"production": {
+				Addrs: []string{"1.2.3.4", "4.3.2.1"},
+				Cert:  "production cert",
+			},
+			"staging": {
+				Addrs: []string{"1.2.3.5"},
+			},
+		},
+		DrainTimeout:        30,
+		ImageName:           "myimage",
+		LoginAllControllers: true,
+		LXDSocketPath:       "/var/lib/lxd/unix.socket",
+		Port:                8047,
+		Profiles:            []string{"default"},
+		StartQueueSize:      10,
 	},
 }, {
 	about: "valid let's encrypt config",
@@ -92,13 +250,35 @@ var readTests = []struct {
 		"profiles":        []string{"default", "termserver"},
 	}),
 	expectedConfig: &config.Config{
-		DNSName:       "shell.example.com",
+		DNSName:        "shell.example.com",
+		DrainTimeout:   30,
+		ImageName:      "myimage",
+		JujuAddrs:      []string{"1.2.3.4", "4.3.2.1"},
+		LogLevel:       zapcore.DebugLevel,
+		LXDSocketPath:  "/var/lib/lxd/unix.socket",
+		Port:           443,
+		Profiles:       []string{"default", "termserver"},
+		StartQueueSize: 10,
+	},
+}, {
+	about: "valid config with queuing and draining disabled",
+	content: mustMarshalYAML(map[string]interface{}{
+		"drain-timeout":    0,
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4"},
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"max-containers":   10,
+		"port":             8047,
+		"profiles":         []string{"default"},
+		"start-queue-size": 0,
+	}),
+	expectedConfig: &config.Config{
 		ImageName:     "myimage",
-		JujuAddrs:     []string{"1.2.3.4", "4.3.2.1"},
-		LogLevel:      zapcore.DebugLevel,
+		JujuAddrs:     []string{"1.2.3.4"},
 		LXDSocketPath: "/var/lib/lxd/unix.socket",
-		Port:          443,
-		Profiles:      []string{"default", "termserver"},
+		MaxContainers: 10,
+		Port:          8047,
+		Profiles:      []string{"default"},
 	},
 }, {
 	about:         "unreadable config",
@@ -118,6 +298,307 @@ var readTests = []struct {
 		"session-timeout": -1,
 	}),
 	expectedError: `invalid configuration at ".*": cannot specify a negative session timeout`,
+}, {
+	about: "invalid config: bad resume timeout",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+		"resume-timeout":  -1,
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative resume timeout`,
+}, {
+	about: "invalid config: bad container expiry",
+	content: mustMarshalYAML(map[string]interface{}{
+		"container-expiry": -1,
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"port":             8047,
+		"profiles":         []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative container expiry`,
+}, {
+	about: "invalid config: container expiry shorter than session timeout",
+	content: mustMarshalYAML(map[string]interface{}{
+		"container-expiry": 42,
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"port":             8047,
+		"profiles":         []string{"default", "termserver"},
+		"session-timeout":  60,
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a container expiry not greater than the session timeout`,
+}, {
+	about: "invalid config: bad pool size",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"pool-size":       -1,
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative pool size`,
+}, {
+	about: "invalid config: both pool and home volumes",
+	content: mustMarshalYAML(map[string]interface{}{
+		"home-volume-pool": "default",
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4"},
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"pool-size":        3,
+		"port":             8047,
+		"profiles":         []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify both pool size and home volume pool`,
+}, {
+	about: "invalid config: negative flavour processes limit",
+	content: mustMarshalYAML(map[string]interface{}{
+		"flavours": map[string]interface{}{
+			"juju3": map[string]interface{}{
+				"limits": map[string]interface{}{
+					"processes": -1,
+				},
+			},
+		},
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative processes limit for flavour "juju3"`,
+}, {
+	about: "invalid config: bad flavour user pattern",
+	content: mustMarshalYAML(map[string]interface{}{
+		"flavours": map[string]interface{}{
+			"sre": map[string]interface{}{
+				"users": []string{"[rose"},
+			},
+		},
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": invalid user pattern "\[rose" for flavour "sre"`,
+}, {
+	about: "invalid config: image rule without users",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name": "myimage",
+		"image-rules": []map[string]interface{}{{
+			"image-name": "myimage-sre",
+		}},
+		"juju-addrs":      []string{"1.2.3.4"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": missing users for image rule 0`,
+}, {
+	about: "invalid config: image rule without image and profiles",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name": "myimage",
+		"image-rules": []map[string]interface{}{{
+			"users":      []string{"rose"},
+			"image-name": "myimage-sre",
+		}, {
+			"users": []string{"who"},
+		}},
+		"juju-addrs":      []string{"1.2.3.4"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": missing image name and profiles for image rule 1`,
+}, {
+	about: "invalid config: bad image rule user pattern",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name": "myimage",
+		"image-rules": []map[string]interface{}{{
+			"users":      []string{"[rose"},
+			"image-name": "myimage-sre",
+		}},
+		"juju-addrs":      []string{"1.2.3.4"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": invalid user pattern "\[rose" for image rule 0`,
+}, {
+	about: "invalid config: absolute preserved file",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"preserved-files": []string{".bash_history", "/etc/passwd"},
+		"profiles":        []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": invalid preserved file "/etc/passwd": path must be relative to the home directory`,
+}, {
+	about: "invalid config: preserved file outside the home directory",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"preserved-files": []string{"../root/.bashrc"},
+		"profiles":        []string{"default"},
+	}),
+	expectedError: `invalid configuration at ".*": invalid preserved file "../root/.bashrc": path must be relative to the home directory`,
+}, {
+	about: "invalid config: bad login rate limit",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4", "4.3.2.1"},
+		"login-rate-limit": -1,
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"port":             8047,
+		"profiles":         []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative login rate limit`,
+}, {
+	about: "invalid config: bad lockout threshold",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":        "myimage",
+		"juju-addrs":        []string{"1.2.3.4", "4.3.2.1"},
+		"lockout-duration":  15,
+		"lockout-threshold": -1,
+		"lxd-socket-path":   "/var/lib/lxd/unix.socket",
+		"port":              8047,
+		"profiles":          []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative lockout threshold or duration`,
+}, {
+	about: "invalid config: lockout threshold without duration",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":        "myimage",
+		"juju-addrs":        []string{"1.2.3.4", "4.3.2.1"},
+		"lockout-threshold": 5,
+		"lxd-socket-path":   "/var/lib/lxd/unix.socket",
+		"port":              8047,
+		"profiles":          []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a lockout threshold without a lockout duration`,
+}, {
+	about: "invalid config: bad max sessions per user",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":            "myimage",
+		"juju-addrs":            []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path":       "/var/lib/lxd/unix.socket",
+		"max-sessions-per-user": -1,
+		"port":                  8047,
+		"profiles":              []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative maximum number of sessions`,
+}, {
+	about: "invalid config: bad max containers",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"max-containers":  -1,
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative maximum number of containers`,
+}, {
+	about: "invalid config: bad start queue size",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"port":             8047,
+		"profiles":         []string{"default", "termserver"},
+		"start-queue-size": -1,
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative start queue size`,
+}, {
+	about: "invalid config: bad drain timeout",
+	content: mustMarshalYAML(map[string]interface{}{
+		"drain-timeout":   -1,
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative drain timeout`,
+}, {
+	about: "invalid config: bad record retention",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":       "myimage",
+		"juju-addrs":       []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path":  "/var/lib/lxd/unix.socket",
+		"port":             8047,
+		"profiles":         []string{"default", "termserver"},
+		"record-dir":       "/var/log/jujushell/sessions",
+		"record-retention": -1,
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative record retention`,
+}, {
+	about: "invalid config: both controllers and juju addresses",
+	content: mustMarshalYAML(map[string]interface{}{
+		"controllers": map[string]interface{}{
+			"production": map[string]interface{}{
+				"addrs": []string{"1.2.3.4"},
+			},
+		},
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify both controllers and juju-addrs or juju-cert`,
+}, {
+	about: "invalid config: controller without addresses",
+	content: mustMarshalYAML(map[string]interface{}{
+		"controllers": map[string]interface{}{
+			"production": map[string]interface{}{
+				"cert": "production cert",
+			},
+		},
+		"image-name":      "myimage",
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": missing addrs for controller "production"`,
+}, {
+	about: "invalid config: bad processes limit",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name": "myimage",
+		"juju-addrs": []string{"1.2.3.4", "4.3.2.1"},
+		"limits": map[string]interface{}{
+			"processes": -1,
+		},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative processes limit`,
+}, {
+	about: "invalid config: bad user processes limit",
+	content: mustMarshalYAML(map[string]interface{}{
+		"image-name":      "myimage",
+		"juju-addrs":      []string{"1.2.3.4", "4.3.2.1"},
+		"lxd-socket-path": "/var/lib/lxd/unix.socket",
+		"port":            8047,
+		"profiles":        []string{"default", "termserver"},
+		"user-limits": map[string]interface{}{
+			"who": map[string]interface{}{
+				"processes": -1,
+			},
+		},
+	}),
+	expectedError: `invalid configuration at ".*": cannot specify a negative processes limit for user "who"`,
 }, {
 	about: "invalid config for let's encrypt: keys specified",
 	content: mustMarshalYAML(map[string]interface{}{
@@ -0,0 +1,206 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/audit"
+	"github.com/juju/jujushell/internal/juju"
+	"github.com/juju/jujushell/internal/registry"
+)
+
+// adminHandler returns the handler for the admin API, which can only be used
+// by the given admin users. Requests are authenticated against the Juju
+// controller using HTTP basic auth. When multiple controllers are available,
+// the one to authenticate against is specified with the "controller" query
+// parameter. As for WebSocket logins, the given limiter and lockout are used
+// to enforce the login rate limit and to lock out users and hosts after too
+// many failed attempts, using the current service parameters from the given
+// holder. Login failures and denials are audited. The following endpoints are
+// available:
+//     GET /admin/sessions: list all active sessions;
+//     POST /admin/sessions/<user>/stop: stop the container of the given user,
+//     succeeding if it is not running;
+//     DELETE /admin/sessions/<user>: delete the container of the given user.
+func adminHandler(jp JujuParams, params *params, adminUsers []string, reg *registry.Registry, lim *limiter, lo *lockout) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lxd, svc := params.get()
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jujushell"`)
+			writeAdminError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if err := lim.login(r.RemoteAddr, svc.LoginRateLimit); err != nil {
+			audit.Log(audit.Event{
+				Type:       audit.LoginDenied,
+				User:       username,
+				RemoteAddr: r.RemoteAddr,
+				Reason:     "limit",
+				Error:      err.Error(),
+			})
+			writeAdminError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		name, ctrl, err := jp.controller(r.URL.Query().Get("controller"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err = lo.check(username, r.RemoteAddr); err != nil {
+			audit.Log(audit.Event{
+				Type:       audit.LoginDenied,
+				User:       username,
+				Controller: name,
+				RemoteAddr: r.RemoteAddr,
+				Reason:     "lockout",
+			})
+			writeAdminError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		info, err := jujuAuthenticate(name, ctrl.Addrs, &juju.Credentials{
+			Username: username,
+			Password: password,
+		}, ctrl.Cert)
+		if err != nil {
+			if errgo.Cause(err) == juju.ErrUnauthorized {
+				lo.failed(username, r.RemoteAddr, svc.LockoutThreshold, svc.LockoutDuration)
+			}
+			log.Infow("cannot authenticate admin user", "user", username, "err", err)
+			msg := "cannot log into juju: " + err.Error()
+			audit.Log(audit.Event{
+				Type:       audit.LoginFailure,
+				User:       username,
+				Controller: name,
+				RemoteAddr: r.RemoteAddr,
+				Reason:     "admin",
+				Error:      msg,
+			})
+			writeAdminError(w, http.StatusUnauthorized, msg)
+			return
+		}
+		lo.succeeded(username, r.RemoteAddr)
+		if !isUserAllowed(info.User, adminUsers) {
+			audit.Log(audit.Event{
+				Type:       audit.LoginDenied,
+				User:       info.User,
+				Controller: name,
+				RemoteAddr: r.RemoteAddr,
+				Reason:     "admin",
+			})
+			writeAdminError(w, http.StatusForbidden, fmt.Sprintf("user %q is not allowed to access the admin API", info.User))
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "" && r.Method == http.MethodGet:
+			listSessions(w, reg)
+		case len(parts) == 2 && parts[1] == "stop" && r.Method == http.MethodPost:
+			name, err := userContainer(lxd.LXDSocketPath, parts[0])
+			if err != nil {
+				writeAdminError(w, http.StatusInternalServerError, fmt.Sprintf("cannot stop container for user %q: %v", parts[0], err))
+				return
+			}
+			log.Infow("stopping container on admin request", "admin", info.User, "user", parts[0], "container", name)
+			err = reg.Stop(name)
+			if errgo.Cause(err) == registry.ErrNotRunning {
+				writeAdminOK(w, fmt.Sprintf("container for user %q already stopped", parts[0]))
+				return
+			}
+			if err != nil {
+				writeAdminError(w, http.StatusInternalServerError, fmt.Sprintf("cannot stop container for user %q: %v", parts[0], err))
+				return
+			}
+			audit.Log(audit.Event{
+				Type:      audit.ContainerStop,
+				User:      parts[0],
+				Admin:     info.User,
+				Container: name,
+				Reason:    "admin",
+			})
+			writeAdminOK(w, fmt.Sprintf("container for user %q stopped", parts[0]))
+		case len(parts) == 1 && path != "" && r.Method == http.MethodDelete:
+			name, err := userContainer(lxd.LXDSocketPath, parts[0])
+			if err != nil {
+				writeAdminError(w, http.StatusInternalServerError, fmt.Sprintf("cannot delete container for user %q: %v", parts[0], err))
+				return
+			}
+			log.Infow("deleting container on admin request", "admin", info.User, "user", parts[0], "container", name)
+			err = reg.Delete(name)
+			if errgo.Cause(err) == registry.ErrNotFound {
+				writeAdminOK(w, fmt.Sprintf("container for user %q already deleted", parts[0]))
+				return
+			}
+			if err != nil {
+				writeAdminError(w, http.StatusInternalServerError, fmt.Sprintf("cannot delete container for user %q: %v", parts[0], err))
+				return
+			}
+			audit.Log(audit.Event{
+				Type:      audit.ContainerDelete,
+				User:      parts[0],
+				Admin:     info.User,
+				Container: name,
+				Reason:    "admin",
+			})
+			writeAdminOK(w, fmt.Sprintf("container for user %q deleted", parts[0]))
+		default:
+			writeAdminError(w, http.StatusNotFound, fmt.Sprintf("%s %s not found", r.Method, r.URL.Path))
+		}
+	})
+}
+
+// listSessions writes the sessions currently tracked by the given registry.
+func listSessions(w http.ResponseWriter, reg *registry.Registry) {
+	cs := reg.Containers()
+	resp := apiparams.Sessions{
+		Sessions: make([]apiparams.Session, len(cs)),
+	}
+	for i, c := range cs {
+		resp.Sessions[i] = apiparams.Session{
+			Container:    c.Name,
+			User:         c.User,
+			Address:      c.Addr,
+			StartTime:    c.StartTime,
+			LastActivity: c.LastActivity,
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// writeAdminOK writes a successful admin response with the given message.
+func writeAdminOK(w http.ResponseWriter, msg string) {
+	writeJSON(w, http.StatusOK, apiparams.Response{
+		Operation: apiparams.OpAdmin,
+		Code:      apiparams.OK,
+		Message:   msg,
+	})
+}
+
+// writeAdminError writes an admin error response with the given HTTP status
+// code and message.
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, apiparams.Response{
+		Operation: apiparams.OpAdmin,
+		Code:      apiparams.Error,
+		Message:   msg,
+	})
+}
+
+// writeJSON writes the JSON encoding of v as the response body, with the
+// given HTTP status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// Ignore errors here.
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,280 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/api"
+	"github.com/juju/jujushell/internal/audit"
+	"github.com/juju/jujushell/internal/juju"
+	"github.com/juju/jujushell/internal/logging"
+)
+
+var adminHandlerTests = []struct {
+	about            string
+	method           string
+	path             string
+	username         string
+	password         string
+	authUser         string
+	authErr          string
+	expectedStatus   int
+	expectedResponse interface{}
+}{{
+	about:          "no credentials",
+	method:         "GET",
+	path:           "/admin/sessions",
+	expectedStatus: http.StatusUnauthorized,
+	expectedResponse: &apiparams.Response{
+		Operation: apiparams.OpAdmin,
+		Code:      apiparams.Error,
+		Message:   "authentication required",
+	},
+}, {
+	about:          "authentication error",
+	method:         "GET",
+	path:           "/admin/sessions",
+	username:       "who",
+	password:       "bad",
+	authErr:        "bad wolf",
+	expectedStatus: http.StatusUnauthorized,
+	expectedResponse: &apiparams.Response{
+		Operation: apiparams.OpAdmin,
+		Code:      apiparams.Error,
+		Message:   "cannot log into juju: bad wolf",
+	},
+}, {
+	about:          "user not allowed",
+	method:         "GET",
+	path:           "/admin/sessions",
+	username:       "dalek",
+	password:       "exterminate",
+	authUser:       "dalek",
+	expectedStatus: http.StatusForbidden,
+	expectedResponse: &apiparams.Response{
+		Operation: apiparams.OpAdmin,
+		Code:      apiparams.Error,
+		Message:   `user "dalek" is not allowed to access the admin API`,
+	},
+}, {
+	about:          "list sessions",
+	method:         "GET",
+	path:           "/admin/sessions",
+	username:       "rose",
+	password:       "secret",
+	authUser:       "rose",
+	expectedStatus: http.StatusOK,
+	expectedResponse: &apiparams.Sessions{
+		Sessions: []apiparams.Session{},
+	},
+}, {
+	about:          "list sessions with trailing slash",
+	method:         "GET",
+	path:           "/admin/sessions/",
+	username:       "rose",
+	password:       "secret",
+	authUser:       "rose",
+	expectedStatus: http.StatusOK,
+	expectedResponse: &apiparams.Sessions{
+		Sessions: []apiparams.Session{},
+	},
+}, {
+	about:          "invalid method",
+	method:         "POST",
+	path:           "/admin/sessions/who",
+	username:       "rose",
+	password:       "secret",
+	authUser:       "rose",
+	expectedStatus: http.StatusNotFound,
+	expectedResponse: &apiparams.Response{
+		Operation: apiparams.OpAdmin,
+		Code:      apiparams.Error,
+		Message:   "POST /admin/sessions/who not found",
+	},
+}, {
+	about:          "invalid path",
+	method:         "POST",
+	path:           "/admin/sessions/who/bad-wolf",
+	username:       "rose",
+	password:       "secret",
+	authUser:       "rose",
+	expectedStatus: http.StatusNotFound,
+	expectedResponse: &apiparams.Response{
+		Operation: apiparams.OpAdmin,
+		Code:      apiparams.Error,
+		Message:   "POST /admin/sessions/who/bad-wolf not found",
+	},
+}}
+
+func TestAdminHandler(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+
+	for _, test := range adminHandlerTests {
+		c.Run(test.about, func(c *qt.C) {
+			// Set up the server.
+			mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+				AdminUsers: []string{"rose"},
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			c.Patch(api.JujuAuthenticate, func(controller string, addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
+				c.Assert(controller, qt.Equals, "ctrl")
+				c.Assert(creds.Username, qt.Equals, test.username)
+				c.Assert(creds.Password, qt.Equals, test.password)
+				if test.authErr != "" {
+					return nil, errors.New(test.authErr)
+				}
+				return &juju.Info{
+					User: test.authUser,
+				}, nil
+			})
+
+			// Send the request.
+			req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+			c.Assert(err, qt.Equals, nil)
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			c.Assert(err, qt.Equals, nil)
+			defer resp.Body.Close()
+
+			// Check the response.
+			c.Assert(resp.StatusCode, qt.Equals, test.expectedStatus)
+			c.Assert(resp.Header.Get("Content-Type"), qt.Equals, "application/json")
+			var r interface{}
+			switch test.expectedResponse.(type) {
+			case *apiparams.Sessions:
+				r = new(apiparams.Sessions)
+			default:
+				r = new(apiparams.Response)
+			}
+			err = json.NewDecoder(resp.Body).Decode(r)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(r, qt.DeepEquals, test.expectedResponse)
+		})
+	}
+}
+
+func TestAdminHandlerDisabled(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/admin/sessions")
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func TestAdminHandlerLoginRateLimit(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+		AdminUsers:     []string{"rose"},
+		LoginRateLimit: 1,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	c.Patch(api.JujuAuthenticate, func(controller string, addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
+		return &juju.Info{
+			User: "rose",
+		}, nil
+	})
+
+	// The first request is allowed.
+	code, _ := adminRequest(c, server.URL, "rose", "secret")
+	c.Assert(code, qt.Equals, http.StatusOK)
+
+	// The rate limit applies to following requests.
+	code, msg := adminRequest(c, server.URL, "rose", "secret")
+	c.Assert(code, qt.Equals, http.StatusTooManyRequests)
+	c.Assert(msg, qt.Equals, "too many login attempts from 127.0.0.1, please retry later")
+}
+
+func TestAdminHandlerLockout(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	auditPath := filepath.Join(c.Mkdir(), "audit.log")
+	err := audit.Open(auditPath)
+	c.Assert(err, qt.Equals, nil)
+	defer audit.Close()
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+		AdminUsers:       []string{"rose"},
+		LockoutDuration:  time.Minute,
+		LockoutThreshold: 2,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	var calls int
+	c.Patch(api.JujuAuthenticate, func(controller string, addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
+		calls++
+		return nil, errgo.WithCausef(nil, juju.ErrUnauthorized, "bad wolf")
+	})
+
+	// Failed attempts are recorded until the user is locked out.
+	for i := 0; i < 2; i++ {
+		code, msg := adminRequest(c, server.URL, "rose", "bad")
+		c.Assert(code, qt.Equals, http.StatusUnauthorized)
+		c.Assert(msg, qt.Equals, "cannot log into juju: bad wolf")
+	}
+	code, msg := adminRequest(c, server.URL, "rose", "secret")
+	c.Assert(code, qt.Equals, http.StatusTooManyRequests)
+	c.Assert(msg, qt.Equals, "too many failed login attempts, please retry later")
+	// The controller is not contacted while the user is locked out.
+	c.Assert(calls, qt.Equals, 2)
+
+	// Failures and denials are audited.
+	err = audit.Close()
+	c.Assert(err, qt.Equals, nil)
+	data, err := ioutil.ReadFile(auditPath)
+	c.Assert(err, qt.Equals, nil)
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e audit.Event
+		err = json.Unmarshal([]byte(line), &e)
+		c.Assert(err, qt.Equals, nil)
+		events = append(events, e.Type+" "+e.User+" "+e.Reason)
+	}
+	c.Assert(events, qt.DeepEquals, []string{
+		"login-failure rose admin",
+		"login-failure rose admin",
+		"login-denied rose lockout",
+	})
+}
+
+// adminRequest sends a request for listing sessions to the admin API at the
+// given server URL, using the given credentials. It returns the response
+// status code and, for errors, the response message.
+func adminRequest(c *qt.C, serverURL, username, password string) (int, string) {
+	req, err := http.NewRequest("GET", serverURL+"/admin/sessions", nil)
+	c.Assert(err, qt.Equals, nil)
+	req.SetBasicAuth(username, password)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, ""
+	}
+	var r apiparams.Response
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	c.Assert(err, qt.Equals, nil)
+	return resp.StatusCode, r.Message
+}
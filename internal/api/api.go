@@ -6,6 +6,9 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,10 +16,14 @@ import (
 	"gopkg.in/errgo.v1"
 
 	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/audit"
 	"github.com/juju/jujushell/internal/juju"
 	"github.com/juju/jujushell/internal/logging"
+	"github.com/juju/jujushell/internal/lxdclient"
 	"github.com/juju/jujushell/internal/lxdutils"
 	"github.com/juju/jujushell/internal/metrics"
+	"github.com/juju/jujushell/internal/pool"
+	"github.com/juju/jujushell/internal/recorder"
 	"github.com/juju/jujushell/internal/registry"
 	"github.com/juju/jujushell/internal/wsproxy"
 	"github.com/juju/jujushell/internal/wstransport"
@@ -24,74 +31,334 @@ import (
 
 var log = logging.Log()
 
-// Register registers the API handlers in the given mux.
-func Register(mux *http.ServeMux, juju JujuParams, lxd LXDParams, svc SvcParams) error {
-	reg, err := registryNew(svc.SessionDuration, lxd.LXDSocketPath)
+// Register registers the API handlers in the given mux. The returned service
+// can be used to reload parameters and to gracefully shut down the API.
+func Register(mux *http.ServeMux, juju JujuParams, lxd LXDParams, svc SvcParams) (*Service, error) {
+	reg, err := registryNew(svc.SessionDuration, svc.ResumeDuration, svc.ContainerExpiry, lxd.LXDSocketPath)
 	if err != nil {
-		return errgo.Notef(err, "cannot create container registry")
+		return nil, errgo.Notef(err, "cannot create container registry")
 	}
-	mux.Handle("/ws/", metrics.InstrumentHandler(serveWebSocket(juju, lxd, svc, reg)))
+	var p lxdutils.Pool
+	var rp *pool.Pool
+	if lxd.PoolSize > 0 {
+		rp, err = poolNew(lxd.ImageName, lxd.Profiles, lxd.Limits, lxd.PoolSize, lxd.LXDSocketPath)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create container pool")
+		}
+		p = metrics.InstrumentPool(rp)
+	}
+	var store *recorder.Store
+	if svc.RecordDir != "" {
+		store, err = recorder.NewStore(svc.RecordDir, svc.RecordRetention, svc.RecordInput)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create session recordings store")
+		}
+	}
+	s := &Service{
+		params: newParams(lxd, svc),
+		reg:    reg,
+		pool:   rp,
+		t:      newTracker(),
+	}
+	lim, lo := newLimiter(), newLockout(metrics.LockoutCounter())
+	mux.Handle("/ws/", metrics.InstrumentHandler(serveWebSocket(juju, s.params, reg, p, lxdutils.NewQueue(), store, s.t, lim, lo)))
 	mux.HandleFunc("/status/", statusHandler)
 	mux.Handle("/metrics", promhttp.Handler())
-	return nil
+	if len(svc.AdminUsers) != 0 {
+		h := adminHandler(juju, s.params, svc.AdminUsers, reg, lim, lo)
+		mux.Handle("/admin/sessions", h)
+		mux.Handle("/admin/sessions/", h)
+	}
+	return s, nil
 }
 
-// JujuParams holds parameters for interacting with the Juju controller.
+// JujuParams holds parameters for interacting with Juju controllers.
 type JujuParams struct {
-	// Addrs holds the addresses of the current Juju controller.
+	// Controllers holds the Juju controllers users can log into, keyed by
+	// controller name.
+	Controllers map[string]ControllerParams
+	// LoginAllControllers holds whether users are also logged into all the
+	// other controllers, with the same credentials, so that they can use
+	// them from the shell session. Note that credentials are then sent to
+	// all the controllers.
+	LoginAllControllers bool
+}
+
+// ControllerParams holds parameters for connecting to a Juju controller.
+type ControllerParams struct {
+	// Addrs holds the addresses of the Juju controller.
 	Addrs []string
 	// Cert holds the controller CA certificate in PEM format.
 	Cert string
 }
 
+// controller returns the name and parameters of the controller with the given
+// name. The name can be omitted if there is only one controller.
+func (jp JujuParams) controller(name string) (string, ControllerParams, error) {
+	if name == "" {
+		if len(jp.Controllers) != 1 {
+			return "", ControllerParams{}, errgo.Newf("controller must be specified, available controllers: %s", strings.Join(jp.names(), ", "))
+		}
+		name = jp.names()[0]
+	}
+	ctrl, ok := jp.Controllers[name]
+	if !ok {
+		return "", ControllerParams{}, errgo.Newf("controller %q not found", name)
+	}
+	return name, ctrl, nil
+}
+
+// names returns the sorted names of all the controllers.
+func (jp JujuParams) names() []string {
+	names := make([]string, 0, len(jp.Controllers))
+	for name := range jp.Controllers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // LXDParams holds parameters used for creating LXD containers.
 type LXDParams struct {
+	// Flavours holds the environments users can choose from when starting a
+	// session, keyed by name.
+	Flavours map[string]Flavour
+	// HomeVolumePool optionally holds the LXD storage pool where persistent
+	// per-user volumes, mounted in the home directory, are created. No files
+	// are persisted if empty.
+	HomeVolumePool string
 	// ImageName holds the name of the LXD image to use.
 	ImageName string
+	// ImageRules holds rules selecting the image and profiles for specific
+	// users, in order of precedence.
+	ImageRules []ImageRule
+	// Limits holds the resource limits applied to new containers.
+	Limits Limits
 	// LXDSocketPath holds the path to the LXD unix socket.
 	LXDSocketPath string
+	// PoolSize holds the number of pre-warmed containers kept ready to be
+	// assigned to new users. A zero value disables the pool.
+	PoolSize int
+	// PreservedFiles holds the paths of user files, relative to the home
+	// directory, preserved when containers are recreated after an image
+	// change.
+	PreservedFiles []string
 	// Profiles holds the LXD profile names.
 	Profiles []string `yaml:"profiles"`
+	// UserLimits holds per-user resource limits, overriding the global ones.
+	UserLimits map[string]Limits
+}
+
+// image returns the name of the LXD image and the profiles to use for the
+// given user, and whether they are selected by an image rule.
+func (p LXDParams) image(user string) (image string, profiles []string, ok bool) {
+	for _, r := range p.ImageRules {
+		if !r.matches(user) {
+			continue
+		}
+		image, profiles = r.ImageName, r.Profiles
+		if image == "" {
+			image = p.ImageName
+		}
+		if len(profiles) == 0 {
+			profiles = p.Profiles
+		}
+		return image, profiles, true
+	}
+	return p.ImageName, p.Profiles, false
+}
+
+// flavour returns the flavour with the given name, checking that the given
+// user is allowed to choose it.
+func (p LXDParams) flavour(name, user string) (Flavour, error) {
+	f, ok := p.Flavours[name]
+	if !ok {
+		return Flavour{}, errgo.Newf("flavour %q not found", name)
+	}
+	if len(f.Users) != 0 && !matchUser(f.Users, user) {
+		return Flavour{}, errgo.Newf("user %q is not allowed to use flavour %q", user, name)
+	}
+	return f, nil
+}
+
+// Flavour holds an environment users can choose when starting a session.
+type Flavour struct {
+	// ImageName holds the name of the LXD image to use. The image otherwise
+	// selected for the user is used if empty.
+	ImageName string
+	// Limits holds resource limits overriding the ones otherwise applied.
+	Limits Limits
+	// Profiles holds the LXD profile names. The profiles otherwise selected
+	// for the user are used if empty.
+	Profiles []string
+	// Users holds the user names or patterns, including "*" wildcards,
+	// allowed to choose the flavour. All users are allowed if empty.
+	Users []string
+}
+
+// Limits holds resource limits for containers. Empty values mean that no
+// limits are set.
+type Limits = lxdclient.Limits
+
+// ImageRule holds the LXD image and profiles used for specific users.
+type ImageRule struct {
+	// Users holds the user names or patterns, including "*" wildcards, the
+	// rule applies to.
+	Users []string
+	// ImageName holds the name of the LXD image to use. The global image is
+	// used if empty.
+	ImageName string
+	// Profiles holds the LXD profile names. The global profiles are used if
+	// empty.
+	Profiles []string
+}
+
+// matches reports whether the rule applies to the given user.
+func (r ImageRule) matches(user string) bool {
+	return matchUser(r.Users, user)
+}
+
+// matchUser reports whether the given user name matches any of the given
+// patterns.
+func matchUser(patterns []string, user string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, user); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // SvcParams holds parameters used for configuring and running the service.
 type SvcParams struct {
+	// AdminUsers holds a list of names of users allowed to use the admin API.
+	// The admin API is disabled if the list is empty.
+	AdminUsers []string
+	// AllowedOrigins holds the patterns of origins allowed to open WebSocket
+	// connections. All origins are allowed if the list is empty.
+	AllowedOrigins []string
 	// AllowedUsers holds a list of names of users allowed to use the service.
 	AllowedUsers []string
+	// ContainerExpiry holds the time duration of inactivity before deleting
+	// stopped containers. A zero value means that containers are never
+	// deleted.
+	ContainerExpiry time.Duration
+	// LockoutDuration holds the time duration for which users and remote
+	// hosts are locked out after too many failed login attempts.
+	LockoutDuration time.Duration
+	// LockoutThreshold holds the number of consecutive failed login attempts
+	// after which users and remote hosts are locked out. A zero value means
+	// that lockouts are disabled.
+	LockoutThreshold int
+	// LoginRateLimit holds the maximum number of login attempts per minute
+	// from the same remote host. A zero value means no limit.
+	LoginRateLimit int
+	// MaxContainers holds the maximum number of user containers running at
+	// the same time, including the ones in the pool. Further container starts
+	// are queued. A zero value means no limit.
+	MaxContainers int
+	// MaxSessionsPerAddr holds the maximum number of simultaneous WebSocket
+	// sessions from the same remote host. A zero value means no limit.
+	MaxSessionsPerAddr int
+	// MaxSessionsPerUser holds the maximum number of simultaneous WebSocket
+	// sessions of the same user. A zero value means no limit.
+	MaxSessionsPerUser int
+	// RecordDir optionally holds the directory where shell sessions are
+	// recorded in the asciicast v2 format. Sessions are not recorded if empty.
+	RecordDir string
+	// RecordInput holds whether to also record the terminal input.
+	RecordInput bool
+	// RecordRetention holds the time duration after which session recordings
+	// are removed. A zero value means that recordings are never removed.
+	RecordRetention time.Duration
+	// ResumeDuration holds the time duration in which a disconnected session
+	// can be resumed. A zero value means that sessions cannot be resumed.
+	ResumeDuration time.Duration
 	// SessionDuration holds time duration before expiring container sessions.
 	SessionDuration time.Duration
+	// StartQueueSize holds the maximum number of container starts waiting in
+	// the queue when MaxContainers is reached. Further starts are refused.
+	StartQueueSize int
 	// WelcomeMessage optionally holds an initial welcome message for users.
 	WelcomeMessage string
 }
 
-// serveWebSocket handles WebSocket connections.
-func serveWebSocket(juju JujuParams, lxd LXDParams, svc SvcParams, reg *registry.Registry) http.Handler {
+// serveWebSocket handles WebSocket connections, using the current LXD and
+// service parameters from the given holder. The given container pool and
+// recordings store can be nil. Container starts are admitted by the given
+// queue. Live connections are tracked by the given tracker, so that they can
+// be drained when the server shuts down. The given limiter is used to enforce
+// the session and login limits, before users are authenticated against the
+// controller, and the given lockout is used to lock out users and hosts after
+// too many failed login attempts.
+func serveWebSocket(juju JujuParams, params *params, reg *registry.Registry, p lxdutils.Pool, q *lxdutils.Queue, store *recorder.Store, t *tracker, lim *limiter, lo *lockout) http.Handler {
+	upgrade := metrics.InstrumentUpgrade(wstransport.Upgrade)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lxd, svc := params.get()
+		if t.shuttingDown() {
+			http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		// Upgrade the HTTP connection.
-		conn, err := wstransport.Upgrade(w, r)
+		conn, err := upgrade(w, r, svc.AllowedOrigins)
 		if err != nil {
 			log.Errorw("cannot upgrade to WebSocket", "url", r.URL, "err", err)
 			return
 		}
 		defer conn.Close()
 		conn = metrics.InstrumentWSConnection(conn)
+		lc, done, err := t.add(conn)
+		if err != nil {
+			conn.Error(apiparams.OpShutdown, err)
+			return
+		}
+		defer done()
+		conn = lc
 		log.Infow("WebSocket connection established", "remote-addr", r.RemoteAddr)
 
+		// Enforce limits before calling out to the controller.
+		release, err := lim.acquireAddr(r.RemoteAddr, svc.MaxSessionsPerAddr)
+		if err == nil {
+			defer release()
+			err = lim.login(r.RemoteAddr, svc.LoginRateLimit)
+		}
+		if err != nil {
+			audit.Log(audit.Event{
+				Type:       audit.LoginDenied,
+				RemoteAddr: r.RemoteAddr,
+				Reason:     "limit",
+				Error:      err.Error(),
+			})
+			log.Infow("WebSocket connection refused", "remote-addr", r.RemoteAddr, "err", err)
+			conn.Error(apiparams.OpLogin, err)
+			return
+		}
+
 		// Start serving requests.
-		info, creds, err := handleLogin(conn, juju.Addrs, juju.Cert, svc.AllowedUsers)
+		var releaseUser func()
+		defer func() {
+			if releaseUser != nil {
+				releaseUser()
+			}
+		}()
+		infos, creds, err := handleLogin(conn, juju, svc, r.RemoteAddr, lo, func(user string) (err error) {
+			releaseUser, err = lim.acquireUser(user, svc.MaxSessionsPerUser)
+			return err
+		})
 		if err != nil {
 			log.Infow("cannot authenticate the user", "err", err)
 			return
 		}
-		log.Infow("user authenticated", "user", info.User, "uuid", info.ControllerUUID, "endpoints", info.Endpoints)
-		name, addr, err := handleStart(conn, lxd, svc, info, creds)
+		info := infos[0]
+		log.Infow("user authenticated", "user", info.User, "controller", info.ControllerName, "uuid", info.ControllerUUID, "endpoints", info.Endpoints)
+		s, err := handleStart(conn, lxd, svc, reg, p, q, infos, creds)
 		if err != nil {
 			log.Infow("cannot start user session", "user", info.User, "err", err)
 			return
 		}
-		log.Infow("session started", "user", info.User, "address", addr)
-		if err = handleSession(conn, name, addr, reg); err != nil {
-			log.Infow("session closed", "user", info.User, "address", addr, "err", err)
+		log.Infow("session started", "user", info.User, "address", s.Addr)
+		if err = handleSession(conn, s, reg, store); err != nil {
+			log.Infow("session closed", "user", info.User, "address", s.Addr, "err", err)
 			return
 		}
 		log.Infow("closing WebSocket connection", "remote-addr", r.RemoteAddr)
@@ -99,12 +366,21 @@ func serveWebSocket(juju JujuParams, lxd LXDParams, svc SvcParams, reg *registry
 }
 
 // handleLogin checks that the user has the right credentials for logging into
-// the Juju controller at the given addresses. If the provided list of allowed
-// users is not empty, this function also checks that the user is allowed.
+// the requested Juju controller, which can be omitted if only one controller
+// is available. Users and hosts locked out because of too many failed
+// attempts are refused before contacting the controller, and credentials
+// rejected by the controller are recorded in the given lockout. If the list of
+// allowed users in the given service parameters is not empty, this function
+// also checks that the user is allowed. The given acquire function is then called with the user name,
+// so that the user can be denied access, for instance because too many
+// sessions are live. Information about the requested controller is returned
+// first, followed, if enabled, by all the other controllers the user can
+// authenticate against with the same credentials: see authenticateOthers.
+// Login attempts from the given remote address are audited.
 // Example request/response:
-//     --> {"operation": "login", "username": "admin", "password": "secret"}
+//     --> {"operation": "login", "username": "admin", "password": "secret", "controller": "prod"}
 //     <-- {"operation": "login", "code": "ok", "message": "logged in as \"admin\""}
-func handleLogin(conn wstransport.Conn, jujuAddrs []string, jujuCert string, allowedUsers []string) (info *juju.Info, creds *juju.Credentials, err error) {
+func handleLogin(conn wstransport.Conn, jp JujuParams, svc SvcParams, remoteAddr string, lo *lockout, acquire func(user string) error) (infos []*juju.Info, creds *juju.Credentials, err error) {
 	var req apiparams.Login
 	if err = conn.ReadJSON(&req); err != nil {
 		return nil, nil, conn.Error(apiparams.OpLogin, errgo.Notef(err, "cannot unmarshal login request"))
@@ -117,66 +393,399 @@ func handleLogin(conn wstransport.Conn, jujuAddrs []string, jujuCert string, all
 		Password:  req.Password,
 		Macaroons: req.Macaroons,
 	}
-	log.Debugw("authenticating to the controller", "addresses", jujuAddrs)
-	info, err = jujuAuthenticate(jujuAddrs, creds, jujuCert)
+	name, ctrl, err := jp.controller(req.Controller)
 	if err != nil {
-		return nil, nil, conn.Error(apiparams.OpLogin, errgo.Notef(err, "cannot log into juju"))
+		err = conn.Error(apiparams.OpLogin, errgo.Notef(err, "cannot log into juju"))
+		audit.Log(audit.Event{
+			Type:       audit.LoginFailure,
+			User:       req.Username,
+			Controller: req.Controller,
+			RemoteAddr: remoteAddr,
+			Error:      err.Error(),
+		})
+		return nil, nil, err
 	}
-	if !isUserAllowed(info.User, allowedUsers) {
+	if err = lo.check(req.Username, remoteAddr); err != nil {
+		audit.Log(audit.Event{
+			Type:       audit.LoginDenied,
+			User:       req.Username,
+			Controller: name,
+			RemoteAddr: remoteAddr,
+			Reason:     "lockout",
+		})
+		return nil, nil, conn.Error(apiparams.OpLogin, errgo.Mask(err, errgo.Is(errLockedOut)))
+	}
+	log.Debugw("authenticating to the controller", "controller", name, "addresses", ctrl.Addrs)
+	info, err := jujuAuthenticate(name, ctrl.Addrs, creds, ctrl.Cert)
+	if err != nil {
+		if errgo.Cause(err) == juju.ErrUnauthorized {
+			// Only credentials rejected by the controller are counted, so
+			// that users are not locked out when the controller cannot be
+			// reached.
+			lo.failed(req.Username, remoteAddr, svc.LockoutThreshold, svc.LockoutDuration)
+		}
+		err = conn.Error(apiparams.OpLogin, errgo.Notef(err, "cannot log into juju"))
+		audit.Log(audit.Event{
+			Type:       audit.LoginFailure,
+			User:       req.Username,
+			Controller: name,
+			RemoteAddr: remoteAddr,
+			Error:      err.Error(),
+		})
+		return nil, nil, err
+	}
+	lo.succeeded(req.Username, remoteAddr)
+	if !isUserAllowed(info.User, svc.AllowedUsers) {
+		audit.Log(audit.Event{
+			Type:       audit.LoginDenied,
+			User:       info.User,
+			Controller: name,
+			RemoteAddr: remoteAddr,
+		})
 		return nil, nil, conn.Error(apiparams.OpLogin, errgo.Newf("user %q is not allowed to access the service", info.User))
 	}
-	return info, creds, conn.OK(apiparams.OpLogin, "logged in as %q", info.User)
+	if err = acquire(info.User); err != nil {
+		audit.Log(audit.Event{
+			Type:       audit.LoginDenied,
+			User:       info.User,
+			Controller: name,
+			RemoteAddr: remoteAddr,
+			Reason:     "limit",
+			Error:      err.Error(),
+		})
+		return nil, nil, conn.Error(apiparams.OpLogin, errgo.Mask(err))
+	}
+	audit.Log(audit.Event{
+		Type:       audit.LoginSuccess,
+		User:       info.User,
+		Controller: name,
+		RemoteAddr: remoteAddr,
+	})
+	infos = append([]*juju.Info{info}, authenticateOthers(jp, info, creds)...)
+	return infos, creds, conn.OK(apiparams.OpLogin, "logged in as %q", info.User)
+}
+
+// authenticateOthers logs the user described by the given controller info
+// into all the other controllers, if enabled, and returns information about
+// the ones the user can authenticate against as the same user. Authentication
+// failures are not errors, as users are not required to have access to all
+// controllers. Controllers are contacted concurrently, and the ones not
+// responding within otherLoginTimeout are skipped, so that unreachable
+// controllers do not delay logins.
+func authenticateOthers(jp JujuParams, info *juju.Info, creds *juju.Credentials) []*juju.Info {
+	if !jp.LoginAllControllers {
+		return nil
+	}
+	var names []string
+	for _, name := range jp.names() {
+		if name != info.ControllerName {
+			names = append(names, name)
+		}
+	}
+	type result struct {
+		i    int
+		info *juju.Info
+	}
+	// The channel is buffered so that late authentications do not block.
+	ch := make(chan result, len(names))
+	for i, name := range names {
+		go func(i int, name string) {
+			ctrl := jp.Controllers[name]
+			other, err := jujuAuthenticate(name, ctrl.Addrs, creds, ctrl.Cert)
+			if err != nil {
+				log.Debugw("cannot authenticate to other controller", "controller", name, "err", err)
+				other = nil
+			} else if other.User != info.User {
+				log.Debugw("skipping controller authenticated as a different user", "controller", name, "user", other.User)
+				other = nil
+			}
+			ch <- result{i: i, info: other}
+		}(i, name)
+	}
+	results := make([]*juju.Info, len(names))
+	timeout := time.After(otherLoginTimeout)
+loop:
+	for range names {
+		select {
+		case r := <-ch:
+			results[r.i] = r.info
+		case <-timeout:
+			log.Infow("timed out authenticating to other controllers", "user", info.User)
+			break loop
+		}
+	}
+	infos := make([]*juju.Info, 0, len(results))
+	for _, other := range results {
+		if other != nil {
+			infos = append(infos, other)
+		}
+	}
+	return infos
 }
 
+// otherLoginTimeout holds the time to wait for logins into other controllers.
+// It is defined as a variable for testing.
+var otherLoginTimeout = 5 * time.Second
+
 // handleStart ensures an LXD is available for the given username, by checking
 // whether one container is already started or, if not, creating one based on
-// the provided LXD parameters. Example request/response:
+// the provided LXD parameters. If the server supports resuming sessions, the
+// response includes a token that can be used to resume the session later.
+// Example request/response:
 //     --> {"operation": "start"}
-//     <-- {"operation": "start", "code": "ok", "message": "session is ready"}
-func handleStart(conn wstransport.Conn, lxd LXDParams, svc SvcParams, info *juju.Info, creds *juju.Credentials) (name, addr string, err error) {
+//     <-- {"operation": "start", "code": "ok", "message": "session is ready", "resume-token": "1a2b3c"}
+// When too many containers are running, the container start is admitted by
+// the given queue, and interim responses report the position in the queue
+// before the final response:
+//     <-- {"operation": "start", "code": "queued", "message": "waiting for a container to be available: position 3 in queue", "position": 3}
+// When a valid resume token is provided, the previous session of the user is
+// resumed rather than starting a new one. Example request:
+//     --> {"operation": "start", "resume-token": "1a2b3c"}
+// A flavour can be provided to choose the environment of the session, among
+// the ones configured and allowed for the user. If the existing container of
+// the user was created with another flavour, it is recreated if stopped, and
+// the start fails if it is running. Example request:
+//     --> {"operation": "start", "flavour": "juju3"}
+// Stop and destroy requests can be sent before the start request: see
+// handleStop.
+func handleStart(conn wstransport.Conn, lxd LXDParams, svc SvcParams, reg *registry.Registry, p lxdutils.Pool, q *lxdutils.Queue, infos []*juju.Info, creds *juju.Credentials) (*registry.Session, error) {
+	info := infos[0]
 	var req apiparams.Start
-	if err = conn.ReadJSON(&req); err != nil {
-		return "", "", conn.Error(apiparams.OpStart, errgo.Notef(err, "cannot unmarshal start request"))
+	for {
+		req = apiparams.Start{}
+		if err := conn.ReadJSON(&req); err != nil {
+			return nil, conn.Error(apiparams.OpStart, errgo.Notef(err, "cannot unmarshal start request"))
+		}
+		if req.Operation != apiparams.OpStop && req.Operation != apiparams.OpDestroy {
+			break
+		}
+		if err := handleStop(conn, lxd, reg, req.Operation, info.User); err != nil {
+			return nil, errgo.Mask(err)
+		}
 	}
 	if req.Operation != apiparams.OpStart {
-		return "", "", conn.Error(apiparams.OpStart, errgo.Newf("invalid operation %q: expected %q", req.Operation, apiparams.OpStart))
+		return nil, conn.Error(apiparams.OpStart, errgo.Newf("invalid operation %q: expected %q", req.Operation, apiparams.OpStart))
+	}
+	var flavour *Flavour
+	if req.Flavour != "" {
+		f, err := lxd.flavour(req.Flavour, info.User)
+		if err != nil {
+			return nil, conn.Error(apiparams.OpStart, errgo.Mask(err))
+		}
+		flavour = &f
+	}
+	if req.ResumeToken != "" {
+		s, err := reg.Resume(req.ResumeToken, info.User)
+		if err == nil {
+			log.Debugw("resuming session", "user", info.User, "container", s.Container)
+			return startOK(conn, svc, reg, s, true)
+		}
+		// Just start a new session.
+		log.Infow("cannot resume session", "user", info.User, "err", err)
 	}
 	log.Debugw("connecting to the LXD server")
-	lxdclient, err := lxdutils.Connect(lxd.LXDSocketPath)
+	client, err := lxdutilsConnect(lxd.LXDSocketPath)
 	if err != nil {
-		return "", "", conn.Error(apiparams.OpStart, errgo.Mask(err))
+		return nil, conn.Error(apiparams.OpStart, errgo.Mask(err))
+	}
+	client = metrics.InstrumentLXDClient(client)
+	limits := lxd.Limits
+	if override, ok := lxd.UserLimits[info.User]; ok {
+		limits = limits.Merge(override)
+		// Pool containers are created with the global limits.
+		p = nil
+	}
+	image, profiles, ok := lxd.image(info.User)
+	if ok {
+		// Pool containers are created with the global image and profiles.
+		p = nil
+	}
+	if flavour != nil {
+		if flavour.ImageName != "" {
+			image = flavour.ImageName
+		}
+		if len(flavour.Profiles) != 0 {
+			profiles = flavour.Profiles
+		}
+		limits = limits.Merge(flavour.Limits)
+		p = nil
+	}
+	admit := func() (func(), error) {
+		return q.Admit(client, svc.MaxContainers, svc.StartQueueSize, func(position int) error {
+			return conn.WriteJSON(apiparams.Response{
+				Operation: apiparams.OpStart,
+				Code:      apiparams.Queued,
+				Message:   fmt.Sprintf("waiting for a container to be available: position %d in queue", position),
+				Position:  position,
+			})
+		})
 	}
-	lxdclient = metrics.InstrumentLXDClient(lxdclient)
-	log.Debugw("setting up the LXD instance", "image", lxd.ImageName, "profiles", lxd.Profiles)
-	name, addr, err = lxdutils.Ensure(lxdclient, lxd.ImageName, lxd.Profiles, info, creds)
+	log.Debugw("setting up the LXD instance", "flavour", req.Flavour, "image", image, "profiles", profiles, "limits", limits)
+	name, addr, err := lxdutils.Ensure(client, p, image, profiles, limits, req.Flavour, lxd.HomeVolumePool, lxd.PreservedFiles, admit, infos, creds)
 	if err != nil {
-		return "", "", conn.Error(apiparams.OpStart, errgo.Mask(err))
+		return nil, conn.Error(apiparams.OpStart, errgo.Mask(err))
 	}
 	url := fmt.Sprintf("http://%s:%d/status", addr, termserverPort)
 	log.Debugw("waiting for the internal shell service to be ready", "url", url)
 	if err = waitReady(url); err != nil {
-		return "", "", conn.Error(apiparams.OpStart, errgo.Mask(err))
+		return nil, conn.Error(apiparams.OpStart, errgo.Mask(err))
 	}
-	return name, addr, conn.OK(apiparams.OpStart, svc.WelcomeMessage)
-}
-
-// handleSession proxies traffic from the client to the LXD instance with the
-// given name and address.
-func handleSession(conn wstransport.Conn, name, addr string, reg *registry.Registry) error {
-	ac := reg.Get(name)
-	ac.SetActive()
 	// The path must reflect what used by the Terminado service which is
 	// running in the LXD container.
-	url := fmt.Sprintf("ws://%s:%d/websocket", addr, termserverPort)
+	url = fmt.Sprintf("ws://%s:%d/websocket", addr, termserverPort)
 	log.Debugw("connecting to internal shell service", "url", url)
 	lxcconn, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
-		return errgo.Notef(err, "cannot dial %s", url)
+		return nil, conn.Error(apiparams.OpStart, errgo.Notef(err, "cannot dial %s", url))
+	}
+	b := wsproxy.NewBackend(lxcconn)
+	s, err := reg.AddSession(info.User, name, addr, b)
+	if err != nil {
+		b.Close()
+		return nil, conn.Error(apiparams.OpStart, errgo.Mask(err))
+	}
+	return startOK(conn, svc, reg, s, false)
+}
+
+// handleStop stops or destroys, depending on the given operation, the
+// container of the given user, closing all the shell sessions running in it.
+// A destroyed container is created again from scratch when the session is
+// started, so that users can recover from a broken environment. Destroying a
+// container does not reset the persistent home volume of the user, if any.
+// Stopping a container which is not running, or destroying a container which
+// does not exist, succeeds. Example requests/responses:
+//     --> {"operation": "stop"}
+//     <-- {"operation": "stop", "code": "ok", "message": "container stopped"}
+//     --> {"operation": "destroy"}
+//     <-- {"operation": "destroy", "code": "ok", "message": "container destroyed"}
+func handleStop(conn wstransport.Conn, lxd LXDParams, reg *registry.Registry, op apiparams.Operation, user string) error {
+	name, err := userContainer(lxd.LXDSocketPath, user)
+	if err != nil {
+		return conn.Error(op, errgo.Mask(err))
+	}
+	if op == apiparams.OpStop {
+		log.Infow("stopping container on user request", "user", user, "container", name)
+		err = reg.Stop(name)
+		if errgo.Cause(err) == registry.ErrNotRunning {
+			log.Infow("container already stopped", "user", user, "container", name, "reason", err.Error())
+			return conn.OK(op, "container already stopped")
+		}
+		if err != nil {
+			return conn.Error(op, errgo.Notef(err, "cannot stop container"))
+		}
+		audit.Log(audit.Event{
+			Type:      audit.ContainerStop,
+			User:      user,
+			Container: name,
+			Reason:    "user",
+		})
+		return conn.OK(op, "container stopped")
+	}
+	log.Infow("destroying container on user request", "user", user, "container", name)
+	err = reg.Delete(name)
+	if errgo.Cause(err) == registry.ErrNotFound {
+		log.Infow("container already destroyed", "user", user, "container", name, "reason", err.Error())
+		return conn.OK(op, "container already destroyed")
+	}
+	if err != nil {
+		return conn.Error(op, errgo.Notef(err, "cannot destroy container"))
 	}
-	defer lxcconn.Close()
+	audit.Log(audit.Event{
+		Type:      audit.ContainerDelete,
+		User:      user,
+		Container: name,
+		Reason:    "user",
+	})
+	return conn.OK(op, "container destroyed")
+}
 
+// userContainer returns the name of the container of the given user, using the
+// LXD server listening on the given socket path.
+func userContainer(socketPath, user string) (string, error) {
+	client, err := lxdutilsConnect(socketPath)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	name, err := lxdutils.UserContainer(client, user)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot retrieve container")
+	}
+	return name, nil
+}
+
+// startOK sends a successful start response for the given session, which is
+// returned. If the response cannot be sent, the session is detached. The
+// resumed argument reports whether the session has been resumed.
+func startOK(conn wstransport.Conn, svc SvcParams, reg *registry.Registry, s *registry.Session, resumed bool) (*registry.Session, error) {
+	resp := apiparams.Response{
+		Operation: apiparams.OpStart,
+		Code:      apiparams.OK,
+		Message:   svc.WelcomeMessage,
+	}
+	if svc.ResumeDuration != 0 {
+		resp.ResumeToken = s.Token
+	}
+	if err := conn.WriteJSON(resp); err != nil {
+		reg.Detach(s)
+		return nil, errgo.Notef(err, "cannot write WebSocket response")
+	}
+	audit.Log(audit.Event{
+		Type:      audit.SessionStart,
+		User:      s.User,
+		Container: s.Container,
+		Address:   s.Addr,
+		Resumed:   resumed,
+	})
+	return s, nil
+}
+
+// handleSession proxies traffic from the client to the LXD instance in the
+// given session. When the client disconnects, the session is detached so that
+// it can be resumed later. While the session is active, clients can notify
+// terminal window size changes. If the given recordings store is not nil, the
+// session is recorded. The end of the session is audited, including the number
+// of bytes transferred. Example request:
+//     --> {"operation": "resize", "rows": 24, "cols": 80}
+func handleSession(conn wstransport.Conn, s *registry.Session, reg *registry.Registry, store *recorder.Store) (err error) {
+	cc := newCountConn(conn)
+	reason := "detached"
+	defer func() {
+		e := audit.Event{
+			Type:      audit.SessionEnd,
+			User:      s.User,
+			Container: s.Container,
+			Address:   s.Addr,
+			Reason:    reason,
+		}
+		e.BytesIn, e.BytesOut = cc.bytes()
+		if err != nil {
+			e.Error = err.Error()
+		}
+		audit.Log(e)
+	}()
+	var client wsproxy.Conn = newResizeConn(cc)
+	if store != nil {
+		rec, err := store.Start(s.User, s.Container)
+		if err != nil {
+			reg.Detach(s)
+			return errgo.Notef(err, "cannot start session recording")
+		}
+		defer rec.Close()
+		client = rec.Conn(client)
+	}
+	ac := reg.Get(s.Container)
+	ac.SetInfo(s.User, s.Addr)
+	ac.SetActive()
 	log.Debugw("starting the proxy")
-	if err = wsproxy.Copy(wsproxy.NewConnWithHooks(conn, ac.SetActive), lxcconn); err != nil {
+	err = s.Backend.Attach(wsproxy.NewConnWithHooks(client, ac.SetActive))
+	select {
+	case <-s.Backend.Done():
+		// The shell session is over.
+		reason = "exited"
+	default:
+		reg.Detach(s)
+	}
+	if err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
@@ -200,11 +809,31 @@ func isUserAllowed(user string, allowed []string) bool {
 }
 
 // jujuAuthenticate is defined as a variable for testing.
-var jujuAuthenticate = func(addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
-	return juju.Authenticate(addrs, creds, cert)
+var jujuAuthenticate = func(controller string, addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
+	return juju.Authenticate(controller, addrs, creds, cert)
+}
+
+// lxdutilsConnect is defined as a variable for testing.
+var lxdutilsConnect = func(socketPath string) (lxdclient.Client, error) {
+	return lxdutils.Connect(socketPath)
 }
 
 // registryNew is defined as a variable for testing.
-var registryNew = func(d time.Duration, socketPath string) (*registry.Registry, error) {
-	return registry.New(d, socketPath)
+var registryNew = func(d, rd, ed time.Duration, socketPath string) (*registry.Registry, error) {
+	return registry.New(d, rd, ed, func() (lxdclient.Client, error) {
+		return lxdutilsConnect(socketPath)
+	})
+}
+
+// poolNew is defined as a variable for testing.
+var poolNew = func(image string, profiles []string, limits lxdclient.Limits, size int, socketPath string) (*pool.Pool, error) {
+	client, err := lxdutilsConnect(socketPath)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	p, err := pool.New(metrics.InstrumentLXDClient(client), image, profiles, limits, size)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return p, nil
 }
@@ -14,17 +14,24 @@ import (
 	qt "github.com/frankban/quicktest"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/jujushell/apiparams"
 	"github.com/juju/jujushell/internal/api"
 	"github.com/juju/jujushell/internal/juju"
+	"github.com/juju/jujushell/internal/juju/jujutest"
 	"github.com/juju/jujushell/internal/logging"
+	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
+	"github.com/juju/jujushell/internal/lxdutils"
 	"github.com/juju/jujushell/internal/registry"
 )
 
 var serveWebSocketTests = []struct {
 	about            string
 	addrs            []string
+	controllers      map[string]api.ControllerParams
+	controller       string
 	allowedUsers     []string
 	authUser         string
 	authErr          string
@@ -66,15 +73,42 @@ var serveWebSocketTests = []struct {
 	authUser:         "who",
 	ops:              []apiparams.Operation{"login", "bad wolf"},
 	expectedMessages: []string{`logged in as "who"`, `invalid operation "bad wolf": expected "start"`},
+}, {
+	about:            "controller not found",
+	addrs:            []string{"1.2.3.4"},
+	controller:       "bad-wolf",
+	authUser:         "who",
+	ops:              []apiparams.Operation{"login"},
+	expectedMessages: []string{`cannot log into juju: controller "bad-wolf" not found`},
+}, {
+	about: "controller not specified",
+	controllers: map[string]api.ControllerParams{
+		"production": {Addrs: []string{"1.2.3.4"}, Cert: "cert"},
+		"staging":    {Addrs: []string{"1.2.3.5"}, Cert: "staging-cert"},
+	},
+	authUser:         "who",
+	ops:              []apiparams.Operation{"login"},
+	expectedMessages: []string{`cannot log into juju: controller must be specified, available controllers: production, staging`},
+}, {
+	about: "multiple controllers",
+	controllers: map[string]api.ControllerParams{
+		"production": {Addrs: []string{"1.2.3.4"}, Cert: "cert"},
+		"staging":    {Addrs: []string{"1.2.3.5"}, Cert: "staging-cert"},
+	},
+	controller:       "staging",
+	authUser:         "who",
+	ops:              []apiparams.Operation{"login", "bad wolf"},
+	expectedMessages: []string{`logged in as "who"`, `invalid operation "bad wolf": expected "start"`},
 }}
 
 func TestServeWebSocket(t *testing.T) {
 	c := qt.New(t)
 	logging.Log().SetLevel(zapcore.ErrorLevel)
 
-	send := func(conn *websocket.Conn, op apiparams.Operation) string {
+	send := func(conn *websocket.Conn, op apiparams.Operation, controller string) string {
 		err := conn.WriteJSON(apiparams.Login{
-			Operation: op,
+			Operation:  op,
+			Controller: controller,
 		})
 		c.Assert(err, qt.Equals, nil)
 		var resp apiparams.Response
@@ -86,9 +120,18 @@ func TestServeWebSocket(t *testing.T) {
 	for _, test := range serveWebSocketTests {
 		c.Run(test.about, func(c *qt.C) {
 			// Set up the WebSocket server.
-			server := httptest.NewServer(setupMux(c, test.addrs, test.allowedUsers))
+			controllers := test.controllers
+			if controllers == nil {
+				controllers = map[string]api.ControllerParams{
+					"ctrl": {Addrs: test.addrs, Cert: "cert"},
+				}
+			}
+			mux, _ := setupMux(c, controllers, api.SvcParams{
+				AllowedUsers: test.allowedUsers,
+			})
+			server := httptest.NewServer(mux)
 			defer server.Close()
-			patchJujuAuthenticate(c, test.authUser, test.authErr, test.addrs)
+			patchJujuAuthenticate(c, test.authUser, test.authErr, controllers)
 
 			// Connect a WebSocket client to the server.
 			conn, _, err := websocket.DefaultDialer.Dial(wsURL(server.URL), nil)
@@ -97,30 +140,629 @@ func TestServeWebSocket(t *testing.T) {
 
 			// Run the operations.
 			for i, op := range test.ops {
-				msg := send(conn, op)
+				msg := send(conn, op, test.controller)
 				c.Assert(msg, qt.Equals, test.expectedMessages[i], qt.Commentf("op %d", i))
 			}
 		})
 	}
 }
 
-// setupMux creates and returns a mux with the API registered.
-func setupMux(c *qt.C, addrs, allowedUsers []string) *http.ServeMux {
+func TestServeWebSocketLogin(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+
+	// Set up a fake Juju controller.
+	ctrl, err := jujutest.NewController()
+	c.Assert(err, qt.Equals, nil)
+	defer ctrl.Close()
+	ctrl.AddUser("who", "tardis")
+	ms, err := ctrl.Macaroons("rose@external")
+	c.Assert(err, qt.Equals, nil)
+
+	tests := []struct {
+		about           string
+		login           apiparams.Login
+		expectedCode    apiparams.ResponseCode
+		expectedMessage string
+	}{{
+		about: "userpass authentication",
+		login: apiparams.Login{
+			Username: "who",
+			Password: "tardis",
+		},
+		expectedCode:    apiparams.OK,
+		expectedMessage: `logged in as "who"`,
+	}, {
+		about: "macaroon authentication",
+		login: apiparams.Login{
+			Macaroons: ms,
+		},
+		expectedCode:    apiparams.OK,
+		expectedMessage: `logged in as "rose@external"`,
+	}, {
+		about: "invalid password",
+		login: apiparams.Login{
+			Username: "who",
+			Password: "bad-wolf",
+		},
+		expectedCode:    apiparams.Error,
+		expectedMessage: "cannot log into juju: cannot authenticate user: invalid entity name or password.*",
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			// Set up the WebSocket server without patching authentication.
+			mux, _ := setupMux(c, map[string]api.ControllerParams{
+				"ctrl": {Addrs: []string{ctrl.Addr()}, Cert: ctrl.CACert()},
+			}, api.SvcParams{})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			// Connect a WebSocket client to the server and log in.
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL(server.URL), nil)
+			c.Assert(err, qt.Equals, nil)
+			defer conn.Close()
+			test.login.Operation = apiparams.OpLogin
+			err = conn.WriteJSON(test.login)
+			c.Assert(err, qt.Equals, nil)
+			var resp apiparams.Response
+			err = conn.ReadJSON(&resp)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(resp.Code, qt.Equals, test.expectedCode)
+			c.Assert(resp.Message, qt.Matches, test.expectedMessage)
+		})
+	}
+}
+
+func TestAuthenticateOthers(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	c.Patch(api.OtherLoginTimeout, 100*time.Millisecond)
+	// The unreachable controller only responds when the test completes.
+	unblock := make(chan struct{})
+	c.Defer(func() {
+		close(unblock)
+	})
+	c.Patch(api.JujuAuthenticate, func(controller string, addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
+		c.Check(creds.Password, qt.Equals, "tardis")
+		switch controller {
+		case "staging":
+			return &juju.Info{User: "who", ControllerName: controller}, nil
+		case "dalek":
+			return &juju.Info{User: "dalek", ControllerName: controller}, nil
+		case "invalid":
+			return nil, errgo.WithCausef(nil, juju.ErrUnauthorized, "bad wolf")
+		case "unreachable":
+			<-unblock
+			return nil, errors.New("cannot connect to the controller")
+		}
+		c.Errorf("unexpected controller %q", controller)
+		return nil, errors.New("unexpected controller")
+	})
+	jp := api.JujuParams{
+		Controllers: map[string]api.ControllerParams{
+			"production":  {Addrs: []string{"1.2.3.4"}},
+			"staging":     {Addrs: []string{"1.2.3.5"}},
+			"dalek":       {Addrs: []string{"1.2.3.6"}},
+			"invalid":     {Addrs: []string{"1.2.3.7"}},
+			"unreachable": {Addrs: []string{"1.2.3.8"}},
+		},
+		LoginAllControllers: true,
+	}
+	info := &juju.Info{
+		User:           "who",
+		ControllerName: "production",
+	}
+	creds := &juju.Credentials{
+		Username: "who",
+		Password: "tardis",
+	}
+
+	// Only the controllers accepting the same user in time are returned.
+	infos := api.AuthenticateOthers(jp, info, creds)
+	c.Assert(infos, qt.DeepEquals, []*juju.Info{{
+		User:           "who",
+		ControllerName: "staging",
+	}})
+
+	// Other controllers are not contacted unless enabled.
+	jp.LoginAllControllers = false
+	infos = api.AuthenticateOthers(jp, info, creds)
+	c.Assert(infos, qt.HasLen, 0)
+}
+
+func TestServeWebSocketStartError(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	name := lxdutils.ContainerName("who")
+
+	tests := []struct {
+		about           string
+		setup           func(client *lxdtest.Client)
+		flavour         string
+		expectedMessage string
+		expectedCalls   [][]string
+		// preserved reports whether the container is expected to be kept,
+		// as it was already present before the start request.
+		preserved bool
+	}{{
+		about: "container creation failure",
+		setup: func(client *lxdtest.Client) {
+			client.SetError("Create", "", errors.New("bad wolf"))
+		},
+		expectedMessage: `cannot create container "` + name + `": bad wolf`,
+		expectedCalls: [][]string{
+			{"All"},
+			{"ImageFingerprint", "image"},
+			{"Create", "image", name, "default", "termserver"},
+		},
+	}, {
+		about: "container start failure",
+		setup: func(client *lxdtest.Client) {
+			client.SetError("Start", name, errors.New("bad wolf"))
+		},
+		expectedMessage: `cannot start container "` + name + `": bad wolf`,
+		expectedCalls: [][]string{
+			{"All"},
+			{"ImageFingerprint", "image"},
+			{"Create", "image", name, "default", "termserver"},
+			{"(" + name + ").Start"},
+			{"Get", name},
+			{"Delete", name},
+		},
+	}, {
+		about: "existing container start failure",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer(name, false)
+			client.SetError("Start", name, errors.New("bad wolf"))
+		},
+		expectedMessage: `cannot start container "` + name + `": bad wolf`,
+		expectedCalls: [][]string{
+			{"All"},
+			{"ImageFingerprint", "image"},
+			{"(" + name + ").Start"},
+		},
+		preserved: true,
+	}, {
+		about: "container creation failure with flavour",
+		setup: func(client *lxdtest.Client) {
+			client.SetError("Create", "", errors.New("bad wolf"))
+		},
+		flavour:         "juju3",
+		expectedMessage: `cannot create container "` + name + `": bad wolf`,
+		expectedCalls: [][]string{
+			{"All"},
+			{"ImageFingerprint", "image-juju3"},
+			{"Create", "image-juju3", name, "default", "juju3"},
+		},
+	}, {
+		about: "running container with a different flavour",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer(name, true)
+		},
+		flavour:         "juju3",
+		expectedMessage: `container "` + name + `" is running with a different flavour: stop it before choosing flavour "juju3"`,
+		expectedCalls: [][]string{
+			{"All"},
+		},
+		preserved: true,
+	}, {
+		about:           "flavour not found",
+		setup:           func(client *lxdtest.Client) {},
+		flavour:         "no-such",
+		expectedMessage: `flavour "no-such" not found`,
+		expectedCalls:   [][]string{},
+	}, {
+		about:           "flavour not allowed",
+		setup:           func(client *lxdtest.Client) {},
+		flavour:         "sre",
+		expectedMessage: `user "who" is not allowed to use flavour "sre"`,
+		expectedCalls:   [][]string{},
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			// Set up the WebSocket server with a fake LXD client.
+			client := lxdtest.New()
+			test.setup(client)
+			c.Patch(api.LXDUtilsConnect, func(socketPath string) (lxdclient.Client, error) {
+				return client, nil
+			})
+			controllers := map[string]api.ControllerParams{
+				"ctrl": {Addrs: []string{"1.2.3.4"}, Cert: "cert"},
+			}
+			mux, _ := setupMux(c, controllers, api.SvcParams{})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			patchJujuAuthenticate(c, "who", "", controllers)
+
+			// Connect a WebSocket client to the server and log in.
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL(server.URL), nil)
+			c.Assert(err, qt.Equals, nil)
+			defer conn.Close()
+			err = conn.WriteJSON(apiparams.Login{
+				Operation: apiparams.OpLogin,
+				Username:  "who",
+				Password:  "secret",
+			})
+			c.Assert(err, qt.Equals, nil)
+			var resp apiparams.Response
+			err = conn.ReadJSON(&resp)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(resp.Code, qt.Equals, apiparams.OK)
+
+			// Start the session.
+			err = conn.WriteJSON(apiparams.Start{
+				Operation: apiparams.OpStart,
+				Flavour:   test.flavour,
+			})
+			c.Assert(err, qt.Equals, nil)
+			err = conn.ReadJSON(&resp)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(resp, qt.DeepEquals, apiparams.Response{
+				Operation: apiparams.OpStart,
+				Code:      apiparams.Error,
+				Message:   test.expectedMessage,
+			})
+
+			// The failed container has been removed, unless it was already
+			// present.
+			c.Assert(client.Calls(), qt.DeepEquals, test.expectedCalls)
+			if test.preserved {
+				c.Assert(client.Container(name), qt.Not(qt.IsNil))
+				return
+			}
+			c.Assert(client.Container(name), qt.IsNil)
+		})
+	}
+}
+
+func TestServeWebSocketStop(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	name := lxdutils.ContainerName("who")
+	stopOK := apiparams.Response{
+		Operation: apiparams.OpStop,
+		Code:      apiparams.OK,
+		Message:   "container stopped",
+	}
+
+	tests := []struct {
+		about             string
+		setup             func(client *lxdtest.Client)
+		ops               []apiparams.Operation
+		expectedResponses []apiparams.Response
+		expectedCalls     [][]string
+	}{{
+		about: "stop then start",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer(name, true)
+			// Make the start fail so that the container is not proxied.
+			client.SetError("Start", name, errors.New("bad wolf"))
+		},
+		ops: []apiparams.Operation{apiparams.OpStop, apiparams.OpStart},
+		expectedResponses: []apiparams.Response{stopOK, {
+			Operation: apiparams.OpStart,
+			Code:      apiparams.Error,
+			Message:   `cannot start container "` + name + `": bad wolf`,
+		}},
+		expectedCalls: [][]string{
+			{"All"},
+			{"Get", name},
+			{"(" + name + ").Stop"},
+			{"All"},
+			{"ImageFingerprint", "image"},
+			{"(" + name + ").Start"},
+		},
+	}, {
+		about: "destroy then start",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer(name, true)
+			client.SetError("Create", "", errors.New("bad wolf"))
+		},
+		ops: []apiparams.Operation{apiparams.OpDestroy, apiparams.OpStart},
+		expectedResponses: []apiparams.Response{{
+			Operation: apiparams.OpDestroy,
+			Code:      apiparams.OK,
+			Message:   "container destroyed",
+		}, {
+			Operation: apiparams.OpStart,
+			Code:      apiparams.Error,
+			Message:   `cannot create container "` + name + `": bad wolf`,
+		}},
+		expectedCalls: [][]string{
+			{"All"},
+			{"Get", name},
+			{"(" + name + ").Stop"},
+			{"Delete", name},
+			{"All"},
+			{"ImageFingerprint", "image"},
+			{"Create", "image", name, "default", "termserver"},
+		},
+	}, {
+		about: "stop when no container exists",
+		setup: func(client *lxdtest.Client) {
+			client.SetError("Create", "", errors.New("bad wolf"))
+		},
+		ops: []apiparams.Operation{apiparams.OpStop, apiparams.OpStart},
+		expectedResponses: []apiparams.Response{{
+			Operation: apiparams.OpStop,
+			Code:      apiparams.OK,
+			Message:   "container already stopped",
+		}, {
+			Operation: apiparams.OpStart,
+			Code:      apiparams.Error,
+			Message:   `cannot create container "` + name + `": bad wolf`,
+		}},
+		expectedCalls: [][]string{
+			{"All"},
+			{"Get", name},
+			{"All"},
+			{"All"},
+			{"ImageFingerprint", "image"},
+			{"Create", "image", name, "default", "termserver"},
+		},
+	}, {
+		about: "stop twice",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer(name, true)
+		},
+		ops: []apiparams.Operation{apiparams.OpStop, apiparams.OpStop},
+		expectedResponses: []apiparams.Response{stopOK, {
+			Operation: apiparams.OpStop,
+			Code:      apiparams.OK,
+			Message:   "container already stopped",
+		}},
+		expectedCalls: [][]string{
+			{"All"},
+			{"Get", name},
+			{"(" + name + ").Stop"},
+			{"All"},
+			{"Get", name},
+		},
+	}, {
+		about: "stop container claimed from the pool",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer("tp-1", true).SetConfig("user.jujushell.user", "who")
+		},
+		ops: []apiparams.Operation{apiparams.OpStop, apiparams.OpStop},
+		expectedResponses: []apiparams.Response{stopOK, {
+			Operation: apiparams.OpStop,
+			Code:      apiparams.OK,
+			Message:   "container already stopped",
+		}},
+		expectedCalls: [][]string{
+			{"All"},
+			{"Get", "tp-1"},
+			{"(tp-1).Stop"},
+			{"All"},
+			{"Get", "tp-1"},
+		},
+	}, {
+		about: "destroy twice",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer(name, false)
+		},
+		ops: []apiparams.Operation{apiparams.OpDestroy, apiparams.OpDestroy},
+		expectedResponses: []apiparams.Response{{
+			Operation: apiparams.OpDestroy,
+			Code:      apiparams.OK,
+			Message:   "container destroyed",
+		}, {
+			Operation: apiparams.OpDestroy,
+			Code:      apiparams.OK,
+			Message:   "container already destroyed",
+		}},
+		expectedCalls: [][]string{
+			{"All"},
+			{"Get", name},
+			{"Delete", name},
+			{"All"},
+			{"Get", name},
+			{"All"},
+		},
+	}, {
+		about: "invalid operation after stop",
+		setup: func(client *lxdtest.Client) {
+			client.AddContainer(name, true)
+		},
+		ops: []apiparams.Operation{apiparams.OpStop, "bad-wolf"},
+		expectedResponses: []apiparams.Response{stopOK, {
+			Operation: apiparams.OpStart,
+			Code:      apiparams.Error,
+			Message:   `invalid operation "bad-wolf": expected "start"`,
+		}},
+		expectedCalls: [][]string{
+			{"All"},
+			{"Get", name},
+			{"(" + name + ").Stop"},
+		},
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			// Set up the WebSocket server with a fake LXD client, used by
+			// both the API and the registry.
+			client := lxdtest.New()
+			test.setup(client)
+			c.Patch(api.LXDUtilsConnect, func(socketPath string) (lxdclient.Client, error) {
+				return client, nil
+			})
+			controllers := map[string]api.ControllerParams{
+				"ctrl": {Addrs: []string{"1.2.3.4"}, Cert: "cert"},
+			}
+			patchJujuAuthenticate(c, "who", "", controllers)
+			mux := http.NewServeMux()
+			_, err := api.Register(mux, api.JujuParams{
+				Controllers: controllers,
+			}, api.LXDParams{
+				ImageName: "image",
+				Profiles:  []string{"default", "termserver"},
+			}, api.SvcParams{})
+			c.Assert(err, qt.Equals, nil)
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			client.ResetCalls()
+
+			// Connect a WebSocket client to the server and log in.
+			conn := dialLogin(c, server.URL)
+			defer conn.Close()
+			c.Assert(readMessage(c, conn), qt.Equals, `logged in as "who"`)
+
+			// Send the requests.
+			for i, op := range test.ops {
+				err = conn.WriteJSON(apiparams.Start{
+					Operation: op,
+				})
+				c.Assert(err, qt.Equals, nil)
+				var resp apiparams.Response
+				err = conn.ReadJSON(&resp)
+				c.Assert(err, qt.Equals, nil)
+				c.Assert(resp, qt.DeepEquals, test.expectedResponses[i])
+			}
+			c.Assert(client.Calls(), qt.DeepEquals, test.expectedCalls)
+		})
+	}
+}
+
+func TestLXDParamsImage(t *testing.T) {
+	c := qt.New(t)
+	lxd := api.LXDParams{
+		ImageName: "termserver",
+		ImageRules: []api.ImageRule{{
+			Users:     []string{"rose", "who"},
+			ImageName: "termserver-sre",
+			Profiles:  []string{"default", "sre"},
+		}, {
+			Users:     []string{"*@external"},
+			ImageName: "termserver-workshop",
+		}, {
+			Users:    []string{"dalek"},
+			Profiles: []string{"default", "restricted"},
+		}},
+		Profiles: []string{"default", "termserver"},
+	}
+
+	tests := []struct {
+		user             string
+		expectedImage    string
+		expectedProfiles []string
+		expectedOK       bool
+	}{{
+		user:             "who",
+		expectedImage:    "termserver-sre",
+		expectedProfiles: []string{"default", "sre"},
+		expectedOK:       true,
+	}, {
+		user:             "cyberman@external",
+		expectedImage:    "termserver-workshop",
+		expectedProfiles: []string{"default", "termserver"},
+		expectedOK:       true,
+	}, {
+		user:             "dalek",
+		expectedImage:    "termserver",
+		expectedProfiles: []string{"default", "restricted"},
+		expectedOK:       true,
+	}, {
+		user:             "cyberman",
+		expectedImage:    "termserver",
+		expectedProfiles: []string{"default", "termserver"},
+	}}
+	for _, test := range tests {
+		c.Run(test.user, func(c *qt.C) {
+			image, profiles, ok := api.LXDParamsImage(lxd, test.user)
+			c.Assert(image, qt.Equals, test.expectedImage)
+			c.Assert(profiles, qt.DeepEquals, test.expectedProfiles)
+			c.Assert(ok, qt.Equals, test.expectedOK)
+		})
+	}
+}
+
+func TestLXDParamsFlavour(t *testing.T) {
+	c := qt.New(t)
+	juju3 := api.Flavour{
+		ImageName: "termserver-juju3",
+		Limits:    lxdclient.Limits{Memory: "4GB"},
+	}
+	sre := api.Flavour{
+		Profiles: []string{"default", "sre"},
+		Users:    []string{"rose", "*@sre"},
+	}
+	lxd := api.LXDParams{
+		Flavours: map[string]api.Flavour{
+			"juju3": juju3,
+			"sre":   sre,
+		},
+	}
+
+	tests := []struct {
+		name            string
+		user            string
+		expectedFlavour api.Flavour
+		expectedError   string
+	}{{
+		name:            "juju3",
+		user:            "who",
+		expectedFlavour: juju3,
+	}, {
+		name:            "sre",
+		user:            "rose",
+		expectedFlavour: sre,
+	}, {
+		name:            "sre",
+		user:            "dalek@sre",
+		expectedFlavour: sre,
+	}, {
+		name:          "sre",
+		user:          "who",
+		expectedError: `user "who" is not allowed to use flavour "sre"`,
+	}, {
+		name:          "juju1",
+		user:          "who",
+		expectedError: `flavour "juju1" not found`,
+	}}
+	for _, test := range tests {
+		c.Run(test.name+" "+test.user, func(c *qt.C) {
+			f, err := api.LXDParamsFlavour(lxd, test.name, test.user)
+			if test.expectedError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectedError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(f, qt.DeepEquals, test.expectedFlavour)
+		})
+	}
+}
+
+// defaultControllers holds the controllers used by tests not specifically
+// exercising multiple controllers.
+var defaultControllers = map[string]api.ControllerParams{
+	"ctrl": {Addrs: []string{"1.2.3.4"}, Cert: "cert"},
+}
+
+// setupMux creates and returns a mux with the API registered for the given
+// controllers and service parameters, using an empty container registry. The
+// resulting service is also returned.
+func setupMux(c *qt.C, controllers map[string]api.ControllerParams, svc api.SvcParams) (*http.ServeMux, *api.Service) {
 	mux := http.NewServeMux()
-	c.Patch(api.RegistryNew, func(d time.Duration, socketPath string) (*registry.Registry, error) {
+	c.Patch(api.RegistryNew, func(d, rd, ed time.Duration, socketPath string) (*registry.Registry, error) {
 		return &registry.Registry{}, nil
 	})
-	err := api.Register(mux, api.JujuParams{
-		Addrs: addrs,
-		Cert:  "cert",
+	s, err := api.Register(mux, api.JujuParams{
+		Controllers: controllers,
 	}, api.LXDParams{
+		Flavours: map[string]api.Flavour{
+			"juju3": {
+				ImageName: "image-juju3",
+				Profiles:  []string{"default", "juju3"},
+			},
+			"sre": {
+				ImageName: "image-sre",
+				Users:     []string{"rose", "*@sre"},
+			},
+		},
 		ImageName: "image",
 		Profiles:  []string{"default", "termserver"},
-	}, api.SvcParams{
-		AllowedUsers: allowedUsers,
-	})
+	}, svc)
 	c.Assert(err, qt.Equals, nil)
-	return mux
+	return mux, s
 }
 
 // wsURL returns a WebSocket URL from the given HTTP URL.
@@ -128,18 +770,42 @@ func wsURL(u string) string {
 	return strings.Replace(u, "http://", "ws://", 1) + "/ws/"
 }
 
-func patchJujuAuthenticate(c *qt.C, user, err string, addrs []string) {
-	c.Patch(api.JujuAuthenticate, func(addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
-		c.Assert(addrs, qt.DeepEquals, addrs)
-		c.Assert(cert, qt.Equals, "cert")
+// dialLogin connects to the WebSocket server at the given URL and sends a
+// login request.
+func dialLogin(c *qt.C, u string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(u), nil)
+	c.Assert(err, qt.Equals, nil)
+	err = conn.WriteJSON(apiparams.Login{
+		Operation: apiparams.OpLogin,
+		Username:  "who",
+		Password:  "tardis",
+	})
+	c.Assert(err, qt.Equals, nil)
+	return conn
+}
+
+// readMessage reads a response from the given connection and returns its
+// message.
+func readMessage(c *qt.C, conn *websocket.Conn) string {
+	var resp apiparams.Response
+	err := conn.ReadJSON(&resp)
+	c.Assert(err, qt.Equals, nil)
+	return resp.Message
+}
+
+func patchJujuAuthenticate(c *qt.C, user, err string, controllers map[string]api.ControllerParams) {
+	c.Patch(api.JujuAuthenticate, func(controller string, addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
+		c.Assert(addrs, qt.DeepEquals, controllers[controller].Addrs)
+		c.Assert(cert, qt.Equals, controllers[controller].Cert)
 		if user != "" {
 			return &juju.Info{
-				User: user,
+				User:           user,
+				ControllerName: controller,
 			}, nil
 		}
 		if err != "" {
 			return nil, errors.New(err)
 		}
-		return juju.Authenticate(addrs, creds, cert)
+		return juju.Authenticate(controller, addrs, creds, cert)
 	})
 }
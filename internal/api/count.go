@@ -0,0 +1,81 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
+// newCountConn returns a connection that counts the bytes received from and
+// sent to the given client connection.
+func newCountConn(conn wsproxy.Conn) *countConn {
+	return &countConn{
+		Conn: conn,
+	}
+}
+
+// countConn implements wsproxy.Conn by counting transferred bytes.
+type countConn struct {
+	wsproxy.Conn
+	in  int64
+	out int64
+}
+
+// NextReader implements wsproxy.Conn.NextReader.
+func (c *countConn) NextReader() (messageType int, r io.Reader, err error) {
+	messageType, r, err = c.Conn.NextReader()
+	if err != nil {
+		return messageType, r, err
+	}
+	return messageType, &countReader{
+		Reader: r,
+		n:      &c.in,
+	}, nil
+}
+
+// NextWriter implements wsproxy.Conn.NextWriter.
+func (c *countConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	w, err := c.Conn.NextWriter(messageType)
+	if err != nil {
+		return nil, err
+	}
+	return &countWriter{
+		WriteCloser: w,
+		n:           &c.out,
+	}, nil
+}
+
+// bytes returns the number of bytes received from and sent to the client.
+func (c *countConn) bytes() (in, out int64) {
+	return atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+}
+
+// countReader is a reader counting the bytes read.
+type countReader struct {
+	io.Reader
+	n *int64
+}
+
+// Read implements io.Reader.
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// countWriter is a writer counting the bytes written.
+type countWriter struct {
+	io.WriteCloser
+	n *int64
+}
+
+// Write implements io.Writer.
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
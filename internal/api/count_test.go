@@ -0,0 +1,54 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api_test
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+
+	"github.com/juju/jujushell/internal/api"
+)
+
+func TestCountConn(t *testing.T) {
+	c := qt.New(t)
+	mc := &messageConn{
+		messages: []message{
+			{websocket.TextMessage, `["stdin", "ls\r"]`},
+			{websocket.BinaryMessage, "binary data"},
+		},
+	}
+	conn, bytes := api.NewCountConn(mc)
+
+	// Read all messages.
+	for {
+		_, r, err := conn.NextReader()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, qt.Equals, nil)
+		_, err = ioutil.ReadAll(r)
+		c.Assert(err, qt.Equals, nil)
+	}
+	in, out := bytes()
+	c.Assert(in, qt.Equals, int64(28))
+	c.Assert(out, qt.Equals, int64(0))
+
+	// Write a message.
+	w, err := conn.NextWriter(websocket.TextMessage)
+	c.Assert(err, qt.Equals, nil)
+	_, err = io.WriteString(w, `["stdout", "$ "]`)
+	c.Assert(err, qt.Equals, nil)
+	err = w.Close()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(mc.written, qt.DeepEquals, []message{
+		{websocket.TextMessage, `["stdout", "$ "]`},
+	})
+	in, out = bytes()
+	c.Assert(in, qt.Equals, int64(28))
+	c.Assert(out, qt.Equals, int64(16))
+}
@@ -3,9 +3,60 @@
 
 package api
 
+import (
+	"time"
+
+	"github.com/juju/jujushell/internal/juju"
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
 var (
-	JujuAuthenticate = &jujuAuthenticate
-	RegistryNew      = &registryNew
-	Sleep            = &sleep
-	WaitReady        = waitReady
+	JujuAuthenticate  = &jujuAuthenticate
+	LXDUtilsConnect   = &lxdutilsConnect
+	NewResizeConn     = newResizeConn
+	OtherLoginTimeout = &otherLoginTimeout
+	RegistryNew       = &registryNew
+	Sleep             = &sleep
+	TimeNow           = &timeNow
+	WaitReady         = waitReady
 )
+
+// AuthenticateOthers logs the user described by the given controller info
+// into the other controllers.
+func AuthenticateOthers(jp JujuParams, info *juju.Info, creds *juju.Credentials) []*juju.Info {
+	return authenticateOthers(jp, info, creds)
+}
+
+// LXDParamsFlavour returns the flavour with the given name for the given
+// user.
+func LXDParamsFlavour(p LXDParams, name, user string) (Flavour, error) {
+	return p.flavour(name, user)
+}
+
+// LXDParamsImage returns the LXD image and profiles for the given user.
+func LXDParamsImage(p LXDParams, user string) (image string, profiles []string, ok bool) {
+	return p.image(user)
+}
+
+// NewLockout returns a new lockout, which can be used with LockoutCheck and
+// LockoutFailed.
+func NewLockout() *lockout {
+	return newLockout(nil)
+}
+
+// LockoutCheck checks whether the given user or remote address are locked out.
+func LockoutCheck(l *lockout, user, remoteAddr string) error {
+	return l.check(user, remoteAddr)
+}
+
+// LockoutFailed records a failed login attempt.
+func LockoutFailed(l *lockout, user, remoteAddr string, threshold int, d time.Duration) {
+	l.failed(user, remoteAddr, threshold, d)
+}
+
+// NewCountConn returns a counting connection wrapping the given one, and a
+// function returning the bytes transferred.
+func NewCountConn(conn wsproxy.Conn) (wsproxy.Conn, func() (in, out int64)) {
+	c := newCountConn(conn)
+	return c, c.bytes
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// newLimiter creates and returns a new limiter.
+func newLimiter() *limiter {
+	return &limiter{
+		addrs:  make(map[string]int),
+		users:  make(map[string]int),
+		logins: make(map[string][]time.Time),
+	}
+}
+
+// limiter enforces limits on concurrent WebSocket sessions, per remote address
+// and per user, and on the rate of login attempts per remote address. Limits
+// are provided on each call, so that they can be changed at any time.
+type limiter struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// addrs and users hold the number of live sessions by remote host and by
+	// user name.
+	addrs map[string]int
+	users map[string]int
+	// logins holds the times of the login attempts made in the last minute,
+	// by remote host, ordered from the oldest.
+	logins map[string][]time.Time
+	// pruned holds when stale login attempts were last removed.
+	pruned time.Time
+}
+
+// acquireAddr registers a new session from the given remote address, and
+// returns a function that must be called when the session ends. An error is
+// returned if max sessions from the same host are already live. A zero max
+// means that the number of sessions is not limited.
+func (l *limiter) acquireAddr(remoteAddr string, max int) (release func(), err error) {
+	host := remoteHost(remoteAddr)
+	release, err = l.acquire(l.addrs, host, max)
+	if err != nil {
+		return nil, errgo.Notef(err, "too many sessions from %s", host)
+	}
+	return release, nil
+}
+
+// acquireUser is like acquireAddr, but limits the sessions of the given user.
+func (l *limiter) acquireUser(user string, max int) (release func(), err error) {
+	release, err = l.acquire(l.users, user, max)
+	if err != nil {
+		return nil, errgo.Notef(err, "too many sessions for user %q", user)
+	}
+	return release, nil
+}
+
+// acquire increments the given counter for the given key, unless max is
+// already reached.
+func (l *limiter) acquire(counts map[string]int, key string, max int) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max > 0 && counts[key] >= max {
+		return nil, errgo.Newf("limit of %d reached", max)
+	}
+	counts[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if counts[key]--; counts[key] <= 0 {
+				delete(counts, key)
+			}
+		})
+	}, nil
+}
+
+// login registers a login attempt from the given remote address. An error is
+// returned if rate attempts have already been made from the same host in the
+// last minute. A zero rate means that login attempts are not limited.
+func (l *limiter) login(remoteAddr string, rate int) error {
+	if rate <= 0 {
+		return nil
+	}
+	host := remoteHost(remoteAddr)
+	now := timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.pruned) >= time.Minute {
+		// Forget hosts without recent login attempts.
+		for h, attempts := range l.logins {
+			if len(recentAttempts(attempts, now)) == 0 {
+				delete(l.logins, h)
+			}
+		}
+		l.pruned = now
+	}
+	attempts := recentAttempts(l.logins[host], now)
+	if len(attempts) >= rate {
+		l.logins[host] = attempts
+		return errgo.Newf("too many login attempts from %s, please retry later", host)
+	}
+	l.logins[host] = append(attempts, now)
+	return nil
+}
+
+// recentAttempts returns the login attempts, from the given ones, made in the
+// minute before now.
+func recentAttempts(attempts []time.Time, now time.Time) []time.Time {
+	for len(attempts) != 0 && now.Sub(attempts[0]) >= time.Minute {
+		attempts = attempts[1:]
+	}
+	return attempts
+}
+
+// remoteHost returns the host part of the given remote address.
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// timeNow is defined as a variable for testing.
+var timeNow = func() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/api"
+	"github.com/juju/jujushell/internal/logging"
+	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
+	"github.com/juju/jujushell/internal/lxdutils"
+)
+
+var limitsTests = []struct {
+	about string
+	svc   api.SvcParams
+	// expectedMessages holds the login responses for consecutive connections,
+	// all kept open.
+	expectedMessages []string
+}{{
+	about: "no limits",
+	expectedMessages: []string{
+		`logged in as "who"`,
+		`logged in as "who"`,
+		`logged in as "who"`,
+	},
+}, {
+	about: "sessions per address",
+	svc: api.SvcParams{
+		MaxSessionsPerAddr: 2,
+	},
+	expectedMessages: []string{
+		`logged in as "who"`,
+		`logged in as "who"`,
+		`too many sessions from 127.0.0.1: limit of 2 reached`,
+	},
+}, {
+	about: "sessions per user",
+	svc: api.SvcParams{
+		MaxSessionsPerUser: 1,
+	},
+	expectedMessages: []string{
+		`logged in as "who"`,
+		`too many sessions for user "who": limit of 1 reached`,
+	},
+}, {
+	about: "login rate",
+	svc: api.SvcParams{
+		LoginRateLimit: 2,
+	},
+	expectedMessages: []string{
+		`logged in as "who"`,
+		`logged in as "who"`,
+		`too many login attempts from 127.0.0.1, please retry later`,
+	},
+}}
+
+func TestLimits(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+
+	for _, test := range limitsTests {
+		c.Run(test.about, func(c *qt.C) {
+			patchJujuAuthenticate(c, "who", "", defaultControllers)
+			mux, _ := setupMux(c, defaultControllers, test.svc)
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			for i, expectedMessage := range test.expectedMessages {
+				conn := dialLogin(c, server.URL)
+				defer conn.Close()
+				c.Assert(readMessage(c, conn), qt.Equals, expectedMessage, qt.Commentf("connection %d", i))
+			}
+		})
+	}
+}
+
+func TestLimitsRelease(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	patchJujuAuthenticate(c, "who", "", defaultControllers)
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+		MaxSessionsPerAddr: 1,
+		MaxSessionsPerUser: 1,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	conn := dialLogin(c, server.URL)
+	c.Assert(readMessage(c, conn), qt.Equals, `logged in as "who"`)
+	// Sessions are released when connections are closed.
+	conn.Close()
+	var msg string
+	for i := 0; i < 100; i++ {
+		conn = dialLogin(c, server.URL)
+		msg = readMessage(c, conn)
+		conn.Close()
+		if msg == `logged in as "who"` {
+			break
+		}
+		// The server may not have noticed the disconnection yet.
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(msg, qt.Equals, `logged in as "who"`)
+}
+
+func TestLoginRateWindow(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.Patch(api.TimeNow, func() time.Time {
+		return now
+	})
+	patchJujuAuthenticate(c, "who", "", defaultControllers)
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+		LoginRateLimit: 1,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	login := func() string {
+		conn := dialLogin(c, server.URL)
+		defer conn.Close()
+		return readMessage(c, conn)
+	}
+	c.Assert(login(), qt.Equals, `logged in as "who"`)
+	now = now.Add(59 * time.Second)
+	c.Assert(login(), qt.Equals, `too many login attempts from 127.0.0.1, please retry later`)
+	// Refused attempts are not counted.
+	now = now.Add(time.Second)
+	c.Assert(login(), qt.Equals, `logged in as "who"`)
+}
+
+func TestMaxContainers(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	client := lxdtest.New()
+	client.AddContainer(lxdutils.ContainerName("dalek"), true)
+	c.Patch(api.LXDUtilsConnect, func(socketPath string) (lxdclient.Client, error) {
+		return client, nil
+	})
+
+	tests := []struct {
+		about            string
+		startQueueSize   int
+		expectedResponse apiparams.Response
+	}{{
+		about: "start refused",
+		expectedResponse: apiparams.Response{
+			Operation: apiparams.OpStart,
+			Code:      apiparams.Error,
+			Message:   "too many running containers: limit of 1 reached, please retry later",
+		},
+	}, {
+		about:          "start queued",
+		startQueueSize: 1,
+		expectedResponse: apiparams.Response{
+			Operation: apiparams.OpStart,
+			Code:      apiparams.Queued,
+			Message:   "waiting for a container to be available: position 1 in queue",
+			Position:  1,
+		},
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			patchJujuAuthenticate(c, "who", "", defaultControllers)
+			mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+				MaxContainers:  1,
+				StartQueueSize: test.startQueueSize,
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			conn := dialLogin(c, server.URL)
+			defer conn.Close()
+			c.Assert(readMessage(c, conn), qt.Equals, `logged in as "who"`)
+			err := conn.WriteJSON(apiparams.Start{
+				Operation: apiparams.OpStart,
+			})
+			c.Assert(err, qt.Equals, nil)
+			var resp apiparams.Response
+			err = conn.ReadJSON(&resp)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(resp, qt.DeepEquals, test.expectedResponse)
+			// No container has been created.
+			c.Assert(client.Container(lxdutils.ContainerName("who")), qt.IsNil)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// newLockout creates and returns a new lockout. The given function, if not
+// nil, is called with the kind of lockout, "user" or "addr", every time a
+// lockout starts.
+func newLockout(onLock func(kind string)) *lockout {
+	return &lockout{
+		onLock:   onLock,
+		failures: make(map[lockoutKey]*failures),
+	}
+}
+
+// lockout tracks failed login attempts per remote host, and per user name
+// from each remote host, and temporarily locks out users and hosts after too
+// many failures. Users are only locked out from the hosts the failures come
+// from, so that nobody can keep legitimate users locked out by failing logins
+// on their behalf. The threshold and duration of lockouts are provided on each
+// call, so that they can be changed at any time.
+type lockout struct {
+	onLock func(kind string)
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	failures map[lockoutKey]*failures
+	// pruned holds when stale failures were last removed.
+	pruned time.Time
+}
+
+// lockoutKey identifies a remote host, or a user logging in from a remote
+// host.
+type lockoutKey struct {
+	kind string
+	user string
+	host string
+}
+
+// failures holds the failed login attempts of a user or remote host.
+type failures struct {
+	// count holds the number of consecutive failures.
+	count int
+	// last holds the time of the last failure.
+	last time.Time
+	// until holds the time when the current lockout ends, if any.
+	until time.Time
+}
+
+// errLockedOut is returned when login is refused because of too many failed
+// attempts.
+var errLockedOut = errgo.New("too many failed login attempts, please retry later")
+
+// check returns errLockedOut if the given user or remote address are
+// currently locked out. The user can be empty, for instance for macaroon
+// based logins.
+func (l *lockout) check(user, remoteAddr string) error {
+	now := timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range lockoutKeys(user, remoteAddr) {
+		if f := l.failures[key]; f != nil && now.Before(f.until) {
+			return errLockedOut
+		}
+	}
+	return nil
+}
+
+// failed records a failed login attempt by the given user from the given
+// remote address. Users and hosts reaching the given threshold of
+// consecutive failures are locked out for the given duration. Failures older
+// than the duration are forgotten. A zero threshold disables lockouts.
+func (l *lockout) failed(user, remoteAddr string, threshold int, d time.Duration) {
+	if threshold <= 0 {
+		return
+	}
+	now := timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now, d)
+	for _, key := range lockoutKeys(user, remoteAddr) {
+		f := l.failures[key]
+		if f == nil || now.Sub(f.last) >= d {
+			f = &failures{}
+			l.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count < threshold {
+			continue
+		}
+		f.count = 0
+		f.until = now.Add(d)
+		log.Infow("login locked out", "kind", key.kind, "user", key.user, "host", key.host, "until", f.until)
+		if l.onLock != nil {
+			l.onLock(key.kind)
+		}
+	}
+}
+
+// succeeded records a successful login of the given user from the given
+// remote address, resetting the failures of the user from that host. Failures
+// from the remote host are preserved, so that valid credentials cannot be used
+// to keep guessing the passwords of other users.
+func (l *lockout) succeeded(user, remoteAddr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, lockoutKey{kind: "user", user: user, host: remoteHost(remoteAddr)})
+}
+
+// prune removes failures older than the given duration, at most once per
+// minute. It must be called with l.mu held.
+func (l *lockout) prune(now time.Time, d time.Duration) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	for key, f := range l.failures {
+		if now.Sub(f.last) >= d && !now.Before(f.until) {
+			delete(l.failures, key)
+		}
+	}
+	l.pruned = now
+}
+
+// lockoutKeys returns the keys identifying the given remote host and the
+// given user logging in from that host.
+func lockoutKeys(user, remoteAddr string) []lockoutKey {
+	host := remoteHost(remoteAddr)
+	keys := []lockoutKey{{kind: "addr", host: host}}
+	if user != "" {
+		keys = append(keys, lockoutKey{kind: "user", user: user, host: host})
+	}
+	return keys
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/internal/api"
+	"github.com/juju/jujushell/internal/juju"
+	"github.com/juju/jujushell/internal/logging"
+)
+
+func TestLockout(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.Patch(api.TimeNow, func() time.Time {
+		return now
+	})
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+		LockoutDuration:  10 * time.Minute,
+		LockoutThreshold: 2,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	login := func() string {
+		conn := dialLogin(c, server.URL)
+		defer conn.Close()
+		return readMessage(c, conn)
+	}
+	patchJujuUnauthorized(c)
+	c.Assert(login(), qt.Equals, "cannot log into juju: bad wolf")
+	c.Assert(login(), qt.Equals, "cannot log into juju: bad wolf")
+
+	// The threshold is reached: even valid credentials are refused.
+	patchJujuAuthenticate(c, "who", "", defaultControllers)
+	c.Assert(login(), qt.Equals, "too many failed login attempts, please retry later")
+	now = now.Add(9 * time.Minute)
+	c.Assert(login(), qt.Equals, "too many failed login attempts, please retry later")
+
+	// The lockout expires.
+	now = now.Add(time.Minute)
+	c.Assert(login(), qt.Equals, `logged in as "who"`)
+}
+
+func TestLockoutFailuresExpire(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.Patch(api.TimeNow, func() time.Time {
+		return now
+	})
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+		LockoutDuration:  10 * time.Minute,
+		LockoutThreshold: 2,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	patchJujuUnauthorized(c)
+
+	login := func() string {
+		conn := dialLogin(c, server.URL)
+		defer conn.Close()
+		return readMessage(c, conn)
+	}
+	c.Assert(login(), qt.Equals, "cannot log into juju: bad wolf")
+	// Failures older than the lockout duration are not counted.
+	now = now.Add(10 * time.Minute)
+	c.Assert(login(), qt.Equals, "cannot log into juju: bad wolf")
+	c.Assert(login(), qt.Equals, "cannot log into juju: bad wolf")
+	c.Assert(login(), qt.Equals, "too many failed login attempts, please retry later")
+}
+
+func TestLockoutUnreachableController(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{
+		LockoutDuration:  10 * time.Minute,
+		LockoutThreshold: 2,
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	login := func() string {
+		conn := dialLogin(c, server.URL)
+		defer conn.Close()
+		return readMessage(c, conn)
+	}
+	patchJujuAuthenticate(c, "", "cannot connect to the controller", defaultControllers)
+	for i := 0; i < 3; i++ {
+		c.Assert(login(), qt.Equals, "cannot log into juju: cannot connect to the controller")
+	}
+
+	// Failures not caused by invalid credentials are not counted.
+	patchJujuAuthenticate(c, "who", "", defaultControllers)
+	c.Assert(login(), qt.Equals, `logged in as "who"`)
+}
+
+func TestLockoutUserPerHost(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	lo := api.NewLockout()
+	api.LockoutFailed(lo, "admin", "1.2.3.4:4242", 2, time.Minute)
+	api.LockoutFailed(lo, "admin", "1.2.3.4:4243", 2, time.Minute)
+
+	// The user and the host are locked out.
+	err := api.LockoutCheck(lo, "admin", "1.2.3.4:4244")
+	c.Assert(err, qt.ErrorMatches, "too many failed login attempts, please retry later")
+	err = api.LockoutCheck(lo, "who", "1.2.3.4:4244")
+	c.Assert(err, qt.ErrorMatches, "too many failed login attempts, please retry later")
+
+	// The user can still log in from other hosts.
+	err = api.LockoutCheck(lo, "admin", "4.3.2.1:4242")
+	c.Assert(err, qt.Equals, nil)
+	api.LockoutFailed(lo, "admin", "4.3.2.1:4242", 2, time.Minute)
+	err = api.LockoutCheck(lo, "admin", "4.3.2.1:4242")
+	c.Assert(err, qt.Equals, nil)
+}
+
+// patchJujuUnauthorized patches Juju authentication so that the controller
+// always rejects the provided credentials.
+func patchJujuUnauthorized(c *qt.C) {
+	c.Patch(api.JujuAuthenticate, func(controller string, addrs []string, creds *juju.Credentials, cert string) (*juju.Info, error) {
+		return nil, errgo.WithCausef(nil, juju.ErrUnauthorized, "bad wolf")
+	})
+}
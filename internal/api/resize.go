@@ -0,0 +1,83 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/terminado"
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
+// newResizeConn returns a connection that translates resize requests sent by
+// the client into Terminado "set_size" messages. Other messages are left
+// untouched. Invalid resize requests are logged and discarded, as no response
+// can be safely sent to the client while the session is being proxied.
+func newResizeConn(conn wsproxy.Conn) wsproxy.Conn {
+	return &resizeConn{
+		Conn: conn,
+	}
+}
+
+// resizeConn implements wsproxy.Conn by handling resize requests.
+type resizeConn struct {
+	wsproxy.Conn
+}
+
+// NextReader implements wsproxy.Conn.NextReader.
+func (c *resizeConn) NextReader() (messageType int, r io.Reader, err error) {
+	for {
+		messageType, r, err = c.Conn.NextReader()
+		if err != nil || messageType != websocket.TextMessage {
+			return messageType, r, err
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg, err := resizeMessage(data)
+		if err != nil {
+			log.Infow("discarding invalid resize request", "err", err)
+			continue
+		}
+		if msg == nil {
+			// This is not a resize request.
+			msg = data
+		}
+		return messageType, bytes.NewReader(msg), nil
+	}
+}
+
+// resizeMessage returns the Terminado message corresponding to the given
+// resize request. A nil message is returned if the given data does not
+// represent a resize request.
+func resizeMessage(data []byte) ([]byte, error) {
+	// Terminado messages are JSON arrays, while API requests are objects.
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, nil
+	}
+	var req apiparams.Resize
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, nil
+	}
+	if req.Operation != apiparams.OpResize {
+		return nil, nil
+	}
+	if req.Rows < 1 || req.Rows > maxTerminalSize || req.Cols < 1 || req.Cols > maxTerminalSize {
+		return nil, errgo.Newf("invalid terminal size %dx%d", req.Rows, req.Cols)
+	}
+	return terminado.Encode(terminado.SetSize, req.Rows, req.Cols)
+}
+
+// maxTerminalSize holds the maximum number of rows or columns allowed in a
+// resize request, which is the maximum value that fits a window size.
+const maxTerminalSize = 65535
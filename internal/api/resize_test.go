@@ -0,0 +1,152 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/juju/jujushell/internal/api"
+	"github.com/juju/jujushell/internal/logging"
+)
+
+var resizeConnTests = []struct {
+	about            string
+	messages         []message
+	expectedMessages []message
+}{{
+	about: "terminal input",
+	messages: []message{
+		{websocket.TextMessage, `["stdin", "ls\r"]`},
+		{websocket.BinaryMessage, "binary data"},
+	},
+	expectedMessages: []message{
+		{websocket.TextMessage, `["stdin", "ls\r"]`},
+		{websocket.BinaryMessage, "binary data"},
+	},
+}, {
+	about: "resize request",
+	messages: []message{
+		{websocket.TextMessage, `{"operation": "resize", "rows": 24, "cols": 80}`},
+	},
+	expectedMessages: []message{
+		{websocket.TextMessage, `["set_size",24,80]`},
+	},
+}, {
+	about: "resize request mixed with terminal input",
+	messages: []message{
+		{websocket.TextMessage, `["stdin", "vim\r"]`},
+		{websocket.TextMessage, ` {"operation": "resize", "rows": 50, "cols": 132}`},
+		{websocket.TextMessage, `["stdin", ":q\r"]`},
+	},
+	expectedMessages: []message{
+		{websocket.TextMessage, `["stdin", "vim\r"]`},
+		{websocket.TextMessage, `["set_size",50,132]`},
+		{websocket.TextMessage, `["stdin", ":q\r"]`},
+	},
+}, {
+	about: "invalid resize requests are discarded",
+	messages: []message{
+		{websocket.TextMessage, `{"operation": "resize", "rows": 0, "cols": 80}`},
+		{websocket.TextMessage, `{"operation": "resize", "rows": 24, "cols": -1}`},
+		{websocket.TextMessage, `{"operation": "resize", "rows": 100000, "cols": 80}`},
+		{websocket.TextMessage, `{"operation": "resize", "rows": 42, "cols": 47}`},
+	},
+	expectedMessages: []message{
+		{websocket.TextMessage, `["set_size",42,47]`},
+	},
+}, {
+	about: "other objects are left untouched",
+	messages: []message{
+		{websocket.TextMessage, `{"operation": "start"}`},
+		{websocket.TextMessage, `{"bad": "wolf"`},
+		{websocket.TextMessage, ` `},
+	},
+	expectedMessages: []message{
+		{websocket.TextMessage, `{"operation": "start"}`},
+		{websocket.TextMessage, `{"bad": "wolf"`},
+		{websocket.TextMessage, ` `},
+	},
+}}
+
+func TestResizeConn(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	for _, test := range resizeConnTests {
+		c.Run(test.about, func(c *qt.C) {
+			conn := api.NewResizeConn(&messageConn{
+				messages: test.messages,
+			})
+			var msgs []message
+			for {
+				messageType, r, err := conn.NextReader()
+				if err == io.EOF {
+					break
+				}
+				c.Assert(err, qt.Equals, nil)
+				data, err := ioutil.ReadAll(r)
+				c.Assert(err, qt.Equals, nil)
+				msgs = append(msgs, message{messageType, string(data)})
+			}
+			c.Assert(msgs, qt.DeepEquals, test.expectedMessages)
+		})
+	}
+}
+
+// message holds a WebSocket message type and content.
+type message struct {
+	MessageType int
+	Data        string
+}
+
+// messageConn implements wsproxy.Conn by returning the stored messages, and
+// by storing written messages.
+type messageConn struct {
+	messages []message
+	written  []message
+}
+
+// NextReader implements wsproxy.Conn.NextReader. It returns io.EOF when all
+// messages have been read.
+func (c *messageConn) NextReader() (messageType int, r io.Reader, err error) {
+	if len(c.messages) == 0 {
+		return 0, nil, io.EOF
+	}
+	msg := c.messages[0]
+	c.messages = c.messages[1:]
+	return msg.MessageType, strings.NewReader(msg.Data), nil
+}
+
+// NextWriter implements wsproxy.Conn.NextWriter.
+func (c *messageConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &messageWriter{
+		conn:        c,
+		messageType: messageType,
+	}, nil
+}
+
+// messageWriter stores the written message in its connection when closed.
+type messageWriter struct {
+	conn        *messageConn
+	messageType int
+	buf         bytes.Buffer
+}
+
+// Write implements io.Writer.
+func (w *messageWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+// Close implements io.Closer.
+func (w *messageWriter) Close() error {
+	w.conn.written = append(w.conn.written, message{w.messageType, w.buf.String()})
+	return nil
+}
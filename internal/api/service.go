@@ -0,0 +1,128 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/jujushell/internal/pool"
+	"github.com/juju/jujushell/internal/registry"
+)
+
+// Service allows managing the API while the server is running.
+type Service struct {
+	params *params
+	reg    *registry.Registry
+	pool   *pool.Pool
+	t      *tracker
+}
+
+// Reload applies the given parameters to the running API, without affecting
+// existing sessions. Only the LXD image name, profiles, image rules,
+// flavours and resource limits, the allowed users, the session, login,
+// lockout and container limits, the welcome message and the session duration
+// are applied: changes to other parameters require a restart. The new session
+// duration also applies to the containers already active, while new resource
+// limits only apply to containers created from now on. If the image,
+// profiles or resource limits change, the container pool is rebuilt.
+func (s *Service) Reload(lxd LXDParams, svc SvcParams) {
+	old, _ := s.params.get()
+	s.params.set(lxd, svc)
+	s.reg.SetDuration(svc.SessionDuration)
+	if current, _ := s.params.get(); s.pool != nil && poolChanged(old, current) {
+		s.pool.Reset(current.ImageName, current.Profiles, current.Limits)
+	}
+	log.Infow("parameters reloaded",
+		"image", lxd.ImageName,
+		"profiles", lxd.Profiles,
+		"image rules", lxd.ImageRules,
+		"flavours", lxd.Flavours,
+		"limits", lxd.Limits,
+		"user limits", lxd.UserLimits,
+		"allowed users", svc.AllowedUsers,
+		"lockout threshold", svc.LockoutThreshold,
+		"lockout duration", svc.LockoutDuration,
+		"login rate limit", svc.LoginRateLimit,
+		"max containers", svc.MaxContainers,
+		"max sessions per addr", svc.MaxSessionsPerAddr,
+		"max sessions per user", svc.MaxSessionsPerUser,
+		"session duration", svc.SessionDuration,
+		"start queue size", svc.StartQueueSize,
+	)
+}
+
+// Shutdown gracefully shuts down the API. New WebSocket connections are
+// refused, and a shutdown notice is sent to all live connections. Then the
+// function waits for live connections to be closed, until the given context
+// is done, in which case the remaining connections are forcibly closed.
+func (s *Service) Shutdown(ctx context.Context) error {
+	return s.t.shutdown(ctx)
+}
+
+// newParams returns a holder for the given parameters.
+func newParams(lxd LXDParams, svc SvcParams) *params {
+	return &params{
+		lxd: lxd,
+		svc: svc,
+	}
+}
+
+// params holds the LXD and service parameters, which can be reloaded while
+// the server is running.
+type params struct {
+	// mu protects the fields below.
+	mu  sync.Mutex
+	lxd LXDParams
+	svc SvcParams
+}
+
+// get returns the current parameters.
+func (p *params) get() (lxd LXDParams, svc SvcParams) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lxd, p.svc
+}
+
+// set applies the reloadable parameters from the given ones.
+func (p *params) set(lxd LXDParams, svc SvcParams) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lxd.Flavours = lxd.Flavours
+	p.lxd.ImageName = lxd.ImageName
+	p.lxd.ImageRules = lxd.ImageRules
+	p.lxd.Limits = lxd.Limits
+	p.lxd.Profiles = lxd.Profiles
+	p.lxd.UserLimits = lxd.UserLimits
+	p.svc.AllowedUsers = svc.AllowedUsers
+	p.svc.LockoutDuration = svc.LockoutDuration
+	p.svc.LockoutThreshold = svc.LockoutThreshold
+	p.svc.LoginRateLimit = svc.LoginRateLimit
+	p.svc.MaxContainers = svc.MaxContainers
+	p.svc.MaxSessionsPerAddr = svc.MaxSessionsPerAddr
+	p.svc.MaxSessionsPerUser = svc.MaxSessionsPerUser
+	p.svc.SessionDuration = svc.SessionDuration
+	p.svc.StartQueueSize = svc.StartQueueSize
+	p.svc.WelcomeMessage = svc.WelcomeMessage
+}
+
+// poolChanged reports whether pool containers created with the old
+// parameters no longer reflect the new ones.
+func poolChanged(old, current LXDParams) bool {
+	return old.ImageName != current.ImageName || !equalStrings(old.Profiles, current.Profiles) || old.Limits != current.Limits
+}
+
+// equalStrings reports whether the given slices hold the same strings in the
+// same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/juju/jujushell/internal/api"
+	"github.com/juju/jujushell/internal/logging"
+	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
+	"github.com/juju/jujushell/internal/pool"
+	"github.com/juju/jujushell/internal/registry"
+)
+
+func TestReload(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	mux, s := setupMux(c, defaultControllers, api.SvcParams{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	patchJujuAuthenticate(c, "who", "", defaultControllers)
+
+	// Initially all users are allowed.
+	conn := dialLogin(c, server.URL)
+	c.Assert(readMessage(c, conn), qt.Equals, `logged in as "who"`)
+	conn.Close()
+
+	// Restrict the allowed users.
+	s.Reload(api.LXDParams{
+		ImageName: "image",
+		Profiles:  []string{"default", "termserver"},
+	}, api.SvcParams{
+		AllowedUsers: []string{"rose"},
+	})
+
+	// The user can no longer log in.
+	conn = dialLogin(c, server.URL)
+	defer conn.Close()
+	c.Assert(readMessage(c, conn), qt.Equals, `user "who" is not allowed to access the service`)
+}
+
+func TestReloadResetsPool(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	cl := lxdtest.New()
+	cl.SetImage("image", "abc")
+	cl.SetImage("new-image", "def")
+	c.Patch(api.LXDUtilsConnect, func(socketPath string) (lxdclient.Client, error) {
+		return cl, nil
+	})
+	c.Patch(api.RegistryNew, func(d, rd, ed time.Duration, socketPath string) (*registry.Registry, error) {
+		return &registry.Registry{}, nil
+	})
+	s, err := api.Register(http.NewServeMux(), api.JujuParams{}, api.LXDParams{
+		ImageName: "image",
+		Profiles:  []string{"default", "termserver"},
+		PoolSize:  1,
+	}, api.SvcParams{})
+	c.Assert(err, qt.Equals, nil)
+	var name string
+	err = lxdtest.WaitFor(poolReady(cl, func(ct *lxdtest.Container) bool {
+		name = ct.Name()
+		return ct.Image() == "image"
+	}))
+	c.Assert(err, qt.Equals, nil)
+
+	// Reloading other parameters does not affect the pool.
+	cl.ResetCalls()
+	s.Reload(api.LXDParams{
+		ImageName: "image",
+		Profiles:  []string{"default", "termserver"},
+	}, api.SvcParams{
+		AllowedUsers: []string{"rose"},
+	})
+	c.Assert(cl.Calls(), qt.HasLen, 0)
+	c.Assert(cl.Container(name).Started(), qt.Equals, true)
+
+	// Changing the image rebuilds the pool.
+	s.Reload(api.LXDParams{
+		ImageName: "new-image",
+		Profiles:  []string{"default", "termserver"},
+	}, api.SvcParams{})
+	err = lxdtest.WaitFor(poolReady(cl, func(ct *lxdtest.Container) bool {
+		return ct.Image() == "new-image"
+	}))
+	c.Assert(err, qt.Equals, nil)
+
+	// Changing the resource limits also rebuilds the pool.
+	limits := lxdclient.Limits{Memory: "2GB"}
+	s.Reload(api.LXDParams{
+		ImageName: "new-image",
+		Profiles:  []string{"default", "termserver"},
+		Limits:    limits,
+	}, api.SvcParams{})
+	err = lxdtest.WaitFor(poolReady(cl, func(ct *lxdtest.Container) bool {
+		return ct.Limits() == limits
+	}))
+	c.Assert(err, qt.Equals, nil)
+}
+
+// poolReady returns a condition which is true when the given client only
+// holds a running pool container for which the given check succeeds.
+func poolReady(cl *lxdtest.Client, check func(ct *lxdtest.Container) bool) func() bool {
+	return func() bool {
+		cs, err := cl.All()
+		if err != nil {
+			return false
+		}
+		return len(cs) == 1 && strings.HasPrefix(cs[0].Name(), pool.Prefix) && cs[0].Started() && check(cs[0].(*lxdtest.Container))
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/wstransport"
+)
+
+// newTracker creates and returns a new tracker for WebSocket connections.
+func newTracker() *tracker {
+	return &tracker{
+		conns: make(map[*liveConn]bool),
+	}
+}
+
+// tracker keeps track of live WebSocket connections, so that they can be
+// drained when the server shuts down.
+type tracker struct {
+	wg sync.WaitGroup
+
+	// mu protects the fields below.
+	mu      sync.Mutex
+	closing bool
+	conns   map[*liveConn]bool
+}
+
+// add starts tracking the given connection, and returns a connection that
+// must be used in its place. The done function must be called when the
+// connection is closed. An error is returned if the server is shutting down.
+func (t *tracker) add(conn wstransport.Conn) (lc *liveConn, done func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return nil, nil, errShuttingDown
+	}
+	lc = &liveConn{
+		Conn: conn,
+	}
+	t.conns[lc] = true
+	t.wg.Add(1)
+	return lc, func() {
+		t.mu.Lock()
+		delete(t.conns, lc)
+		t.mu.Unlock()
+		t.wg.Done()
+	}, nil
+}
+
+// shuttingDown reports whether the server is shutting down.
+func (t *tracker) shuttingDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+// shutdown implements Service.Shutdown.
+func (t *tracker) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	conns := make([]*liveConn, 0, len(t.conns))
+	for lc := range t.conns {
+		conns = append(conns, lc)
+	}
+	t.mu.Unlock()
+
+	log.Infow("notifying live connections about the shutdown", "connections", len(conns))
+	for _, lc := range conns {
+		// Notices are sent concurrently, as writing to a connection can block
+		// until a message currently being written is completed.
+		go func(lc *liveConn) {
+			if err := lc.notify(); err != nil {
+				log.Debugw("cannot send shutdown notice", "err", err)
+			}
+		}(lc)
+	}
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	log.Infow("closing live connections", "connections", len(t.conns))
+	for lc := range t.conns {
+		lc.Close()
+	}
+	return errgo.Notef(ctx.Err(), "cannot drain %d connection(s)", len(t.conns))
+}
+
+// errShuttingDown is returned when connections are refused because the server
+// is shutting down.
+var errShuttingDown = errgo.New("server shutting down")
+
+// liveConn implements wstransport.Conn by serializing writes, so that the
+// shutdown notice can be safely sent at any time.
+type liveConn struct {
+	wstransport.Conn
+	mu sync.Mutex
+}
+
+// WriteJSON implements wstransport.Conn.WriteJSON.
+func (c *liveConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+// NextWriter implements wstransport.Conn.NextWriter. Other writes are blocked
+// until the returned writer is closed.
+func (c *liveConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	c.mu.Lock()
+	w, err := c.Conn.NextWriter(messageType)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	return &unlockWriter{
+		WriteCloser: w,
+		unlock:      c.mu.Unlock,
+	}, nil
+}
+
+// Error implements wstransport.Conn.Error.
+func (c *liveConn) Error(op apiparams.Operation, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Error(op, err)
+}
+
+// OK implements wstransport.Conn.OK.
+func (c *liveConn) OK(op apiparams.Operation, format string, a ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.OK(op, format, a...)
+}
+
+// notify sends the shutdown notice to the client.
+func (c *liveConn) notify() error {
+	return c.WriteJSON(apiparams.Response{
+		Operation: apiparams.OpShutdown,
+		Code:      apiparams.Error,
+		Message:   errShuttingDown.Error(),
+	})
+}
+
+// unlockWriter calls the unlock function when closed.
+type unlockWriter struct {
+	io.WriteCloser
+	unlock   func()
+	unlocked bool
+}
+
+// Close implements io.Closer.
+func (w *unlockWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if !w.unlocked {
+		w.unlocked = true
+		w.unlock()
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/api"
+	"github.com/juju/jujushell/internal/logging"
+)
+
+func TestShutdown(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	mux, s := setupMux(c, defaultControllers, api.SvcParams{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	patchJujuAuthenticate(c, "who", "", defaultControllers)
+
+	// Connect a WebSocket client to the server and log in.
+	conn := dialLogin(c, server.URL)
+	defer conn.Close()
+	c.Assert(readMessage(c, conn), qt.Equals, `logged in as "who"`)
+
+	// Shut down the server.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Shutdown(context.Background())
+	}()
+
+	// The client is notified.
+	var resp apiparams.Response
+	err := conn.ReadJSON(&resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp, qt.DeepEquals, apiparams.Response{
+		Operation: apiparams.OpShutdown,
+		Code:      apiparams.Error,
+		Message:   "server shutting down",
+	})
+
+	// The shutdown completes when the client disconnects.
+	select {
+	case err = <-errCh:
+		c.Fatalf("shutdown completed before the client disconnected: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case err = <-errCh:
+		c.Assert(err, qt.Equals, nil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("shutdown not completed")
+	}
+
+	// New connections are refused.
+	_, httpResp, err := websocket.DefaultDialer.Dial(wsURL(server.URL), nil)
+	c.Assert(err, qt.Equals, websocket.ErrBadHandshake)
+	c.Assert(httpResp.StatusCode, qt.Equals, http.StatusServiceUnavailable)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	c := qt.New(t)
+	logging.Log().SetLevel(zapcore.ErrorLevel)
+	mux, s := setupMux(c, defaultControllers, api.SvcParams{})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	patchJujuAuthenticate(c, "who", "", defaultControllers)
+
+	// Connect a WebSocket client to the server and log in.
+	conn := dialLogin(c, server.URL)
+	defer conn.Close()
+	c.Assert(readMessage(c, conn), qt.Equals, `logged in as "who"`)
+
+	// Shut down the server without waiting for the client.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	c.Assert(err, qt.ErrorMatches, "cannot drain 1 connection\\(s\\): context deadline exceeded")
+
+	// The connection has been closed by the server, possibly after sending
+	// the shutdown notice.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for err == nil {
+		_, _, err = conn.NextReader()
+	}
+	c.Assert(websocket.IsUnexpectedCloseError(err), qt.Equals, true, qt.Commentf("%v", err))
+}
@@ -12,13 +12,15 @@ import (
 	qt "github.com/frankban/quicktest"
 
 	"github.com/juju/jujushell/apiparams"
+	"github.com/juju/jujushell/internal/api"
 )
 
 func TestStatusHandler(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
 	// Set up the WebSocket server.
-	server := httptest.NewServer(setupMux(c, []string{"1.2.3.4"}, nil))
+	mux, _ := setupMux(c, defaultControllers, api.SvcParams{})
+	server := httptest.NewServer(mux)
 	defer server.Close()
 
 	// Exercise the status handler.
@@ -0,0 +1,147 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package audit implements an append-only audit log of security relevant
+// events, like user logins and the lifecycle of containers and sessions.
+// Events are written as JSON objects, one per line, with stable field names,
+// so that they can be easily consumed by external tools. The audit log is
+// separate from the debug logger, and is disabled unless opened.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/internal/logging"
+)
+
+var log = logging.Log()
+
+// Event types.
+const (
+	// LoginSuccess is emitted when a user successfully logs in.
+	LoginSuccess = "login-success"
+	// LoginFailure is emitted when a user cannot authenticate.
+	LoginFailure = "login-failure"
+	// LoginDenied is emitted when a user is not allowed to access the
+	// service, or when a connection is refused because limits are exceeded
+	// or because of a lockout after too many failed login attempts.
+	LoginDenied = "login-denied"
+	// ContainerCreate is emitted when a container is assigned to a user,
+	// either by creating it or by claiming it from the pool.
+	ContainerCreate = "container-create"
+	// ContainerStart is emitted when a container is started.
+	ContainerStart = "container-start"
+	// ContainerStop is emitted when a container is stopped.
+	ContainerStop = "container-stop"
+	// ContainerDelete is emitted when a container is deleted.
+	ContainerDelete = "container-delete"
+	// SessionStart is emitted when a shell session starts or is resumed.
+	SessionStart = "session-start"
+	// SessionEnd is emitted when the client disconnects from the session.
+	SessionEnd = "session-end"
+)
+
+// Event holds an audit event. Empty fields are omitted.
+type Event struct {
+	// Time holds when the event occurred. It is set automatically when the
+	// event is logged, if not already specified.
+	Time time.Time `json:"time"`
+	// Type holds the event type, for instance LoginSuccess.
+	Type string `json:"type"`
+	// User holds the name of the user the event refers to.
+	User string `json:"user,omitempty"`
+	// Admin holds the name of the admin user who requested the action.
+	Admin string `json:"admin,omitempty"`
+	// Controller holds the name of the Juju controller.
+	Controller string `json:"controller,omitempty"`
+	// RemoteAddr holds the address of the client.
+	RemoteAddr string `json:"remote-addr,omitempty"`
+	// Container holds the name of the LXD container.
+	Container string `json:"container,omitempty"`
+	// Address holds the address of the LXD container.
+	Address string `json:"address,omitempty"`
+	// Reason holds why the event occurred, for instance "inactivity".
+	Reason string `json:"reason,omitempty"`
+	// Resumed holds whether a session has been resumed.
+	Resumed bool `json:"resumed,omitempty"`
+	// BytesIn and BytesOut hold the number of bytes respectively received
+	// from and sent to the client during a session.
+	BytesIn  int64 `json:"bytes-in,omitempty"`
+	BytesOut int64 `json:"bytes-out,omitempty"`
+	// Error holds an error message.
+	Error string `json:"error,omitempty"`
+}
+
+// Open opens the audit log file at the given path, creating it if it does not
+// exist. Events are appended to the file.
+func Open(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errgo.Notef(err, "cannot open audit log")
+	}
+	setOutput(f)
+	return nil
+}
+
+// Close closes the audit log. Events logged after closing are discarded.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return nil
+	}
+	err := out.Close()
+	out = nil
+	if err != nil {
+		return errgo.Notef(err, "cannot close audit log")
+	}
+	return nil
+}
+
+// Log logs the given event. It does nothing if the audit log is not open.
+// Events that cannot be encoded, for instance because of an invalid time, are
+// dropped and the error is logged.
+func Log(e Event) {
+	if e.Time.IsZero() {
+		e.Time = timeNow()
+	}
+	e.Time = e.Time.UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorw("cannot encode audit event", "type", e.Type, "err", err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return
+	}
+	if _, err = out.Write(append(data, '\n')); err != nil {
+		log.Errorw("cannot write audit event", "type", e.Type, "err", err)
+	}
+}
+
+var (
+	// mu protects out.
+	mu  sync.Mutex
+	out io.WriteCloser
+)
+
+// setOutput sets the audit log output, closing the previous one if present.
+func setOutput(w io.WriteCloser) {
+	mu.Lock()
+	defer mu.Unlock()
+	if out != nil {
+		out.Close()
+	}
+	out = w
+}
+
+// timeNow is defined as a variable for testing.
+var timeNow = time.Now
@@ -0,0 +1,70 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package audit_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/internal/audit"
+)
+
+func TestLog(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(audit.TimeNow, func() time.Time {
+		return time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	})
+	path := filepath.Join(c.Mkdir(), "audit.log")
+	err := ioutil.WriteFile(path, []byte("existing\n"), 0600)
+	c.Assert(err, qt.Equals, nil)
+
+	// Events logged before opening the audit log are discarded.
+	audit.Log(audit.Event{Type: audit.LoginFailure})
+
+	err = audit.Open(path)
+	c.Assert(err, qt.Equals, nil)
+	audit.Log(audit.Event{
+		Type:       audit.LoginSuccess,
+		User:       "who@external",
+		Controller: "ctrl",
+		RemoteAddr: "1.2.3.4:4242",
+	})
+	audit.Log(audit.Event{
+		Time:      time.Date(2018, 1, 2, 4, 0, 0, 0, time.FixedZone("X", 3600)),
+		Type:      audit.SessionEnd,
+		User:      "who@external",
+		Container: "termserver-who-at-external-1a2b3c",
+		BytesIn:   42,
+		BytesOut:  47,
+	})
+	// Events that cannot be encoded are dropped.
+	audit.Log(audit.Event{
+		Time: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Type: audit.ContainerStop,
+	})
+	err = audit.Close()
+	c.Assert(err, qt.Equals, nil)
+
+	// Events logged after closing the audit log are discarded.
+	audit.Log(audit.Event{Type: audit.LoginDenied})
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(strings.Split(strings.TrimSpace(string(data)), "\n"), qt.DeepEquals, []string{
+		"existing",
+		`{"time":"2018-01-02T03:04:05Z","type":"login-success","user":"who@external","controller":"ctrl","remote-addr":"1.2.3.4:4242"}`,
+		`{"time":"2018-01-02T03:00:00Z","type":"session-end","user":"who@external","container":"termserver-who-at-external-1a2b3c","bytes-in":42,"bytes-out":47}`,
+	})
+}
+
+func TestOpenError(t *testing.T) {
+	c := qt.New(t)
+	err := audit.Open(filepath.Join(c.Mkdir(), "no-such-dir", "audit.log"))
+	c.Assert(err, qt.ErrorMatches, "cannot open audit log: .*")
+}
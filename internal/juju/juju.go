@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/juju/juju/api"
+	"github.com/juju/juju/apiserver/params"
 	"github.com/juju/juju/jujuclient"
 	"github.com/juju/juju/network"
 	"github.com/juju/names"
@@ -20,10 +21,11 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-// Authenticate logs the current user into the Juju controller at the given
-// addresses with the given credentials. It returns information about the Juju
-// controller or an error.
-func Authenticate(addrs []string, creds *Credentials, cert string) (*Info, error) {
+// Authenticate logs the current user into the Juju controller with the given
+// name and addresses, using the given credentials. It returns information
+// about the Juju controller or an error. When the controller rejects the
+// credentials, the error has an ErrUnauthorized cause.
+func Authenticate(controller string, addrs []string, creds *Credentials, cert string) (*Info, error) {
 	info := &api.Info{
 		Addrs:  addrs,
 		CACert: cert,
@@ -47,18 +49,26 @@ func Authenticate(addrs []string, creds *Credentials, cert string) (*Info, error
 	}
 	conn, err := apiOpen(info, opts)
 	if err != nil {
+		if params.IsCodeUnauthorized(err) {
+			return nil, errgo.WithCausef(err, ErrUnauthorized, "cannot authenticate user")
+		}
 		return nil, errgo.Notef(err, "cannot authenticate user")
 	}
 	defer conn.Close()
 	return &Info{
 		User:           conn.AuthTag().Id(),
-		ControllerName: controllerName,
+		ControllerName: controller,
 		ControllerUUID: conn.ControllerTag().Id(),
 		CACert:         cert,
 		Endpoints:      getEndpoints(conn.APIHostPorts()),
 	}, nil
 }
 
+// ErrUnauthorized is the cause of errors returned by Authenticate when the
+// controller rejects the provided credentials, as opposed to other failures,
+// for instance when the controller cannot be reached.
+var ErrUnauthorized = errgo.New("unauthorized")
+
 // Credentials holds credentials for logging into a Juju controller.
 type Credentials struct {
 	// Username and Password hold traditional Juju credentials for local users.
@@ -103,18 +113,20 @@ func SetMacaroons(jar http.CookieJar, macaroons map[string]macaroon.Slice) error
 // TODO(frankban): this should really be provided by candid itself.
 var candidNamespace = checkers.NewNamespace(map[string]string{"std": ""})
 
-// MarshalAccounts encodes the given credentials information so that they are
-// suitable for being used as the content of the Juju accounts.yaml file.
-func MarshalAccounts(controller, user, password string) ([]byte, error) {
+// MarshalAccounts encodes the given credentials information for all the
+// given controllers so that they are suitable for being used as the content of
+// the Juju accounts.yaml file.
+func MarshalAccounts(controllers []string, user, password string) ([]byte, error) {
 	accounts := struct {
 		Controllers map[string]jujuclient.AccountDetails `yaml:"controllers"`
 	}{
-		Controllers: map[string]jujuclient.AccountDetails{
-			controller: {
-				User:     user,
-				Password: password,
-			},
-		},
+		Controllers: make(map[string]jujuclient.AccountDetails, len(controllers)),
+	}
+	for _, controller := range controllers {
+		accounts.Controllers[controller] = jujuclient.AccountDetails{
+			User:     user,
+			Password: password,
+		}
 	}
 	data, err := yaml.Marshal(accounts)
 	if err != nil {
@@ -123,18 +135,23 @@ func MarshalAccounts(controller, user, password string) ([]byte, error) {
 	return data, nil
 }
 
-// MarshalControllers encodes the given controller information so that it is
+// MarshalControllers encodes the given controllers information so that it is
 // suitable for being used as the content of the Juju controllers.yaml file.
-func MarshalControllers(info *Info) ([]byte, error) {
+// The first controller is set as the current one.
+func MarshalControllers(infos []*Info) ([]byte, error) {
+	if len(infos) == 0 {
+		return nil, errgo.New("cannot marshal controllers: no controllers provided")
+	}
 	cs := jujuclient.Controllers{
-		Controllers: map[string]jujuclient.ControllerDetails{
-			info.ControllerName: {
-				ControllerUUID: info.ControllerUUID,
-				APIEndpoints:   info.Endpoints,
-				CACert:         info.CACert,
-			},
-		},
-		CurrentController: info.ControllerName,
+		Controllers:       make(map[string]jujuclient.ControllerDetails, len(infos)),
+		CurrentController: infos[0].ControllerName,
+	}
+	for _, info := range infos {
+		cs.Controllers[info.ControllerName] = jujuclient.ControllerDetails{
+			ControllerUUID: info.ControllerUUID,
+			APIEndpoints:   info.Endpoints,
+			CACert:         info.CACert,
+		}
 	}
 	data, err := yaml.Marshal(cs)
 	if err != nil {
@@ -153,9 +170,6 @@ func getEndpoints(hostports [][]network.HostPort) (endpoints []string) {
 	return endpoints
 }
 
-// controllerName holds the name assigned locally to the Juju controller.
-const controllerName = "ctrl"
-
 // apiOpen is defined as a variable for testing.
 var apiOpen = func(info *api.Info, opts api.DialOpts) (api.Connection, error) {
 	return api.Open(info, opts)
@@ -15,17 +15,20 @@ import (
 	"github.com/juju/juju/api"
 	"github.com/juju/juju/jujuclient"
 	"github.com/juju/juju/network"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/names.v2"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	macaroon "gopkg.in/macaroon.v2"
 	"gopkg.in/yaml.v2"
 
 	"github.com/juju/jujushell/internal/juju"
+	"github.com/juju/jujushell/internal/juju/jujutest"
 )
 
 var (
-	addrs = []string{"1.2.3.4"}
-	cert  = "juju-cert"
+	addrs      = []string{"1.2.3.4"}
+	cert       = "juju-cert"
+	controller = "my-controller"
 )
 
 var authenticateTests = []struct {
@@ -49,7 +52,7 @@ var authenticateTests = []struct {
 	apiOpenEndpoints:      []string{"1.2.3.4:42", "1.2.3.4:47"},
 	expectedInfo: &juju.Info{
 		User:           "rose",
-		ControllerName: "ctrl",
+		ControllerName: "my-controller",
 		ControllerUUID: "c1-uuid",
 		CACert:         cert,
 		Endpoints:      []string{"1.2.3.4:42", "1.2.3.4:47"},
@@ -65,7 +68,7 @@ var authenticateTests = []struct {
 	apiOpenEndpoints:      []string{"1.2.3.4:42"},
 	expectedInfo: &juju.Info{
 		User:           "rose",
-		ControllerName: "ctrl",
+		ControllerName: "my-controller",
 		ControllerUUID: "c2-uuid",
 		CACert:         cert,
 		Endpoints:      []string{"1.2.3.4:42"},
@@ -110,7 +113,7 @@ func TestAuthenticate(t *testing.T) {
 				expectedInfo.Tag = names.NewUserTag(test.username)
 			}
 			patchAPIOpen(c, conn, apiOpenError, expectedInfo, test.macaroons)
-			info, err := juju.Authenticate(addrs, &juju.Credentials{
+			info, err := juju.Authenticate(controller, addrs, &juju.Credentials{
 				Username:  test.username,
 				Password:  test.password,
 				Macaroons: test.macaroons,
@@ -127,6 +130,135 @@ func TestAuthenticate(t *testing.T) {
 	}
 }
 
+var authenticateControllerTests = []struct {
+	about string
+	// creds returns the credentials used to log into the given controller.
+	creds func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials
+	// cert returns the certificate used to connect to the given controller.
+	cert              func(ctrl, other *jujutest.Controller) string
+	endpoints         []string
+	loginErr          error
+	expectedUser      string
+	expectedEndpoints []string
+	expectedError     string
+	// expectedUnauthorized reports whether the error is expected to have an
+	// ErrUnauthorized cause.
+	expectedUnauthorized bool
+}{{
+	about: "userpass authentication",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		ctrl.AddUser("who", "tardis")
+		return &juju.Credentials{Username: "who", Password: "tardis"}
+	},
+	expectedUser: "who",
+}, {
+	about: "macaroon authentication",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		ms, err := ctrl.Macaroons("rose@external")
+		c.Assert(err, qt.Equals, nil)
+		return &juju.Credentials{Macaroons: ms}
+	},
+	expectedUser: "rose@external",
+}, {
+	about: "controller addresses discovery",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		ctrl.AddUser("who", "tardis")
+		ctrl.SetEndpoints(ctrl.Addr(), "1.2.3.4:17070", "juju.example.com:443")
+		return &juju.Credentials{Username: "who", Password: "tardis"}
+	},
+	expectedUser:      "who",
+	expectedEndpoints: []string{"1.2.3.4:17070", "juju.example.com:443"},
+}, {
+	about: "invalid password",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		ctrl.AddUser("who", "tardis")
+		return &juju.Credentials{Username: "who", Password: "bad-wolf"}
+	},
+	expectedError:        "cannot authenticate user: invalid entity name or password.*",
+	expectedUnauthorized: true,
+}, {
+	about: "unknown user",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		return &juju.Credentials{Username: "dalek", Password: "exterminate"}
+	},
+	expectedError:        "cannot authenticate user: invalid entity name or password.*",
+	expectedUnauthorized: true,
+}, {
+	about: "macaroons from another controller",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		ms, err := other.Macaroons("rose@external")
+		c.Assert(err, qt.Equals, nil)
+		m, err := ctrl.Macaroons("rose@external")
+		c.Assert(err, qt.Equals, nil)
+		// Store the macaroons for the URL of the target controller.
+		return &juju.Credentials{Macaroons: map[string]macaroon.Slice{
+			ctrl.CookieURL(): ms[other.CookieURL()],
+			// This URL is never used by the controller.
+			"https://1.2.3.4/identity": m[ctrl.CookieURL()],
+		}}
+	},
+	// The controller requires a discharge, which the identity manager refuses.
+	expectedError: "cannot authenticate user: .*discharge.*",
+}, {
+	about: "invalid certificate",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		ctrl.AddUser("who", "tardis")
+		return &juju.Credentials{Username: "who", Password: "tardis"}
+	},
+	cert: func(ctrl, other *jujutest.Controller) string {
+		return other.CACert()
+	},
+	expectedError: "cannot authenticate user: .*certificate.*",
+}, {
+	about: "login failure",
+	creds: func(c *qt.C, ctrl, other *jujutest.Controller) *juju.Credentials {
+		ctrl.AddUser("who", "tardis")
+		return &juju.Credentials{Username: "who", Password: "tardis"}
+	},
+	loginErr:      errors.New("bad wolf"),
+	expectedError: "cannot authenticate user: bad wolf",
+}}
+
+func TestAuthenticateController(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range authenticateControllerTests {
+		c.Run(test.about, func(c *qt.C) {
+			// Set up the controllers.
+			ctrl, err := jujutest.NewController()
+			c.Assert(err, qt.Equals, nil)
+			defer ctrl.Close()
+			other, err := jujutest.NewController()
+			c.Assert(err, qt.Equals, nil)
+			defer other.Close()
+			ctrl.SetLoginError(test.loginErr)
+			creds := test.creds(c, ctrl, other)
+			cert := ctrl.CACert()
+			if test.cert != nil {
+				cert = test.cert(ctrl, other)
+			}
+
+			// Log into the controller.
+			info, err := juju.Authenticate(controller, []string{ctrl.Addr()}, creds, cert)
+			if test.expectedError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectedError)
+				c.Assert(errgo.Cause(err) == juju.ErrUnauthorized, qt.Equals, test.expectedUnauthorized)
+				c.Assert(info, qt.IsNil)
+				c.Assert(ctrl.Logins(), qt.HasLen, 0)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(info, qt.DeepEquals, &juju.Info{
+				User:           test.expectedUser,
+				ControllerName: controller,
+				ControllerUUID: ctrl.UUID(),
+				CACert:         cert,
+				Endpoints:      append([]string{ctrl.Addr()}, test.expectedEndpoints...),
+			})
+			c.Assert(ctrl.Logins(), qt.DeepEquals, []string{test.expectedUser})
+		})
+	}
+}
+
 var setMacaroonsTests = []struct {
 	about         string
 	macaroons     map[string]macaroon.Slice
@@ -209,9 +341,13 @@ func TestMarshalAccounts(t *testing.T) {
 				User:     "who",
 				Password: "secret!",
 			},
+			"staging": jujuclient.AccountDetails{
+				User:     "who",
+				Password: "secret!",
+			},
 		},
 	}
-	data, err := juju.MarshalAccounts("my-controller", "who", "secret!")
+	data, err := juju.MarshalAccounts([]string{"my-controller", "staging"}, "who", "secret!")
 	c.Assert(err, qt.Equals, nil)
 	var accounts map[string]map[string]jujuclient.AccountDetails
 	err = yaml.Unmarshal(data, &accounts)
@@ -221,13 +357,19 @@ func TestMarshalAccounts(t *testing.T) {
 
 func TestMarshalControllers(t *testing.T) {
 	c := qt.New(t)
-	info := &juju.Info{
+	infos := []*juju.Info{{
 		User:           "rose",
 		ControllerName: "ctrl",
 		ControllerUUID: "c1-uuid",
 		CACert:         cert,
 		Endpoints:      []string{"1.2.3.4:42", "1.2.3.4:47"},
-	}
+	}, {
+		User:           "rose",
+		ControllerName: "staging",
+		ControllerUUID: "c2-uuid",
+		CACert:         "staging-cert",
+		Endpoints:      []string{"1.2.3.5:17070"},
+	}}
 	expectedControllers := jujuclient.Controllers{
 		Controllers: map[string]jujuclient.ControllerDetails{
 			"ctrl": {
@@ -235,10 +377,15 @@ func TestMarshalControllers(t *testing.T) {
 				APIEndpoints:   []string{"1.2.3.4:42", "1.2.3.4:47"},
 				CACert:         "juju-cert",
 			},
+			"staging": {
+				ControllerUUID: "c2-uuid",
+				APIEndpoints:   []string{"1.2.3.5:17070"},
+				CACert:         "staging-cert",
+			},
 		},
 		CurrentController: "ctrl",
 	}
-	data, err := juju.MarshalControllers(info)
+	data, err := juju.MarshalControllers(infos)
 	c.Assert(err, qt.Equals, nil)
 	var controllers jujuclient.Controllers
 	err = yaml.Unmarshal(data, &controllers)
@@ -246,6 +393,13 @@ func TestMarshalControllers(t *testing.T) {
 	c.Assert(controllers, qt.DeepEquals, expectedControllers)
 }
 
+func TestMarshalControllersEmpty(t *testing.T) {
+	c := qt.New(t)
+	data, err := juju.MarshalControllers(nil)
+	c.Assert(err, qt.ErrorMatches, "cannot marshal controllers: no controllers provided")
+	c.Assert(data, qt.IsNil)
+}
+
 // patchAPIOpen patches the juju.apiOpen variable so that it is possible
 // to simulate different API connection scenarios.
 func patchAPIOpen(c *qt.C, conn api.Connection, err error, expectedInfo *api.Info, expectedMacaroons map[string]macaroon.Slice) {
@@ -0,0 +1,504 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package jujutest provides a fake Juju controller, suitable for testing code
+// logging into Juju without a real controller. The fake controller serves the
+// Juju API login endpoint over a TLS WebSocket connection, speaking the Juju
+// RPC protocol, so that clients connect and authenticate as they do in
+// production. Both userpass and macaroon based logins are supported. As with
+// real controllers, macaroon based logins without valid macaroons are asked to
+// discharge a macaroon with a third party caveat addressed to an identity
+// manager: the fake identity manager always refuses to discharge.
+package jujutest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/errgo.v1"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// NewController starts and returns a new fake Juju controller. The controller
+// must be closed after use.
+func NewController() (*Controller, error) {
+	cert, caCert, err := newCert()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	rootKey := make([]byte, 24)
+	if _, err = rand.Read(rootKey); err != nil {
+		return nil, errgo.Notef(err, "cannot generate macaroon root key")
+	}
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	c := &Controller{
+		caCert:  caCert,
+		rootKey: rootKey,
+		uuid:    uuid,
+		users:   make(map[string]string),
+	}
+	c.server = httptest.NewUnstartedServer(http.HandlerFunc(c.serveAPI))
+	c.server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	c.server.StartTLS()
+	c.identity = httptest.NewServer(http.HandlerFunc(serveDischarge))
+	return c, nil
+}
+
+// Controller is a fake Juju controller.
+type Controller struct {
+	server   *httptest.Server
+	identity *httptest.Server
+	caCert   string
+	rootKey  []byte
+	uuid     string
+
+	mu        sync.Mutex
+	users     map[string]string
+	endpoints []string
+	loginErr  error
+	logins    []string
+	numIDs    int
+}
+
+// Addr returns the address of the controller, as a "host:port" string.
+func (c *Controller) Addr() string {
+	return c.server.Listener.Addr().String()
+}
+
+// CACert returns the PEM encoded CA certificate of the controller.
+func (c *Controller) CACert() string {
+	return c.caCert
+}
+
+// UUID returns the unique identifier of the controller.
+func (c *Controller) UUID() string {
+	return c.uuid
+}
+
+// CookieURL returns the URL for which macaroons used to log into the
+// controller must be stored by clients.
+func (c *Controller) CookieURL() string {
+	return "https://" + c.Addr() + "/"
+}
+
+// IdentityURL returns the URL of the identity manager from which clients
+// without valid macaroons are asked to get a discharge.
+func (c *Controller) IdentityURL() string {
+	return c.identity.URL
+}
+
+// AddUser adds a local user with the given name and password. The user can
+// then log in using userpass credentials.
+func (c *Controller) AddUser(name, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[name] = password
+}
+
+// Macaroons returns macaroons authenticating the given user, keyed by the
+// cookie URL of the controller, as required for logging in. The user can be
+// external, for instance "who@external", and does not need to be added.
+// Macaroons from one controller are not valid for logging into another one.
+func (c *Controller) Macaroons(user string) (map[string]macaroon.Slice, error) {
+	c.mu.Lock()
+	m, err := c.newMacaroon()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err = m.AddFirstPartyCaveat([]byte(declaredUsername + user)); err != nil {
+		return nil, errgo.Notef(err, "cannot add caveat to macaroon")
+	}
+	return map[string]macaroon.Slice{
+		c.CookieURL(): {m},
+	}, nil
+}
+
+// SetEndpoints sets the controller API addresses, as "host:port" strings,
+// returned to clients after logging in. By default only the address of the
+// fake controller itself is returned.
+func (c *Controller) SetEndpoints(endpoints ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.endpoints = endpoints
+}
+
+// SetLoginError makes all subsequent logins fail with the given error. A nil
+// error removes a previously set failure.
+func (c *Controller) SetLoginError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loginErr = err
+}
+
+// Logins returns the names of the users successfully logged in so far, in
+// order.
+func (c *Controller) Logins() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.logins...)
+}
+
+// Close shuts down the controller.
+func (c *Controller) Close() {
+	c.server.CloseClientConnections()
+	c.server.Close()
+	c.identity.Close()
+}
+
+// serveAPI serves the Juju API over WebSocket connections. Only logins and
+// pings are supported.
+func (c *Controller) serveAPI(w http.ResponseWriter, req *http.Request) {
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		var r request
+		if err := conn.ReadJSON(&r); err != nil {
+			return
+		}
+		resp := response{
+			RequestID: r.RequestID,
+		}
+		switch {
+		case r.Type == "Admin" && r.Request == "Login":
+			result, err := c.login(r.Params)
+			if err != nil {
+				resp.Error = err.Error()
+				if err == errBadCreds {
+					resp.ErrorCode = codeUnauthorized
+				}
+				break
+			}
+			resp.Response = result
+		case r.Type == "Pinger" && r.Request == "Ping":
+			resp.Response = struct{}{}
+		default:
+			resp.Error = fmt.Sprintf("unknown object type %q", r.Type)
+			resp.ErrorCode = codeNotImplemented
+		}
+		if err := conn.WriteJSON(resp); err != nil {
+			return
+		}
+	}
+}
+
+// login handles login requests with the given JSON encoded parameters.
+func (c *Controller) login(data json.RawMessage) (*loginResult, error) {
+	var params loginRequest
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal login parameters")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loginErr != nil {
+		return nil, c.loginErr
+	}
+	var user string
+	if params.AuthTag != "" {
+		name := strings.TrimPrefix(params.AuthTag, "user-")
+		password, ok := c.users[name]
+		if !ok || name == params.AuthTag || password != params.Credentials {
+			return nil, errBadCreds
+		}
+		user = name
+	} else {
+		for _, ms := range params.Macaroons {
+			if user = c.checkMacaroons(ms); user != "" {
+				break
+			}
+		}
+		if user == "" {
+			return c.dischargeRequired()
+		}
+	}
+	c.logins = append(c.logins, user)
+	endpoints := c.endpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{c.Addr()}
+	}
+	servers := make([][]hostPort, len(endpoints))
+	for i, endpoint := range endpoints {
+		hp, err := newHostPort(endpoint)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		servers[i] = []hostPort{hp}
+	}
+	return &loginResult{
+		Servers:       servers,
+		ControllerTag: "controller-" + c.uuid,
+		UserInfo: &userInfo{
+			DisplayName:      user,
+			Identity:         "user-" + user,
+			ControllerAccess: "login",
+		},
+		Facades: []facadeVersions{{
+			Name:     "Admin",
+			Versions: []int{3},
+		}, {
+			Name:     "Pinger",
+			Versions: []int{1},
+		}},
+		ServerVersion: serverVersion,
+	}, nil
+}
+
+// checkMacaroons checks the given macaroons, the first one being the primary
+// macaroon and the others its discharges, and returns the user they declare,
+// or an empty string if the macaroons are not valid. It must be called with
+// c.mu held.
+func (c *Controller) checkMacaroons(ms macaroon.Slice) string {
+	if len(ms) == 0 {
+		return ""
+	}
+	var user string
+	err := ms[0].Verify(c.rootKey, func(caveat string) error {
+		if !strings.HasPrefix(caveat, declaredUsername) {
+			return errgo.Newf("caveat %q not satisfied", caveat)
+		}
+		user = strings.TrimPrefix(caveat, declaredUsername)
+		return nil
+	}, ms[1:])
+	if err != nil {
+		return ""
+	}
+	return user
+}
+
+// dischargeRequired returns a login result requiring the client to discharge
+// a macaroon with a third party caveat addressed to the identity manager, as
+// real controllers do when no valid macaroons are provided. It must be called
+// with c.mu held.
+func (c *Controller) dischargeRequired() (*loginResult, error) {
+	m, err := c.newMacaroon()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	caveatKey := make([]byte, 24)
+	if _, err = rand.Read(caveatKey); err != nil {
+		return nil, errgo.Notef(err, "cannot generate caveat key")
+	}
+	if err = m.AddThirdPartyCaveat(caveatKey, []byte("is-authenticated-user"), c.identity.URL); err != nil {
+		return nil, errgo.Notef(err, "cannot add third party caveat to macaroon")
+	}
+	return &loginResult{
+		DischargeRequired:       m,
+		DischargeRequiredReason: dischargeRequiredReason,
+	}, nil
+}
+
+// newMacaroon returns a new macaroon for the controller, with no caveats. It
+// must be called with c.mu held.
+func (c *Controller) newMacaroon() (*macaroon.Macaroon, error) {
+	c.numIDs++
+	id := fmt.Sprintf("jujutest-%d", c.numIDs)
+	m, err := macaroon.New(c.rootKey, []byte(id), "jujutest", macaroon.V1)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create macaroon")
+	}
+	return m, nil
+}
+
+// serveDischarge serves the discharge endpoint of the fake identity manager,
+// which refuses all discharge requests with a macaroon bakery error.
+func serveDischarge(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(bakeryError{
+		Code:    codeForbidden,
+		Message: dischargeRefusedMessage,
+	})
+}
+
+// upgrader is used to upgrade HTTP connections to the WebSocket protocol.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+const (
+	// codeNotImplemented and codeUnauthorized are Juju API error codes.
+	codeNotImplemented = "not implemented"
+	codeUnauthorized   = "unauthorized access"
+
+	// codeForbidden is the macaroon bakery error code returned when a
+	// discharge is refused.
+	codeForbidden = "forbidden"
+
+	// dischargeRequiredReason is the reason provided to clients when a
+	// discharge is required to log in.
+	dischargeRequiredReason = "authentication required"
+
+	// dischargeRefusedMessage is the message of the error returned by the
+	// fake identity manager when a discharge is requested.
+	dischargeRefusedMessage = "user not authenticated"
+
+	// declaredUsername is the prefix of the macaroon caveat declaring the
+	// authenticated user.
+	declaredUsername = "declared username "
+
+	// serverVersion holds the Juju version reported by the fake controller.
+	serverVersion = "2.4.0"
+)
+
+// errBadCreds is returned when invalid credentials are provided. The error
+// message is the one returned by real Juju controllers.
+var errBadCreds = errgo.New("invalid entity name or password")
+
+// request holds a Juju RPC request.
+type request struct {
+	RequestID uint64          `json:"request-id"`
+	Type      string          `json:"type"`
+	Version   int             `json:"version"`
+	ID        string          `json:"id"`
+	Request   string          `json:"request"`
+	Params    json.RawMessage `json:"params"`
+}
+
+// response holds a Juju RPC response.
+type response struct {
+	RequestID uint64      `json:"request-id"`
+	Error     string      `json:"error,omitempty"`
+	ErrorCode string      `json:"error-code,omitempty"`
+	Response  interface{} `json:"response,omitempty"`
+}
+
+// loginRequest holds the parameters of Admin.Login requests.
+type loginRequest struct {
+	AuthTag     string           `json:"auth-tag"`
+	Credentials string           `json:"credentials"`
+	Nonce       string           `json:"nonce"`
+	Macaroons   []macaroon.Slice `json:"macaroons"`
+}
+
+// loginResult holds the result of Admin.Login requests. When a discharge is
+// required, only the discharge fields are set.
+type loginResult struct {
+	Servers                 [][]hostPort       `json:"servers"`
+	ControllerTag           string             `json:"controller-tag,omitempty"`
+	UserInfo                *userInfo          `json:"user-info,omitempty"`
+	Facades                 []facadeVersions   `json:"facades"`
+	ServerVersion           string             `json:"server-version,omitempty"`
+	DischargeRequired       *macaroon.Macaroon `json:"discharge-required,omitempty"`
+	DischargeRequiredReason string             `json:"discharge-required-error,omitempty"`
+}
+
+// bakeryError holds an error returned by the macaroon bakery HTTP protocol.
+type bakeryError struct {
+	Code    string `json:",omitempty"`
+	Message string `json:",omitempty"`
+}
+
+// userInfo holds information about the user logged in.
+type userInfo struct {
+	DisplayName      string `json:"display-name"`
+	Identity         string `json:"identity"`
+	ControllerAccess string `json:"controller-access"`
+	ModelAccess      string `json:"model-access"`
+}
+
+// facadeVersions holds the versions supported for an API facade.
+type facadeVersions struct {
+	Name     string `json:"name"`
+	Versions []int  `json:"versions"`
+}
+
+// hostPort holds a controller API address.
+type hostPort struct {
+	Value string `json:"value"`
+	Type  string `json:"type"`
+	Scope string `json:"scope"`
+	Port  int    `json:"port"`
+}
+
+// newHostPort returns the API address corresponding to the given "host:port"
+// endpoint.
+func newHostPort(endpoint string) (hostPort, error) {
+	host, p, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return hostPort{}, errgo.Notef(err, "invalid endpoint %q", endpoint)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return hostPort{}, errgo.Newf("invalid port in endpoint %q", endpoint)
+	}
+	hp := hostPort{
+		Value: host,
+		Type:  "hostname",
+		Scope: "public",
+		Port:  port,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		hp.Type = "ipv4"
+		if ip.To4() == nil {
+			hp.Type = "ipv6"
+		}
+	}
+	return hp, nil
+}
+
+// newCert generates a self-signed certificate valid for the local host and
+// for the "juju-apiserver" name used by Juju clients. It returns the
+// certificate and its PEM encoding.
+func newCert() (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", errgo.Notef(err, "cannot generate key")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: "juju-apiserver"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"juju-apiserver", "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", errgo.Notef(err, "cannot create certificate")
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return cert, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", errgo.Notef(err, "cannot generate UUID")
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
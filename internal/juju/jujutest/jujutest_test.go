@@ -0,0 +1,298 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package jujutest_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/juju/jujushell/internal/juju/jujutest"
+)
+
+func TestLoginUserpass(t *testing.T) {
+	c := qt.New(t)
+	ctrl := newController(c)
+	ctrl.AddUser("who", "tardis")
+
+	resp := call(c, ctrl, "Admin", "Login", map[string]interface{}{
+		"auth-tag":    "user-who",
+		"credentials": "tardis",
+	})
+	c.Assert(resp.Error, qt.Equals, "")
+	result := loginResult(c, resp)
+	c.Assert(result.ControllerTag, qt.Equals, "controller-"+ctrl.UUID())
+	c.Assert(result.UserInfo.Identity, qt.Equals, "user-who")
+	c.Assert(result.Servers, qt.HasLen, 1)
+	c.Assert(result.DischargeRequired, qt.IsNil)
+	c.Assert(ctrl.Logins(), qt.DeepEquals, []string{"who"})
+}
+
+func TestLoginMacaroons(t *testing.T) {
+	c := qt.New(t)
+	ctrl := newController(c)
+	ms, err := ctrl.Macaroons("rose@external")
+	c.Assert(err, qt.Equals, nil)
+
+	resp := call(c, ctrl, "Admin", "Login", map[string]interface{}{
+		"macaroons": []macaroon.Slice{ms[ctrl.CookieURL()]},
+	})
+	c.Assert(resp.Error, qt.Equals, "")
+	result := loginResult(c, resp)
+	c.Assert(result.UserInfo.Identity, qt.Equals, "user-rose@external")
+	c.Assert(result.DischargeRequired, qt.IsNil)
+	c.Assert(ctrl.Logins(), qt.DeepEquals, []string{"rose@external"})
+}
+
+func TestLoginInvalidCredentials(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		about    string
+		authTag  string
+		password string
+	}{{
+		about:    "invalid password",
+		authTag:  "user-who",
+		password: "bad-wolf",
+	}, {
+		about:    "unknown user",
+		authTag:  "user-dalek",
+		password: "exterminate",
+	}, {
+		about:    "invalid tag",
+		authTag:  "who",
+		password: "tardis",
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			ctrl := newController(c)
+			ctrl.AddUser("who", "tardis")
+			resp := call(c, ctrl, "Admin", "Login", map[string]interface{}{
+				"auth-tag":    test.authTag,
+				"credentials": test.password,
+			})
+			c.Assert(resp.Error, qt.Equals, "invalid entity name or password")
+			c.Assert(resp.ErrorCode, qt.Equals, "unauthorized access")
+			c.Assert(ctrl.Logins(), qt.HasLen, 0)
+		})
+	}
+}
+
+func TestLoginDischargeRequired(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		about     string
+		macaroons func(c *qt.C, ctrl, other *jujutest.Controller) []macaroon.Slice
+	}{{
+		about: "no macaroons",
+		macaroons: func(c *qt.C, ctrl, other *jujutest.Controller) []macaroon.Slice {
+			return nil
+		},
+	}, {
+		about: "macaroons from another controller",
+		macaroons: func(c *qt.C, ctrl, other *jujutest.Controller) []macaroon.Slice {
+			ms, err := other.Macaroons("rose@external")
+			c.Assert(err, qt.Equals, nil)
+			return []macaroon.Slice{ms[other.CookieURL()]}
+		},
+	}, {
+		about: "unsatisfied caveats",
+		macaroons: func(c *qt.C, ctrl, other *jujutest.Controller) []macaroon.Slice {
+			ms, err := ctrl.Macaroons("rose@external")
+			c.Assert(err, qt.Equals, nil)
+			m := ms[ctrl.CookieURL()][0]
+			err = m.AddFirstPartyCaveat([]byte("time-before 2000-01-01T00:00:00Z"))
+			c.Assert(err, qt.Equals, nil)
+			return []macaroon.Slice{{m}}
+		},
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			ctrl := newController(c)
+			other := newController(c)
+			resp := call(c, ctrl, "Admin", "Login", map[string]interface{}{
+				"macaroons": test.macaroons(c, ctrl, other),
+			})
+			c.Assert(resp.Error, qt.Equals, "")
+			result := loginResult(c, resp)
+			c.Assert(result.DischargeRequiredReason, qt.Equals, "authentication required")
+			c.Assert(result.UserInfo, qt.IsNil)
+
+			// The macaroon must be discharged by the identity manager.
+			c.Assert(result.DischargeRequired, qt.Not(qt.IsNil))
+			caveats := result.DischargeRequired.Caveats()
+			c.Assert(caveats, qt.HasLen, 1)
+			c.Assert(caveats[0].Location, qt.Equals, ctrl.IdentityURL())
+			c.Assert(caveats[0].VerificationId, qt.Not(qt.HasLen), 0)
+			c.Assert(ctrl.Logins(), qt.HasLen, 0)
+		})
+	}
+}
+
+func TestDischargeRefused(t *testing.T) {
+	c := qt.New(t)
+	ctrl := newController(c)
+
+	resp, err := http.PostForm(ctrl.IdentityURL()+"/discharge", url.Values{"id": {"is-authenticated-user"}})
+	c.Assert(err, qt.Equals, nil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusForbidden)
+	var berr struct {
+		Code    string
+		Message string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&berr)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(berr.Code, qt.Equals, "forbidden")
+	c.Assert(berr.Message, qt.Equals, "user not authenticated")
+}
+
+func TestSetLoginError(t *testing.T) {
+	c := qt.New(t)
+	ctrl := newController(c)
+	ctrl.AddUser("who", "tardis")
+	params := map[string]interface{}{
+		"auth-tag":    "user-who",
+		"credentials": "tardis",
+	}
+
+	ctrl.SetLoginError(errors.New("bad wolf"))
+	resp := call(c, ctrl, "Admin", "Login", params)
+	c.Assert(resp.Error, qt.Equals, "bad wolf")
+	c.Assert(ctrl.Logins(), qt.HasLen, 0)
+
+	// The failure can be removed.
+	ctrl.SetLoginError(nil)
+	resp = call(c, ctrl, "Admin", "Login", params)
+	c.Assert(resp.Error, qt.Equals, "")
+	c.Assert(ctrl.Logins(), qt.DeepEquals, []string{"who"})
+}
+
+func TestSetEndpoints(t *testing.T) {
+	c := qt.New(t)
+	ctrl := newController(c)
+	ctrl.AddUser("who", "tardis")
+	ctrl.SetEndpoints("1.2.3.4:17070", "[::1]:443", "juju.example.com:443")
+
+	resp := call(c, ctrl, "Admin", "Login", map[string]interface{}{
+		"auth-tag":    "user-who",
+		"credentials": "tardis",
+	})
+	c.Assert(resp.Error, qt.Equals, "")
+	result := loginResult(c, resp)
+	c.Assert(result.Servers, qt.DeepEquals, [][]hostPort{{{
+		Value: "1.2.3.4",
+		Type:  "ipv4",
+		Scope: "public",
+		Port:  17070,
+	}}, {{
+		Value: "::1",
+		Type:  "ipv6",
+		Scope: "public",
+		Port:  443,
+	}}, {{
+		Value: "juju.example.com",
+		Type:  "hostname",
+		Scope: "public",
+		Port:  443,
+	}}})
+}
+
+func TestPing(t *testing.T) {
+	c := qt.New(t)
+	ctrl := newController(c)
+
+	resp := call(c, ctrl, "Pinger", "Ping", nil)
+	c.Assert(resp.Error, qt.Equals, "")
+	c.Assert(resp.ErrorCode, qt.Equals, "")
+}
+
+func TestUnknownRequest(t *testing.T) {
+	c := qt.New(t)
+	ctrl := newController(c)
+
+	resp := call(c, ctrl, "Client", "FullStatus", nil)
+	c.Assert(resp.Error, qt.Equals, `unknown object type "Client"`)
+	c.Assert(resp.ErrorCode, qt.Equals, "not implemented")
+}
+
+// newController starts a fake controller which is closed when the test
+// completes.
+func newController(c *qt.C) *jujutest.Controller {
+	ctrl, err := jujutest.NewController()
+	c.Assert(err, qt.Equals, nil)
+	c.Defer(ctrl.Close)
+	return ctrl
+}
+
+// call connects to the given controller, sends a request with the given
+// facade, method and parameters, and returns the response.
+func call(c *qt.C, ctrl *jujutest.Controller, facade, method string, params interface{}) response {
+	pool := x509.NewCertPool()
+	c.Assert(pool.AppendCertsFromPEM([]byte(ctrl.CACert())), qt.Equals, true)
+	dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{
+			RootCAs: pool,
+		},
+	}
+	conn, _, err := dialer.Dial("wss://"+ctrl.Addr()+"/api", nil)
+	c.Assert(err, qt.Equals, nil)
+	defer conn.Close()
+	err = conn.WriteJSON(map[string]interface{}{
+		"request-id": 1,
+		"type":       facade,
+		"version":    1,
+		"request":    method,
+		"params":     params,
+	})
+	c.Assert(err, qt.Equals, nil)
+	var resp response
+	err = conn.ReadJSON(&resp)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(resp.RequestID, qt.Equals, uint64(1))
+	return resp
+}
+
+// loginResult decodes the login result from the given response.
+func loginResult(c *qt.C, resp response) *result {
+	var r result
+	err := json.Unmarshal(resp.Response, &r)
+	c.Assert(err, qt.Equals, nil)
+	return &r
+}
+
+// response holds a Juju RPC response.
+type response struct {
+	RequestID uint64          `json:"request-id"`
+	Error     string          `json:"error"`
+	ErrorCode string          `json:"error-code"`
+	Response  json.RawMessage `json:"response"`
+}
+
+// result holds the result of Admin.Login requests.
+type result struct {
+	Servers       [][]hostPort `json:"servers"`
+	ControllerTag string       `json:"controller-tag"`
+	UserInfo      *struct {
+		Identity string `json:"identity"`
+	} `json:"user-info"`
+	DischargeRequired       *macaroon.Macaroon `json:"discharge-required"`
+	DischargeRequiredReason string             `json:"discharge-required-error"`
+}
+
+// hostPort holds a controller API address.
+type hostPort struct {
+	Value string `json:"value"`
+	Type  string `json:"type"`
+	Scope string `json:"scope"`
+	Port  int    `json:"port"`
+}
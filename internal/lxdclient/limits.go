@@ -0,0 +1,57 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package lxdclient
+
+import "strconv"
+
+// Limits holds resource limits applied to containers. Empty values mean that
+// no limits are set, in which case the ones defined in profiles apply.
+type Limits struct {
+	// CPU holds the number of CPUs or the CPU set available to the container,
+	// for instance "2" or "0-3".
+	CPU string
+	// Memory holds the memory limit, for instance "2GB" or "50%".
+	Memory string
+	// Processes holds the maximum number of processes in the container.
+	Processes int
+	// Disk holds the size of the root disk, for instance "10GB".
+	Disk string
+}
+
+// Merge returns a copy of the limits with values overridden by the non-empty
+// values in the given limits.
+func (l Limits) Merge(override Limits) Limits {
+	if override.CPU != "" {
+		l.CPU = override.CPU
+	}
+	if override.Memory != "" {
+		l.Memory = override.Memory
+	}
+	if override.Processes != 0 {
+		l.Processes = override.Processes
+	}
+	if override.Disk != "" {
+		l.Disk = override.Disk
+	}
+	return l
+}
+
+// config returns the LXD container configuration for the limits, or nil if
+// there are no limits to be set in the configuration.
+func (l Limits) config() map[string]string {
+	config := make(map[string]string)
+	if l.CPU != "" {
+		config["limits.cpu"] = l.CPU
+	}
+	if l.Memory != "" {
+		config["limits.memory"] = l.Memory
+	}
+	if l.Processes != 0 {
+		config["limits.processes"] = strconv.Itoa(l.Processes)
+	}
+	if len(config) == 0 {
+		return nil
+	}
+	return config
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package lxdclient_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/internal/lxdclient"
+)
+
+var mergeTests = []struct {
+	about    string
+	limits   lxdclient.Limits
+	override lxdclient.Limits
+	expected lxdclient.Limits
+}{{
+	about: "empty limits",
+}, {
+	about: "no overrides",
+	limits: lxdclient.Limits{
+		CPU:       "2",
+		Memory:    "2GB",
+		Processes: 500,
+		Disk:      "10GB",
+	},
+	expected: lxdclient.Limits{
+		CPU:       "2",
+		Memory:    "2GB",
+		Processes: 500,
+		Disk:      "10GB",
+	},
+}, {
+	about: "partial overrides",
+	limits: lxdclient.Limits{
+		CPU:       "2",
+		Memory:    "2GB",
+		Processes: 500,
+	},
+	override: lxdclient.Limits{
+		Memory: "4GB",
+		Disk:   "20GB",
+	},
+	expected: lxdclient.Limits{
+		CPU:       "2",
+		Memory:    "4GB",
+		Processes: 500,
+		Disk:      "20GB",
+	},
+}, {
+	about: "all overrides",
+	limits: lxdclient.Limits{
+		CPU:       "2",
+		Memory:    "2GB",
+		Processes: 500,
+		Disk:      "10GB",
+	},
+	override: lxdclient.Limits{
+		CPU:       "0-3",
+		Memory:    "50%",
+		Processes: 1000,
+		Disk:      "20GB",
+	},
+	expected: lxdclient.Limits{
+		CPU:       "0-3",
+		Memory:    "50%",
+		Processes: 1000,
+		Disk:      "20GB",
+	},
+}}
+
+func TestMerge(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range mergeTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(test.limits.Merge(test.override), qt.Equals, test.expected)
+		})
+	}
+}
@@ -6,6 +6,7 @@ package lxdclient
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 	"strings"
 	"time"
@@ -24,10 +25,19 @@ type Client interface {
 	// Get returns the LXD container with the given name.
 	Get(name string) (Container, error)
 	// Create creates a container using the LXD image with the given name.
-	Create(image, name string, profiles ...string) (Container, error)
+	// The given resource limits are applied to the container, and the given
+	// custom storage volumes, created if they do not exist, are attached to
+	// it.
+	Create(image, name string, limits Limits, volumes []Volume, profiles ...string) (Container, error)
 	// Delete removes the container with the given name. It assumes the
 	// container exists and is not running.
 	Delete(name string) error
+	// Rename changes the name of the given container. It assumes the
+	// container exists and is not running.
+	Rename(name, newName string) error
+	// ImageFingerprint returns the fingerprint of the image the given image
+	// alias currently points to.
+	ImageFingerprint(alias string) (string, error)
 }
 
 // Container describes an LXD container instance.
@@ -44,8 +54,29 @@ type Container interface {
 	Stop() error
 	// WriteFile creates a file in the container at the given path and data.
 	WriteFile(path string, data []byte) error
+	// ReadFile returns the content of the file at the given path in the
+	// container.
+	ReadFile(path string) ([]byte, error)
 	// Exec executes the given command in the container and returns its output.
 	Exec(command string, args ...string) (string, error)
+	// Config returns the value of the given container configuration key, or
+	// an empty string if the key is not set.
+	Config(key string) string
+	// SetConfig sets the given container configuration key to the given
+	// value.
+	SetConfig(key, value string) error
+}
+
+// Volume describes an LXD custom storage volume attached to a container.
+// Volumes are not removed when containers are deleted, so that their contents
+// are preserved.
+type Volume struct {
+	// Pool holds the name of the storage pool including the volume.
+	Pool string
+	// Name holds the name of the volume.
+	Name string
+	// Path holds the path where the volume is mounted in the container.
+	Path string
 }
 
 // New returns an LXD client connected to the socket at the given path.
@@ -80,6 +111,7 @@ func (cl *client) All() ([]Container, error) {
 		containers[i] = &container{
 			name:    c.Name,
 			started: c.Status != "Stopped",
+			config:  c.Config,
 			srv:     cl.srv,
 		}
 	}
@@ -95,12 +127,15 @@ func (cl *client) Get(name string) (Container, error) {
 	return &container{
 		name:    c.Name,
 		started: c.Status != "Stopped",
+		config:  c.Config,
 		srv:     cl.srv,
 	}, nil
 }
 
 // Create creates a container using the LXD image with the given name.
-func (cl *client) Create(image, name string, profiles ...string) (Container, error) {
+// The given resource limits are applied to the container, and the given
+// custom storage volumes, created if they do not exist, are attached to it.
+func (cl *client) Create(image, name string, limits Limits, volumes []Volume, profiles ...string) (Container, error) {
 	req := lxdapi.ContainersPost{
 		Name: name,
 		Source: lxdapi.ContainerSource{
@@ -108,9 +143,36 @@ func (cl *client) Create(image, name string, profiles ...string) (Container, err
 			Alias: image,
 		},
 		ContainerPut: lxdapi.ContainerPut{
+			Config:   limits.config(),
 			Profiles: profiles,
 		},
 	}
+	if limits.Disk != "" {
+		// The root disk device is usually defined in profiles: override it
+		// in the container in order to set the quota.
+		dname, device, err := cl.rootDevice(profiles)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create container %q", name)
+		}
+		device["size"] = limits.Disk
+		req.Devices = map[string]map[string]string{
+			dname: device,
+		}
+	}
+	for _, v := range volumes {
+		if err := cl.ensureVolume(v); err != nil {
+			return nil, errgo.Notef(err, "cannot create container %q", name)
+		}
+		if req.Devices == nil {
+			req.Devices = make(map[string]map[string]string, len(volumes))
+		}
+		req.Devices[v.Name] = map[string]string{
+			"type":   "disk",
+			"pool":   v.Pool,
+			"source": v.Name,
+			"path":   v.Path,
+		}
+	}
 	op, err := cl.srv.CreateContainer(req)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot create container %q", name)
@@ -125,6 +187,46 @@ func (cl *client) Create(image, name string, profiles ...string) (Container, err
 	}, nil
 }
 
+// ensureVolume creates the given custom storage volume if it does not exist.
+func (cl *client) ensureVolume(v Volume) error {
+	if _, _, err := cl.srv.GetStoragePoolVolume(v.Pool, "custom", v.Name); err == nil {
+		return nil
+	}
+	if err := cl.srv.CreateStoragePoolVolume(v.Pool, lxdapi.StorageVolumesPost{
+		Name: v.Name,
+		Type: "custom",
+	}); err != nil {
+		return errgo.Notef(err, "cannot create storage volume %q in pool %q", v.Name, v.Pool)
+	}
+	return nil
+}
+
+// rootDevice returns the name and a copy of the root disk device defined in
+// the given profiles. Later profiles take precedence, as in LXD.
+func (cl *client) rootDevice(profiles []string) (string, map[string]string, error) {
+	var dname string
+	var device map[string]string
+	for _, pname := range profiles {
+		p, _, err := cl.srv.GetProfile(pname)
+		if err != nil {
+			return "", nil, errgo.Notef(err, "cannot get profile %q", pname)
+		}
+		for n, d := range p.Devices {
+			if d["type"] == "disk" && d["path"] == "/" {
+				dname, device = n, d
+			}
+		}
+	}
+	if device == nil {
+		return "", nil, errgo.New("cannot set disk quota: no root disk device found in profiles")
+	}
+	root := make(map[string]string, len(device)+1)
+	for k, v := range device {
+		root[k] = v
+	}
+	return dname, root, nil
+}
+
 // Delete removes the container with the given name. It assumes the container
 // exists and is not running.
 func (cl *client) Delete(name string) error {
@@ -139,10 +241,37 @@ func (cl *client) Delete(name string) error {
 	return nil
 }
 
+// Rename changes the name of the given container. It assumes the container
+// exists and is not running.
+func (cl *client) Rename(name, newName string) error {
+	op, err := cl.srv.RenameContainer(name, lxdapi.ContainerPost{
+		Name: newName,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot rename container %q to %q", name, newName)
+	}
+	// Wait for the operation to complete.
+	if err = op.Wait(); err != nil {
+		return errgo.Notef(err, "cannot rename container %q to %q: operation failed", name, newName)
+	}
+	return nil
+}
+
+// ImageFingerprint returns the fingerprint of the image the given image alias
+// currently points to.
+func (cl *client) ImageFingerprint(alias string) (string, error) {
+	a, _, err := cl.srv.GetImageAlias(alias)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot get image alias %q", alias)
+	}
+	return a.Target, nil
+}
+
 // container implements Container, and represents an LXD instance.
 type container struct {
 	name    string
 	started bool
+	config  map[string]string
 	srv     lxd.ContainerServer
 }
 
@@ -211,6 +340,27 @@ func (c *container) WriteFile(path string, data []byte) error {
 	return nil
 }
 
+// ReadFile returns the content of the file at the given path in the
+// container.
+func (c *container) ReadFile(path string) ([]byte, error) {
+	r, resp, err := c.srv.GetContainerFile(c.name, path)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read file %q in the container", path)
+	}
+	if resp.Type != "file" {
+		if r != nil {
+			r.Close()
+		}
+		return nil, errgo.Newf("cannot read file %q in the container: not a file", path)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read file %q in the container", path)
+	}
+	return data, nil
+}
+
 // Exec executes the given command in the container and returns its output.
 func (c *container) Exec(command string, args ...string) (string, error) {
 	cmd := append([]string{command}, args...)
@@ -250,6 +400,35 @@ func (c *container) Exec(command string, args ...string) (string, error) {
 	return stdout.(string), nil
 }
 
+// Config returns the value of the given container configuration key, or an
+// empty string if the key is not set.
+func (c *container) Config(key string) string {
+	return c.config[key]
+}
+
+// SetConfig sets the given container configuration key to the given value.
+func (c *container) SetConfig(key, value string) error {
+	ct, etag, err := c.srv.GetContainer(c.name)
+	if err != nil {
+		return errgo.Notef(err, "cannot get container %q", c.name)
+	}
+	req := ct.Writable()
+	if req.Config == nil {
+		req.Config = make(map[string]string, 1)
+	}
+	req.Config[key] = value
+	op, err := c.srv.UpdateContainer(c.name, req, etag)
+	if err != nil {
+		return errgo.Notef(err, "cannot update container %q", c.name)
+	}
+	// Wait for the operation to complete.
+	if err = op.Wait(); err != nil {
+		return errgo.Notef(err, "cannot update container %q: operation failed", c.name)
+	}
+	c.config = req.Config
+	return nil
+}
+
 // updateState updates the state of the container.
 func (c *container) updateState(action string) error {
 	req := lxdapi.ContainerStatePut{
@@ -6,6 +6,7 @@ package lxdclient_test
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
 	"time"
@@ -99,6 +100,11 @@ var clientTests = []struct {
 			Name:   "container-1",
 			Status: "Stopped",
 		}, {
+			ContainerPut: lxdapi.ContainerPut{
+				Config: map[string]string{
+					"user.key": "value",
+				},
+			},
 			Name:   "container-2",
 			Status: "Running",
 		}},
@@ -108,6 +114,8 @@ var clientTests = []struct {
 		c.Assert(err, qt.Equals, nil)
 		c.Assert(container, qt.Not(qt.IsNil))
 		c.Assert(container.Name(), qt.Equals, "container-2")
+		c.Assert(container.Config("user.key"), qt.Equals, "value")
+		c.Assert(container.Config("user.no-such"), qt.Equals, "")
 		c.Assert(srv.getContainerProvidedName, qt.Equals, "container-2")
 	},
 }, {
@@ -116,7 +124,7 @@ var clientTests = []struct {
 		createContainerError: errors.New("bad wolf"),
 	},
 	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
-		container, err := client.Create("my-image", "my-container", "default", "termserver-limited")
+		container, err := client.Create("my-image", "my-container", lxdclient.Limits{}, nil, "default", "termserver-limited")
 		c.Assert(err, qt.ErrorMatches, `cannot create container "my-container": bad wolf`)
 		c.Assert(container, qt.IsNil)
 		c.Assert(srv.createContainerProvidedReq, qt.DeepEquals, lxdapi.ContainersPost{
@@ -136,7 +144,7 @@ var clientTests = []struct {
 		createContainerOpError: errors.New("bad wolf"),
 	},
 	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
-		container, err := client.Create("my-image", "my-container", "default", "termserver-limited")
+		container, err := client.Create("my-image", "my-container", lxdclient.Limits{}, nil, "default", "termserver-limited")
 		c.Assert(err, qt.ErrorMatches, `cannot create container "my-container": operation failed: bad wolf`)
 		c.Assert(container, qt.IsNil)
 	},
@@ -144,7 +152,7 @@ var clientTests = []struct {
 	about: "Create: success",
 	srv:   &srv{},
 	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
-		container, err := client.Create("ubuntu:lts", "my-container", "default")
+		container, err := client.Create("ubuntu:lts", "my-container", lxdclient.Limits{}, nil, "default")
 		c.Assert(err, qt.Equals, nil)
 		c.Assert(container, qt.Not(qt.IsNil))
 		c.Assert(container.Name(), qt.Equals, "my-container")
@@ -160,6 +168,130 @@ var clientTests = []struct {
 			},
 		})
 	},
+}, {
+	about: "Create: success with limits",
+	srv: &srv{
+		getProfileResults: map[string]*lxdapi.Profile{
+			"default": {
+				ProfilePut: lxdapi.ProfilePut{
+					Devices: map[string]map[string]string{
+						"eth0": {"type": "nic", "nictype": "bridged"},
+						"root": {"type": "disk", "path": "/", "pool": "default"},
+					},
+				},
+			},
+			"termserver": {
+				ProfilePut: lxdapi.ProfilePut{
+					Devices: map[string]map[string]string{
+						"rootfs": {"type": "disk", "path": "/", "pool": "fast"},
+					},
+				},
+			},
+		},
+	},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		container, err := client.Create("ubuntu:lts", "my-container", lxdclient.Limits{
+			CPU:       "2",
+			Memory:    "2GB",
+			Processes: 500,
+			Disk:      "10GB",
+		}, nil, "default", "termserver")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(container.Name(), qt.Equals, "my-container")
+		c.Assert(srv.createContainerProvidedReq, qt.DeepEquals, lxdapi.ContainersPost{
+			ContainerPut: lxdapi.ContainerPut{
+				Config: map[string]string{
+					"limits.cpu":       "2",
+					"limits.memory":    "2GB",
+					"limits.processes": "500",
+				},
+				Devices: map[string]map[string]string{
+					"rootfs": {"type": "disk", "path": "/", "pool": "fast", "size": "10GB"},
+				},
+				Profiles: []string{"default", "termserver"},
+			},
+			Name: "my-container",
+			Source: lxdapi.ContainerSource{
+				Type:  "image",
+				Alias: "ubuntu:lts",
+			},
+		})
+		// Profiles are not modified.
+		c.Assert(srv.getProfileResults["termserver"].Devices["rootfs"]["size"], qt.Equals, "")
+	},
+}, {
+	about: "Create: success with volumes",
+	srv: &srv{
+		storageVolumes: map[string]bool{
+			"default/existing": true,
+		},
+	},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		container, err := client.Create("ubuntu:lts", "my-container", lxdclient.Limits{}, []lxdclient.Volume{{
+			Pool: "default",
+			Name: "existing",
+			Path: "/home/ubuntu",
+		}, {
+			Pool: "fast",
+			Name: "new",
+			Path: "/srv",
+		}}, "default")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(container.Name(), qt.Equals, "my-container")
+		c.Assert(srv.createStoragePoolVolumeProvided, qt.DeepEquals, []string{"fast/new"})
+		c.Assert(srv.createContainerProvidedReq, qt.DeepEquals, lxdapi.ContainersPost{
+			ContainerPut: lxdapi.ContainerPut{
+				Devices: map[string]map[string]string{
+					"existing": {"type": "disk", "pool": "default", "source": "existing", "path": "/home/ubuntu"},
+					"new":      {"type": "disk", "pool": "fast", "source": "new", "path": "/srv"},
+				},
+				Profiles: []string{"default"},
+			},
+			Name: "my-container",
+			Source: lxdapi.ContainerSource{
+				Type:  "image",
+				Alias: "ubuntu:lts",
+			},
+		})
+	},
+}, {
+	about: "Create: failure creating volume",
+	srv: &srv{
+		createStoragePoolVolumeError: errors.New("bad wolf"),
+	},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		container, err := client.Create("ubuntu:lts", "my-container", lxdclient.Limits{}, []lxdclient.Volume{{
+			Pool: "default",
+			Name: "home",
+			Path: "/home/ubuntu",
+		}}, "default")
+		c.Assert(err, qt.ErrorMatches, `cannot create container "my-container": cannot create storage volume "home" in pool "default": bad wolf`)
+		c.Assert(container, qt.IsNil)
+	},
+}, {
+	about: "Create: failure getting profiles",
+	srv:   &srv{},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		container, err := client.Create("ubuntu:lts", "my-container", lxdclient.Limits{
+			Disk: "10GB",
+		}, nil, "default")
+		c.Assert(err, qt.ErrorMatches, `cannot create container "my-container": cannot get profile "default": not found`)
+		c.Assert(container, qt.IsNil)
+	},
+}, {
+	about: "Create: failure without root device",
+	srv: &srv{
+		getProfileResults: map[string]*lxdapi.Profile{
+			"default": {},
+		},
+	},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		container, err := client.Create("ubuntu:lts", "my-container", lxdclient.Limits{
+			Disk: "10GB",
+		}, nil, "default")
+		c.Assert(err, qt.ErrorMatches, `cannot create container "my-container": cannot set disk quota: no root disk device found in profiles`)
+		c.Assert(container, qt.IsNil)
+	},
 }, {
 	about: "Delete: failure",
 	srv: &srv{
@@ -187,6 +319,56 @@ var clientTests = []struct {
 		c.Assert(err, qt.Equals, nil)
 		c.Assert(srv.deleteContainerProvidedName, qt.Equals, "existing-container")
 	},
+}, {
+	about: "Rename: failure",
+	srv: &srv{
+		renameContainerError: errors.New("bad wolf"),
+	},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		err := client.Rename("my-container", "new-container")
+		c.Assert(err, qt.ErrorMatches, `cannot rename container "my-container" to "new-container": bad wolf`)
+		c.Assert(srv.renameContainerProvidedName, qt.Equals, "my-container")
+	},
+}, {
+	about: "Rename: operation failure",
+	srv: &srv{
+		renameContainerOpError: errors.New("bad wolf"),
+	},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		err := client.Rename("my-container", "new-container")
+		c.Assert(err, qt.ErrorMatches, `cannot rename container "my-container" to "new-container": operation failed: bad wolf`)
+	},
+}, {
+	about: "Rename: success",
+	srv:   &srv{},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		err := client.Rename("existing-container", "new-container")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(srv.renameContainerProvidedName, qt.Equals, "existing-container")
+		c.Assert(srv.renameContainerProvidedReq, qt.DeepEquals, lxdapi.ContainerPost{
+			Name: "new-container",
+		})
+	},
+}, {
+	about: "ImageFingerprint: failure",
+	srv:   &srv{},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		fingerprint, err := client.ImageFingerprint("no-such-image")
+		c.Assert(err, qt.ErrorMatches, `cannot get image alias "no-such-image": not found`)
+		c.Assert(fingerprint, qt.Equals, "")
+	},
+}, {
+	about: "ImageFingerprint: success",
+	srv: &srv{
+		imageAliases: map[string]string{
+			"termserver": "6b4b3a9d",
+		},
+	},
+	test: func(c *qt.C, client lxdclient.Client, srv *srv) {
+		fingerprint, err := client.ImageFingerprint("termserver")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(fingerprint, qt.Equals, "6b4b3a9d")
+	},
 }}
 
 func TestClient(t *testing.T) {
@@ -366,6 +548,38 @@ var containerTests = []struct {
 			Timeout: -1,
 		})
 	},
+}, {
+	about: "ReadFile: failure",
+	srv: &srv{
+		getContainerFileResponses: []fileResponse{{hasErr: true}},
+	},
+	test: func(c *qt.C, container lxdclient.Container, srv *srv) {
+		data, err := container.ReadFile("/example/file")
+		c.Assert(err, qt.ErrorMatches, `cannot read file "/example/file" in the container: no such file`)
+		c.Assert(data, qt.IsNil)
+	},
+}, {
+	about: "ReadFile: failure as the path is a directory",
+	srv: &srv{
+		getContainerFileResponses: []fileResponse{{}},
+	},
+	test: func(c *qt.C, container lxdclient.Container, srv *srv) {
+		data, err := container.ReadFile("/example")
+		c.Assert(err, qt.ErrorMatches, `cannot read file "/example" in the container: not a file`)
+		c.Assert(data, qt.IsNil)
+	},
+}, {
+	about: "ReadFile: success",
+	srv: &srv{
+		getContainerFileResponses: []fileResponse{{isFile: true, content: "data"}},
+	},
+	test: func(c *qt.C, container lxdclient.Container, srv *srv) {
+		data, err := container.ReadFile("/example/file")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(data), qt.Equals, "data")
+		c.Assert(srv.getContainerFileProvidedName, qt.Equals, "my-container")
+		c.Assert(srv.getContainerFileProvidedPaths, qt.DeepEquals, []string{"/example/file"})
+	},
 }, {
 	about: "WriteFile: failure as a file in the path already exists",
 	srv: &srv{
@@ -507,6 +721,42 @@ var containerTests = []struct {
 			WaitForWS: true,
 		})
 	},
+}, {
+	about: "SetConfig: failure",
+	srv: &srv{
+		updateContainerError: errors.New("bad wolf"),
+	},
+	test: func(c *qt.C, container lxdclient.Container, srv *srv) {
+		err := container.SetConfig("user.key", "value")
+		c.Assert(err, qt.ErrorMatches, `cannot update container "my-container": bad wolf`)
+		c.Assert(container.Config("user.key"), qt.Equals, "")
+		c.Assert(srv.updateContainerProvidedName, qt.Equals, "my-container")
+	},
+}, {
+	about: "SetConfig: operation failure",
+	srv: &srv{
+		updateContainerOpError: errors.New("bad wolf"),
+	},
+	test: func(c *qt.C, container lxdclient.Container, srv *srv) {
+		err := container.SetConfig("user.key", "value")
+		c.Assert(err, qt.ErrorMatches, `cannot update container "my-container": operation failed: bad wolf`)
+		c.Assert(container.Config("user.key"), qt.Equals, "")
+	},
+}, {
+	about: "SetConfig: success",
+	srv:   &srv{},
+	test: func(c *qt.C, container lxdclient.Container, srv *srv) {
+		err := container.SetConfig("user.key", "value")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(container.Config("user.key"), qt.Equals, "value")
+		c.Assert(srv.updateContainerProvidedName, qt.Equals, "my-container")
+		c.Assert(srv.updateContainerProvidedReq, qt.DeepEquals, lxdapi.ContainerPut{
+			Config: map[string]string{
+				"user.key": "value",
+			},
+		})
+		c.Assert(srv.updateContainerProvidedETag, qt.Equals, "my-etag")
+	},
 }}
 
 func TestContainer(t *testing.T) {
@@ -540,14 +790,33 @@ type srv struct {
 	createContainerOpError     error
 	createContainerProvidedReq lxdapi.ContainersPost
 
+	getProfileResults map[string]*lxdapi.Profile
+
+	imageAliases map[string]string
+
+	storageVolumes                  map[string]bool
+	createStoragePoolVolumeError    error
+	createStoragePoolVolumeProvided []string
+
 	deleteContainerError        error
 	deleteContainerOpError      error
 	deleteContainerProvidedName string
 
+	renameContainerError        error
+	renameContainerOpError      error
+	renameContainerProvidedName string
+	renameContainerProvidedReq  lxdapi.ContainerPost
+
 	getContainerStateAddresses    []lxdapi.ContainerStateNetworkAddress
 	getContainerStateError        error
 	getContainerStateProvidedName string
 
+	updateContainerError        error
+	updateContainerOpError      error
+	updateContainerProvidedName string
+	updateContainerProvidedReq  lxdapi.ContainerPut
+	updateContainerProvidedETag string
+
 	updateContainerStateError        error
 	updateContainerStateOpError      error
 	updateContainerStateProvidedName string
@@ -577,7 +846,7 @@ func (s *srv) GetContainer(name string) (container *lxdapi.Container, ETag strin
 	s.getContainerProvidedName = name
 	for _, container := range s.getContainersResult {
 		if container.Name == name {
-			return &container, "", nil
+			return &container, "my-etag", nil
 		}
 	}
 	return nil, "", errors.New("not found")
@@ -593,6 +862,45 @@ func (s *srv) CreateContainer(req lxdapi.ContainersPost) (lxd.Operation, error)
 	}, nil
 }
 
+func (s *srv) GetProfile(name string) (*lxdapi.Profile, string, error) {
+	p, ok := s.getProfileResults[name]
+	if !ok {
+		return nil, "", errors.New("not found")
+	}
+	return p, "", nil
+}
+
+func (s *srv) GetStoragePoolVolume(pool, volType, name string) (*lxdapi.StorageVolume, string, error) {
+	if volType != "custom" || !s.storageVolumes[pool+"/"+name] {
+		return nil, "", errors.New("not found")
+	}
+	return &lxdapi.StorageVolume{
+		Name: name,
+		Type: volType,
+	}, "", nil
+}
+
+func (s *srv) GetImageAlias(name string) (*lxdapi.ImageAliasesEntry, string, error) {
+	target, ok := s.imageAliases[name]
+	if !ok {
+		return nil, "", errors.New("not found")
+	}
+	return &lxdapi.ImageAliasesEntry{
+		ImageAliasesEntryPut: lxdapi.ImageAliasesEntryPut{
+			Target: target,
+		},
+		Name: name,
+	}, "", nil
+}
+
+func (s *srv) CreateStoragePoolVolume(pool string, volume lxdapi.StorageVolumesPost) error {
+	if s.createStoragePoolVolumeError != nil {
+		return s.createStoragePoolVolumeError
+	}
+	s.createStoragePoolVolumeProvided = append(s.createStoragePoolVolumeProvided, pool+"/"+volume.Name)
+	return nil
+}
+
 func (s *srv) DeleteContainer(name string) (lxd.Operation, error) {
 	s.deleteContainerProvidedName = name
 	if s.deleteContainerError != nil {
@@ -603,6 +911,17 @@ func (s *srv) DeleteContainer(name string) (lxd.Operation, error) {
 	}, nil
 }
 
+func (s *srv) RenameContainer(name string, req lxdapi.ContainerPost) (lxd.Operation, error) {
+	s.renameContainerProvidedName = name
+	s.renameContainerProvidedReq = req
+	if s.renameContainerError != nil {
+		return nil, s.renameContainerError
+	}
+	return &operation{
+		err: s.renameContainerOpError,
+	}, nil
+}
+
 func (s *srv) GetContainerState(name string) (*lxdapi.ContainerState, string, error) {
 	s.getContainerStateProvidedName = name
 	if s.getContainerStateError != nil {
@@ -617,6 +936,18 @@ func (s *srv) GetContainerState(name string) (*lxdapi.ContainerState, string, er
 	}, "", nil
 }
 
+func (s *srv) UpdateContainer(name string, req lxdapi.ContainerPut, ETag string) (lxd.Operation, error) {
+	s.updateContainerProvidedName = name
+	s.updateContainerProvidedReq = req
+	s.updateContainerProvidedETag = ETag
+	if s.updateContainerError != nil {
+		return nil, s.updateContainerError
+	}
+	return &operation{
+		err: s.updateContainerOpError,
+	}, nil
+}
+
 func (s *srv) UpdateContainerState(name string, req lxdapi.ContainerStatePut, ETag string) (lxd.Operation, error) {
 	s.updateContainerStateProvidedName = name
 	s.updateContainerStateProvidedReq = req
@@ -704,8 +1035,9 @@ func (op *operation) Wait() error {
 // fileResponse is used to build responses to
 // lxd.ContainerServer.CreateContainerFile calls.
 type fileResponse struct {
-	isFile bool
-	hasErr bool
+	isFile  bool
+	hasErr  bool
+	content string
 }
 
 func (r fileResponse) value() (io.ReadCloser, *lxd.ContainerFileResponse, error) {
@@ -719,6 +1051,7 @@ func (r fileResponse) value() (io.ReadCloser, *lxd.ContainerFileResponse, error)
 	}
 	if r.isFile {
 		resp.Type = "file"
+		return ioutil.NopCloser(strings.NewReader(r.content)), resp, nil
 	}
 	return nil, resp, nil
 }
@@ -0,0 +1,569 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package lxdtest provides an in-memory implementation of lxdclient.Client,
+// suitable for testing code interacting with LXD without an LXD daemon.
+// The fake client tracks the state of containers, the files written and the
+// commands executed in them, and records all the calls it receives. Command
+// outputs can be scripted, and failures can be injected for any operation.
+package lxdtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/internal/lxdclient"
+)
+
+// New returns a new fake LXD client with no containers.
+func New() *Client {
+	return &Client{
+		containers: make(map[string]*Container),
+		errors:     make(map[errorKey]error),
+		images:     make(map[string]string),
+		volumes:    make(map[string]bool),
+	}
+}
+
+// WaitFor polls the given condition until it is true. It is useful for
+// waiting on operations performed in the background on the fake client. An
+// error is returned if the condition is still false after five seconds.
+func WaitFor(condition func() bool) error {
+	timeout := time.After(5 * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			return errgo.New("timeout waiting for condition")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// Client implements lxdclient.Client in memory. It is safe to use the client
+// and its containers concurrently.
+type Client struct {
+	mu         sync.Mutex
+	containers map[string]*Container
+	errors     map[errorKey]error
+	images     map[string]string
+	volumes    map[string]bool
+	exec       ExecFunc
+	calls      [][]string
+	numAddrs   int
+}
+
+// ExecFunc is used to script the output of commands executed in containers.
+// It is called with the name of the container and the command to execute.
+type ExecFunc func(container string, command string, args ...string) (string, error)
+
+// errorKey identifies an injected failure.
+type errorKey struct {
+	op   string
+	name string
+}
+
+// SetError makes the given operation fail with the given error. Operations
+// are identified by the name of the corresponding lxdclient.Client or
+// lxdclient.Container method, for instance "Create" or "Start". If name is not
+// empty, only operations on the container with that name fail. For the
+// WriteFile and ReadFile operations, name can also be a file path, in which
+// case only operations on that file fail. A nil error removes a previously
+// injected failure.
+func (cl *Client) SetError(op, name string, err error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	key := errorKey{op: op, name: name}
+	if err == nil {
+		delete(cl.errors, key)
+		return
+	}
+	cl.errors[key] = err
+}
+
+// SetExec sets the function used to script the output of commands executed
+// in containers. By default commands succeed with an empty output.
+func (cl *Client) SetExec(f ExecFunc) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.exec = f
+}
+
+// SetImage makes the given image alias point to the image with the given
+// fingerprint. Containers created using the alias record the fingerprint in
+// their "volatile.base_image" configuration key, as LXD does.
+func (cl *Client) SetImage(alias, fingerprint string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.images[alias] = fingerprint
+}
+
+// Calls returns the calls received by the client and its containers, in
+// order. Each call is represented by the method name followed by its string
+// arguments. Container methods are prefixed with the container name, as in
+// "(my-container).Start".
+func (cl *Client) Calls() [][]string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	calls := make([][]string, len(cl.calls))
+	copy(calls, cl.calls)
+	return calls
+}
+
+// ResetCalls forgets the calls received so far.
+func (cl *Client) ResetCalls() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.calls = nil
+}
+
+// AddContainer adds a container with the given name and state, as if it
+// already existed in LXD, and returns it. It panics if a container with the
+// same name already exists.
+func (cl *Client) AddContainer(name string, started bool) *Container {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.containers[name] != nil {
+		panic(fmt.Sprintf("container %q already exists", name))
+	}
+	c := cl.newContainer(name)
+	if started {
+		cl.start(c)
+	}
+	return c
+}
+
+// Volumes returns the custom storage volumes created so far, as sorted
+// "pool/name" strings.
+func (cl *Client) Volumes() []string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	volumes := make([]string, 0, len(cl.volumes))
+	for v := range cl.volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// Container returns the container with the given name, or nil if the
+// container does not exist.
+func (cl *Client) Container(name string) *Container {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.containers[name]
+}
+
+// All implements lxdclient.Client.All. Containers are returned sorted by
+// name.
+func (cl *Client) All() ([]lxdclient.Container, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if err := cl.call("All", ""); err != nil {
+		return nil, errgo.Notef(err, "cannot get containers")
+	}
+	names := make([]string, 0, len(cl.containers))
+	for name := range cl.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cs := make([]lxdclient.Container, len(names))
+	for i, name := range names {
+		cs[i] = cl.containers[name]
+	}
+	return cs, nil
+}
+
+// Get implements lxdclient.Client.Get.
+func (cl *Client) Get(name string) (lxdclient.Container, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if err := cl.call("Get", name, name); err != nil {
+		return nil, errgo.Notef(err, "cannot get container %q", name)
+	}
+	c := cl.containers[name]
+	if c == nil {
+		return nil, errgo.Newf("cannot get container %q: not found", name)
+	}
+	return c, nil
+}
+
+// Create implements lxdclient.Client.Create. The container is created in the
+// stopped state. Volumes are created if they do not exist, and they survive
+// the deletion of the container.
+func (cl *Client) Create(image, name string, limits lxdclient.Limits, volumes []lxdclient.Volume, profiles ...string) (lxdclient.Container, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if err := cl.call("Create", name, append([]string{image, name}, profiles...)...); err != nil {
+		return nil, errgo.Notef(err, "cannot create container %q", name)
+	}
+	if cl.containers[name] != nil {
+		return nil, errgo.Newf("cannot create container %q: already exists", name)
+	}
+	c := cl.newContainer(name)
+	c.image, c.limits = image, limits
+	if fingerprint := cl.images[image]; fingerprint != "" {
+		c.config["volatile.base_image"] = fingerprint
+	}
+	c.profiles = append([]string(nil), profiles...)
+	c.volumes = append([]lxdclient.Volume(nil), volumes...)
+	for _, v := range volumes {
+		cl.volumes[v.Pool+"/"+v.Name] = true
+	}
+	return c, nil
+}
+
+// Delete implements lxdclient.Client.Delete.
+func (cl *Client) Delete(name string) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if err := cl.call("Delete", name, name); err != nil {
+		return errgo.Notef(err, "cannot delete container %q", name)
+	}
+	c := cl.containers[name]
+	if c == nil {
+		return errgo.Newf("cannot delete container %q: not found", name)
+	}
+	if c.started {
+		return errgo.Newf("cannot delete container %q: container is running", name)
+	}
+	delete(cl.containers, name)
+	c.deleted = true
+	return nil
+}
+
+// Rename implements lxdclient.Client.Rename.
+func (cl *Client) Rename(name, newName string) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if err := cl.call("Rename", name, name, newName); err != nil {
+		return errgo.Notef(err, "cannot rename container %q to %q", name, newName)
+	}
+	c := cl.containers[name]
+	if c == nil {
+		return errgo.Newf("cannot rename container %q to %q: not found", name, newName)
+	}
+	if c.started {
+		return errgo.Newf("cannot rename container %q to %q: container is running", name, newName)
+	}
+	if cl.containers[newName] != nil {
+		return errgo.Newf("cannot rename container %q to %q: already exists", name, newName)
+	}
+	delete(cl.containers, name)
+	c.name = newName
+	cl.containers[newName] = c
+	return nil
+}
+
+// ImageFingerprint implements lxdclient.Client.ImageFingerprint. Image
+// aliases are defined using Client.SetImage.
+func (cl *Client) ImageFingerprint(alias string) (string, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if err := cl.call("ImageFingerprint", "", alias); err != nil {
+		return "", errgo.Notef(err, "cannot get image alias %q", alias)
+	}
+	fingerprint := cl.images[alias]
+	if fingerprint == "" {
+		return "", errgo.Newf("cannot get image alias %q: not found", alias)
+	}
+	return fingerprint, nil
+}
+
+// newContainer creates and stores a stopped container with the given name.
+// It must be called with cl.mu held.
+func (cl *Client) newContainer(name string) *Container {
+	c := &Container{
+		client: cl,
+		name:   name,
+		config: make(map[string]string),
+		files:  make(map[string][]byte),
+	}
+	cl.containers[name] = c
+	return c
+}
+
+// start starts the given container, assigning an address to it if required.
+// It must be called with cl.mu held.
+func (cl *Client) start(c *Container) {
+	if c.addr == "" {
+		c.addr = fmt.Sprintf("10.0.%d.%d", cl.numAddrs/254, cl.numAddrs%254+1)
+		cl.numAddrs++
+	}
+	c.started = true
+}
+
+// call records a call to the given operation with the given arguments, and
+// returns the injected failure for the operation on the given container, if
+// any. It must be called with cl.mu held.
+func (cl *Client) call(op, name string, args ...string) error {
+	cl.calls = append(cl.calls, append([]string{op}, args...))
+	return cl.failure(op, name)
+}
+
+// failure returns the failure injected for the given operation on the
+// container with the given name, if any. It must be called with cl.mu held.
+func (cl *Client) failure(op, name string) error {
+	if err := cl.errors[errorKey{op: op, name: name}]; err != nil {
+		return err
+	}
+	return cl.errors[errorKey{op: op}]
+}
+
+// Container implements lxdclient.Container in memory. Containers returned by
+// the client are live: their state reflects all subsequent operations.
+type Container struct {
+	client *Client
+
+	// The fields below are protected by client.mu.
+	name     string
+	image    string
+	profiles []string
+	limits   lxdclient.Limits
+	volumes  []lxdclient.Volume
+	started  bool
+	deleted  bool
+	addr     string
+	config   map[string]string
+	files    map[string][]byte
+	execs    [][]string
+}
+
+// Name implements lxdclient.Container.Name.
+func (c *Container) Name() string {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	return c.name
+}
+
+// Addr implements lxdclient.Container.Addr. Addresses are assigned when
+// containers are first started.
+func (c *Container) Addr() (string, error) {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	if err := c.call("Addr"); err != nil {
+		return "", errgo.Notef(err, "cannot get state for container %q", c.name)
+	}
+	if !c.started {
+		return "", errgo.Newf("cannot find address for %q", c.name)
+	}
+	return c.addr, nil
+}
+
+// Started implements lxdclient.Container.Started.
+func (c *Container) Started() bool {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	return c.started
+}
+
+// Start implements lxdclient.Container.Start.
+func (c *Container) Start() error {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	if err := c.check("Start", "start"); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.started {
+		return errgo.Newf("cannot start container %q: already running", c.name)
+	}
+	c.client.start(c)
+	return nil
+}
+
+// Stop implements lxdclient.Container.Stop.
+func (c *Container) Stop() error {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	if err := c.check("Stop", "stop"); err != nil {
+		return errgo.Mask(err)
+	}
+	if !c.started {
+		return errgo.Newf("cannot stop container %q: already stopped", c.name)
+	}
+	c.started = false
+	return nil
+}
+
+// WriteFile implements lxdclient.Container.WriteFile.
+func (c *Container) WriteFile(path string, data []byte) error {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	if err := c.fileCall("WriteFile", path); err != nil {
+		return errgo.Notef(err, "cannot create file %q in the container", path)
+	}
+	if err := c.checkRunning(); err != nil {
+		return errgo.Notef(err, "cannot create file %q in the container", path)
+	}
+	c.files[path] = append([]byte(nil), data...)
+	return nil
+}
+
+// ReadFile implements lxdclient.Container.ReadFile. Only the files written
+// using WriteFile can be read.
+func (c *Container) ReadFile(path string) ([]byte, error) {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	if err := c.fileCall("ReadFile", path); err != nil {
+		return nil, errgo.Notef(err, "cannot read file %q in the container", path)
+	}
+	if c.deleted {
+		return nil, errgo.Newf("cannot read file %q in the container: container %q not found", path, c.name)
+	}
+	data, ok := c.files[path]
+	if !ok {
+		return nil, errgo.Newf("cannot read file %q in the container: not found", path)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Exec implements lxdclient.Container.Exec. The output is provided by the
+// function set using Client.SetExec, if any.
+func (c *Container) Exec(command string, args ...string) (string, error) {
+	c.client.mu.Lock()
+	cmd := append([]string{command}, args...)
+	cmdstr := strings.Join(cmd, " ")
+	if err := c.call("Exec", cmd...); err != nil {
+		c.client.mu.Unlock()
+		return "", errgo.Notef(err, "cannot execute command %q on %q", cmdstr, c.name)
+	}
+	if err := c.checkRunning(); err != nil {
+		c.client.mu.Unlock()
+		return "", errgo.Notef(err, "cannot execute command %q on %q", cmdstr, c.name)
+	}
+	c.execs = append(c.execs, cmd)
+	name, exec := c.name, c.client.exec
+	c.client.mu.Unlock()
+	if exec == nil {
+		return "", nil
+	}
+	// The exec function is called without holding the lock, so that it can
+	// safely interact with the client.
+	return exec(name, command, args...)
+}
+
+// Config implements lxdclient.Container.Config.
+func (c *Container) Config(key string) string {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	return c.config[key]
+}
+
+// SetConfig implements lxdclient.Container.SetConfig.
+func (c *Container) SetConfig(key, value string) error {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	if err := c.check("SetConfig", "update", key, value); err != nil {
+		return errgo.Mask(err)
+	}
+	c.config[key] = value
+	return nil
+}
+
+// Image returns the name of the image used to create the container. It is
+// empty for containers added with Client.AddContainer.
+func (c *Container) Image() string {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	return c.image
+}
+
+// Profiles returns the profiles used to create the container.
+func (c *Container) Profiles() []string {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	return append([]string(nil), c.profiles...)
+}
+
+// Limits returns the resource limits applied when creating the container.
+func (c *Container) Limits() lxdclient.Limits {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	return c.limits
+}
+
+// Volumes returns the volumes attached when creating the container.
+func (c *Container) Volumes() []lxdclient.Volume {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	return append([]lxdclient.Volume(nil), c.volumes...)
+}
+
+// File returns the content of the file written at the given path, and
+// whether the file exists.
+func (c *Container) File(path string) ([]byte, bool) {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	data, ok := c.files[path]
+	return append([]byte(nil), data...), ok
+}
+
+// Files returns the paths of all the files written in the container, sorted.
+func (c *Container) Files() []string {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	paths := make([]string, 0, len(c.files))
+	for path := range c.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Execs returns the commands executed in the container, in order. Each
+// command is represented by the command name followed by its arguments.
+func (c *Container) Execs() [][]string {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	execs := make([][]string, len(c.execs))
+	copy(execs, c.execs)
+	return execs
+}
+
+// call records a call to the given container operation with the given
+// arguments, and returns the injected failure, if any. It must be called with
+// client.mu held.
+func (c *Container) call(op string, args ...string) error {
+	c.client.calls = append(c.client.calls, append([]string{"(" + c.name + ")." + op}, args...))
+	return c.client.failure(op, c.name)
+}
+
+// fileCall is like call, but it also returns the failure injected for the
+// operation on the file with the given path, if any. It must be called with
+// client.mu held.
+func (c *Container) fileCall(op, path string) error {
+	if err := c.call(op, path); err != nil {
+		return err
+	}
+	return c.client.errors[errorKey{op: op, name: path}]
+}
+
+// check is like call, but it also checks that the container still exists.
+// The given action is used in error messages. It must be called with
+// client.mu held.
+func (c *Container) check(op, action string, args ...string) error {
+	if err := c.call(op, args...); err != nil {
+		return errgo.Notef(err, "cannot %s container %q", action, c.name)
+	}
+	if c.deleted {
+		return errgo.Newf("cannot %s container %q: not found", action, c.name)
+	}
+	return nil
+}
+
+// checkRunning checks that the container exists and is running. It must be
+// called with client.mu held.
+func (c *Container) checkRunning() error {
+	if c.deleted {
+		return errgo.Newf("container %q not found", c.name)
+	}
+	if !c.started {
+		return errgo.Newf("container %q is not running", c.name)
+	}
+	return nil
+}
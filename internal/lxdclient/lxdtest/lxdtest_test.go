@@ -0,0 +1,226 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package lxdtest_test
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
+)
+
+var _ lxdclient.Client = (*lxdtest.Client)(nil)
+var _ lxdclient.Container = (*lxdtest.Container)(nil)
+
+func TestLifecycle(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	limits := lxdclient.Limits{CPU: "1"}
+	volumes := []lxdclient.Volume{{Pool: "default", Name: "home", Path: "/home/ubuntu"}}
+
+	// Create a container.
+	container, err := client.Create("image", "c1", limits, volumes, "default", "termserver")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(container.Name(), qt.Equals, "c1")
+	c.Assert(container.Started(), qt.Equals, false)
+	_, err = container.Addr()
+	c.Assert(err, qt.ErrorMatches, `cannot find address for "c1"`)
+	_, err = client.Create("image", "c1", limits, nil)
+	c.Assert(err, qt.ErrorMatches, `cannot create container "c1": already exists`)
+
+	fake := client.Container("c1")
+	c.Assert(fake.Image(), qt.Equals, "image")
+	c.Assert(fake.Profiles(), qt.DeepEquals, []string{"default", "termserver"})
+	c.Assert(fake.Limits(), qt.Equals, limits)
+	c.Assert(fake.Volumes(), qt.DeepEquals, volumes)
+	c.Assert(client.Volumes(), qt.DeepEquals, []string{"default/home"})
+
+	// Start the container.
+	err = container.Start()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(container.Started(), qt.Equals, true)
+	addr, err := container.Addr()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(addr, qt.Equals, "10.0.0.1")
+	err = container.Start()
+	c.Assert(err, qt.ErrorMatches, `cannot start container "c1": already running`)
+	err = client.Delete("c1")
+	c.Assert(err, qt.ErrorMatches, `cannot delete container "c1": container is running`)
+
+	// Write files and execute commands.
+	err = container.WriteFile("/home/ubuntu/file", []byte("content"))
+	c.Assert(err, qt.Equals, nil)
+	data, ok := fake.File("/home/ubuntu/file")
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(string(data), qt.Equals, "content")
+	_, ok = fake.File("/no/such/file")
+	c.Assert(ok, qt.Equals, false)
+	c.Assert(fake.Files(), qt.DeepEquals, []string{"/home/ubuntu/file"})
+	data, err = container.ReadFile("/home/ubuntu/file")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Equals, "content")
+	_, err = container.ReadFile("/no/such/file")
+	c.Assert(err, qt.ErrorMatches, `cannot read file "/no/such/file" in the container: not found`)
+	out, err := container.Exec("ls", "-l")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(out, qt.Equals, "")
+	c.Assert(fake.Execs(), qt.DeepEquals, [][]string{{"ls", "-l"}})
+
+	// Set config.
+	err = container.SetConfig("user.key", "value")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(container.Config("user.key"), qt.Equals, "value")
+
+	// Stop, rename and delete the container.
+	err = container.Stop()
+	c.Assert(err, qt.Equals, nil)
+	err = container.Stop()
+	c.Assert(err, qt.ErrorMatches, `cannot stop container "c1": already stopped`)
+	_, err = container.Exec("ls")
+	c.Assert(err, qt.ErrorMatches, `cannot execute command "ls" on "c1": container "c1" is not running`)
+	err = client.Rename("c1", "c2")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(container.Name(), qt.Equals, "c2")
+	_, err = client.Get("c1")
+	c.Assert(err, qt.ErrorMatches, `cannot get container "c1": not found`)
+	err = client.Delete("c2")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(client.Container("c2"), qt.IsNil)
+	// Volumes survive the deletion of the container.
+	c.Assert(client.Volumes(), qt.DeepEquals, []string{"default/home"})
+	err = container.Start()
+	c.Assert(err, qt.ErrorMatches, `cannot start container "c2": not found`)
+
+	c.Assert(client.Calls(), qt.DeepEquals, [][]string{
+		{"Create", "image", "c1", "default", "termserver"},
+		{"(c1).Addr"},
+		{"Create", "image", "c1"},
+		{"(c1).Start"},
+		{"(c1).Addr"},
+		{"(c1).Start"},
+		{"Delete", "c1"},
+		{"(c1).WriteFile", "/home/ubuntu/file"},
+		{"(c1).ReadFile", "/home/ubuntu/file"},
+		{"(c1).ReadFile", "/no/such/file"},
+		{"(c1).Exec", "ls", "-l"},
+		{"(c1).SetConfig", "user.key", "value"},
+		{"(c1).Stop"},
+		{"(c1).Stop"},
+		{"(c1).Exec", "ls"},
+		{"Rename", "c1", "c2"},
+		{"Get", "c1"},
+		{"Delete", "c2"},
+		{"(c2).Start"},
+	})
+}
+
+func TestAll(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	client.AddContainer("c2", true)
+	client.AddContainer("c1", false)
+
+	cs, err := client.All()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cs, qt.HasLen, 2)
+	c.Assert(cs[0].Name(), qt.Equals, "c1")
+	c.Assert(cs[0].Started(), qt.Equals, false)
+	c.Assert(cs[1].Name(), qt.Equals, "c2")
+	c.Assert(cs[1].Started(), qt.Equals, true)
+	c.Assert(func() { client.AddContainer("c1", true) }, qt.PanicMatches, `container "c1" already exists`)
+}
+
+func TestImageFingerprint(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+
+	// Unknown aliases are reported as errors.
+	_, err := client.ImageFingerprint("termserver")
+	c.Assert(err, qt.ErrorMatches, `cannot get image alias "termserver": not found`)
+
+	// Containers created from an alias record the image fingerprint.
+	client.SetImage("termserver", "abc")
+	fingerprint, err := client.ImageFingerprint("termserver")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(fingerprint, qt.Equals, "abc")
+	container, err := client.Create("termserver", "c1", lxdclient.Limits{}, nil)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(container.Config("volatile.base_image"), qt.Equals, "abc")
+
+	// Aliases can be updated.
+	client.SetImage("termserver", "def")
+	fingerprint, err = client.ImageFingerprint("termserver")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(fingerprint, qt.Equals, "def")
+	c.Assert(container.Config("volatile.base_image"), qt.Equals, "abc")
+}
+
+func TestSetError(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	c1 := client.AddContainer("c1", false)
+	c2 := client.AddContainer("c2", false)
+
+	// Errors can be injected for specific containers.
+	client.SetError("Start", "c1", errors.New("bad wolf"))
+	err := c1.Start()
+	c.Assert(err, qt.ErrorMatches, `cannot start container "c1": bad wolf`)
+	c.Assert(c1.Started(), qt.Equals, false)
+	err = c2.Start()
+	c.Assert(err, qt.Equals, nil)
+
+	// Errors can be injected for all containers.
+	client.SetError("All", "", errors.New("bad wolf"))
+	_, err = client.All()
+	c.Assert(err, qt.ErrorMatches, `cannot get containers: bad wolf`)
+	client.SetError("Get", "", errors.New("bad wolf"))
+	_, err = client.Get("c2")
+	c.Assert(err, qt.ErrorMatches, `cannot get container "c2": bad wolf`)
+
+	// Errors can be injected for specific files.
+	client.SetError("WriteFile", "/etc/hosts", errors.New("bad wolf"))
+	err = c2.WriteFile("/etc/hosts", []byte("127.0.0.1"))
+	c.Assert(err, qt.ErrorMatches, `cannot create file "/etc/hosts" in the container: bad wolf`)
+	err = c2.WriteFile("/etc/hostname", []byte("c2"))
+	c.Assert(err, qt.Equals, nil)
+
+	// Errors can be removed.
+	client.SetError("Start", "c1", nil)
+	err = c1.Start()
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestSetExec(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	container := client.AddContainer("c1", true)
+	client.SetExec(func(name string, command string, args ...string) (string, error) {
+		if command == "fail" {
+			return "", errors.New("bad wolf")
+		}
+		return name + ": " + command, nil
+	})
+
+	out, err := container.Exec("echo", "hello")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(out, qt.Equals, "c1: echo")
+	_, err = container.Exec("fail")
+	c.Assert(err, qt.ErrorMatches, "bad wolf")
+	c.Assert(container.Execs(), qt.DeepEquals, [][]string{{"echo", "hello"}, {"fail"}})
+}
+
+func TestWaitFor(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	go client.AddContainer("c1", true)
+
+	err := lxdtest.WaitFor(func() bool {
+		return client.Container("c1") != nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(client.Container("c1").Started(), qt.Equals, true)
+}
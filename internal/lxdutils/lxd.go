@@ -6,6 +6,7 @@ package lxdutils
 import (
 	"crypto/sha1"
 	"fmt"
+	"path"
 	"path/filepath"
 	"strings"
 	"unicode"
@@ -14,9 +15,11 @@ import (
 	"golang.org/x/sync/singleflight"
 	"gopkg.in/errgo.v1"
 
+	"github.com/juju/jujushell/internal/audit"
 	"github.com/juju/jujushell/internal/juju"
 	"github.com/juju/jujushell/internal/logging"
 	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/pool"
 )
 
 // jujuDataDir holds the directory used by Juju for its data.
@@ -33,13 +36,68 @@ func Connect(socketPath string) (lxdclient.Client, error) {
 	return client, nil
 }
 
-// Ensure ensures that an LXD is available for the given user, and returns its
-// name and address. If the container is not available, one is created using
-// the given image, which is assumed to have Juju already installed.
-func Ensure(client lxdclient.Client, image string, profiles []string, info *juju.Info, creds *juju.Credentials) (cname, caddr string, err error) {
-	name := containerName(info.User)
+// Pool describes a pool of pre-warmed containers.
+type Pool interface {
+	// Claim assigns a container from the pool to the given user. A nil
+	// container is returned if the pool is empty.
+	Claim(user string) (lxdclient.Container, error)
+}
+
+// Ensure ensures that an LXD is available for the user, and returns its name
+// and address. The given controllers are the ones the user is authenticated
+// against: the first one is the current controller, which also identifies the
+// user. The container is prepared so that the user is logged into all of
+// them. If the container is not available, one is claimed from the given pool
+// if possible, or otherwise created using the given image, which is assumed to
+// have Juju already installed, and the given resource limits. Containers
+// claimed from the pool keep their name, which is therefore not necessarily
+// the one returned by ContainerName: see UserContainer. If the given
+// home pool is not empty, a persistent per-user storage volume in that LXD
+// storage pool is attached to new containers and mounted in the user's home
+// directory as "persistent", so that files stored there survive the deletion
+// of the container. The rest of the home directory, including the Juju data
+// directory, comes from the image. The pool can be nil. If the container is
+// stopped and it was created from an image other than the one the image alias
+// currently points to, it is replaced with a new one, so that users get
+// updated images. In that case, the given preserved files, with paths
+// relative to the home directory, are copied from the old container to the
+// new one. The old
+// container is renamed aside while the new one is created, and it is only
+// deleted once the new container is ready: if anything goes wrong, the old
+// container is restored. The given flavour, if not empty, is recorded in new
+// containers. When a flavour is requested and the existing container was
+// created with a different one, the container is replaced in the same way if
+// it is stopped, while an error is returned if it is running.
+// Before creating or starting a container, the given admit function, if not
+// nil, is called so that the start can be delayed or refused, for instance
+// when too many containers are running: see Queue.Admit. If anything goes
+// wrong, containers created by this call are deleted, while existing ones
+// started by this call are stopped. Container creation, deletion, start and
+// stop are audited.
+func Ensure(client lxdclient.Client, pool Pool, image string, profiles []string, limits lxdclient.Limits, flavour, homePool string, preserved []string, admit func() (release func(), err error), infos []*juju.Info, creds *juju.Credentials) (cname, caddr string, err error) {
+	user := infos[0].User
+	name := ContainerName(user)
+	// created and started record whether the container has been respectively
+	// created or claimed, and started, by this call.
+	var created, started bool
+	// aside holds the name the outdated container has been renamed to while
+	// it is being replaced, if any, and reason holds why it is replaced.
+	var aside, reason string
+	defer func() {
+		if err == nil || aside == "" {
+			return
+		}
+		// This runs after the cleanup below, so that the new container, if
+		// any, has already been removed.
+		log.Debugw("cleaning up: restoring outdated container", "container", name)
+		if cleanupErr := client.Rename(aside, name); cleanupErr != nil {
+			log.Errorw("cannot restore outdated container", "container", name, "outdated", aside, "err", cleanupErr)
+		}
+	}()
 	defer func() {
-		if err == nil {
+		if err == nil || (!created && !started) {
+			// Existing containers are preserved, for instance when the start
+			// is not admitted or when it fails.
 			return
 		}
 		log.Debugw("cleaning up due to error", "original error", err.Error())
@@ -59,12 +117,32 @@ func Ensure(client lxdclient.Client, image string, profiles []string, info *juju
 			log.Debugw("cleaning up: stopping container", "container", name)
 			if cleanupErr = c.Stop(); cleanupErr != nil {
 				log.Debugw("cleaning up: cannot stop the container", "container", name, "error", cleanupErr.Error())
+				return
 			}
+			audit.Log(audit.Event{
+				Type:      audit.ContainerStop,
+				User:      user,
+				Container: name,
+				Reason:    "error",
+				Error:     err.Error(),
+			})
+		}
+		if !created {
+			// Only stop containers which were already present.
+			return
 		}
 		log.Debugw("cleaning up: deleting container", "container", name)
 		if cleanupErr = client.Delete(name); cleanupErr != nil {
 			log.Debugw("cleaning up: cannot delete the container", "container", name, "error", cleanupErr.Error())
+			return
 		}
+		audit.Log(audit.Event{
+			Type:      audit.ContainerDelete,
+			User:      user,
+			Container: name,
+			Reason:    "error",
+			Error:     err.Error(),
+		})
 	}()
 
 	container, err, _ := group.Do(name, func() (interface{}, error) {
@@ -74,33 +152,126 @@ func Ensure(client lxdclient.Client, image string, profiles []string, info *juju
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
-		var c lxdclient.Container
-		for _, container := range cs {
-			// If container exists, check if it's started.
-			if container.Name() == name {
-				c = container
+		c := findContainer(cs, user)
+		// Check whether a different flavour has been requested: running
+		// containers must be stopped before changing flavour.
+		changed := flavour != "" && c != nil && c.Config(flavourKey) != flavour
+		if changed && c.Started() {
+			return nil, errgo.Newf("container %q is running with a different flavour: stop it before choosing flavour %q", c.Name(), flavour)
+		}
+		// Check whether the container is stopped and outdated, in which case
+		// it is recreated.
+		var fingerprint string
+		if c == nil || !c.Started() {
+			fingerprint = imageFingerprint(client, image)
+		}
+		stale := c != nil && !c.Started() && (changed || fingerprint != "" && outdated(c, fingerprint))
+		// Claim a container from the pool if available. The claimed container
+		// keeps its name, so the fallback below can still create a container
+		// with the user container name if anything goes wrong.
+		if c == nil && pool != nil {
+			log.Debugw("claiming container", "user", user)
+			c, err = pool.Claim(user)
+			if err != nil {
+				// Fall back to creating a new container.
+				log.Infow("cannot claim container from the pool", "user", user, "err", err)
+				c = nil
+			}
+			if c != nil {
+				created = true
+				audit.Log(audit.Event{
+					Type:      audit.ContainerCreate,
+					User:      user,
+					Container: c.Name(),
+					Reason:    "pool",
+				})
+			}
+		}
+		// Wait for the container start to be admitted if required. Containers
+		// claimed from the pool are already running, and are already counted
+		// as running containers while in the pool.
+		if admit != nil && (c == nil || !c.Started()) {
+			log.Debugw("waiting for the container start to be admitted", "container", name)
+			release, err := admit()
+			if err != nil {
+				return nil, errgo.WithCausef(err, errNotAdmitted, "")
+			}
+			defer release()
+		}
+		// Move the outdated container aside, preserving user files.
+		var files []file
+		if stale {
+			files = readFiles(c, preserved)
+			log.Infow("replacing outdated container", "container", name, "image", image, "flavour", flavour)
+			if err := client.Rename(c.Name(), outdatedName(name)); err != nil {
+				if changed {
+					return nil, errgo.Notef(err, "cannot replace container %q with flavour %q", name, flavour)
+				}
+				// Just keep using the outdated container.
+				log.Infow("cannot rename outdated container", "container", name, "err", err)
+				files = nil
+			} else {
+				aside = outdatedName(name)
+				c, reason = nil, "image"
+				if changed {
+					reason = "flavour"
+				}
 			}
 		}
 		// Create and start the container if required.
 		if c == nil {
-			log.Debugw("creating container", "container", name, "image", image)
-			c, err = client.Create(image, name, profiles...)
+			var volumes []lxdclient.Volume
+			if homePool != "" {
+				volumes = []lxdclient.Volume{{
+					Pool: homePool,
+					Name: homeVolumeName(user),
+					Path: homeVolumePath,
+				}}
+			}
+			log.Debugw("creating container", "container", name, "image", image, "limits", limits, "volumes", volumes)
+			c, err = client.Create(image, name, limits, volumes, profiles...)
 			if err != nil {
 				return nil, errgo.Mask(err)
 			}
+			created = true
+			audit.Log(audit.Event{
+				Type:      audit.ContainerCreate,
+				User:      user,
+				Container: name,
+				Reason:    reason,
+			})
+			if fingerprint != "" {
+				if err := c.SetConfig(imageKey, fingerprint); err != nil {
+					log.Infow("cannot record container image", "container", name, "err", err)
+				}
+			}
+			if flavour != "" {
+				if err := c.SetConfig(flavourKey, flavour); err != nil {
+					log.Infow("cannot record container flavour", "container", name, "err", err)
+				}
+			}
 		}
 		if !c.Started() {
 			log.Debugw("starting container", "container", name)
 			if err = c.Start(); err != nil {
 				return nil, errgo.Mask(err)
 			}
+			started = true
+			audit.Log(audit.Event{
+				Type:      audit.ContainerStart,
+				User:      user,
+				Container: name,
+			})
 		}
+		writeFiles(c, files)
 		return c, nil
 	})
 	if err != nil {
-		return "", "", errgo.Mask(err)
+		return "", "", errgo.Mask(err, errgo.Is(errNotAdmitted))
 	}
 	c := container.(lxdclient.Container)
+	// Containers claimed from the pool keep their name.
+	name = c.Name()
 
 	// Retrieve the container address.
 	log.Debugw("retreiving container address", "container", name)
@@ -113,15 +284,145 @@ func Ensure(client lxdclient.Client, image string, profiles []string, info *juju
 	// every time, even if the container was already existing, in order, for
 	// instance, to update credentials.
 	log.Debugw("preparing container", "container", name, "address", addr)
-	if err = prepare(c, info, creds); err != nil {
+	if homePool != "" {
+		if err = setupHome(c); err != nil {
+			return "", "", errgo.Mask(err)
+		}
+	}
+	if err = prepare(c, infos, creds); err != nil {
 		return "", "", errgo.Mask(err)
 	}
+	if aside != "" {
+		// The new container is ready: the outdated one can be deleted.
+		log.Infow("deleting outdated container", "container", name, "outdated", aside)
+		if err := client.Delete(aside); err != nil {
+			log.Errorw("cannot delete outdated container", "container", name, "outdated", aside, "err", err)
+		} else {
+			audit.Log(audit.Event{
+				Type:      audit.ContainerDelete,
+				User:      user,
+				Container: name,
+				Reason:    reason,
+			})
+		}
+	}
 	return name, addr, nil
 }
 
+// UserContainer returns the name of the container of the given user, which is
+// the container claimed from the pool for the user if any, or the one named
+// after the user otherwise, whether it exists or not.
+func UserContainer(client lxdclient.Client, user string) (string, error) {
+	cs, err := client.All()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if c := findContainer(cs, user); c != nil {
+		return c.Name(), nil
+	}
+	return ContainerName(user), nil
+}
+
+// findContainer returns the container of the given user among the given
+// containers, or nil if the user does not have a container.
+func findContainer(cs []lxdclient.Container, user string) lxdclient.Container {
+	name := ContainerName(user)
+	for _, c := range cs {
+		if c.Name() == name || strings.HasPrefix(c.Name(), pool.Prefix) && c.Config(pool.UserKey) == user {
+			return c
+		}
+	}
+	return nil
+}
+
+// outdatedName returns the name given to the container with the given name
+// while it is replaced, for instance because it was created from an outdated
+// image.
+func outdatedName(name string) string {
+	return outdatedPrefix + strings.TrimPrefix(name, ContainerPrefix)
+}
+
+// errNotAdmitted is the cause of errors returned by Ensure when the container
+// start is not admitted.
+var errNotAdmitted = errgo.New("container start not admitted")
+
+// imageFingerprint returns the fingerprint of the image the given image alias
+// points to, or an empty string if the fingerprint cannot be retrieved.
+func imageFingerprint(client lxdclient.Client, image string) string {
+	fingerprint, err := client.ImageFingerprint(image)
+	if err != nil {
+		log.Infow("cannot retrieve image fingerprint", "image", image, "err", err)
+		return ""
+	}
+	return fingerprint
+}
+
+// outdated reports whether the given container was created from an image
+// other than the one with the given fingerprint. Containers created before the
+// image was recorded by jujushell are checked using the base image recorded by
+// LXD.
+func outdated(c lxdclient.Container, fingerprint string) bool {
+	current := c.Config(imageKey)
+	if current == "" {
+		current = c.Config("volatile.base_image")
+	}
+	return current != "" && current != fingerprint
+}
+
+// file holds a file preserved when recreating a container.
+type file struct {
+	path string
+	data []byte
+}
+
+// readFiles reads the given files, with paths relative to the home directory,
+// from the given container. Files that cannot be read, for instance because
+// they do not exist, are skipped.
+func readFiles(c lxdclient.Container, paths []string) []file {
+	files := make([]file, 0, len(paths))
+	for _, p := range paths {
+		p = path.Join(homeDir, p)
+		data, err := c.ReadFile(p)
+		if err != nil {
+			log.Debugw("cannot read preserved file", "container", c.Name(), "path", p, "err", err)
+			continue
+		}
+		files = append(files, file{path: p, data: data})
+	}
+	return files
+}
+
+// writeFiles writes the given preserved files in the given container. Errors
+// are logged, as there is nothing else we can do at this point.
+func writeFiles(c lxdclient.Container, files []file) {
+	for _, f := range files {
+		log.Debugw("restoring preserved file", "container", c.Name(), "path", f.path)
+		if err := c.WriteFile(f.path, f.data); err != nil {
+			log.Errorw("cannot restore preserved file", "container", c.Name(), "path", f.path, "err", err)
+		}
+	}
+}
+
+// setupHome makes the persistent home volume, if mounted in the given
+// container, owned by the ubuntu user. The volume only holds user files:
+// files provided by the image, like the shell configuration, are not
+// persisted, so that they are updated when the container is recreated.
+func setupHome(c lxdclient.Container) error {
+	log.Debugw("setting up the home directory", "container", c.Name())
+	script := fmt.Sprintf("if mountpoint -q %[1]s; then chown ubuntu:ubuntu %[1]s; fi", homeVolumePath)
+	if _, err := c.Exec("sh", "-c", script); err != nil {
+		return errgo.Notef(err, "cannot set up the home directory in container %q", c.Name())
+	}
+	return nil
+}
+
 // prepare sets up dynamic container contents, like the Juju data directory
 // which is user specific.
-func prepare(c lxdclient.Container, info *juju.Info, creds *juju.Credentials) error {
+func prepare(c lxdclient.Container, infos []*juju.Info, creds *juju.Credentials) error {
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.ControllerName
+	}
 	if len(creds.Macaroons) != 0 {
 		// Save authentication cookies in the container.
 		jar, err := cookiejar.New(&cookiejar.Options{
@@ -135,13 +436,15 @@ func prepare(c lxdclient.Container, info *juju.Info, creds *juju.Credentials) er
 		}
 		log.Debugw("writing macaroons to cookie jar", "container", c.Name())
 		data, _ := jar.MarshalJSON() // MarshalJSON never fails.
-		path := filepath.Join(jujuDataDir, "cookies", info.ControllerName+".json")
-		if err = c.WriteFile(path, data); err != nil {
-			return errgo.Notef(err, "cannot create cookie file in container %q", c.Name())
+		for _, name := range names {
+			path := filepath.Join(jujuDataDir, "cookies", name+".json")
+			if err = c.WriteFile(path, data); err != nil {
+				return errgo.Notef(err, "cannot create cookie file in container %q", c.Name())
+			}
 		}
 	} else {
 		// Prepare and save the accounts.yaml file in the container.
-		data, err := juju.MarshalAccounts(info.ControllerName, creds.Username, creds.Password)
+		data, err := juju.MarshalAccounts(names, creds.Username, creds.Password)
 		if err != nil {
 			return errgo.Notef(err, "cannot marshal Juju accounts")
 		}
@@ -153,7 +456,7 @@ func prepare(c lxdclient.Container, info *juju.Info, creds *juju.Credentials) er
 	}
 
 	// Prepare and save the controllers.yaml file in the container.
-	data, err := juju.MarshalControllers(info)
+	data, err := juju.MarshalControllers(infos)
 	if err != nil {
 		return errgo.Notef(err, "cannot marshal Juju credentials")
 	}
@@ -163,17 +466,20 @@ func prepare(c lxdclient.Container, info *juju.Info, creds *juju.Credentials) er
 		return errgo.Notef(err, "cannot create controllers file in container %q", c.Name())
 	}
 
-	// Run "juju login" in the container.
-	log.Debugw("logging into Juju", "container", c.Name())
-	output, err := c.Exec("su", "-", "ubuntu", "-c", "juju login -c "+info.ControllerName)
-	if err != nil {
-		return errgo.Notef(err, "cannot log into Juju in container %q", c.Name())
+	// Run "juju login" in the container. As logging in switches to the given
+	// controller, the current controller is the last one to be logged into.
+	for i := len(names) - 1; i >= 0; i-- {
+		log.Debugw("logging into Juju", "container", c.Name(), "controller", names[i])
+		output, err := c.Exec("su", "-", "ubuntu", "-c", "juju login -c "+names[i])
+		if err != nil {
+			return errgo.Notef(err, "cannot log into Juju controller %q in container %q", names[i], c.Name())
+		}
+		log.Debugw("successfully logged into Juju", "container", c.Name(), "controller", names[i], "output", output)
 	}
-	log.Debugw("successfully logged into Juju", "container", c.Name(), "output", output)
 
 	// Initialize the shell session, including SSH keys.
 	log.Debugw("initializing the shell session", "container", c.Name())
-	output, err = c.Exec("su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1")
+	output, err := c.Exec("su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1")
 	if err != nil {
 		return errgo.Notef(err, "cannot initialize the shell session in container %q", c.Name())
 	}
@@ -182,11 +488,10 @@ func prepare(c lxdclient.Container, info *juju.Info, creds *juju.Credentials) er
 	return nil
 }
 
-// containerName generates a container name for the given user name.
+// ContainerName generates a container name for the given user name.
 // The container name is unique for every user, so that stealing access is
 // never possible.
-func containerName(username string) string {
-	sum := sha1.Sum([]byte(username))
+func ContainerName(username string) string {
 	// Some characters cannot be included in LXD container names.
 	r := strings.NewReplacer(
 		"@", "-",
@@ -194,7 +499,7 @@ func containerName(username string) string {
 		".", "-",
 		"_", "-",
 	)
-	name := fmt.Sprintf("ts-%x-%s", sum, r.Replace(username))
+	name := fmt.Sprintf("%s%s-%s", ContainerPrefix, userHash(username), r.Replace(username))
 	// LXD containers have a limit of 63 characters for container names, which
 	// seems a bit arbitrary. Anyway, cropping it at 60 should be safe enough.
 	if len(name) > 60 {
@@ -206,5 +511,41 @@ func containerName(username string) string {
 	})
 }
 
+// homeVolumeName returns the name of the persistent home volume of the given
+// user. As for containers, the name is unique for every user.
+func homeVolumeName(username string) string {
+	return "home-" + userHash(username)
+}
+
+// userHash returns the hash identifying the given user in container and
+// volume names.
+func userHash(username string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(username)))
+}
+
+// ContainerPrefix holds the prefix used for the names of all the containers
+// created for users.
+const ContainerPrefix = "ts-"
+
+// outdatedPrefix holds the prefix used for the names of user containers while
+// they are replaced, for instance because they were created from an outdated
+// image. Using a different prefix ensures those containers are not considered
+// user containers, for instance when deleting expired ones.
+const outdatedPrefix = "to-"
+
+const (
+	// homeDir holds the home directory of the ubuntu user in containers.
+	homeDir = "/home/ubuntu"
+	// homeVolumePath holds the path where the persistent home volume is
+	// mounted in containers.
+	homeVolumePath = homeDir + "/persistent"
+	// imageKey holds the container configuration key used to record the
+	// fingerprint of the image the container was created from.
+	imageKey = "user.jujushell.image"
+	// flavourKey holds the container configuration key used to record the
+	// flavour the container was created with.
+	flavourKey = "user.jujushell.flavour"
+)
+
 // group holds the namespace used for executing tasks suppressing duplicates.
 var group = &singleflight.Group{}
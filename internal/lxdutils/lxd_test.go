@@ -4,91 +4,124 @@
 package lxdutils_test
 
 import (
+	"encoding/json"
 	"errors"
-	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
 	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/juju/jujushell/internal/audit"
 	"github.com/juju/jujushell/internal/juju"
 	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
 	"github.com/juju/jujushell/internal/lxdutils"
+	"github.com/juju/jujushell/internal/pool"
 )
 
 var ensureTests = []struct {
-	about  string
-	client *client
-	info   *juju.Info
-	creds  *juju.Credentials
+	about string
+	// setup optionally prepares the LXD client, for instance for injecting
+	// failures. The client already holds three user containers: the ones of
+	// dalek and rose are running, while the one of cyberman@external is
+	// stopped.
+	setup func(client *lxdtest.Client)
+	// fingerprint holds the fingerprint of the image, if known.
+	fingerprint string
+	// pool holds whether to claim containers from a pool, which is created
+	// after the setup function is called.
+	pool   bool
+	limits lxdclient.Limits
+	// flavour holds the requested flavour.
+	flavour string
+	// homePool holds the storage pool for home volumes.
+	homePool string
+	// preserved holds the files preserved when recreating containers.
+	preserved []string
+	// image holds the image recorded in the existing stopped container, and
+	// files holds the files in that container.
+	image string
+	files map[string]string
+	// maxContainers holds, if not zero, the maximum number of running
+	// containers enforced when admitting container starts.
+	maxContainers int
+	info          *juju.Info
+	others        []*juju.Info
+	creds         *juju.Credentials
 
-	expectedName  string
-	expectedAddr  string
-	expectedError string
+	expectedName    string
+	expectedAddr    string
+	expectedError   string
+	expectedFiles   map[string]string
+	expectedVolumes []lxdclient.Volume
+	// expectedEvents holds, if not nil, the types of the audit events
+	// logged, followed by their reasons if any.
+	expectedEvents []string
+	// expectedImage holds, if not empty, the image recorded in the container
+	// of cyberman@external after the call, even if the call fails.
+	expectedImage string
 
 	expectedCalls [][]string
 }{{
 	about: "error getting containers",
-	client: &client{
-		allError: errors.New("bad wolf"),
+	setup: func(client *lxdtest.Client) {
+		client.SetError("All", "", errors.New("bad wolf"))
 	},
-	expectedError: "bad wolf",
+	expectedError: "cannot get containers: bad wolf",
 	expectedCalls: [][]string{
-		call("All"),
-		// Cleaning up.
-		call("Get", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"),
+		{"All"},
 	},
 }, {
 	about: "error creating the container",
-	client: &client{
-		createError: errors.New("bad wolf"),
+	setup: func(client *lxdtest.Client) {
+		client.SetError("Create", "", errors.New("bad wolf"))
 	},
-	expectedError: "bad wolf",
+	expectedError: `cannot create container "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who": bad wolf`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("Create", "termserver", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who", "default", "termserver"),
-		// Cleaning up.
-		call("Get", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"),
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who", "default", "termserver"},
 	},
 }, {
 	about: "error starting the container",
-	client: &client{
-		startError: errors.New("bad wolf"),
+	setup: func(client *lxdtest.Client) {
+		client.SetError("Start", "", errors.New("bad wolf"))
 	},
-	expectedError: "bad wolf",
+	expectedError: `cannot start container "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who": bad wolf`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("Create", "termserver", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who", "default", "termserver"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Started"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Start"),
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who", "default", "termserver"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Start"},
 		// Cleaning up.
-		call("Get", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Started"),
-		call("Delete", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"),
+		{"Get", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"},
+		{"Delete", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"},
 	},
+	expectedEvents: []string{"container-create", "container-delete error"},
 }, {
 	about: "error retrieving container address",
-	client: &client{
-		addrError: errors.New("bad wolf"),
+	setup: func(client *lxdtest.Client) {
+		client.SetError("Addr", "", errors.New("bad wolf"))
 	},
-	expectedError: "bad wolf",
+	expectedError: `cannot get state for container "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who": bad wolf`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("Create", "termserver", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who", "default", "termserver"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Started"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Start"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Addr"),
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who", "default", "termserver"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Start"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Addr"},
 		// Cleaning up.
-		call("Get", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Started"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"),
-		call("(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Stop"),
-		call("Delete", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"),
+		{"Get", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Stop"},
+		{"Delete", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who"},
 	},
+	expectedEvents: []string{"container-create", "container-start", "container-stop error", "container-delete error"},
 }, {
-	about:  "error setting macaroons in the jar",
-	client: &client{},
+	about: "error setting macaroons in the jar",
 	info: &juju.Info{
 		User: "dalek",
 	},
@@ -99,20 +132,13 @@ var ensureTests = []struct {
 	},
 	expectedError: `cannot set macaroons in jar: cannot parse macaroon URL ":::": parse :::: missing protocol scheme`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"),
-		// Cleaning up.
-		call("Get", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Stop"),
-		call("Delete", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
+		{"All"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"},
 	},
 }, {
 	about: "error writing the cookie file",
-	client: &client{
-		writeFileErrors: []error{errors.New("bad wolf")},
+	setup: func(client *lxdtest.Client) {
+		client.SetError("WriteFile", "", errors.New("bad wolf"))
 	},
 	info: &juju.Info{
 		User:           "dalek",
@@ -123,23 +149,16 @@ var ensureTests = []struct {
 			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
 		},
 	},
-	expectedError: `cannot create cookie file in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": bad wolf`,
+	expectedError: `cannot create cookie file in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": cannot create file "/home/ubuntu/.local/share/juju/cookies/my-controller.json" in the container: bad wolf`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json", "macaroon cookie data"),
-		// Cleaning up.
-		call("Get", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Stop"),
-		call("Delete", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
+		{"All"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json"},
 	},
 }, {
 	about: "error writing the accounts file",
-	client: &client{
-		writeFileErrors: []error{errors.New("bad wolf")},
+	setup: func(client *lxdtest.Client) {
+		client.SetError("WriteFile", "", errors.New("bad wolf"))
 	},
 	info: &juju.Info{
 		User:           "dalek",
@@ -149,26 +168,16 @@ var ensureTests = []struct {
 		Username: "dalek@skaro",
 		Password: "exterminate",
 	},
-	expectedError: `cannot create accounts file in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": bad wolf`,
+	expectedError: `cannot create accounts file in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": cannot create file "/home/ubuntu/.local/share/juju/accounts.yaml" in the container: bad wolf`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"),
-		call(
-			"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile",
-			"/home/ubuntu/.local/share/juju/accounts.yaml",
-			"controllers:\n  my-controller:\n    user: dalek@skaro\n    password: exterminate\n"),
-		// Cleaning up.
-		call("Get", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Stop"),
-		call("Delete", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
+		{"All"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/accounts.yaml"},
 	},
 }, {
 	about: "error writing controllers.yaml",
-	client: &client{
-		writeFileErrors: []error{nil, errors.New("bad wolf")},
+	setup: func(client *lxdtest.Client) {
+		client.SetError("WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml", errors.New("bad wolf"))
 	},
 	info: &juju.Info{
 		User:           "dalek",
@@ -182,27 +191,17 @@ var ensureTests = []struct {
 			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
 		},
 	},
-	expectedError: `cannot create controllers file in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": bad wolf`,
+	expectedError: `cannot create controllers file in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": cannot create file "/home/ubuntu/.local/share/juju/controllers.yaml" in the container: bad wolf`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json", "macaroon cookie data"),
-		call(
-			"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile",
-			"/home/ubuntu/.local/share/juju/controllers.yaml",
-			"controllers:\n  my-controller:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.4]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: my-controller\n"),
-		// Cleaning up.
-		call("Get", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Stop"),
-		call("Delete", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
+		{"All"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
 	},
 }, {
 	about: "error logging into juju",
-	client: &client{
-		execErrors: []error{errors.New("bad wolf")},
+	setup: func(client *lxdtest.Client) {
+		client.SetExec(failExec("juju login", errors.New("bad wolf")))
 	},
 	info: &juju.Info{
 		User:           "dalek",
@@ -216,28 +215,18 @@ var ensureTests = []struct {
 			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
 		},
 	},
-	expectedError: `cannot log into Juju in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": bad wolf`,
-	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json", "macaroon cookie data"),
-		call(
-			"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile",
-			"/home/ubuntu/.local/share/juju/controllers.yaml",
-			"controllers:\n  my-controller:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.4]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: my-controller\n"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "juju login -c my-controller"),
-		// Cleaning up.
-		call("Get", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Stop"),
-		call("Delete", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
+	expectedError: `cannot log into Juju controller "my-controller" in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": bad wolf`,
+	expectedCalls: [][]string{
+		{"All"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "juju login -c my-controller"},
 	},
 }, {
 	about: "error initializing the shell",
-	client: &client{
-		execErrors: []error{nil, errors.New("bad wolf")},
+	setup: func(client *lxdtest.Client) {
+		client.SetExec(failExec("~/.session setup", errors.New("bad wolf")))
 	},
 	info: &juju.Info{
 		User:           "dalek",
@@ -253,26 +242,58 @@ var ensureTests = []struct {
 	},
 	expectedError: `cannot initialize the shell session in container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek": bad wolf`,
 	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json", "macaroon cookie data"),
-		call(
-			"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile",
-			"/home/ubuntu/.local/share/juju/controllers.yaml",
-			"controllers:\n  my-controller:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.4]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: my-controller\n"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "juju login -c my-controller"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"),
-		// Cleaning up.
-		call("Get", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Started"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"),
-		call("(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Stop"),
-		call("Delete", "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek"),
+		{"All"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Addr"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "juju login -c my-controller"},
+		{"(ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "error starting an existing container",
+	setup: func(client *lxdtest.Client) {
+		client.SetError("Start", "", errors.New("bad wolf"))
+	},
+	info: &juju.Info{
+		User: "cyberman@external",
+	},
+	expectedError: `cannot start container "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa": bad wolf`,
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		// The existing container is not removed.
+	},
+	expectedEvents: []string{},
+}, {
+	about: "error preparing an existing container",
+	setup: func(client *lxdtest.Client) {
+		client.SetError("WriteFile", "", errors.New("bad wolf"))
+	},
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "my-controller",
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedError: `cannot create cookie file in container "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa": cannot create file "/home/ubuntu/.local/share/juju/cookies/my-controller.json" in the container: bad wolf`,
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json"},
+		// Cleaning up: the existing container is stopped but not removed.
+		{"Get", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Stop"},
 	},
+	expectedEvents: []string{"container-start", "container-stop error"},
 }, {
-	about:  "success",
-	client: &client{},
+	about: "success",
 	info: &juju.Info{
 		User:           "rose",
 		ControllerName: "my-controller",
@@ -286,22 +307,507 @@ var ensureTests = []struct {
 		},
 	},
 	expectedName: "ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose",
-	expectedAddr: "1.2.3.6",
+	expectedAddr: "10.0.0.2",
+	expectedFiles: map[string]string{
+		"/home/ubuntu/.local/share/juju/controllers.yaml": "controllers:\n  my-controller:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.4]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: my-controller\n",
+	},
+	expectedCalls: [][]string{
+		{"All"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Addr"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Exec", "su", "-", "ubuntu", "-c", "juju login -c my-controller"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "success with multiple controllers",
+	info: &juju.Info{
+		User:           "rose",
+		ControllerName: "production",
+		ControllerUUID: "production-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.4"},
+	},
+	others: []*juju.Info{{
+		User:           "rose",
+		ControllerName: "staging",
+		ControllerUUID: "staging-uuid",
+		CACert:         "staging-certificate",
+		Endpoints:      []string{"1.2.3.5"},
+	}},
+	creds: &juju.Credentials{
+		Username: "rose",
+		Password: "bad-wolf",
+	},
+	expectedName: "ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose",
+	expectedAddr: "10.0.0.2",
+	expectedFiles: map[string]string{
+		"/home/ubuntu/.local/share/juju/accounts.yaml":    "controllers:\n  production:\n    user: rose\n    password: bad-wolf\n  staging:\n    user: rose\n    password: bad-wolf\n",
+		"/home/ubuntu/.local/share/juju/controllers.yaml": "controllers:\n  production:\n    uuid: production-uuid\n    api-endpoints: [1.2.3.4]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\n  staging:\n    uuid: staging-uuid\n    api-endpoints: [1.2.3.5]\n    ca-cert: staging-certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: production\n",
+	},
+	expectedCalls: [][]string{
+		{"All"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Addr"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).WriteFile", "/home/ubuntu/.local/share/juju/accounts.yaml"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Exec", "su", "-", "ubuntu", "-c", "juju login -c staging"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Exec", "su", "-", "ubuntu", "-c", "juju login -c production"},
+		{"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "success with container stopped and external user",
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
+	expectedAddr: "10.0.0.3",
+	expectedFiles: map[string]string{
+		"/home/ubuntu/.local/share/juju/controllers.yaml": "controllers:\n  ctrl:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.7]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: ctrl\n",
+	},
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about:         "start of existing container not admitted",
+	maxContainers: 2,
+	info: &juju.Info{
+		User: "cyberman@external",
+	},
+	expectedError: "too many running containers: limit of 2 reached, please retry later",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		// Admitting the start. The existing container is not removed.
+		{"All"},
+	},
+}, {
+	about:         "start of new container not admitted",
+	maxContainers: 2,
+	expectedError: "too many running containers: limit of 2 reached, please retry later",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		// Admitting the start.
+		{"All"},
+	},
+}, {
+	about: "start of new container not admitted with idle pool containers",
+	setup: func(client *lxdtest.Client) {
+		addPoolContainer(client, "tp-1")
+	},
+	maxContainers: 3,
+	expectedError: "too many running containers: limit of 3 reached, please retry later",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		// Admitting the start: the pool container is counted.
+		{"All"},
+	},
+}, {
+	about: "success claiming from the pool without admitting the start",
+	setup: func(client *lxdtest.Client) {
+		addPoolContainer(client, "tp-1")
+	},
+	fingerprint: "abc",
+	pool:        true,
+	// The limit is reached, but the pool container is already counted.
+	maxContainers: 3,
+	info: &juju.Info{
+		User:           "d_a+l@e.k",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "tp-1",
+	expectedAddr: "10.0.0.4",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		// Claiming the container.
+		{"Get", "tp-1"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-1).SetConfig", "user.jujushell.user", "d_a+l@e.k"},
+		{"(tp-1).Addr"},
+		{"(tp-1).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(tp-1).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(tp-1).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(tp-1).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about:         "success with container start admitted",
+	maxContainers: 3,
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
+	expectedAddr: "10.0.0.3",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		// Admitting the start.
+		{"All"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about:    "success with home volume",
+	homePool: "default",
+	info: &juju.Info{
+		User:           "who",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who",
+	expectedAddr: "10.0.0.4",
+	expectedVolumes: []lxdclient.Volume{{
+		Pool: "default",
+		Name: "home-b7adf77905f540249517ca164255899e9ad1e2ac",
+		Path: "/home/ubuntu/persistent",
+	}},
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-b7adf77905f540249517ca164255899e9ad1e2ac-who", "default", "termserver"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Start"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Addr"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Exec", "sh", "-c", "if mountpoint -q /home/ubuntu/persistent; then chown ubuntu:ubuntu /home/ubuntu/persistent; fi"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-b7adf77905f540249517ca164255899e9ad1e2ac-who).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about:       "success recreating container from an outdated image",
+	fingerprint: "new-image",
+	preserved:   []string{".bash_history", ".config/missing"},
+	image:       "old-image",
+	files: map[string]string{
+		"/home/ubuntu/.bash_history": "juju status",
+	},
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
+	expectedAddr: "10.0.0.4",
+	expectedFiles: map[string]string{
+		"/home/ubuntu/.bash_history":                      "juju status",
+		"/home/ubuntu/.local/share/juju/controllers.yaml": "controllers:\n  ctrl:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.7]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: ctrl\n",
+	},
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).ReadFile", "/home/ubuntu/.bash_history"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).ReadFile", "/home/ubuntu/.config/missing"},
+		{"Rename", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"Create", "termserver", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "default", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).SetConfig", "user.jujushell.image", "new-image"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.bash_history"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+		{"Delete", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+	},
+	expectedEvents: []string{"container-create image", "container-start", "container-delete image"},
+}, {
+	about:       "success recreating container from an outdated image with home volume",
+	fingerprint: "new-image",
+	homePool:    "default",
+	preserved:   []string{".bash_history"},
+	image:       "old-image",
+	files: map[string]string{
+		"/home/ubuntu/.bash_history": "juju status",
+	},
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
+	expectedAddr: "10.0.0.4",
+	expectedVolumes: []lxdclient.Volume{{
+		Pool: "default",
+		Name: "home-fc1565bb1f8fe145fda53955901546405e01a80b",
+		Path: "/home/ubuntu/persistent",
+	}},
+	expectedFiles: map[string]string{
+		"/home/ubuntu/.bash_history": "juju status",
+	},
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).ReadFile", "/home/ubuntu/.bash_history"},
+		{"Rename", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"Create", "termserver", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "default", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).SetConfig", "user.jujushell.image", "new-image"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.bash_history"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "sh", "-c", "if mountpoint -q /home/ubuntu/persistent; then chown ubuntu:ubuntu /home/ubuntu/persistent; fi"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+		{"Delete", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+	},
+}, {
+	about: "success keeping outdated container when renaming fails",
+	setup: func(client *lxdtest.Client) {
+		client.SetError("Rename", "", errors.New("bad wolf"))
+	},
+	fingerprint: "new-image",
+	preserved:   []string{".bash_history"},
+	image:       "old-image",
+	files: map[string]string{
+		"/home/ubuntu/.bash_history": "juju status",
+	},
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
+	expectedAddr: "10.0.0.3",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).ReadFile", "/home/ubuntu/.bash_history"},
+		{"Rename", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "error creating container replacing an outdated image",
+	setup: func(client *lxdtest.Client) {
+		client.SetError("Create", "", errors.New("bad wolf"))
+	},
+	fingerprint: "new-image",
+	preserved:   []string{".bash_history"},
+	image:       "old-image",
+	files: map[string]string{
+		"/home/ubuntu/.bash_history": "juju status",
+	},
+	info: &juju.Info{
+		User: "cyberman@external",
+	},
+	expectedError: `cannot create container "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa": bad wolf`,
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).ReadFile", "/home/ubuntu/.bash_history"},
+		{"Rename", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"Create", "termserver", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "default", "termserver"},
+		// Cleaning up: the outdated container is restored.
+		{"Rename", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+	},
+	expectedEvents: []string{},
+	expectedImage:  "old-image",
+}, {
+	about: "error preparing container replacing an outdated image",
+	setup: func(client *lxdtest.Client) {
+		client.SetError("WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json", errors.New("bad wolf"))
+	},
+	fingerprint: "new-image",
+	preserved:   []string{".bash_history"},
+	image:       "old-image",
+	files: map[string]string{
+		"/home/ubuntu/.bash_history": "juju status",
+	},
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedError: `cannot create cookie file in container "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa": cannot create file "/home/ubuntu/.local/share/juju/cookies/ctrl.json" in the container: bad wolf`,
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).ReadFile", "/home/ubuntu/.bash_history"},
+		{"Rename", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"Create", "termserver", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "default", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).SetConfig", "user.jujushell.image", "new-image"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.bash_history"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		// Cleaning up: the new container is removed and the outdated one is
+		// restored.
+		{"Get", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session teardown"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Stop"},
+		{"Delete", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"Rename", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+	},
+	expectedEvents: []string{"container-create image", "container-start", "container-stop error", "container-delete error"},
+	expectedImage:  "old-image",
+}, {
+	about:   "error requesting a different flavour for a running container",
+	flavour: "juju3",
+	info: &juju.Info{
+		User: "dalek",
+	},
+	expectedError: `container "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek" is running with a different flavour: stop it before choosing flavour "juju3"`,
+	expectedCalls: [][]string{
+		{"All"},
+	},
+}, {
+	about: "error replacing container with a different flavour",
+	setup: func(client *lxdtest.Client) {
+		client.SetError("Rename", "", errors.New("bad wolf"))
+	},
+	flavour: "juju3",
+	info: &juju.Info{
+		User: "cyberman@external",
+	},
+	expectedError: `cannot replace container "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa" with flavour "juju3": cannot rename container "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa" to "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa": bad wolf`,
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Rename", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+	},
+	expectedEvents: []string{},
+}, {
+	about:   "success recreating container with a different flavour",
+	flavour: "juju3",
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
+	expectedAddr: "10.0.0.4",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Rename", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+		{"Create", "termserver", "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", "default", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).SetConfig", "user.jujushell.flavour", "juju3"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+		{"Delete", "to-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa"},
+	},
+	expectedEvents: []string{"container-create flavour", "container-start", "container-delete flavour"},
+}, {
+	about: "success with same flavour",
+	setup: func(client *lxdtest.Client) {
+		client.Container("ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa").SetConfig("user.jujushell.flavour", "juju3")
+	},
+	flavour: "juju3",
+	info: &juju.Info{
+		User:           "cyberman@external",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
+	expectedAddr: "10.0.0.3",
 	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Started"),
-		call("(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Addr"),
-		call("(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).WriteFile", "/home/ubuntu/.local/share/juju/cookies/my-controller.json", "macaroon cookie data"),
-		call(
-			"(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).WriteFile",
-			"/home/ubuntu/.local/share/juju/controllers.yaml",
-			"controllers:\n  my-controller:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.4]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: my-controller\n"),
-		call("(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Exec", "su", "-", "ubuntu", "-c", "juju login -c my-controller"),
-		call("(ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"),
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
 	},
 }, {
-	about:  "success with container stopped and external user",
-	client: &client{},
+	about:       "success with up to date container",
+	fingerprint: "new-image",
+	preserved:   []string{".bash_history"},
+	image:       "new-image",
 	info: &juju.Info{
 		User:           "cyberman@external",
 		ControllerName: "ctrl",
@@ -315,23 +821,19 @@ var ensureTests = []struct {
 		},
 	},
 	expectedName: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
-	expectedAddr: "1.2.3.7",
+	expectedAddr: "10.0.0.3",
 	expectedCalls: [][]string{
-		call("All"),
-		call("(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Started"),
-		call("(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"),
-		call("(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"),
-		call("(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json", "macaroon cookie data"),
-		call(
-			"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile",
-			"/home/ubuntu/.local/share/juju/controllers.yaml",
-			"controllers:\n  ctrl:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.7]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: ctrl\n"),
-		call("(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"),
-		call("(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"),
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Start"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Addr"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
 	},
 }, {
-	about:  "success without machine and user with invalid characters",
-	client: &client{},
+	about: "success without machine and user with invalid characters",
 	info: &juju.Info{
 		User:           "d_a+l@e.k",
 		ControllerName: "ctrl",
@@ -345,24 +847,20 @@ var ensureTests = []struct {
 		},
 	},
 	expectedName: "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k",
-	expectedAddr: "1.2.3.4",
+	expectedAddr: "10.0.0.4",
 	expectedCalls: [][]string{
-		call("All"),
-		call("Create", "termserver", "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k", "default", "termserver"),
-		call("(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Started"),
-		call("(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Start"),
-		call("(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Addr"),
-		call("(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json", "macaroon cookie data"),
-		call(
-			"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile",
-			"/home/ubuntu/.local/share/juju/controllers.yaml",
-			"controllers:\n  ctrl:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.7]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: ctrl\n"),
-		call("(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"),
-		call("(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"),
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k", "default", "termserver"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Start"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Addr"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
 	},
 }, {
-	about:  "success without machine and user ending with hyphens",
-	client: &client{},
+	about: "success without machine and user ending with hyphens",
 	info: &juju.Info{
 		User:           "rose--!",
 		ControllerName: "ctrl",
@@ -376,20 +874,180 @@ var ensureTests = []struct {
 		},
 	},
 	expectedName: "ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose",
-	expectedAddr: "1.2.3.4",
-	expectedCalls: [][]string{
-		call("All"),
-		call("Create", "termserver", "ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose", "default", "termserver"),
-		call("(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Started"),
-		call("(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Start"),
-		call("(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Addr"),
-		call("(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json", "macaroon cookie data"),
-		call(
-			"(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).WriteFile",
-			"/home/ubuntu/.local/share/juju/controllers.yaml",
-			"controllers:\n  ctrl:\n    uuid: ctrl-uuid\n    api-endpoints: [1.2.3.7]\n    ca-cert: certificate\n    cloud: \"\"\n    controller-machine-count: 0\n    active-controller-machine-count: 0\ncurrent-controller: ctrl\n"),
-		call("(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"),
-		call("(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"),
+	expectedAddr: "10.0.0.4",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose", "default", "termserver"},
+		{"(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Start"},
+		{"(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Addr"},
+		{"(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-beea39c0e6f0984b3f7aa70a2fbf413fad16cd13-rose).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "success claiming the container from the pool",
+	setup: func(client *lxdtest.Client) {
+		addPoolContainer(client, "tp-1")
+	},
+	fingerprint: "abc",
+	pool:        true,
+	info: &juju.Info{
+		User:           "d_a+l@e.k",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "tp-1",
+	expectedAddr: "10.0.0.4",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		// Claiming the container.
+		{"Get", "tp-1"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-1).SetConfig", "user.jujushell.user", "d_a+l@e.k"},
+		{"(tp-1).Addr"},
+		{"(tp-1).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(tp-1).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(tp-1).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(tp-1).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "success with container already claimed from the pool",
+	setup: func(client *lxdtest.Client) {
+		addPoolContainer(client, "tp-1")
+		client.Container("tp-1").SetConfig("user.jujushell.user", "d_a+l@e.k")
+	},
+	pool: true,
+	info: &juju.Info{
+		User:           "d_a+l@e.k",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "tp-1",
+	expectedAddr: "10.0.0.4",
+	expectedCalls: [][]string{
+		{"All"},
+		{"(tp-1).Addr"},
+		{"(tp-1).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(tp-1).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(tp-1).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(tp-1).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "success with empty pool",
+	pool:  true,
+	info: &juju.Info{
+		User:           "d_a+l@e.k",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k",
+	expectedAddr: "10.0.0.4",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k", "default", "termserver"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Start"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Addr"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "success with resource limits",
+	limits: lxdclient.Limits{
+		CPU:    "2",
+		Memory: "2GB",
+	},
+	info: &juju.Info{
+		User:           "d_a+l@e.k",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k",
+	expectedAddr: "10.0.0.4",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k", "default", "termserver"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Start"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Addr"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
+	},
+}, {
+	about: "success with error claiming from the pool",
+	setup: func(client *lxdtest.Client) {
+		addPoolContainer(client, "tp-1")
+		client.SetError("SetConfig", "tp-1", errors.New("bad wolf"))
+	},
+	fingerprint: "abc",
+	pool:        true,
+	info: &juju.Info{
+		User:           "d_a+l@e.k",
+		ControllerName: "ctrl",
+		ControllerUUID: "ctrl-uuid",
+		CACert:         "certificate",
+		Endpoints:      []string{"1.2.3.7"},
+	},
+	creds: &juju.Credentials{
+		Macaroons: map[string]macaroon.Slice{
+			"https://1.2.3.4/identity": macaroon.Slice{mustNewMacaroon("m1")},
+		},
+	},
+	expectedName: "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k",
+	expectedAddr: "10.0.0.5",
+	expectedCalls: [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		// Claiming the container.
+		{"Get", "tp-1"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-1).SetConfig", "user.jujushell.user", "d_a+l@e.k"},
+		{"(tp-1).Stop"},
+		{"Delete", "tp-1"},
+		// Falling back to creating the container.
+		{"Create", "termserver", "ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k", "default", "termserver"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).SetConfig", "user.jujushell.image", "abc"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Start"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Addr"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/cookies/ctrl.json"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).WriteFile", "/home/ubuntu/.local/share/juju/controllers.yaml"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "juju login -c ctrl"},
+		{"(ts-3c91974643169203624b07aa9d35afb0564d6103-d-a-l-e-k).Exec", "su", "-", "ubuntu", "-c", "~/.session setup >> .session.log 2>&1"},
 	},
 }}
 
@@ -402,175 +1060,130 @@ func TestEnsure(t *testing.T) {
 					User: "who",
 				}
 			}
-			test.client.allResult = []*container{{
-				name:    "ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek",
-				addr:    "1.2.3.5",
-				started: true,
-			}, {
-				name:    "ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose",
-				addr:    "1.2.3.6",
-				started: true,
-			}, {
-				name: "ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa",
-				addr: "1.2.3.7",
-			}}
-			name, addr, err := lxdutils.Ensure(test.client, "termserver", []string{"default", "termserver"}, test.info, test.creds)
+			client := lxdtest.New()
+			client.AddContainer("ts-2f8dfb546853a3f551884e57e458533dfa5ad928-dalek", true)
+			client.AddContainer("ts-7b7074fca36fc89fb3f1e3c46d74f6ffe2477a09-rose", true)
+			// Start the stopped container once, so that files can be written
+			// and an address is assigned.
+			stopped := client.AddContainer("ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa", true)
+			for path, data := range test.files {
+				err := stopped.WriteFile(path, []byte(data))
+				c.Assert(err, qt.Equals, nil)
+			}
+			if test.image != "" {
+				err := stopped.SetConfig("user.jujushell.image", test.image)
+				c.Assert(err, qt.Equals, nil)
+			}
+			err := stopped.Stop()
+			c.Assert(err, qt.Equals, nil)
+			if test.fingerprint != "" {
+				client.SetImage("termserver", test.fingerprint)
+			}
+			if test.setup != nil {
+				test.setup(client)
+			}
+			var p lxdutils.Pool
+			if test.pool {
+				// Use a zero size so that the pool is not refilled.
+				p, err = pool.New(client, "termserver", []string{"default", "termserver"}, lxdclient.Limits{}, 0)
+				c.Assert(err, qt.Equals, nil)
+			}
+			q := lxdutils.NewQueue()
+			var admit func() (func(), error)
+			if test.maxContainers != 0 {
+				admit = func() (func(), error) {
+					return q.Admit(client, test.maxContainers, 0, func(int) error {
+						return nil
+					})
+				}
+			}
+			client.ResetCalls()
+			auditPath := filepath.Join(c.Mkdir(), "audit.log")
+			err = audit.Open(auditPath)
+			c.Assert(err, qt.Equals, nil)
+			defer audit.Close()
+
+			name, addr, err := lxdutils.Ensure(client, p, "termserver", []string{"default", "termserver"}, test.limits, test.flavour, test.homePool, test.preserved, admit, append([]*juju.Info{test.info}, test.others...), test.creds)
+			c.Assert(client.Calls(), qt.DeepEquals, test.expectedCalls)
+			if test.expectedEvents != nil {
+				c.Assert(auditEvents(c, auditPath), qt.DeepEquals, test.expectedEvents)
+			}
+			if test.expectedImage != "" {
+				container := client.Container("ts-fc1565bb1f8fe145fda53955901546405e01a80b-cyberman-externa")
+				c.Assert(container, qt.Not(qt.IsNil))
+				c.Assert(container.Config("user.jujushell.image"), qt.Equals, test.expectedImage)
+			}
 			if test.expectedError != "" {
 				c.Assert(err, qt.ErrorMatches, test.expectedError)
 				c.Assert(name, qt.Equals, "")
 				c.Assert(addr, qt.Equals, "")
-			} else {
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(name, qt.Equals, test.expectedName)
+			c.Assert(addr, qt.Equals, test.expectedAddr)
+			container := client.Container(name)
+			c.Assert(container.Started(), qt.Equals, true)
+			c.Assert(container.Limits(), qt.Equals, test.limits)
+			c.Assert(container.Volumes(), qt.DeepEquals, test.expectedVolumes)
+			for path, expectedData := range test.expectedFiles {
+				data, ok := container.File(path)
+				c.Assert(ok, qt.Equals, true, qt.Commentf("file %s", path))
+				c.Assert(string(data), qt.Equals, expectedData)
+			}
+			if test.maxContainers != 0 {
+				// The admitted start has been released: only the containers
+				// actually running are counted.
+				release, err := q.Admit(client, test.maxContainers+1, 0, func(int) error {
+					return nil
+				})
 				c.Assert(err, qt.Equals, nil)
-				c.Assert(name, qt.Equals, test.expectedName)
-				c.Assert(addr, qt.Equals, test.expectedAddr)
+				release()
 			}
-			c.Assert(test.client.calls, qt.DeepEquals, test.expectedCalls)
 		})
 	}
 }
 
-// client implements lxdclient.Client for testing purposes.
-type client struct {
-	lxdclient.Client
-
-	allResult []*container
-	allError  error
-
-	createError error
-	startError  error
-	stopError   error
-	addrError   error
-
-	writeFileErrors []error
-
-	execOutput string
-	execErrors []error
-
-	calls [][]string
-}
-
-func (cl *client) register(name string, args ...string) {
-	cl.calls = append(cl.calls, call(name, args...))
-}
-
-func (cl *client) All() ([]lxdclient.Container, error) {
-	cl.register("All")
-	result := make([]lxdclient.Container, len(cl.allResult))
-	for i, container := range cl.allResult {
-		container.client = cl
-		result[i] = container
-	}
-	return result, cl.allError
-}
-
-func (cl *client) Get(name string) (lxdclient.Container, error) {
-	cl.register("Get", name)
-	for _, container := range cl.allResult {
-		if container.name == name {
-			container.client = cl
-			return container, nil
+// auditEvents returns the types of the events in the audit log at the given
+// path, followed by their reasons if any.
+func auditEvents(c *qt.C, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	events := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
 		}
+		var e audit.Event
+		err := json.Unmarshal([]byte(line), &e)
+		c.Assert(err, qt.Equals, nil)
+		event := e.Type
+		if e.Reason != "" {
+			event += " " + e.Reason
+		}
+		events = append(events, event)
 	}
-	return nil, errors.New("not found")
-}
-
-func (cl *client) Create(image, name string, profiles ...string) (lxdclient.Container, error) {
-	args := append([]string{image, name}, profiles...)
-	cl.register("Create", args...)
-	if cl.createError != nil {
-		return nil, cl.createError
-	}
-	c := &container{
-		client:  cl,
-		name:    name,
-		addr:    "1.2.3.4",
-		started: false,
-	}
-	cl.allResult = append(cl.allResult, c)
-	return c, nil
-}
-
-func (cl *client) Delete(name string) error {
-	cl.register("Delete", name)
-	return nil
-}
-
-// container implements lxdclient.Container for testing purposes.
-type container struct {
-	lxdclient.Container
-
-	client *client
-
-	name    string
-	addr    string
-	started bool
-}
-
-func (c *container) register(name string, args ...string) {
-	name = fmt.Sprintf("(%s).%s", c.name, name)
-	c.client.register(name, args...)
-}
-
-func (c *container) Name() string {
-	return c.name
-}
-
-func (c *container) Addr() (string, error) {
-	c.register("Addr")
-	if c.client.addrError != nil {
-		return "", c.client.addrError
-	}
-	return c.addr, nil
-}
-
-func (c *container) Started() bool {
-	c.register("Started")
-	return c.started
-}
-
-func (c *container) Start() error {
-	c.register("Start")
-	if c.client.startError != nil {
-		return c.client.startError
-	}
-	c.started = true
-	return nil
+	return events
 }
 
-func (c *container) Stop() error {
-	c.register("Stop")
-	if c.client.stopError != nil {
-		return c.client.stopError
-	}
-	c.started = false
-	return nil
+// addPoolContainer adds a running pool container with the given name to the
+// given client, as created by a pool using the "termserver" image alias, with
+// fingerprint "abc", and the default and termserver profiles.
+func addPoolContainer(client *lxdtest.Client, name string) {
+	c := client.AddContainer(name, true)
+	c.SetConfig("user.jujushell.image", "abc")
+	c.SetConfig("user.jujushell.pool-spec", "profiles=default,termserver cpu= memory= processes=0 disk=")
 }
 
-func (c *container) WriteFile(path string, data []byte) (err error) {
-	content := string(data)
-	if strings.Contains(path, "/cookies/") {
-		content = "macaroon cookie data"
-	}
-	c.register("WriteFile", path, content)
-	if len(c.client.writeFileErrors) > 0 {
-		err = c.client.writeFileErrors[0]
-		c.client.writeFileErrors = c.client.writeFileErrors[1:]
-	}
-	return err
-}
-
-func (c *container) Exec(command string, args ...string) (output string, err error) {
-	cmd := append([]string{command}, args...)
-	c.register("Exec", cmd...)
-	if len(c.client.execErrors) > 0 {
-		err = c.client.execErrors[0]
-		c.client.execErrors = c.client.execErrors[1:]
+// failExec returns a function for scripting command executions in which
+// commands including the given string fail with the given error.
+func failExec(command string, err error) lxdtest.ExecFunc {
+	return func(container string, cmd string, args ...string) (string, error) {
+		if strings.Contains(strings.Join(append([]string{cmd}, args...), " "), command) {
+			return "", err
+		}
+		return "", nil
 	}
-	return c.client.execOutput, err
-}
-
-func call(name string, args ...string) []string {
-	return append([]string{name}, args...)
 }
 
 func mustNewMacaroon(root string) *macaroon.Macaroon {
@@ -0,0 +1,163 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package lxdutils
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/pool"
+)
+
+// NewQueue creates and returns a new admission queue for container starts.
+func NewQueue() *Queue {
+	return &Queue{
+		changed: make(chan struct{}),
+	}
+}
+
+// Queue admits container starts in order of arrival, so that the number of
+// running user containers never exceeds a maximum. The maximum and the size
+// of the queue are provided on each call, so that they can be changed at any
+// time.
+type Queue struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// next holds the identifier assigned to the next request.
+	next int
+	// waiting holds the identifiers of the requests waiting to be admitted,
+	// in order.
+	waiting []int
+	// starting holds the number of admitted containers not yet started.
+	starting int
+	// changed is closed, and then replaced, every time a request leaves the
+	// queue or a start completes.
+	changed chan struct{}
+}
+
+// Admit waits until a new container can be started without exceeding the
+// given maximum number of running user containers, as reported by the given
+// client. A non-positive maximum means no limit. If the maximum is reached,
+// the request is queued, and the given notify function is called with the
+// request position in the queue, starting from 1, when the position changes
+// and periodically while waiting. If notify returns an error, for instance
+// because the client disconnected, the request leaves the queue and the error
+// is returned. Requests are refused if more than the given size of requests
+// would be waiting. The returned release function must be called when the
+// container is started, or when the start failed.
+func (q *Queue) Admit(client lxdclient.Client, max, size int, notify func(position int) error) (release func(), err error) {
+	if max <= 0 {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	req := q.next
+	q.next++
+	q.waiting = append(q.waiting, req)
+	q.mu.Unlock()
+	lastPosition := 0
+	for {
+		q.mu.Lock()
+		position, err := q.position(req)
+		changed := q.changed
+		q.mu.Unlock()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if position == 1 {
+			n, err := running(client)
+			if err != nil {
+				q.leave(req)
+				return nil, errgo.Notef(err, "cannot count running containers")
+			}
+			q.mu.Lock()
+			if n+q.starting < max {
+				q.starting++
+				q.mu.Unlock()
+				q.leave(req)
+				return q.release, nil
+			}
+			q.mu.Unlock()
+		}
+		if position > size {
+			q.leave(req)
+			return nil, errgo.Newf("too many running containers: limit of %d reached, please retry later", max)
+		}
+		if position != lastPosition {
+			log.Debugw("container start queued", "position", position)
+		}
+		lastPosition = position
+		if err = notify(position); err != nil {
+			q.leave(req)
+			return nil, errgo.Mask(err)
+		}
+		select {
+		case <-changed:
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
+
+// release records that an admitted container start completed.
+func (q *Queue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.starting--
+	q.notifyChanged()
+}
+
+// leave removes the given request from the queue.
+func (q *Queue) leave(req int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, r := range q.waiting {
+		if r == req {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	q.notifyChanged()
+}
+
+// position returns the position of the given request in the queue, starting
+// from 1. It must be called with q.mu held.
+func (q *Queue) position(req int) (int, error) {
+	for i, r := range q.waiting {
+		if r == req {
+			return i + 1, nil
+		}
+	}
+	return 0, errgo.Newf("request %d not found in the queue", req)
+}
+
+// notifyChanged wakes up all the waiting requests. It must be called with
+// q.mu held.
+func (q *Queue) notifyChanged() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// running returns the number of running user containers, including the ones
+// in the pool which are not yet assigned to users.
+func running(client lxdclient.Client) (int, error) {
+	cs, err := client.All()
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	n := 0
+	for _, c := range cs {
+		name := c.Name()
+		if (strings.HasPrefix(name, ContainerPrefix) || strings.HasPrefix(name, pool.Prefix)) && c.Started() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// queuePollInterval holds the interval at which waiting requests check
+// whether containers have been stopped, and notify their position.
+var queuePollInterval = 5 * time.Second
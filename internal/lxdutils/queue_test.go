@@ -0,0 +1,152 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package lxdutils_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
+	"github.com/juju/jujushell/internal/lxdutils"
+)
+
+func TestQueueNoLimit(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	client.AddContainer("ts-1", true)
+	q := lxdutils.NewQueue()
+	release, err := q.Admit(client, 0, 0, func(int) error {
+		c.Fatalf("unexpected notification")
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	release()
+	c.Assert(client.Calls(), qt.HasLen, 0)
+}
+
+func TestQueueAdmitAndRefuse(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	client.AddContainer("ts-1", true)
+	// Idle pool containers are counted, while stopped containers and
+	// containers not managed by jujushell are not.
+	client.AddContainer("tp-1", true)
+	client.AddContainer("ts-2", false)
+	client.AddContainer("juju-1", true)
+	q := lxdutils.NewQueue()
+	notify := func(int) error {
+		c.Fatalf("unexpected notification")
+		return nil
+	}
+	release, err := q.Admit(client, 3, 0, notify)
+	c.Assert(err, qt.Equals, nil)
+	// Admitted starts are counted until released.
+	_, err = q.Admit(client, 3, 0, notify)
+	c.Assert(err, qt.ErrorMatches, "too many running containers: limit of 3 reached, please retry later")
+	release()
+	release, err = q.Admit(client, 3, 0, notify)
+	c.Assert(err, qt.Equals, nil)
+	release()
+}
+
+func TestQueueError(t *testing.T) {
+	c := qt.New(t)
+	client := lxdtest.New()
+	client.SetError("All", "", errors.New("bad wolf"))
+	q := lxdutils.NewQueue()
+	_, err := q.Admit(client, 1, 1, func(int) error {
+		return nil
+	})
+	c.Assert(err, qt.ErrorMatches, "cannot count running containers: cannot get containers: bad wolf")
+}
+
+func TestQueuePositionNotFound(t *testing.T) {
+	c := qt.New(t)
+	q := lxdutils.NewQueue()
+	_, err := lxdutils.QueuePosition(q, 42)
+	c.Assert(err, qt.ErrorMatches, "request 42 not found in the queue")
+}
+
+func TestQueueOrder(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(lxdutils.QueuePollInterval, 10*time.Millisecond)
+	client := lxdtest.New()
+	client.AddContainer("ts-1", true)
+	q := lxdutils.NewQueue()
+
+	// admit starts waiting in the queue, and returns a channel receiving
+	// the notified positions, and a channel receiving the result.
+	admit := func() (<-chan int, <-chan error) {
+		positions := make(chan int, 1000)
+		result := make(chan error, 1)
+		go func() {
+			release, err := q.Admit(client, 1, 2, func(position int) error {
+				select {
+				case positions <- position:
+				default:
+				}
+				return nil
+			})
+			if err == nil {
+				release()
+			}
+			result <- err
+		}()
+		return positions, result
+	}
+	positions1, result1 := admit()
+	c.Assert(<-positions1, qt.Equals, 1)
+	positions2, result2 := admit()
+	c.Assert(<-positions2, qt.Equals, 2)
+	// The queue is full.
+	_, result3 := admit()
+	c.Assert(<-result3, qt.ErrorMatches, "too many running containers: limit of 1 reached, please retry later")
+
+	// Stopping the running container admits the requests in order.
+	err := client.Container("ts-1").Stop()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(<-result1, qt.Equals, nil)
+	c.Assert(<-result2, qt.Equals, nil)
+	for position := range drain(positions2) {
+		if position == 1 {
+			return
+		}
+	}
+	c.Fatalf("second request never reached the head of the queue")
+}
+
+func TestQueueNotifyError(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(lxdutils.QueuePollInterval, 10*time.Millisecond)
+	client := lxdtest.New()
+	client.AddContainer("ts-1", true)
+	q := lxdutils.NewQueue()
+	_, err := q.Admit(client, 1, 1, func(int) error {
+		return errors.New("bad wolf")
+	})
+	c.Assert(err, qt.ErrorMatches, "bad wolf")
+	// The request left the queue.
+	err = client.Container("ts-1").Stop()
+	c.Assert(err, qt.Equals, nil)
+	release, err := q.Admit(client, 1, 0, func(int) error {
+		c.Fatalf("unexpected notification")
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	release()
+}
+
+// drain returns a channel receiving all the values currently in the given
+// buffered channel.
+func drain(ch <-chan int) <-chan int {
+	out := make(chan int, len(ch))
+	for len(ch) > 0 {
+		out <- <-ch
+	}
+	close(out)
+	return out
+}
@@ -9,9 +9,11 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/jujushell/apiparams"
 	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdutils"
 	"github.com/juju/jujushell/internal/wstransport"
 )
 
@@ -77,6 +79,39 @@ func (conn *connection) Error(op apiparams.Operation, err error) error {
 	return err
 }
 
+// InstrumentUpgrade is a wrapper for functions upgrading connections to
+// WebSocket, like wstransport.Upgrade, which counts connections rejected
+// because their origin is not allowed.
+func InstrumentUpgrade(upgrade wstransport.UpgradeFunc) wstransport.UpgradeFunc {
+	rejectedCount := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_origins_count",
+		Help:      "the number of WebSocket connections rejected because of their origin",
+	})
+	rejectedCount = mustRegisterOnce(rejectedCount).(prometheus.Counter)
+	return func(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (wstransport.Conn, error) {
+		conn, err := upgrade(w, r, allowedOrigins)
+		if errgo.Cause(err) == wstransport.ErrOriginNotAllowed {
+			rejectedCount.Inc()
+		}
+		return conn, err
+	}
+}
+
+// LockoutCounter returns a function counting the lockouts caused by too many
+// failed login attempts, by kind of lockout, for instance "user" or "addr".
+func LockoutCounter() func(kind string) {
+	lockoutsCount := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_lockouts_count",
+		Help:      "the number of lockouts caused by too many failed login attempts",
+	}, []string{"kind"})
+	lockoutsCount = mustRegisterOnce(lockoutsCount).(*prometheus.CounterVec)
+	return func(kind string) {
+		lockoutsCount.WithLabelValues(kind).Inc()
+	}
+}
+
 // InstrumentLXDClient is a wrapper for lxdclient.Client which observes the
 // duration of common client actions, like creating or retreiving containers.
 func InstrumentLXDClient(client lxdclient.Client) lxdclient.Client {
@@ -118,10 +153,10 @@ func (client *lxdClient) All() ([]lxdclient.Container, error) {
 }
 
 // Create implements lxdclient.Client.Create.
-func (client *lxdClient) Create(image, name string, profiles ...string) (lxdclient.Container, error) {
+func (client *lxdClient) Create(image, name string, limits lxdclient.Limits, volumes []lxdclient.Volume, profiles ...string) (lxdclient.Container, error) {
 	observe := timeit(client.duration.WithLabelValues("create-container"))
 	defer observe()
-	return client.Client.Create(image, name, profiles...)
+	return client.Client.Create(image, name, limits, volumes, profiles...)
 }
 
 // Delete implements lxdclient.Client.Delete.
@@ -131,6 +166,64 @@ func (client *lxdClient) Delete(name string) error {
 	return client.Client.Delete(name)
 }
 
+// Rename implements lxdclient.Client.Rename.
+func (client *lxdClient) Rename(name, newName string) error {
+	observe := timeit(client.duration.WithLabelValues("rename-container"))
+	defer observe()
+	return client.Client.Rename(name, newName)
+}
+
+// Pool describes a pool of containers that can be instrumented.
+type Pool interface {
+	lxdutils.Pool
+	// Ready returns the number of containers ready to be claimed.
+	Ready() int
+}
+
+// InstrumentPool is a wrapper for container pools which observes the number
+// of ready containers and counts claims, grouped by their result: "hit" when
+// a container was assigned from the pool, "miss" when the pool was empty and
+// "error" when the claim failed.
+func InstrumentPool(p Pool) lxdutils.Pool {
+	ready := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_ready_containers",
+		Help:      "the number of containers ready to be claimed from the pool",
+	}, func() float64 {
+		return float64(p.Ready())
+	})
+	mustRegisterOnce(ready)
+	claimsCount := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pool_claims_count",
+		Help:      "the number of containers claimed from the pool",
+	}, []string{"result"})
+	return &pool{
+		Pool:        p,
+		claimsCount: mustRegisterOnce(claimsCount).(*prometheus.CounterVec),
+	}
+}
+
+// pool implements lxdutils.Pool by wrapping the given pool and adding
+// metrics.
+type pool struct {
+	lxdutils.Pool
+	claimsCount *prometheus.CounterVec
+}
+
+// Claim implements lxdutils.Pool.Claim.
+func (p *pool) Claim(user string) (lxdclient.Container, error) {
+	c, err := p.Pool.Claim(user)
+	result := "hit"
+	if err != nil {
+		result = "error"
+	} else if c == nil {
+		result = "miss"
+	}
+	p.claimsCount.WithLabelValues(result).Inc()
+	return c, err
+}
+
 // mustRegisterOnce registers the given metrics collector only if not already
 // registered. It returns the registered collector.
 func mustRegisterOnce(c prometheus.Collector) prometheus.Collector {
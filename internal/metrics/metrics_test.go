@@ -16,9 +16,11 @@ import (
 	qt "github.com/frankban/quicktest"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/jujushell/apiparams"
 	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
 	"github.com/juju/jujushell/internal/metrics"
 	"github.com/juju/jujushell/internal/wstransport"
 )
@@ -63,13 +65,41 @@ func TestInstrumentHandler(t *testing.T) {
 	})
 }
 
+func TestInstrumentUpgrade(t *testing.T) {
+	c := qt.New(t)
+	upgrade := metrics.InstrumentUpgrade(func(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (wstransport.Conn, error) {
+		c.Assert(allowedOrigins, qt.DeepEquals, []string{"example.com"})
+		if r.Header.Get("Origin") == "https://bad-wolf.com" {
+			return nil, errgo.WithCausef(nil, wstransport.ErrOriginNotAllowed, "bad wolf")
+		}
+		return nil, errors.New("other error")
+	})
+	for _, origin := range []string{"https://bad-wolf.com", "https://example.com", "https://bad-wolf.com"} {
+		req := httptest.NewRequest("GET", "/ws/", nil)
+		req.Header.Set("Origin", origin)
+		_, err := upgrade(httptest.NewRecorder(), req, []string{"example.com"})
+		c.Assert(err, qt.Not(qt.IsNil))
+	}
+
+	// Set up a metrics server.
+	metricsSrv := httptest.NewServer(promhttp.Handler())
+	defer metricsSrv.Close()
+
+	// Check the resulting metrics.
+	checkMetrics(c, metricsSrv.URL, "jujushell_rejected_origins", []string{
+		"# HELP jujushell_rejected_origins_count the number of WebSocket connections rejected because of their origin",
+		"# TYPE jujushell_rejected_origins_count counter",
+		"jujushell_rejected_origins_count 2",
+	})
+}
+
 func TestInstrumentWSConnection(t *testing.T) {
 	c := qt.New(t)
 	errs := []string{"bad wolf", "bad wolf", "exterminate"}
 	msgs := make(chan string, 1)
 	// Set up a WebSocket server that writes a JSON error response.
 	wsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		conn, err := wstransport.Upgrade(w, req)
+		conn, err := wstransport.Upgrade(w, req, nil)
 		c.Assert(err, qt.Equals, nil)
 		defer conn.Close()
 		conn = metrics.InstrumentWSConnection(conn)
@@ -101,16 +131,15 @@ func TestInstrumentWSConnection(t *testing.T) {
 
 func TestInstrumentLXDClient(t *testing.T) {
 	c := qt.New(t)
-	var cl lxdclient.Client = &client{}
-	cl = metrics.InstrumentLXDClient(cl)
+	cl := metrics.InstrumentLXDClient(lxdtest.New())
 
 	// Set up a metrics server.
 	metricsSrv := httptest.NewServer(promhttp.Handler())
 	defer metricsSrv.Close()
 
 	// Work with the client.
-	cl.Create("image", "name")
-	cl.Create("image", "name")
+	cl.Create("image", "c1", lxdclient.Limits{}, nil)
+	cl.Create("image", "c2", lxdclient.Limits{}, nil)
 	cl.All()
 
 	// Check the resulting metrics (just the counts as they are deterministic).
@@ -125,9 +154,10 @@ func TestInstrumentLXDClient(t *testing.T) {
 	})
 
 	// Work more.
-	cl.Delete("name")
-	cl.Create("image", "name")
-	cl.Create("image", "name")
+	cl.Delete("c1")
+	cl.Create("image", "c3", lxdclient.Limits{}, nil)
+	cl.Create("image", "c4", lxdclient.Limits{}, nil)
+	cl.Rename("c3", "c5")
 	cl.All()
 
 	// Check the resulting metrics again.
@@ -135,6 +165,7 @@ func TestInstrumentLXDClient(t *testing.T) {
 		`jujushell_containers_duration_count{operation="create-container"} 4`,
 		`jujushell_containers_duration_count{operation="delete-container"} 1`,
 		`jujushell_containers_duration_count{operation="get-all-containers"} 2`,
+		`jujushell_containers_duration_count{operation="rename-container"} 1`,
 	})
 	checkMetrics(c, metricsSrv.URL, "jujushell_containers_in_flight", []string{
 		"# HELP jujushell_containers_in_flight the number of containers currently present in the machine",
@@ -143,24 +174,58 @@ func TestInstrumentLXDClient(t *testing.T) {
 	})
 }
 
-// client implements lxdclient.Client for testing purposes.
-type client struct {
-	lxdclient.Client
-	numContainer int
+func TestInstrumentPool(t *testing.T) {
+	c := qt.New(t)
+	p := &pool{
+		ready: 2,
+	}
+	ip := metrics.InstrumentPool(p)
+
+	// Set up a metrics server.
+	metricsSrv := httptest.NewServer(promhttp.Handler())
+	defer metricsSrv.Close()
+
+	// Claim containers from the pool.
+	ip.Claim("c1")
+	ip.Claim("c2")
+	ip.Claim("c3")
+	p.err = errors.New("bad wolf")
+	ip.Claim("c4")
+
+	// Check the resulting metrics.
+	checkMetrics(c, metricsSrv.URL, "jujushell_pool_claims_count", []string{
+		"# HELP jujushell_pool_claims_count the number of containers claimed from the pool",
+		"# TYPE jujushell_pool_claims_count counter",
+		`jujushell_pool_claims_count{result="error"} 1`,
+		`jujushell_pool_claims_count{result="hit"} 2`,
+		`jujushell_pool_claims_count{result="miss"} 1`,
+	})
+	checkMetrics(c, metricsSrv.URL, "jujushell_pool_ready_containers", []string{
+		"# HELP jujushell_pool_ready_containers the number of containers ready to be claimed from the pool",
+		"# TYPE jujushell_pool_ready_containers gauge",
+		"jujushell_pool_ready_containers 0",
+	})
 }
 
-func (cl *client) All() ([]lxdclient.Container, error) {
-	return make([]lxdclient.Container, cl.numContainer), nil
+// pool implements metrics.Pool for testing purposes.
+type pool struct {
+	ready int
+	err   error
 }
 
-func (cl *client) Create(image, name string, profiles ...string) (lxdclient.Container, error) {
-	cl.numContainer++
-	return nil, nil
+func (p *pool) Claim(name string) (lxdclient.Container, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.ready == 0 {
+		return nil, nil
+	}
+	p.ready--
+	return &lxdtest.Container{}, nil
 }
 
-func (cl *client) Delete(name string) error {
-	cl.numContainer--
-	return nil
+func (p *pool) Ready() int {
+	return p.ready
 }
 
 func checkMetrics(c *qt.C, url, substr string, expectedLines []string) {
@@ -0,0 +1,287 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package pool implements a pool of LXD containers which are created and
+// booted in advance, so that they are ready to be assigned to new users. This
+// reduces the time required to start sessions for users without containers.
+package pool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/internal/logging"
+	"github.com/juju/jujushell/internal/lxdclient"
+)
+
+var log = logging.Log()
+
+// Prefix holds the prefix used for the names of containers in the pool.
+const Prefix = "tp-"
+
+// New creates and returns a pool keeping the given number of containers
+// ready, created from the given image and profiles, with the given resource
+// limits. Running containers already in the pool, for instance created by a
+// previous server process, are reused if they were created with the same
+// image, profiles and limits, while the other ones are deleted. Containers
+// already claimed by users are left alone. The pool is filled in the
+// background.
+func New(client lxdclient.Client, image string, profiles []string, limits lxdclient.Limits, size int) (*Pool, error) {
+	cs, err := client.All()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve initial containers")
+	}
+	p := &Pool{
+		client:   client,
+		image:    image,
+		profiles: profiles,
+		limits:   limits,
+		size:     size,
+	}
+	fingerprint := p.fingerprint(image)
+	spec := containerSpec(profiles, limits)
+	for _, c := range cs {
+		name := c.Name()
+		if !strings.HasPrefix(name, Prefix) || Claimed(c) {
+			continue
+		}
+		if c.Started() && fingerprint != "" && c.Config(imageKey) == fingerprint && c.Config(specKey) == spec {
+			p.ready = append(p.ready, name)
+			continue
+		}
+		log.Debugw("deleting stale pool container", "container", name)
+		p.discard(c)
+	}
+	p.fill()
+	return p, nil
+}
+
+// Pool holds a set of running containers not yet assigned to users.
+type Pool struct {
+	client lxdclient.Client
+	size   int
+
+	// mu protects the fields below.
+	mu         sync.Mutex
+	image      string
+	profiles   []string
+	limits     lxdclient.Limits
+	generation int
+	ready      []string
+	pending    int
+}
+
+// Ready returns the number of containers ready to be claimed.
+func (p *Pool) Ready() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.ready)
+}
+
+// Reset changes the image, profiles and resource limits used to create pool
+// containers. Ready containers are deleted in the background, as are the ones
+// still being created, and the pool is then filled again with containers
+// reflecting the new parameters.
+func (p *Pool) Reset(image string, profiles []string, limits lxdclient.Limits) {
+	p.mu.Lock()
+	p.image, p.profiles, p.limits = image, profiles, limits
+	p.generation++
+	stale := p.ready
+	p.ready = nil
+	p.mu.Unlock()
+	for _, name := range stale {
+		go func(name string) {
+			log.Debugw("deleting stale pool container", "container", name)
+			c, err := p.client.Get(name)
+			if err != nil {
+				log.Infow("cannot retrieve stale pool container", "container", name, "err", err)
+				return
+			}
+			p.discard(c)
+		}(name)
+	}
+	p.fill()
+}
+
+// Claim assigns one of the ready containers to the given user, and returns
+// it. A nil container is returned if the pool is empty, or if the image alias
+// used by the pool now points to another image. In all cases, the pool is
+// refilled in the background. As LXD does not allow renaming running
+// containers, the claimed container keeps its name, and the user is recorded
+// in its configuration instead: see Claimed. This way the container does not
+// need to be restarted. Containers that cannot be claimed are deleted.
+func (p *Pool) Claim(user string) (lxdclient.Container, error) {
+	p.mu.Lock()
+	if len(p.ready) == 0 {
+		p.mu.Unlock()
+		p.fill()
+		return nil, nil
+	}
+	name, image := p.ready[0], p.image
+	p.ready = p.ready[1:]
+	p.mu.Unlock()
+	p.fill()
+
+	log.Debugw("claiming container from the pool", "container", name, "user", user)
+	c, err := p.client.Get(name)
+	if err != nil {
+		p.delete(name)
+		return nil, errgo.Mask(err)
+	}
+	if fingerprint := p.fingerprint(image); fingerprint != "" && c.Config(imageKey) != fingerprint {
+		log.Infow("deleting pool container created from an outdated image", "container", name, "image", image)
+		p.discard(c)
+		return nil, nil
+	}
+	if err = c.SetConfig(UserKey, user); err != nil {
+		p.discard(c)
+		return nil, errgo.Mask(err)
+	}
+	return c, nil
+}
+
+// Claimed reports whether the given pool container has been claimed by a
+// user.
+func Claimed(c lxdclient.Container) bool {
+	return c.Config(UserKey) != ""
+}
+
+// fill starts creating containers in the background until the pool is full.
+func (p *Pool) fill() {
+	p.mu.Lock()
+	n := p.size - len(p.ready) - p.pending
+	if n > 0 {
+		p.pending += n
+	}
+	image, profiles, limits, generation := p.image, p.profiles, p.limits, p.generation
+	p.mu.Unlock()
+	for i := 0; i < n; i++ {
+		go p.add(image, profiles, limits, generation)
+	}
+}
+
+// add creates a new container and adds it to the pool when ready. The
+// container is deleted if the pool has been reset in the meantime.
+func (p *Pool) add(image string, profiles []string, limits lxdclient.Limits, generation int) {
+	name, err := p.create(image, profiles, limits)
+	p.mu.Lock()
+	p.pending--
+	stale := err == nil && generation != p.generation
+	if err == nil && !stale {
+		log.Debugw("container added to the pool", "container", name)
+		p.ready = append(p.ready, name)
+	}
+	p.mu.Unlock()
+	if err != nil {
+		log.Infow("cannot add container to the pool", "err", err)
+		return
+	}
+	if stale {
+		log.Debugw("deleting stale pool container", "container", name)
+		if c, err := p.client.Get(name); err == nil {
+			p.discard(c)
+		}
+		p.fill()
+	}
+}
+
+// create creates and starts a new pool container from the given image and
+// profiles, with the given limits, and waits for it to be up and running. The
+// image fingerprint, profiles and limits are recorded in the container
+// configuration, so that the container can be reused by later server
+// processes. It returns the container name.
+func (p *Pool) create(image string, profiles []string, limits lxdclient.Limits) (string, error) {
+	name, err := newName()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	c, err := p.client.Create(image, name, limits, nil, profiles...)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if fingerprint := p.fingerprint(image); fingerprint != "" {
+		err = c.SetConfig(imageKey, fingerprint)
+	}
+	if err == nil {
+		err = c.SetConfig(specKey, containerSpec(profiles, limits))
+	}
+	if err == nil {
+		err = c.Start()
+	}
+	if err == nil {
+		// Wait for the container to be up and running.
+		_, err = c.Addr()
+	}
+	if err != nil {
+		p.discard(c)
+		return "", errgo.Mask(err)
+	}
+	return name, nil
+}
+
+// discard stops, if required, and deletes the given pool container. Errors
+// are logged, as there is nothing else we can do.
+func (p *Pool) discard(c lxdclient.Container) {
+	name := c.Name()
+	if c.Started() {
+		if err := c.Stop(); err != nil {
+			log.Infow("cannot stop pool container", "container", name, "err", err)
+		}
+	}
+	p.delete(name)
+}
+
+// delete deletes the pool container with the given name, logging errors.
+func (p *Pool) delete(name string) {
+	if err := p.client.Delete(name); err != nil {
+		log.Infow("cannot delete pool container", "container", name, "err", err)
+	}
+}
+
+// fingerprint returns the fingerprint of the image the given image alias
+// points to, or an empty string if the fingerprint cannot be retrieved.
+func (p *Pool) fingerprint(image string) string {
+	fingerprint, err := p.client.ImageFingerprint(image)
+	if err != nil {
+		log.Infow("cannot retrieve image fingerprint", "image", image, "err", err)
+		return ""
+	}
+	return fingerprint
+}
+
+// containerSpec returns a string describing the given profiles and limits,
+// which is recorded in the configuration of pool containers.
+func containerSpec(profiles []string, limits lxdclient.Limits) string {
+	return fmt.Sprintf("profiles=%s cpu=%s memory=%s processes=%d disk=%s",
+		strings.Join(profiles, ","), limits.CPU, limits.Memory, limits.Processes, limits.Disk)
+}
+
+const (
+	// imageKey holds the container configuration key used to record the
+	// fingerprint of the image the container was created from. It is the
+	// same key used for user containers, so that claimed containers are
+	// recognized as outdated when the image changes.
+	imageKey = "user.jujushell.image"
+	// specKey holds the container configuration key used to record the
+	// profiles and limits pool containers are created with.
+	specKey = "user.jujushell.pool-spec"
+)
+
+// UserKey holds the container configuration key used to record the user a
+// pool container has been assigned to.
+const UserKey = "user.jujushell.user"
+
+// newName returns a new random name for a pool container. It is defined as a
+// variable for testing.
+var newName = func() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Notef(err, "cannot generate container name")
+	}
+	return Prefix + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,357 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package pool_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
+	"github.com/juju/jujushell/internal/pool"
+)
+
+func TestNewError(t *testing.T) {
+	c := qt.New(t)
+	cl := lxdtest.New()
+	cl.SetError("All", "", errors.New("bad wolf"))
+	p, err := pool.New(cl, "termserver", []string{"default"}, lxdclient.Limits{}, 1)
+	c.Assert(err, qt.ErrorMatches, "cannot retrieve initial containers: cannot get containers: bad wolf")
+	c.Assert(p, qt.IsNil)
+}
+
+func TestNew(t *testing.T) {
+	c := qt.New(t)
+	patchNewName(c)
+	profiles := []string{"default", "termserver"}
+	spec := pool.ContainerSpec(profiles, lxdclient.Limits{})
+	cl := lxdtest.New()
+	cl.SetImage("termserver", "abc")
+	cl.AddContainer("ts-who", true)
+	addPoolContainer(cl, "tp-existing", "abc", spec)
+	addPoolContainer(cl, "tp-limits", "abc", pool.ContainerSpec(profiles, lxdclient.Limits{CPU: "1"}))
+	addPoolContainer(cl, "tp-outdated", "old", spec)
+	cl.AddContainer("tp-stopped", false)
+	// Containers claimed by users are left alone.
+	cl.AddContainer("tp-claimed", false).SetConfig("user.jujushell.user", "who")
+	cl.ResetCalls()
+	p, err := pool.New(cl, "termserver", profiles, lxdclient.Limits{}, 2)
+	c.Assert(err, qt.Equals, nil)
+	err = lxdtest.WaitFor(func() bool {
+		return p.Ready() == 2
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-limits).Stop"},
+		{"Delete", "tp-limits"},
+		{"(tp-outdated).Stop"},
+		{"Delete", "tp-outdated"},
+		{"Delete", "tp-stopped"},
+		{"Create", "termserver", "tp-1", "default", "termserver"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-1).SetConfig", "user.jujushell.image", "abc"},
+		{"(tp-1).SetConfig", "user.jujushell.pool-spec", spec},
+		{"(tp-1).Start"},
+		{"(tp-1).Addr"},
+	})
+	c.Assert(cl.Container("tp-existing").Started(), qt.Equals, true)
+	c.Assert(cl.Container("tp-limits"), qt.IsNil)
+	c.Assert(cl.Container("tp-outdated"), qt.IsNil)
+	c.Assert(cl.Container("tp-stopped"), qt.IsNil)
+	c.Assert(cl.Container("tp-claimed"), qt.Not(qt.IsNil))
+	c.Assert(cl.Container("tp-1").Started(), qt.Equals, true)
+}
+
+func TestNewWithoutFingerprint(t *testing.T) {
+	c := qt.New(t)
+	cl := lxdtest.New()
+	addPoolContainer(cl, "tp-existing", "abc", pool.ContainerSpec(nil, lxdclient.Limits{}))
+	cl.ResetCalls()
+	// Containers cannot be reused if the image cannot be checked.
+	p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Ready(), qt.Equals, 0)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-existing).Stop"},
+		{"Delete", "tp-existing"},
+	})
+}
+
+func TestNewCreateError(t *testing.T) {
+	c := qt.New(t)
+	patchNewName(c)
+	cl := lxdtest.New()
+	cl.SetImage("termserver", "abc")
+	cl.SetError("Addr", "", errors.New("bad wolf"))
+	p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 1)
+	c.Assert(err, qt.Equals, nil)
+	err = lxdtest.WaitFor(func() bool {
+		return len(cl.Calls()) == 10
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Ready(), qt.Equals, 0)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+		{"Create", "termserver", "tp-1"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-1).SetConfig", "user.jujushell.image", "abc"},
+		{"(tp-1).SetConfig", "user.jujushell.pool-spec", pool.ContainerSpec(nil, lxdclient.Limits{})},
+		{"(tp-1).Start"},
+		{"(tp-1).Addr"},
+		{"(tp-1).Stop"},
+		{"Delete", "tp-1"},
+	})
+	c.Assert(cl.Container("tp-1"), qt.IsNil)
+}
+
+func TestClaimEmpty(t *testing.T) {
+	c := qt.New(t)
+	cl := lxdtest.New()
+	p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 0)
+	c.Assert(err, qt.Equals, nil)
+	ct, err := p.Claim("who")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ct, qt.IsNil)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+	})
+}
+
+func TestClaim(t *testing.T) {
+	c := qt.New(t)
+	patchNewName(c)
+	cl := lxdtest.New()
+	cl.SetImage("termserver", "abc")
+	addPoolContainer(cl, "tp-existing", "abc", pool.ContainerSpec(nil, lxdclient.Limits{}))
+	cl.ResetCalls()
+	p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Ready(), qt.Equals, 1)
+
+	// Claim the existing container, which keeps running with its name.
+	ct, err := p.Claim("who")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ct.Name(), qt.Equals, "tp-existing")
+	c.Assert(ct.Started(), qt.Equals, true)
+	c.Assert(ct.Config("user.jujushell.user"), qt.Equals, "who")
+	c.Assert(pool.Claimed(ct), qt.Equals, true)
+
+	// The pool is refilled in the background.
+	err = lxdtest.WaitFor(func() bool {
+		return p.Ready() == 1
+	})
+	c.Assert(err, qt.Equals, nil)
+	calls := cl.Calls()
+	c.Assert(calls[:2], qt.DeepEquals, [][]string{
+		{"All"},
+		{"ImageFingerprint", "termserver"},
+	})
+	c.Assert(calls[2:], qt.HasLen, 9)
+	claimCalls, fillCalls := splitCalls(calls[2:], "tp-1")
+	c.Assert(claimCalls, qt.DeepEquals, [][]string{
+		{"Get", "tp-existing"},
+		{"(tp-existing).SetConfig", "user.jujushell.user", "who"},
+	})
+	c.Assert(fillCalls, qt.DeepEquals, [][]string{
+		{"Create", "termserver", "tp-1"},
+		{"(tp-1).SetConfig", "user.jujushell.image", "abc"},
+		{"(tp-1).SetConfig", "user.jujushell.pool-spec", pool.ContainerSpec(nil, lxdclient.Limits{})},
+		{"(tp-1).Start"},
+		{"(tp-1).Addr"},
+	})
+}
+
+func TestClaimOutdated(t *testing.T) {
+	c := qt.New(t)
+	cl := lxdtest.New()
+	cl.SetImage("termserver", "abc")
+	addPoolContainer(cl, "tp-existing", "abc", pool.ContainerSpec(nil, lxdclient.Limits{}))
+	// Use a zero size so that the pool is not refilled.
+	p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 0)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Ready(), qt.Equals, 1)
+
+	// The image alias is updated, so the container is not claimed.
+	cl.SetImage("termserver", "def")
+	cl.ResetCalls()
+	ct, err := p.Claim("who")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ct, qt.IsNil)
+	c.Assert(p.Ready(), qt.Equals, 0)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"Get", "tp-existing"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-existing).Stop"},
+		{"Delete", "tp-existing"},
+	})
+	c.Assert(cl.Container("tp-existing"), qt.IsNil)
+}
+
+var claimErrorTests = []struct {
+	about         string
+	setup         func(cl *lxdtest.Client)
+	expectedError string
+	expectedCalls [][]string
+}{{
+	about: "get error",
+	setup: func(cl *lxdtest.Client) {
+		// Simulate the container being stopped behind our back.
+		cl.Container("tp-existing").Stop()
+		cl.SetError("Get", "tp-existing", errors.New("bad wolf"))
+	},
+	expectedError: `cannot get container "tp-existing": bad wolf`,
+	expectedCalls: [][]string{
+		{"Get", "tp-existing"},
+		{"Delete", "tp-existing"},
+	},
+}, {
+	about: "set config error",
+	setup: func(cl *lxdtest.Client) {
+		cl.SetError("SetConfig", "tp-existing", errors.New("bad wolf"))
+	},
+	expectedError: `cannot update container "tp-existing": bad wolf`,
+	expectedCalls: [][]string{
+		{"Get", "tp-existing"},
+		{"ImageFingerprint", "termserver"},
+		{"(tp-existing).SetConfig", "user.jujushell.user", "who"},
+		{"(tp-existing).Stop"},
+		{"Delete", "tp-existing"},
+	},
+}}
+
+func TestClaimError(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range claimErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			cl := lxdtest.New()
+			cl.SetImage("termserver", "abc")
+			addPoolContainer(cl, "tp-existing", "abc", pool.ContainerSpec(nil, lxdclient.Limits{}))
+			// Use a zero size so that the pool is not refilled.
+			p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 0)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(p.Ready(), qt.Equals, 1)
+			test.setup(cl)
+			cl.ResetCalls()
+
+			ct, err := p.Claim("who")
+			c.Assert(err, qt.ErrorMatches, test.expectedError)
+			c.Assert(ct, qt.IsNil)
+			c.Assert(p.Ready(), qt.Equals, 0)
+			c.Assert(cl.Calls(), qt.DeepEquals, test.expectedCalls)
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	c := qt.New(t)
+	patchNewName(c)
+	cl := lxdtest.New()
+	cl.SetImage("termserver", "abc")
+	cl.SetImage("new-termserver", "def")
+	addPoolContainer(cl, "tp-existing", "abc", pool.ContainerSpec(nil, lxdclient.Limits{}))
+	p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 1)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(p.Ready(), qt.Equals, 1)
+
+	// Existing containers are replaced with new ones.
+	limits := lxdclient.Limits{Memory: "1GB"}
+	p.Reset("new-termserver", []string{"default"}, limits)
+	err = lxdtest.WaitFor(func() bool {
+		return p.Ready() == 1 && cl.Container("tp-existing") == nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	ct := cl.Container("tp-1")
+	c.Assert(ct.Started(), qt.Equals, true)
+	c.Assert(ct.Image(), qt.Equals, "new-termserver")
+	c.Assert(ct.Profiles(), qt.DeepEquals, []string{"default"})
+	c.Assert(ct.Limits(), qt.Equals, limits)
+	c.Assert(ct.Config("user.jujushell.image"), qt.Equals, "def")
+	c.Assert(ct.Config("user.jujushell.pool-spec"), qt.Equals, pool.ContainerSpec([]string{"default"}, limits))
+}
+
+func TestResetPending(t *testing.T) {
+	c := qt.New(t)
+	cl := lxdtest.New()
+	cl.SetImage("termserver", "abc")
+	cl.SetImage("new-termserver", "def")
+	// Block the creation of the first container.
+	first, unblock := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var n int
+	c.Patch(pool.NewName, func() (string, error) {
+		mu.Lock()
+		n++
+		name := fmt.Sprintf("tp-%d", n)
+		mu.Unlock()
+		if name == "tp-1" {
+			close(first)
+			<-unblock
+		}
+		return name, nil
+	})
+	p, err := pool.New(cl, "termserver", nil, lxdclient.Limits{}, 1)
+	c.Assert(err, qt.Equals, nil)
+	<-first
+
+	// Reset the pool while the first container is being created: that
+	// container is discarded and a new one is created with the new image.
+	p.Reset("new-termserver", nil, lxdclient.Limits{})
+	close(unblock)
+	err = lxdtest.WaitFor(func() bool {
+		return p.Ready() == 1 && cl.Container("tp-1") == nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	cs, err := cl.All()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cs, qt.HasLen, 1)
+	c.Assert(cs[0].(*lxdtest.Container).Image(), qt.Equals, "new-termserver")
+}
+
+// addPoolContainer adds a running pool container to the given client,
+// created from the image with the given fingerprint and with the given spec.
+func addPoolContainer(cl *lxdtest.Client, name, fingerprint, spec string) {
+	ct := cl.AddContainer(name, true)
+	ct.SetConfig("user.jujushell.image", fingerprint)
+	ct.SetConfig("user.jujushell.pool-spec", spec)
+}
+
+// patchNewName patches the function used to generate pool container names so
+// that names are predictable.
+func patchNewName(c *qt.C) {
+	var mu sync.Mutex
+	var n int
+	c.Patch(pool.NewName, func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return fmt.Sprintf("tp-%d", n), nil
+	})
+}
+
+// splitCalls splits the given calls between the ones related to the
+// container with the given name and all the others. Image fingerprint calls
+// are not related to specific containers, and are therefore dropped.
+func splitCalls(calls [][]string, name string) (others, related [][]string) {
+	for _, call := range calls {
+		switch {
+		case call[0] == "ImageFingerprint":
+		case strings.HasPrefix(call[0], "("+name+")."), call[0] == "Create" && call[2] == name:
+			related = append(related, call)
+		default:
+			others = append(others, call)
+		}
+	}
+	return others, related
+}
@@ -0,0 +1,9 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package recorder
+
+var (
+	TimeAfterFunc = &timeAfterFunc
+	TimeNow       = &timeNow
+)
@@ -0,0 +1,297 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package recorder implements the recording of shell sessions in the asciicast
+// v2 format, so that sessions can be audited and replayed, for instance using
+// asciinema. See
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md.
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/internal/logging"
+	"github.com/juju/jujushell/internal/terminado"
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
+var log = logging.Log()
+
+// NewStore creates and returns a store saving session recordings in the given
+// directory, which is created if it does not exist. If input is true, the
+// terminal input is recorded as well as the output. Recordings older than the
+// given retention are periodically removed. A zero retention means that
+// recordings are never removed.
+func NewStore(dir string, retention time.Duration, input bool) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errgo.Notef(err, "cannot create recordings directory")
+	}
+	s := &Store{
+		dir:       dir,
+		retention: retention,
+		input:     input,
+	}
+	if retention != 0 {
+		s.collectGarbage()
+	}
+	return s, nil
+}
+
+// Store saves session recordings in a directory.
+type Store struct {
+	dir       string
+	retention time.Duration
+	input     bool
+}
+
+// Start starts recording a new session for the given user and container.
+func (s *Store) Start(user, container string) (*Recording, error) {
+	now := timeNow()
+	name := fmt.Sprintf("%s-%s.cast", now.UTC().Format("20060102T150405.000000000Z"), sanitize(user))
+	path := filepath.Join(s.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create recording file")
+	}
+	r := &Recording{
+		path:  path,
+		start: now,
+		input: s.input,
+		f:     f,
+	}
+	if err = r.writeLine(header{
+		Version:   2,
+		Width:     defaultWidth,
+		Height:    defaultHeight,
+		Timestamp: now.Unix(),
+		Title:     fmt.Sprintf("%s (%s)", user, container),
+		Env: map[string]string{
+			"TERM": "xterm",
+		},
+	}); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, errgo.Notef(err, "cannot write recording header")
+	}
+	log.Debugw("session recording started", "user", user, "path", path)
+	return r, nil
+}
+
+// collectGarbage removes expired recordings and schedules its next execution.
+func (s *Store) collectGarbage() {
+	if err := s.removeExpired(); err != nil {
+		log.Infow("cannot remove expired recordings", "err", err)
+	}
+	timeAfterFunc(gcInterval, s.collectGarbage)
+}
+
+// removeExpired removes the recordings older than the store retention.
+func (s *Store) removeExpired() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errgo.Notef(err, "cannot read recordings directory")
+	}
+	now := timeNow()
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".cast" {
+			continue
+		}
+		if now.Sub(info.ModTime()) < s.retention {
+			continue
+		}
+		path := filepath.Join(s.dir, info.Name())
+		log.Debugw("removing expired recording", "path", path)
+		if err = os.Remove(path); err != nil {
+			return errgo.Notef(err, "cannot remove expired recording")
+		}
+	}
+	return nil
+}
+
+// Recording is an in progress session recording.
+type Recording struct {
+	path  string
+	start time.Time
+	input bool
+
+	// mu protects the fields below.
+	mu     sync.Mutex
+	f      *os.File
+	failed bool
+}
+
+// Conn returns a connection recording the Terminado messages sent and
+// received through the given client connection.
+func (r *Recording) Conn(c wsproxy.Conn) wsproxy.Conn {
+	return &conn{
+		Conn: c,
+		r:    r,
+	}
+}
+
+// Close stops the recording.
+func (r *Recording) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	if err != nil {
+		return errgo.Notef(err, "cannot close recording %q", r.path)
+	}
+	return nil
+}
+
+// record records the given Terminado message.
+func (r *Recording) record(data []byte) {
+	typ, args, err := terminado.Decode(data)
+	if err != nil {
+		// Not a Terminado message: nothing to record.
+		return
+	}
+	var code, value string
+	switch {
+	case typ == terminado.Stdout && len(args) == 1:
+		code = "o"
+		err = json.Unmarshal(args[0], &value)
+	case typ == terminado.Stdin && len(args) == 1 && r.input:
+		code = "i"
+		err = json.Unmarshal(args[0], &value)
+	case typ == terminado.SetSize && len(args) == 2:
+		var rows, cols int
+		if err = json.Unmarshal(args[0], &rows); err == nil {
+			err = json.Unmarshal(args[1], &cols)
+		}
+		code, value = "r", fmt.Sprintf("%dx%d", cols, rows)
+	default:
+		return
+	}
+	if err != nil {
+		return
+	}
+	elapsed := timeNow().Sub(r.start).Seconds()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err = r.writeLine([]interface{}{elapsed, code, value}); err != nil && !r.failed {
+		r.failed = true
+		log.Errorw("cannot write to recording", "path", r.path, "err", err)
+	}
+}
+
+// writeLine writes the JSON encoding of v as a line of the recording.
+func (r *Recording) writeLine(v interface{}) error {
+	if r.f == nil {
+		return errgo.New("recording closed")
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	_, err = r.f.Write(append(data, '\n'))
+	return errgo.Mask(err)
+}
+
+// conn implements wsproxy.Conn by recording messages.
+type conn struct {
+	wsproxy.Conn
+	r *Recording
+}
+
+// NextReader implements wsproxy.Conn.NextReader by recording messages sent
+// by the client.
+func (c *conn) NextReader() (messageType int, r io.Reader, err error) {
+	messageType, r, err = c.Conn.NextReader()
+	if err != nil {
+		return messageType, r, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.r.record(data)
+	return messageType, bytes.NewReader(data), nil
+}
+
+// NextWriter implements wsproxy.Conn.NextWriter by recording messages sent
+// to the client.
+func (c *conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	w, err := c.Conn.NextWriter(messageType)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{
+		WriteCloser: w,
+		r:           c.r,
+	}, nil
+}
+
+// writer records the message written to the client when closed.
+type writer struct {
+	io.WriteCloser
+	r   *Recording
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer.
+func (w *writer) Write(data []byte) (int, error) {
+	n, err := w.WriteCloser.Write(data)
+	w.buf.Write(data[:n])
+	return n, err
+}
+
+// Close implements io.Closer.
+func (w *writer) Close() error {
+	w.r.record(w.buf.Bytes())
+	return w.WriteCloser.Close()
+}
+
+// header holds the asciicast v2 header.
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env"`
+}
+
+// sanitize returns a version of the given user name suitable for being used
+// as part of a file name.
+func sanitize(user string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '@' || r == '.' || r == '_') {
+			return r
+		}
+		return '-'
+	}, user)
+}
+
+const (
+	// defaultWidth and defaultHeight hold the terminal size stored in the
+	// recording header. Actual sizes are recorded as resize events.
+	defaultWidth  = 80
+	defaultHeight = 24
+
+	// gcInterval holds the interval between expired recordings removals.
+	gcInterval = time.Hour
+)
+
+// timeNow and timeAfterFunc are defined as variables for testing.
+var (
+	timeNow       = time.Now
+	timeAfterFunc = time.AfterFunc
+)
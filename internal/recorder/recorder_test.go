@@ -0,0 +1,223 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package recorder_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+
+	"github.com/juju/jujushell/internal/recorder"
+	"github.com/juju/jujushell/internal/terminado"
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
+var recordingTests = []struct {
+	about         string
+	input         bool
+	expectedLines []string
+}{{
+	about: "output only",
+	expectedLines: []string{
+		`{"version":2,"width":80,"height":24,"timestamp":1500000000,"title":"who@external (termserver-who-at-external-1a2b3c)","env":{"TERM":"xterm"}}`,
+		`[1,"r","80x24"]`,
+		`[2,"o","$ "]`,
+		`[3,"o","ls\r\n"]`,
+	},
+}, {
+	about: "output and input",
+	input: true,
+	expectedLines: []string{
+		`{"version":2,"width":80,"height":24,"timestamp":1500000000,"title":"who@external (termserver-who-at-external-1a2b3c)","env":{"TERM":"xterm"}}`,
+		`[1,"r","80x24"]`,
+		`[2,"i","ls\r"]`,
+		`[3,"o","$ "]`,
+		`[4,"o","ls\r\n"]`,
+	},
+}}
+
+func TestRecording(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range recordingTests {
+		c.Run(test.about, func(c *qt.C) {
+			dir := c.Mkdir()
+			patchTime(c)
+			store, err := recorder.NewStore(dir, 0, test.input)
+			c.Assert(err, qt.Equals, nil)
+			rec, err := store.Start("who@external", "termserver-who-at-external-1a2b3c")
+			c.Assert(err, qt.Equals, nil)
+
+			// Exchange messages through the recording connection.
+			conn := rec.Conn(&stubConn{
+				messages: [][]byte{
+					mustEncode(c, terminado.SetSize, 24, 80),
+					mustEncode(c, terminado.Stdin, "ls\r"),
+					[]byte("not a terminado message"),
+				},
+			})
+			for i := 0; i < 3; i++ {
+				_, r, err := conn.NextReader()
+				c.Assert(err, qt.Equals, nil)
+				_, err = ioutil.ReadAll(r)
+				c.Assert(err, qt.Equals, nil)
+			}
+			write(c, conn, mustEncode(c, terminado.Stdout, "$ "))
+			write(c, conn, mustEncode(c, "disconnect", 1))
+			write(c, conn, mustEncode(c, terminado.Stdout, "ls\r\n"))
+			err = rec.Close()
+			c.Assert(err, qt.Equals, nil)
+
+			// Check the resulting recording.
+			files, err := filepath.Glob(filepath.Join(dir, "*.cast"))
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(files, qt.HasLen, 1)
+			c.Assert(filepath.Base(files[0]), qt.Equals, "20170714T024000.000000000Z-who@external.cast")
+			data, err := ioutil.ReadFile(files[0])
+			c.Assert(err, qt.Equals, nil)
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			c.Assert(lines, qt.DeepEquals, test.expectedLines)
+		})
+	}
+}
+
+func TestRecordingConnPassesMessages(t *testing.T) {
+	c := qt.New(t)
+	store, err := recorder.NewStore(c.Mkdir(), 0, false)
+	c.Assert(err, qt.Equals, nil)
+	rec, err := store.Start("who", "termserver-who-1a2b3c")
+	c.Assert(err, qt.Equals, nil)
+	defer rec.Close()
+
+	stub := &stubConn{
+		messages: [][]byte{[]byte("bad wolf")},
+	}
+	conn := rec.Conn(stub)
+	typ, r, err := conn.NextReader()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(typ, qt.Equals, websocket.TextMessage)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Equals, "bad wolf")
+	_, _, err = conn.NextReader()
+	c.Assert(err, qt.Equals, io.EOF)
+
+	write(c, conn, []byte("exterminate"))
+	c.Assert(stub.written, qt.DeepEquals, []string{"exterminate"})
+}
+
+func TestNewStoreRemovesExpiredRecordings(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	now := time.Now()
+	c.Patch(recorder.TimeNow, func() time.Time {
+		return now
+	})
+	var scheduled []time.Duration
+	c.Patch(recorder.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		scheduled = append(scheduled, d)
+		return nil
+	})
+	files := map[string]time.Duration{
+		"old.cast":    72 * time.Hour,
+		"recent.cast": time.Hour,
+		"old.txt":     72 * time.Hour,
+	}
+	for name, age := range files {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, nil, 0600)
+		c.Assert(err, qt.Equals, nil)
+		err = os.Chtimes(path, now.Add(-age), now.Add(-age))
+		c.Assert(err, qt.Equals, nil)
+	}
+
+	_, err := recorder.NewStore(dir, 48*time.Hour, false)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(scheduled, qt.DeepEquals, []time.Duration{time.Hour})
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, qt.Equals, nil)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	c.Assert(names, qt.DeepEquals, []string{"old.txt", "recent.cast"})
+}
+
+func TestNewStoreError(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "file")
+	err := ioutil.WriteFile(path, nil, 0600)
+	c.Assert(err, qt.Equals, nil)
+	store, err := recorder.NewStore(filepath.Join(path, "recordings"), 0, false)
+	c.Assert(err, qt.ErrorMatches, "cannot create recordings directory: .*")
+	c.Assert(store, qt.IsNil)
+}
+
+// patchTime patches the current time so that each call returns a time one
+// second later than the previous one. Note that events are only timestamped
+// when actually recorded.
+func patchTime(c *qt.C) {
+	now := time.Unix(1500000000, 0)
+	c.Patch(recorder.TimeNow, func() time.Time {
+		t := now
+		now = now.Add(time.Second)
+		return t
+	})
+}
+
+// write writes the given message to the given connection.
+func write(c *qt.C, conn wsproxy.Conn, data []byte) {
+	w, err := conn.NextWriter(websocket.TextMessage)
+	c.Assert(err, qt.Equals, nil)
+	_, err = w.Write(data)
+	c.Assert(err, qt.Equals, nil)
+	err = w.Close()
+	c.Assert(err, qt.Equals, nil)
+}
+
+func mustEncode(c *qt.C, typ string, args ...interface{}) []byte {
+	data, err := terminado.Encode(typ, args...)
+	c.Assert(err, qt.Equals, nil)
+	return data
+}
+
+// stubConn implements wsproxy.Conn for testing purposes.
+type stubConn struct {
+	messages [][]byte
+	written  []string
+}
+
+func (c *stubConn) NextReader() (messageType int, r io.Reader, err error) {
+	if len(c.messages) == 0 {
+		return 0, nil, io.EOF
+	}
+	data := c.messages[0]
+	c.messages = c.messages[1:]
+	return websocket.TextMessage, bytes.NewReader(data), nil
+}
+
+func (c *stubConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &stubWriter{conn: c}, nil
+}
+
+type stubWriter struct {
+	conn *stubConn
+	buf  bytes.Buffer
+}
+
+func (w *stubWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+func (w *stubWriter) Close() error {
+	w.conn.written = append(w.conn.written, w.buf.String())
+	return nil
+}
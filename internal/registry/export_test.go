@@ -4,6 +4,8 @@
 package registry
 
 var (
-	LXDutilsConnect = &lxdutilsConnect
-	TimeAfterFunc   = &timeAfterFunc
+	DeleteExpired = (*Registry).deleteExpired
+	NewToken      = &newToken
+	TimeAfterFunc = &timeAfterFunc
+	TimeNow       = &timeNow
 )
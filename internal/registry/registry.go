@@ -4,23 +4,31 @@
 package registry
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"gopkg.in/errgo.v1"
 
+	"github.com/juju/jujushell/internal/audit"
 	"github.com/juju/jujushell/internal/logging"
 	"github.com/juju/jujushell/internal/lxdclient"
 	"github.com/juju/jujushell/internal/lxdutils"
+	"github.com/juju/jujushell/internal/pool"
 )
 
 var log = logging.Log()
 
 // New creates and returns a new registry for active containers. Containers are
-// stopped after the provided duration. The LXD client is connected using the
-// given socket path.
-func New(d time.Duration, socketPath string) (*Registry, error) {
-	client, err := lxdutilsConnect(socketPath)
+// stopped after the provided duration d. Detached sessions can be resumed
+// within the provided resume duration rd. Stopped containers are deleted after
+// the provided expiry duration ed, unless it is zero. The given connect
+// function is used to connect to the LXD server. Containers already running
+// are registered taking into account their last activity, as persisted by
+// previous registries.
+func New(d, rd, ed time.Duration, connect func() (lxdclient.Client, error)) (*Registry, error) {
+	client, err := connect()
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot connect to LXD")
 	}
@@ -30,64 +38,230 @@ func New(d time.Duration, socketPath string) (*Registry, error) {
 	}
 	r := Registry{
 		d:          d,
-		socketPath: socketPath,
+		rd:         rd,
+		ed:         ed,
+		connect:    connect,
 		containers: make(map[string]*ActiveContainer, len(cs)),
+		sessions:   make(map[string]*Session),
 	}
 	for _, c := range cs {
-		if c.Started() {
-			r.Get(c.Name())
+		if !c.Started() {
+			continue
 		}
+		name := c.Name()
+		// Containers in the pool are not assigned to users until claimed.
+		if strings.HasPrefix(name, pool.Prefix) && !pool.Claimed(c) {
+			continue
+		}
+		r.get(name, lastActivity(c))
+	}
+	if ed != 0 {
+		timeAfterFunc(gcInterval, r.collectGarbage)
 	}
 	return &r, nil
 }
 
 // Registry stores and keeps track of the currently active cobtainers. Use the
 // Get method on the registry to retrieve a stored container or add a new one.
+// The registry also keeps track of shell sessions, so that they can be resumed
+// after the client disconnects.
 type Registry struct {
 	d          time.Duration
-	socketPath string
+	rd         time.Duration
+	ed         time.Duration
+	connect    func() (lxdclient.Client, error)
 	mu         sync.Mutex
 	containers map[string]*ActiveContainer
+	sessions   map[string]*Session
 }
 
 // Get returns the active container with the given name. The container is also
 // stored in the registry if not already known.
 func (r *Registry) Get(name string) *ActiveContainer {
+	return r.get(name, time.Time{})
+}
+
+// get returns the active container with the given name, storing it in the
+// registry if not already known. In that case, the given last activity time
+// is used to compute when the container must be stopped. A zero time means
+// that the container has just been used.
+func (r *Registry) get(name string, lastActive time.Time) *ActiveContainer {
 	log.Debugw("current active containers", "containers", r.containers)
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	c := r.containers[name]
 	if c == nil {
+		now := timeNow()
 		c = &ActiveContainer{
-			name: name,
-			d:    r.d,
+			name:       name,
+			d:          r.d,
+			startTime:  now,
+			registry:   r,
+			lastActive: now,
+		}
+		d := r.d
+		if !lastActive.IsZero() {
+			c.lastActive, c.persisted = lastActive, lastActive
+			if d -= now.Sub(lastActive); d < 0 {
+				d = 0
+			}
 		}
 		if r.d != 0 {
-			c.timer = timeAfterFunc(r.d, func() {
-				log.Debugw("stopping container for inactivity", "container", name)
-				if err := r.stop(name); err != nil {
-					log.Debugw("cannot stop container for inactivity", "container", name, "error", err.Error())
-				}
-			})
+			c.timer = timeAfterFunc(d, r.stopInactive(c))
 		}
 		r.containers[name] = c
 	}
 	return c
 }
 
+// SetDuration changes the duration of inactivity after which containers are
+// stopped. The new duration also applies to the containers already active,
+// taking into account their last activity. A zero duration means that
+// containers are never stopped.
+func (r *Registry) SetDuration(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.d = d
+	now := timeNow()
+	for _, c := range r.containers {
+		c.mu.Lock()
+		c.d = d
+		if c.timer != nil {
+			c.timer.Stop()
+			c.timer = nil
+		}
+		if d != 0 {
+			remaining := d - now.Sub(c.lastActive)
+			if remaining < 0 {
+				remaining = 0
+			}
+			c.timer = timeAfterFunc(remaining, r.stopInactive(c))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// stopInactive returns a function stopping the given container for
+// inactivity.
+func (r *Registry) stopInactive(c *ActiveContainer) func() {
+	return func() {
+		log.Debugw("stopping container for inactivity", "container", c.name)
+		if err := r.stop(c.name); err != nil {
+			log.Debugw("cannot stop container for inactivity", "container", c.name, "error", err.Error())
+			return
+		}
+		audit.Log(audit.Event{
+			Type:      audit.ContainerStop,
+			User:      c.info().User,
+			Container: c.name,
+			Reason:    "inactivity",
+		})
+	}
+}
+
+// Containers returns information about all the active containers.
+func (r *Registry) Containers() []ContainerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]ContainerInfo, 0, len(r.containers))
+	for _, c := range r.containers {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Stop stops the container with the given name, and closes all the shell
+// sessions running in the container. If the container is not running or does
+// not exist, an error with an ErrNotRunning cause is returned.
+func (r *Registry) Stop(name string) error {
+	r.remove(name)
+	if err := r.stop(name); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotRunning))
+	}
+	return nil
+}
+
+// Delete removes the container with the given name, stopping it first if
+// required. All the shell sessions running in the container are closed. If the
+// container does not exist, an error with an ErrNotFound cause is returned.
+func (r *Registry) Delete(name string) error {
+	r.remove(name)
+	client, err := r.connect()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c, err := client.Get(name)
+	if err != nil {
+		if exists, existsErr := containerExists(client, name); existsErr == nil && !exists {
+			return errgo.WithCausef(nil, ErrNotFound, "container %s does not exist", name)
+		}
+		return errgo.Mask(err)
+	}
+	if c.Started() {
+		if err = c.Stop(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err = client.Delete(name); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// remove removes the container with the given name from the registry, and
+// closes its shell sessions.
+func (r *Registry) remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := r.containers[name]; c != nil {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		delete(r.containers, name)
+	}
+	for _, s := range r.sessions {
+		if s.Container == name {
+			s.Backend.Close()
+		}
+	}
+}
+
+// persist stores the given last activity time in the configuration of the
+// container with the given name, so that it survives server restarts.
+func (r *Registry) persist(name string, lastActive time.Time) error {
+	client, err := r.connect()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	c, err := client.Get(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err = c.SetConfig(lastActivityKey, lastActive.UTC().Format(time.RFC3339)); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
 // stop stops the container with the given name. It is usally called by a timer
 // after a certain amount of time without any activity on the container.
 func (r *Registry) stop(name string) error {
-	client, err := lxdutilsConnect(r.socketPath)
+	client, err := r.connect()
 	if err != nil {
 		return errgo.Mask(err)
 	}
 	c, err := client.Get(name)
 	if err != nil {
+		if exists, existsErr := containerExists(client, name); existsErr == nil && !exists {
+			return errgo.WithCausef(nil, ErrNotRunning, "container %s does not exist", name)
+		}
 		return errgo.Mask(err)
 	}
 	if !c.Started() {
-		return errgo.Newf("container %s is not started", name)
+		return errgo.WithCausef(nil, ErrNotRunning, "container %s is not started", name)
 	}
 	if err = c.Stop(); err != nil {
 		return errgo.Mask(err)
@@ -98,11 +272,82 @@ func (r *Registry) stop(name string) error {
 	return nil
 }
 
+// collectGarbage deletes expired containers, and then schedules the next
+// garbage collection.
+func (r *Registry) collectGarbage() {
+	log.Debugw("deleting expired containers")
+	if err := r.deleteExpired(); err != nil {
+		log.Infow("cannot delete expired containers", "err", err)
+	}
+	timeAfterFunc(gcInterval, r.collectGarbage)
+}
+
+// deleteExpired deletes all the stopped user containers, including the ones
+// claimed from the pool, in which there has been no activity for the registry
+// expiry duration. Containers without a persisted
+// last activity time, for instance because created by previous versions of
+// the server, are considered active at the time of the first check.
+func (r *Registry) deleteExpired() error {
+	client, err := r.connect()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	cs, err := client.All()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	now := timeNow()
+	for _, c := range cs {
+		name := c.Name()
+		claimed := strings.HasPrefix(name, pool.Prefix) && pool.Claimed(c)
+		if !strings.HasPrefix(name, lxdutils.ContainerPrefix) && !claimed || c.Started() {
+			continue
+		}
+		r.mu.Lock()
+		active := r.containers[name] != nil
+		r.mu.Unlock()
+		if active {
+			continue
+		}
+		lastActive := lastActivity(c)
+		if lastActive.IsZero() {
+			if err = c.SetConfig(lastActivityKey, now.UTC().Format(time.RFC3339)); err != nil {
+				log.Infow("cannot persist container activity", "container", name, "err", err)
+			}
+			continue
+		}
+		if now.Sub(lastActive) < r.ed {
+			continue
+		}
+		log.Infow("deleting expired container", "container", name, "last activity", lastActive)
+		if err = client.Delete(name); err != nil {
+			log.Infow("cannot delete expired container", "container", name, "err", err)
+			continue
+		}
+		audit.Log(audit.Event{
+			Type:      audit.ContainerDelete,
+			Container: name,
+			Reason:    "expired",
+		})
+	}
+	return nil
+}
+
 // ActiveContainer represents a container currently running.
 type ActiveContainer struct {
-	name  string
-	d     time.Duration
-	timer *time.Timer
+	name      string
+	startTime time.Time
+	registry  *Registry
+
+	// mu protects the fields below.
+	mu         sync.Mutex
+	d          time.Duration
+	timer      *time.Timer
+	user       string
+	addr       string
+	lastActive time.Time
+	persisted  time.Time
+	persisting bool
 }
 
 // Name returns the name of the container.
@@ -110,19 +355,124 @@ func (c *ActiveContainer) Name() string {
 	return c.name
 }
 
-// SetActive registers activity on the container.
+// SetInfo stores the name of the user owning the container and the container
+// address.
+func (c *ActiveContainer) SetInfo(user, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user, c.addr = user, addr
+}
+
+// SetActive registers activity on the container. The last activity time is
+// persisted in the container configuration in the background, at most once
+// every persistInterval, so that callers are never blocked by LXD.
 func (c *ActiveContainer) SetActive() {
-	if c.timer == nil {
+	now := timeNow()
+	c.mu.Lock()
+	c.lastActive = now
+	persist := c.registry != nil && !c.persisting && now.Sub(c.persisted) >= persistInterval
+	if persist {
+		c.persisted, c.persisting = now, true
+	}
+	timer, d := c.timer, c.d
+	c.mu.Unlock()
+	if persist {
+		go c.persist(now)
+	}
+	if timer == nil {
 		return
 	}
-	if c.timer.Stop() {
-		c.timer.Reset(c.d)
+	if timer.Stop() {
+		timer.Reset(d)
+	}
+}
+
+// persist stores the given last activity time in the container
+// configuration. Only one persist operation at a time runs for each
+// container: activity registered in the meantime is persisted later.
+func (c *ActiveContainer) persist(lastActive time.Time) {
+	if err := c.registry.persist(c.name, lastActive); err != nil {
+		log.Debugw("cannot persist container activity", "container", c.name, "error", err.Error())
+	}
+	c.mu.Lock()
+	c.persisting = false
+	c.mu.Unlock()
+}
+
+// info returns information about the container.
+func (c *ActiveContainer) info() ContainerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ContainerInfo{
+		Name:         c.name,
+		User:         c.user,
+		Addr:         c.addr,
+		StartTime:    c.startTime,
+		LastActivity: c.lastActive,
+	}
+}
+
+// ContainerInfo holds information about an active container.
+type ContainerInfo struct {
+	// Name holds the container name.
+	Name string
+	// User holds the name of the user owning the container. It is empty if
+	// the container has not been used since the registry was created.
+	User string
+	// Addr holds the container address, if known.
+	Addr string
+	// StartTime holds the time at which the container was registered.
+	StartTime time.Time
+	// LastActivity holds the time of the last registered activity.
+	LastActivity time.Time
+}
+
+// lastActivity returns the last activity time persisted in the configuration
+// of the given container, or a zero time if not available.
+func lastActivity(c lxdclient.Container) time.Time {
+	t, err := time.Parse(time.RFC3339, c.Config(lastActivityKey))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// lastActivityKey holds the LXD configuration key used to persist the last
+// activity time of containers.
+const lastActivityKey = "user.jujushell.last-activity"
+
+// gcInterval holds the interval between two checks for expired containers.
+const gcInterval = 10 * time.Minute
+
+// ErrNotRunning is the cause of errors returned when stopping containers which
+// are not running or do not exist.
+var ErrNotRunning = errgo.New("container is not running")
+
+// ErrNotFound is the cause of errors returned when deleting containers which do
+// not exist.
+var ErrNotFound = errgo.New("container not found")
+
+// containerExists reports whether a container with the given name exists.
+func containerExists(client lxdclient.Client, name string) (bool, error) {
+	cs, err := client.All()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	for _, c := range cs {
+		if c.Name() == name {
+			return true, nil
+		}
 	}
+	return false, nil
 }
 
-// lxdutilsConnect is defined as a variable for testing.
-var lxdutilsConnect = func(socketPath string) (lxdclient.Client, error) {
-	return lxdutils.Connect(socketPath)
+// persistInterval holds the minimum interval between two writes of the last
+// activity time of a container.
+const persistInterval = time.Minute
+
+// timeNow is defined as a variable for testing.
+var timeNow = func() time.Time {
+	return time.Now()
 }
 
 // timeAfterFunc is defined as a variable for testing.
@@ -5,19 +5,21 @@ package registry_test
 
 import (
 	"errors"
-	"fmt"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
 
 	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
 	"github.com/juju/jujushell/internal/registry"
+	"github.com/juju/jujushell/internal/wsproxy"
 )
 
 var newTests = []struct {
 	about                  string
-	client                 *client
+	setup                  func(client *lxdtest.Client)
 	clientError            string
 	expectedAfterFuncCalls int
 	expectedCalls          [][]string
@@ -28,36 +30,42 @@ var newTests = []struct {
 	expectedError: "cannot connect to LXD: bad wolf",
 }, {
 	about: "error retrieving containers",
-	client: &client{
-		allError: errors.New("bad wolf"),
+	setup: func(client *lxdtest.Client) {
+		client.SetError("All", "", errors.New("bad wolf"))
 	},
 	expectedCalls: [][]string{
-		call("All"),
+		{"All"},
 	},
-	expectedError: "cannot retrieve initial containers: bad wolf",
+	expectedError: "cannot retrieve initial containers: cannot get containers: bad wolf",
 }, {
-	about:  "success",
-	client: &client{},
+	about: "success",
+	setup: func(client *lxdtest.Client) {},
 	expectedCalls: [][]string{
-		call("All"),
+		{"All"},
 	},
 }, {
 	about: "success with existing container instances",
-	client: &client{
-		allResult: []*container{
-			newContainer("c1", true, nil),
-			newContainer("c2", false, nil),
-			newContainer("c3", true, nil),
-		},
+	setup: func(client *lxdtest.Client) {
+		client.AddContainer("c1", true)
+		client.AddContainer("c2", false)
+		client.AddContainer("c3", true)
 	},
 	expectedAfterFuncCalls: 2,
 	expectedCalls: [][]string{
-		call("All"),
-		call("(c1).Started"),
-		call("(c1).Name"),
-		call("(c2).Started"),
-		call("(c3).Started"),
-		call("(c3).Name"),
+		{"All"},
+	},
+}, {
+	about: "success with pool container instances",
+	setup: func(client *lxdtest.Client) {
+		client.AddContainer("tp-1", true)
+		client.AddContainer("c1", true)
+		// Containers claimed from the pool are assigned to users.
+		client.AddContainer("tp-2", true).SetConfig("user.jujushell.user", "who")
+		client.ResetCalls()
+	},
+	expectedAfterFuncCalls: 2,
+	expectedCalls: [][]string{
+		{"All"},
 	},
 }}
 
@@ -65,14 +73,17 @@ func TestNew(t *testing.T) {
 	c := qt.New(t)
 	for _, test := range newTests {
 		c.Run(test.about, func(c *qt.C) {
-			// Patch the LXD client connection.
-			c.Patch(registry.LXDutilsConnect, func(socket string) (lxdclient.Client, error) {
-				c.Assert(socket, qt.Equals, socketPath)
+			// Set up the LXD client connection.
+			client := lxdtest.New()
+			if test.setup != nil {
+				test.setup(client)
+			}
+			connect := func() (lxdclient.Client, error) {
 				if test.clientError != "" {
 					return nil, errors.New(test.clientError)
 				}
-				return test.client, nil
-			})
+				return client, nil
+			}
 
 			// Patch the time.AfterFunc call.
 			var afterFuncCalls int
@@ -83,7 +94,7 @@ func TestNew(t *testing.T) {
 			})
 
 			// Run the test.
-			r, err := registry.New(duration, socketPath)
+			r, err := registry.New(duration, resumeDuration, 0, connect)
 			if test.expectedError != "" {
 				c.Assert(err, qt.ErrorMatches, test.expectedError)
 				c.Assert(r, qt.IsNil)
@@ -92,24 +103,177 @@ func TestNew(t *testing.T) {
 				c.Assert(r, qt.Not(qt.IsNil))
 			}
 			c.Assert(afterFuncCalls, qt.Equals, test.expectedAfterFuncCalls)
-			if test.client != nil {
-				c.Assert(test.client.calls, qt.DeepEquals, test.expectedCalls)
+			if test.setup != nil {
+				c.Assert(client.Calls(), qt.DeepEquals, test.expectedCalls)
 			}
 		})
 	}
 }
 
-func TestGet(t *testing.T) {
+func TestNewWithLastActivity(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	// Set up the LXD client and patch time.AfterFunc and time.Now calls.
+	cl := lxdtest.New()
+	now := time.Date(2018, 5, 4, 12, 0, 0, 0, time.UTC)
+	cl.AddContainer("c1", true).SetConfig("user.jujushell.last-activity", now.Add(-10*time.Second).Format(time.RFC3339))
+	cl.AddContainer("c2", true).SetConfig("user.jujushell.last-activity", now.Add(-time.Hour).Format(time.RFC3339))
+	cl.AddContainer("c3", true).SetConfig("user.jujushell.last-activity", "bad wolf")
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
+	}
+	durations := make(map[time.Duration]bool)
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		durations[d] = true
+		return time.NewTimer(time.Hour)
+	})
+	c.Patch(registry.TimeNow, func() time.Time {
+		return now
+	})
+
+	// Create the registry.
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+
+	// Timers take into account the persisted last activity.
+	c.Assert(durations, qt.DeepEquals, map[time.Duration]bool{
+		duration - 10*time.Second: true,
+		0:                         true,
+		duration:                  true,
+	})
+	infos := r.Containers()
+	c.Assert(infos, qt.HasLen, 3)
+	c.Assert(infos[0].LastActivity, qt.Equals, now.Add(-10*time.Second))
+	c.Assert(infos[1].LastActivity, qt.Equals, now.Add(-time.Hour))
+	c.Assert(infos[2].LastActivity, qt.Equals, now)
+}
+
+func TestSetActive(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	// Set up the LXD client and patch time.AfterFunc and time.Now calls.
+	cl := lxdtest.New()
+	container := cl.AddContainer("my-container", true)
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
+	}
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		return time.NewTimer(time.Hour)
+	})
+	now := time.Date(2018, 5, 4, 12, 0, 0, 0, time.UTC)
+	c.Patch(registry.TimeNow, func() time.Time {
+		return now
+	})
+
+	// Create a registry.
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	ac := r.Get("my-container")
+
+	// The first activity is persisted in the background.
+	cl.ResetCalls()
+	ac.SetActive()
+	err = lxdtest.WaitFor(func() bool {
+		return len(cl.Calls()) >= 2
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"Get", "my-container"},
+		{"(my-container).SetConfig", "user.jujushell.last-activity", "2018-05-04T12:00:00Z"},
+	})
+
+	// Subsequent activity is not persisted until the persist interval
+	// elapses.
+	cl.ResetCalls()
+	now = now.Add(30 * time.Second)
+	ac.SetActive()
+	c.Assert(cl.Calls(), qt.HasLen, 0)
+	now = now.Add(30 * time.Second)
+	ac.SetActive()
+	err = lxdtest.WaitFor(func() bool {
+		return len(cl.Calls()) >= 2
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"Get", "my-container"},
+		{"(my-container).SetConfig", "user.jujushell.last-activity", "2018-05-04T12:01:00Z"},
+	})
+	c.Assert(container.Config("user.jujushell.last-activity"), qt.Equals, "2018-05-04T12:01:00Z")
+	c.Assert(r.Containers()[0].LastActivity, qt.Equals, now)
+}
+
+func TestSetActiveBlockedLXD(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
 
-	// Patch lxdutils.Connect and time.AfterFunc calls.
-	cl := client{
-		getResult: newContainer("my-container", true, nil),
+	// Set up the LXD client and patch time.AfterFunc and time.Now calls.
+	cl := lxdtest.New()
+	container := cl.AddContainer("my-container", true)
+	var blocked bool
+	unblock := make(chan struct{})
+	connections := make(chan struct{}, 10)
+	connect := func() (lxdclient.Client, error) {
+		if blocked {
+			connections <- struct{}{}
+			<-unblock
+		}
+		return cl, nil
+	}
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		return time.NewTimer(time.Hour)
+	})
+	now := time.Date(2018, 5, 4, 12, 0, 0, 0, time.UTC)
+	c.Patch(registry.TimeNow, func() time.Time {
+		return now
+	})
+
+	// Create a registry, and then make LXD hang.
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	ac := r.Get("my-container")
+	blocked = true
+
+	// Registering activity does not block.
+	done := make(chan struct{})
+	go func() {
+		ac.SetActive()
+		now = now.Add(2 * time.Minute)
+		ac.SetActive()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("SetActive blocked by LXD")
 	}
-	c.Patch(registry.LXDutilsConnect, func(socket string) (lxdclient.Client, error) {
-		return &cl, nil
+
+	// Only one persist operation is in flight.
+	<-connections
+	close(unblock)
+	err = lxdtest.WaitFor(func() bool {
+		return len(cl.Calls()) >= 2
 	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"Get", "my-container"},
+		{"(my-container).SetConfig", "user.jujushell.last-activity", "2018-05-04T12:00:00Z"},
+	})
+	c.Assert(connections, qt.HasLen, 0)
+	c.Assert(container.Config("user.jujushell.last-activity"), qt.Equals, "2018-05-04T12:00:00Z")
+}
+
+func TestGet(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	// Set up the LXD client and patch time.AfterFunc calls.
+	cl := lxdtest.New()
+	container := cl.AddContainer("my-container", true)
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
+	}
 	var timeoutFunc func()
 	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
 		timeoutFunc = f
@@ -117,7 +281,7 @@ func TestGet(t *testing.T) {
 	})
 
 	//  Create a registry.
-	r, err := registry.New(duration, socketPath)
+	r, err := registry.New(duration, resumeDuration, 0, connect)
 	c.Assert(err, qt.Equals, nil)
 
 	// Get an active container.
@@ -127,104 +291,363 @@ func TestGet(t *testing.T) {
 	// Ensure that running the timeout function stops the container.
 	c.Assert(timeoutFunc, qt.Not(qt.IsNil))
 	timeoutFunc()
-	c.Assert(cl.calls, qt.DeepEquals, [][]string{
-		call("All"),
-		call("Get", "my-container"),
-		call("(my-container).Started"),
-		call("(my-container).Stop"),
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"All"},
+		{"Get", "my-container"},
+		{"(my-container).Stop"},
 	})
+	c.Assert(container.Started(), qt.Equals, false)
 
 	// Try again with a container already stopped.
-	cl.calls = nil
+	cl.ResetCalls()
 	timeoutFunc()
-	c.Assert(cl.calls, qt.DeepEquals, [][]string{
-		call("Get", "my-container"),
-		call("(my-container).Started"),
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"Get", "my-container"},
 	})
 }
 
-// client implements lxdclient.Client for testing.
-type client struct {
-	lxdclient.Client
-
-	allResult []*container
-	allError  error
+func TestSetDuration(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
 
-	getResult *container
-	getError  error
+	// Set up the LXD client and patch time.AfterFunc and time.Now calls.
+	cl := lxdtest.New()
+	cl.AddContainer("my-container", true)
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
+	}
+	var durations []time.Duration
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		durations = append(durations, d)
+		return time.NewTimer(time.Hour)
+	})
+	now := time.Date(2018, 5, 4, 12, 0, 0, 0, time.UTC)
+	c.Patch(registry.TimeNow, func() time.Time {
+		return now
+	})
 
-	calls [][]string
+	// Create a registry: the running container is registered.
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	r.Get("my-container")
+	c.Assert(durations, qt.DeepEquals, []time.Duration{duration})
+
+	// The new duration applies to existing containers taking into account
+	// their last activity.
+	durations = nil
+	now = now.Add(10 * time.Second)
+	r.SetDuration(time.Minute)
+	c.Assert(durations, qt.DeepEquals, []time.Duration{50 * time.Second})
+
+	// Containers are never stopped with a zero duration.
+	durations = nil
+	r.SetDuration(0)
+	r.Get("another-container")
+	c.Assert(durations, qt.HasLen, 0)
+
+	// Containers inactive for longer than the duration are stopped
+	// immediately.
+	now = now.Add(time.Minute)
+	r.SetDuration(30 * time.Second)
+	c.Assert(durations, qt.DeepEquals, []time.Duration{0, 0})
+
+	// The new duration applies to new containers.
+	durations = nil
+	r.Get("yet-another-container")
+	c.Assert(durations, qt.DeepEquals, []time.Duration{30 * time.Second})
 }
 
-func (cl *client) register(name string, args ...string) {
-	cl.calls = append(cl.calls, call(name, args...))
-}
+func TestContainers(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
 
-func (cl *client) All() ([]lxdclient.Container, error) {
-	cl.register("All")
-	result := make([]lxdclient.Container, len(cl.allResult))
-	for i, container := range cl.allResult {
-		container.client = cl
-		result[i] = container
+	// Set up the LXD client and patch time.AfterFunc and time.Now calls.
+	cl := lxdtest.New()
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
 	}
-	return result, cl.allError
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		return time.NewTimer(time.Hour)
+	})
+	now := time.Date(2018, 5, 4, 12, 0, 0, 0, time.UTC)
+	c.Patch(registry.TimeNow, func() time.Time {
+		return now
+	})
+
+	// Create a registry.
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Containers(), qt.DeepEquals, []registry.ContainerInfo{})
+	cl.AddContainer("c2", true)
+
+	// Add some active containers.
+	r.Get("c2").SetInfo("dalek", "1.2.3.5")
+	r.Get("c1")
+	now = now.Add(time.Minute)
+	ac := r.Get("c2")
+	ac.SetActive()
+	c.Assert(r.Containers(), qt.DeepEquals, []registry.ContainerInfo{{
+		Name:         "c1",
+		StartTime:    now.Add(-time.Minute),
+		LastActivity: now.Add(-time.Minute),
+	}, {
+		Name:         "c2",
+		User:         "dalek",
+		Addr:         "1.2.3.5",
+		StartTime:    now.Add(-time.Minute),
+		LastActivity: now,
+	}})
 }
 
-func (cl *client) Get(name string) (lxdclient.Container, error) {
-	cl.register("Get", name)
-	if cl.getResult != nil {
-		cl.getResult.client = cl
+func TestStop(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	// Set up the LXD client and patch time.AfterFunc calls.
+	cl := lxdtest.New()
+	container := cl.AddContainer("my-container", true)
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
 	}
-	return cl.getResult, cl.getError
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		return time.NewTimer(time.Hour)
+	})
+
+	// Create a registry with an active container and a session.
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	r.Get("my-container")
+	conn := newBackendConn()
+	s, err := r.AddSession("who", "my-container", "1.2.3.4", wsproxy.NewBackend(conn))
+	c.Assert(err, qt.Equals, nil)
+
+	// Stop the container.
+	err = r.Stop("my-container")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"All"},
+		{"Get", "my-container"},
+		{"(my-container).Stop"},
+	})
+	c.Assert(container.Started(), qt.Equals, false)
+	c.Assert(r.Containers(), qt.HasLen, 0)
+	c.Assert(conn.isClosed(), qt.Equals, true)
+	<-s.Backend.Done()
+
+	// Stopping the container again reports that it is not running.
+	err = r.Stop("my-container")
+	c.Assert(err, qt.ErrorMatches, "container my-container is not started")
+	c.Assert(errgo.Cause(err), qt.Equals, registry.ErrNotRunning)
 }
 
-// newContainer creates and returns a new testing container.
-func newContainer(name string, started bool, stopErr error) *container {
-	return &container{
-		name:    name,
-		started: started,
-		stopErr: stopErr,
+func TestStopNotFound(t *testing.T) {
+	c := qt.New(t)
+	cl := lxdtest.New()
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
 	}
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	cl.ResetCalls()
+
+	// Stopping a container which does not exist reports that it is not
+	// running.
+	err = r.Stop("my-container")
+	c.Assert(err, qt.ErrorMatches, "container my-container does not exist")
+	c.Assert(errgo.Cause(err), qt.Equals, registry.ErrNotRunning)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"Get", "my-container"},
+		{"All"},
+	})
+
+	// Other errors are returned as they are.
+	cl.SetError("All", "", errors.New("bad wolf"))
+	err = r.Stop("my-container")
+	c.Assert(err, qt.ErrorMatches, `cannot get container "my-container": not found`)
+	c.Assert(errgo.Cause(err), qt.Not(qt.Equals), registry.ErrNotRunning)
 }
 
-// container implements lxdclient.Container for testing.
-type container struct {
-	lxdclient.Container
+var deleteTests = []struct {
+	about         string
+	setup         func(client *lxdtest.Client)
+	expectedCalls [][]string
+	expectedError string
+	expectedCause error
+}{{
+	about: "started container",
+	setup: func(client *lxdtest.Client) {
+		client.AddContainer("my-container", true)
+	},
+	expectedCalls: [][]string{
+		{"Get", "my-container"},
+		{"(my-container).Stop"},
+		{"Delete", "my-container"},
+	},
+}, {
+	about: "stopped container",
+	setup: func(client *lxdtest.Client) {
+		client.AddContainer("my-container", false)
+	},
+	expectedCalls: [][]string{
+		{"Get", "my-container"},
+		{"Delete", "my-container"},
+	},
+}, {
+	about: "container not found",
+	setup: func(client *lxdtest.Client) {},
+	expectedCalls: [][]string{
+		{"Get", "my-container"},
+		{"All"},
+	},
+	expectedError: "container my-container does not exist",
+	expectedCause: registry.ErrNotFound,
+}, {
+	about: "error retrieving the container",
+	setup: func(client *lxdtest.Client) {
+		client.AddContainer("my-container", true)
+		client.SetError("Get", "my-container", errors.New("bad wolf"))
+	},
+	expectedCalls: [][]string{
+		{"Get", "my-container"},
+	},
+	expectedError: `cannot get container "my-container": bad wolf`,
+}, {
+	about: "error stopping the container",
+	setup: func(client *lxdtest.Client) {
+		client.AddContainer("my-container", true)
+		client.SetError("Stop", "my-container", errors.New("bad wolf"))
+	},
+	expectedCalls: [][]string{
+		{"Get", "my-container"},
+		{"(my-container).Stop"},
+	},
+	expectedError: `cannot stop container "my-container": bad wolf`,
+}, {
+	about: "error deleting the container",
+	setup: func(client *lxdtest.Client) {
+		client.AddContainer("my-container", false)
+		client.SetError("Delete", "my-container", errors.New("bad wolf"))
+	},
+	expectedCalls: [][]string{
+		{"Get", "my-container"},
+		{"Delete", "my-container"},
+	},
+	expectedError: `cannot delete container "my-container": bad wolf`,
+}}
 
-	client *client
+func TestDelete(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range deleteTests {
+		c.Run(test.about, func(c *qt.C) {
+			// Set up the LXD client and patch time.AfterFunc calls.
+			cl := lxdtest.New()
+			test.setup(cl)
+			connect := func() (lxdclient.Client, error) {
+				return cl, nil
+			}
+			c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+				return time.NewTimer(time.Hour)
+			})
 
-	name    string
-	started bool
-	stopErr error
-}
+			// Create a registry with an active container.
+			r, err := registry.New(duration, resumeDuration, 0, connect)
+			c.Assert(err, qt.Equals, nil)
+			r.Get("my-container")
+			cl.ResetCalls()
 
-func (c *container) register(name string, args ...string) {
-	name = fmt.Sprintf("(%s).%s", c.name, name)
-	c.client.register(name, args...)
+			// Delete the container.
+			err = r.Delete("my-container")
+			if test.expectedError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectedError)
+				if test.expectedCause != nil {
+					c.Assert(errgo.Cause(err), qt.Equals, test.expectedCause)
+				}
+				c.Assert(cl.Calls(), qt.DeepEquals, test.expectedCalls)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(cl.Calls(), qt.DeepEquals, test.expectedCalls)
+			c.Assert(cl.Container("my-container"), qt.IsNil)
+			c.Assert(r.Containers(), qt.HasLen, 0)
+		})
+	}
 }
 
-func (c *container) Name() string {
-	c.register("Name")
-	return c.name
-}
+func TestDeleteExpired(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
 
-func (c *container) Started() bool {
-	c.register("Started")
-	return c.started
-}
+	// Set up the LXD client and patch time.AfterFunc and time.Now calls.
+	now := time.Date(2018, 5, 4, 12, 0, 0, 0, time.UTC)
+	cl := lxdtest.New()
+	cl.AddContainer("ts-started", true)
+	cl.AddContainer("other", false)
+	cl.AddContainer("ts-expired", false).SetConfig("user.jujushell.last-activity", now.Add(-expiry).Format(time.RFC3339))
+	cl.AddContainer("ts-recent", false).SetConfig("user.jujushell.last-activity", now.Add(-expiry+time.Minute).Format(time.RFC3339))
+	unknown := cl.AddContainer("ts-unknown", false)
+	// Containers claimed from the pool keep their name, while unclaimed
+	// pool containers are managed by the pool.
+	claimed := cl.AddContainer("tp-expired", false)
+	claimed.SetConfig("user.jujushell.user", "who")
+	claimed.SetConfig("user.jujushell.last-activity", now.Add(-expiry).Format(time.RFC3339))
+	cl.AddContainer("tp-unclaimed", false)
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
+	}
+	var gcFunc func()
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		if d == 10*time.Minute {
+			gcFunc = f
+		}
+		return time.NewTimer(time.Hour)
+	})
+	c.Patch(registry.TimeNow, func() time.Time {
+		return now
+	})
 
-func (c *container) Stop() error {
-	c.register("Stop")
-	c.started = false
-	return c.stopErr
+	// Create a registry: garbage collection is scheduled.
+	r, err := registry.New(duration, resumeDuration, expiry, connect)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(gcFunc, qt.Not(qt.IsNil))
+
+	// Delete expired containers.
+	cl.ResetCalls()
+	err = registry.DeleteExpired(r)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(cl.Calls(), qt.DeepEquals, [][]string{
+		{"All"},
+		{"Delete", "tp-expired"},
+		{"Delete", "ts-expired"},
+		{"(ts-unknown).SetConfig", "user.jujushell.last-activity", "2018-05-04T12:00:00Z"},
+	})
+	c.Assert(cl.Container("tp-expired"), qt.IsNil)
+	c.Assert(cl.Container("tp-unclaimed"), qt.Not(qt.IsNil))
+	c.Assert(cl.Container("ts-expired"), qt.IsNil)
+	c.Assert(cl.Container("ts-recent"), qt.Not(qt.IsNil))
+	c.Assert(cl.Container("ts-started"), qt.Not(qt.IsNil))
+	c.Assert(cl.Container("other"), qt.Not(qt.IsNil))
+	c.Assert(unknown.Config("user.jujushell.last-activity"), qt.Equals, "2018-05-04T12:00:00Z")
 }
 
-func call(name string, args ...string) []string {
-	return append([]string{name}, args...)
+func TestDeleteExpiredError(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	cl := lxdtest.New()
+	connect := func() (lxdclient.Client, error) {
+		return cl, nil
+	}
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	cl.SetError("All", "", errors.New("bad wolf"))
+	err = registry.DeleteExpired(r)
+	c.Assert(err, qt.ErrorMatches, "cannot get containers: bad wolf")
 }
 
 // duration is the timeout duration used in tests.
 var duration = 42 * time.Second
 
-// socketPath is the path to the LXD socket used in tests.
-const socketPath = "/path/to/lxd.socket"
+// expiry is the container expiry duration used in tests.
+var expiry = 24 * time.Hour
+
+// resumeDuration is the session resume duration used in tests.
+var resumeDuration = 47 * time.Second
@@ -0,0 +1,118 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
+// Session represents a shell session, which can be resumed by its owner after
+// the client disconnects, provided that the registry resume duration is not
+// zero.
+type Session struct {
+	// Token holds the token used by clients to resume the session.
+	Token string
+	// User holds the name of the user owning the session.
+	User string
+	// Container and Addr hold the name and address of the LXD container.
+	Container string
+	Addr      string
+	// Backend holds the connection to the shell service in the container.
+	Backend *wsproxy.Backend
+
+	attached bool
+	timer    *time.Timer
+}
+
+// AddSession stores and returns a new attached session for the given user,
+// container and shell service connection. The session is removed from the
+// registry when the backend connection is closed.
+func (r *Registry) AddSession(user, container, addr string, b *wsproxy.Backend) (*Session, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot generate session token")
+	}
+	s := &Session{
+		Token:     token,
+		User:      user,
+		Container: container,
+		Addr:      addr,
+		Backend:   b,
+		attached:  true,
+	}
+	r.mu.Lock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]*Session)
+	}
+	r.sessions[token] = s
+	r.mu.Unlock()
+	go func() {
+		<-b.Done()
+		r.removeSession(s)
+	}()
+	return s, nil
+}
+
+// Resume returns the detached session with the given token and owned by the
+// given user, and marks it as attached.
+func (r *Registry) Resume(token, user string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.sessions[token]
+	if s == nil || s.User != user {
+		return nil, errgo.New("session not found")
+	}
+	if s.attached {
+		return nil, errgo.New("session already in use")
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.attached = true
+	return s, nil
+}
+
+// Detach marks the given session as detached. The session is closed if not
+// resumed before the registry resume duration elapses.
+func (r *Registry) Detach(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.attached = false
+	if r.rd == 0 {
+		s.Backend.Close()
+		return
+	}
+	log.Debugw("session detached", "user", s.User, "container", s.Container)
+	s.timer = timeAfterFunc(r.rd, func() {
+		log.Debugw("closing detached session", "user", s.User, "container", s.Container)
+		s.Backend.Close()
+	})
+}
+
+// removeSession removes the given session from the registry.
+func (r *Registry) removeSession(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	delete(r.sessions, s.Token)
+}
+
+// newToken returns a new random session token. It is defined as a variable
+// for testing.
+var newToken = func() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package registry_test
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/internal/lxdclient"
+	"github.com/juju/jujushell/internal/lxdclient/lxdtest"
+	"github.com/juju/jujushell/internal/registry"
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
+func TestSessions(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	// Set up the LXD client and patch time.AfterFunc and the token generation.
+	connect := func() (lxdclient.Client, error) {
+		return lxdtest.New(), nil
+	}
+	var timeoutFunc func()
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		c.Assert(d, qt.Equals, resumeDuration)
+		timeoutFunc = f
+		return time.NewTimer(time.Hour)
+	})
+	c.Patch(registry.NewToken, func() (string, error) {
+		return "my-token", nil
+	})
+
+	// Create a registry.
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+
+	// Add a session.
+	conn := newBackendConn()
+	b := wsproxy.NewBackend(conn)
+	s, err := r.AddSession("who", "my-container", "1.2.3.4", b)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s.Token, qt.Equals, "my-token")
+	c.Assert(s.User, qt.Equals, "who")
+	c.Assert(s.Container, qt.Equals, "my-container")
+	c.Assert(s.Addr, qt.Equals, "1.2.3.4")
+	c.Assert(s.Backend, qt.Equals, b)
+
+	// The session cannot be resumed while attached.
+	_, err = r.Resume("my-token", "who")
+	c.Assert(err, qt.ErrorMatches, "session already in use")
+
+	// Detach the session.
+	r.Detach(s)
+	c.Assert(timeoutFunc, qt.Not(qt.IsNil))
+
+	// The session cannot be resumed by other users or with a bad token.
+	_, err = r.Resume("my-token", "dalek")
+	c.Assert(err, qt.ErrorMatches, "session not found")
+	_, err = r.Resume("bad-wolf", "who")
+	c.Assert(err, qt.ErrorMatches, "session not found")
+
+	// The session owner can resume the session.
+	s2, err := r.Resume("my-token", "who")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(s2, qt.Equals, s)
+
+	// Detach the session again, and simulate the resume timeout.
+	r.Detach(s)
+	timeoutFunc()
+	c.Assert(conn.isClosed(), qt.Equals, true)
+	<-b.Done()
+	waitRemoved(c, r, "my-token", "who")
+}
+
+func TestSessionsResumeDisabled(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	// Set up the LXD client and patch time.AfterFunc calls.
+	connect := func() (lxdclient.Client, error) {
+		return lxdtest.New(), nil
+	}
+	c.Patch(registry.TimeAfterFunc, func(d time.Duration, f func()) *time.Timer {
+		c.Fatalf("unexpected timer for duration %v", d)
+		return nil
+	})
+
+	// Create a registry without resume duration.
+	r, err := registry.New(0, 0, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+
+	// Add and detach a session.
+	conn := newBackendConn()
+	s, err := r.AddSession("who", "my-container", "1.2.3.4", wsproxy.NewBackend(conn))
+	c.Assert(err, qt.Equals, nil)
+	r.Detach(s)
+
+	// The session has been immediately closed.
+	c.Assert(conn.isClosed(), qt.Equals, true)
+	<-s.Backend.Done()
+	waitRemoved(c, r, s.Token, "who")
+}
+
+func TestAddSessionTokenError(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	connect := func() (lxdclient.Client, error) {
+		return lxdtest.New(), nil
+	}
+	c.Patch(registry.NewToken, func() (string, error) {
+		return "", errors.New("bad wolf")
+	})
+	r, err := registry.New(duration, resumeDuration, 0, connect)
+	c.Assert(err, qt.Equals, nil)
+	conn := newBackendConn()
+	defer conn.Close()
+	s, err := r.AddSession("who", "my-container", "1.2.3.4", wsproxy.NewBackend(conn))
+	c.Assert(err, qt.ErrorMatches, "cannot generate session token: bad wolf")
+	c.Assert(s, qt.IsNil)
+}
+
+// waitRemoved waits for the session with the given token to be removed from
+// the registry.
+func waitRemoved(c *qt.C, r *registry.Registry, token, user string) {
+	for i := 0; i < 100; i++ {
+		if _, err := r.Resume(token, user); err != nil {
+			c.Assert(err, qt.ErrorMatches, "session not found")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("session %q not removed", token)
+}
+
+// newBackendConn returns a backend connection for testing.
+func newBackendConn() *backendConn {
+	return &backendConn{
+		closed: make(chan struct{}),
+	}
+}
+
+// backendConn implements wsproxy.BackendConn for testing. No messages are
+// ever sent by the backend.
+type backendConn struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *backendConn) NextReader() (messageType int, r io.Reader, err error) {
+	<-c.closed
+	return 0, nil, errors.New("connection closed")
+}
+
+func (c *backendConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *backendConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package terminado implements the message format used by the Terminado
+// service running in the LXD containers. Messages are JSON arrays in which the
+// first element is the message type and the remaining ones are its arguments,
+// for instance ["stdin", "ls\r"] or ["set_size", 24, 80].
+package terminado
+
+import (
+	"encoding/json"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Stdin, Stdout, SetSize and Disconnect hold the Terminado message types.
+// Disconnect is sent by Terminado when the shell exits.
+const (
+	Stdin      = "stdin"
+	Stdout     = "stdout"
+	SetSize    = "set_size"
+	Disconnect = "disconnect"
+)
+
+// Encode encodes a Terminado message with the given type and arguments.
+func Encode(typ string, args ...interface{}) ([]byte, error) {
+	msg := append([]interface{}{typ}, args...)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal %q message", typ)
+	}
+	return data, nil
+}
+
+// Decode decodes the given Terminado message, and returns its type and raw
+// arguments.
+func Decode(data []byte) (typ string, args []json.RawMessage, err error) {
+	var msg []json.RawMessage
+	if err = json.Unmarshal(data, &msg); err != nil {
+		return "", nil, errgo.Notef(err, "cannot unmarshal message")
+	}
+	if len(msg) == 0 {
+		return "", nil, errgo.New("empty message")
+	}
+	if err = json.Unmarshal(msg[0], &typ); err != nil {
+		return "", nil, errgo.Notef(err, "cannot unmarshal message type")
+	}
+	return typ, msg[1:], nil
+}
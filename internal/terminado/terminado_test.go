@@ -0,0 +1,70 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package terminado_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/jujushell/internal/terminado"
+)
+
+func TestEncode(t *testing.T) {
+	c := qt.New(t)
+	data, err := terminado.Encode(terminado.SetSize, 24, 80)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Equals, `["set_size",24,80]`)
+
+	data, err = terminado.Encode(terminado.Stdin, "ls\r")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Equals, `["stdin","ls\r"]`)
+}
+
+var decodeTests = []struct {
+	about         string
+	data          string
+	expectedType  string
+	expectedArgs  []json.RawMessage
+	expectedError string
+}{{
+	about:        "stdout message",
+	data:         `["stdout", "exterminate!"]`,
+	expectedType: "stdout",
+	expectedArgs: []json.RawMessage{json.RawMessage(`"exterminate!"`)},
+}, {
+	about:        "message without arguments",
+	data:         `["disconnect"]`,
+	expectedType: "disconnect",
+	expectedArgs: []json.RawMessage{},
+}, {
+	about:         "invalid message",
+	data:          `{"operation": "start"}`,
+	expectedError: "cannot unmarshal message: .*",
+}, {
+	about:         "empty message",
+	data:          `[]`,
+	expectedError: "empty message",
+}, {
+	about:         "invalid message type",
+	data:          `[42, "bad wolf"]`,
+	expectedError: "cannot unmarshal message type: .*",
+}}
+
+func TestDecode(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range decodeTests {
+		c.Run(test.about, func(c *qt.C) {
+			typ, args, err := terminado.Decode([]byte(test.data))
+			if test.expectedError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectedError)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(typ, qt.Equals, test.expectedType)
+			c.Assert(args, qt.DeepEquals, test.expectedArgs)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package wsproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// BackendConn is a WebSocket connection to a backend server.
+type BackendConn interface {
+	Conn
+	// Close closes the WebSocket connection.
+	Close() error
+}
+
+// NewBackend returns a backend wrapping the given WebSocket connection. The
+// backend connection survives client disconnections, so that different client
+// connections can be attached to it over time. While no clients are attached,
+// the most recent messages sent by the backend are buffered, and then sent to
+// the next attached client.
+func NewBackend(conn BackendConn) *Backend {
+	b := &Backend{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	go b.pump()
+	return b
+}
+
+// Backend holds a WebSocket connection to a backend server.
+type Backend struct {
+	conn BackendConn
+	done chan struct{}
+
+	// writeMu protects writes to the backend connection.
+	writeMu sync.Mutex
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	err      error
+	client   Conn
+	detachCh chan error
+	buffer   []message
+	size     int
+}
+
+// message holds a WebSocket message.
+type message struct {
+	messageType int
+	data        []byte
+}
+
+// Attach copies messages back and forth between the given client connection
+// and the backend, until either the client or the backend connection fails.
+// Only one client can be attached at a time.
+func (b *Backend) Attach(client Conn) error {
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return b.err
+	}
+	if b.client != nil {
+		b.mu.Unlock()
+		return errgo.New("a client is already attached")
+	}
+	// Send messages received while no clients were attached.
+	for _, msg := range b.buffer {
+		if err := writeMessage(client, msg); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	b.buffer, b.size = nil, 0
+	detachCh := make(chan error, 1)
+	b.client, b.detachCh = client, detachCh
+	b.mu.Unlock()
+
+	go b.copyFrom(client, detachCh)
+	err := <-detachCh
+
+	b.mu.Lock()
+	if b.client == client {
+		b.client, b.detachCh = nil, nil
+	}
+	b.mu.Unlock()
+	return err
+}
+
+// Done returns a channel that is closed when the backend connection is
+// closed.
+func (b *Backend) Done() <-chan struct{} {
+	return b.done
+}
+
+// Close closes the backend connection.
+func (b *Backend) Close() error {
+	return b.conn.Close()
+}
+
+// copyFrom copies messages sent by the given client to the backend, until the
+// client is detached or its connection fails.
+func (b *Backend) copyFrom(client Conn, detachCh chan error) {
+	for {
+		msg, err := readMessage(client)
+		if err != nil {
+			notify(detachCh, err)
+			return
+		}
+		b.writeMu.Lock()
+		b.mu.Lock()
+		attached := b.client == client
+		b.mu.Unlock()
+		if attached {
+			err = writeMessage(b.conn, msg)
+		}
+		b.writeMu.Unlock()
+		if !attached {
+			return
+		}
+		if err != nil {
+			notify(detachCh, err)
+			return
+		}
+	}
+}
+
+// pump reads messages from the backend and sends them to the currently
+// attached client, if any, or to the buffer otherwise.
+func (b *Backend) pump() {
+	for {
+		msg, err := readMessage(b.conn)
+		if err != nil {
+			b.mu.Lock()
+			b.err = errgo.Notef(err, "backend connection closed")
+			close(b.done)
+			if b.detachCh != nil {
+				notify(b.detachCh, b.err)
+			}
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Lock()
+		client, detachCh := b.client, b.detachCh
+		if client == nil {
+			b.store(msg)
+		}
+		b.mu.Unlock()
+		if client == nil {
+			continue
+		}
+		if err = writeMessage(client, msg); err != nil {
+			notify(detachCh, err)
+		}
+	}
+}
+
+// notify sends the given error to the given detach channel, unless another
+// error has been already sent.
+func notify(detachCh chan error, err error) {
+	select {
+	case detachCh <- err:
+	default:
+	}
+}
+
+// store adds the given message to the buffer, discarding the oldest messages
+// if the buffer is full. It must be called with b.mu held.
+func (b *Backend) store(msg message) {
+	b.buffer = append(b.buffer, msg)
+	b.size += len(msg.data)
+	for b.size > maxBufferSize && len(b.buffer) > 1 {
+		b.size -= len(b.buffer[0].data)
+		b.buffer = b.buffer[1:]
+	}
+}
+
+// maxBufferSize holds the maximum number of bytes buffered while no clients
+// are attached to a backend.
+const maxBufferSize = 64 * 1024
+
+// readMessage reads a whole message from the given connection.
+func readMessage(conn Conn) (message, error) {
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return message{}, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return message{}, err
+	}
+	return message{
+		messageType: messageType,
+		data:        data,
+	}, nil
+}
+
+// writeMessage writes the given message to the given connection.
+func writeMessage(conn Conn, msg message) error {
+	w, err := conn.NextWriter(msg.messageType)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(msg.data)); err != nil {
+		// Always close the writer, so that resources are released.
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
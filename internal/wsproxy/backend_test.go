@@ -0,0 +1,126 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package wsproxy_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/gorilla/websocket"
+
+	"github.com/juju/jujushell/internal/wsproxy"
+)
+
+func TestBackendAttach(t *testing.T) {
+	c := qt.New(t)
+	backendConn := newChanConn()
+	b := wsproxy.NewBackend(backendConn)
+	defer b.Close()
+
+	// Attach a client.
+	client := newChanConn()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.Attach(client)
+	}()
+
+	// Messages are copied back and forth.
+	client.in <- "ping"
+	c.Assert(<-backendConn.out, qt.Equals, "ping")
+	backendConn.in <- "pong"
+	c.Assert(<-client.out, qt.Equals, "pong")
+
+	// Detach the client by closing its connection.
+	client.Close()
+	c.Assert(<-errCh, qt.ErrorMatches, "connection closed")
+
+	// Messages sent by the backend while no clients are attached are sent to
+	// the next client.
+	backendConn.in <- "these"
+	backendConn.in <- "are the voyages"
+	client = newChanConn()
+	go func() {
+		errCh <- b.Attach(client)
+	}()
+	c.Assert(<-client.out, qt.Equals, "these")
+	c.Assert(<-client.out, qt.Equals, "are the voyages")
+	client.in <- "exterminate"
+	c.Assert(<-backendConn.out, qt.Equals, "exterminate")
+
+	// Only one client at a time can be attached.
+	err := b.Attach(newChanConn())
+	c.Assert(err, qt.ErrorMatches, "a client is already attached")
+
+	// Closing the backend connection detaches the client.
+	b.Close()
+	c.Assert(<-errCh, qt.ErrorMatches, "backend connection closed: connection closed")
+	<-b.Done()
+
+	// Clients can no longer be attached.
+	err = b.Attach(newChanConn())
+	c.Assert(err, qt.ErrorMatches, "backend connection closed: connection closed")
+}
+
+// newChanConn returns a new connection used for testing.
+func newChanConn() *chanConn {
+	return &chanConn{
+		in:     make(chan string),
+		out:    make(chan string),
+		closed: make(chan struct{}),
+	}
+}
+
+// chanConn implements wsproxy.BackendConn for testing. Messages sent to the
+// in channel can be read from the connection, and messages written to the
+// connection are sent to the out channel.
+type chanConn struct {
+	in     chan string
+	out    chan string
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *chanConn) NextReader() (messageType int, r io.Reader, err error) {
+	select {
+	case msg := <-c.in:
+		return websocket.TextMessage, strings.NewReader(msg), nil
+	case <-c.closed:
+		return 0, nil, errConnClosed
+	}
+}
+
+func (c *chanConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &chanWriter{
+		conn: c,
+	}, nil
+}
+
+func (c *chanConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// chanWriter is a writer sending the written message on close.
+type chanWriter struct {
+	bytes.Buffer
+	conn *chanConn
+}
+
+func (w *chanWriter) Close() error {
+	select {
+	case w.conn.out <- w.String():
+		return nil
+	case <-w.conn.closed:
+		return errConnClosed
+	}
+}
+
+var errConnClosed = errors.New("connection closed")
@@ -38,6 +38,8 @@ func copyMessage(dst, src Conn) error {
 		return err
 	}
 	if _, err := io.Copy(w, r); err != nil {
+		// Always close the writer, so that resources are released.
+		w.Close()
 		return err
 	}
 	return w.Close()
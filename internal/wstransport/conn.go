@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 
 	"github.com/gorilla/websocket"
 	errgo "gopkg.in/errgo.v1"
@@ -42,8 +45,31 @@ type Conn interface {
 
 // Upgrade upgrades the HTTP server connection to the WebSocket protocol.
 // If the upgrade fails, then Upgrade replies to the client with an HTTP error.
-func Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// Connections are only accepted if their origin matches one of the given
+// allowed origin patterns, or if no patterns are provided. If the origin is
+// not allowed, the cause of the returned error is ErrOriginNotAllowed. See
+// OriginAllowed for a description of the patterns syntax.
+func Upgrade(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (Conn, error) {
+	var rejected bool
+	u := upgrader
+	u.CheckOrigin = func(r *http.Request) bool {
+		if len(allowedOrigins) == 0 {
+			return true
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// The request has not been sent by a web browser.
+			return true
+		}
+		rejected = !OriginAllowed(origin, allowedOrigins)
+		return !rejected
+	}
+	conn, err := u.Upgrade(w, r, nil)
+	if rejected {
+		origin := r.Header.Get("Origin")
+		log.Infow("WebSocket connection rejected: origin not allowed", "origin", origin, "remote-addr", r.RemoteAddr)
+		return nil, errgo.WithCausef(err, ErrOriginNotAllowed, "origin %q not allowed", origin)
+	}
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -52,6 +78,39 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
 	}, nil
 }
 
+// UpgradeFunc is the signature of Upgrade.
+type UpgradeFunc func(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (Conn, error)
+
+// ErrOriginNotAllowed is the error cause used when a connection is rejected
+// because its origin is not allowed.
+var ErrOriginNotAllowed = errgo.New("origin not allowed")
+
+// OriginAllowed reports whether the given origin, as included in the Origin
+// header of HTTP requests, matches any of the given patterns. Patterns can
+// include "*" wildcards, and are matched against the origin host name, for
+// instance "*.example.com". Patterns including a port, like "example.com:8080",
+// are matched against the origin host and port, and patterns including a
+// scheme, like "https://*.example.com", are matched against the whole origin.
+func OriginAllowed(origin string, patterns []string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		target := u.Hostname()
+		if strings.Contains(pattern, "://") {
+			target = u.Scheme + "://" + u.Host
+		} else if strings.Contains(pattern, ":") {
+			target = u.Host
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // connection implements Conn.
 type connection struct {
 	*websocket.Conn
@@ -89,11 +148,9 @@ func writeResponse(conn Conn, op apiparams.Operation, code apiparams.ResponseCod
 	return nil
 }
 
-// upgrader is an HTTP connection upgrader to WebSocket allowing all origins.
+// upgrader is an HTTP connection upgrader to WebSocket. Origins are checked
+// by Upgrade.
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(*http.Request) bool {
-		return true
-	},
 	ReadBufferSize:  webSocketBufferSize,
 	WriteBufferSize: webSocketBufferSize,
 }
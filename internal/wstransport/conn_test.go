@@ -12,6 +12,7 @@ import (
 
 	qt "github.com/frankban/quicktest"
 	"github.com/gorilla/websocket"
+	errgo "gopkg.in/errgo.v1"
 
 	"github.com/juju/jujushell/apiparams"
 	"github.com/juju/jujushell/internal/wstransport"
@@ -68,6 +69,127 @@ func TestConnOK(t *testing.T) {
 	})
 }
 
+var upgradeOriginTests = []struct {
+	about          string
+	allowedOrigins []string
+	origin         string
+	expectedError  string
+}{{
+	about:  "all origins allowed",
+	origin: "https://bad-wolf.example.com",
+}, {
+	about:          "no origin",
+	allowedOrigins: []string{"example.com"},
+}, {
+	about:          "origin allowed",
+	allowedOrigins: []string{"jujucharms.com", "*.example.com"},
+	origin:         "https://shell.example.com",
+}, {
+	about:          "origin not allowed",
+	allowedOrigins: []string{"jujucharms.com", "*.example.com"},
+	origin:         "https://bad-wolf.com",
+	expectedError:  `origin "https://bad-wolf.com" not allowed`,
+}}
+
+func TestUpgradeOrigin(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range upgradeOriginTests {
+		c.Run(test.about, func(c *qt.C) {
+			errs := make(chan error, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				conn, err := wstransport.Upgrade(w, req, test.allowedOrigins)
+				if err == nil {
+					conn.Close()
+				}
+				errs <- err
+			}))
+			defer srv.Close()
+
+			header := make(http.Header)
+			if test.origin != "" {
+				header.Set("Origin", test.origin)
+			}
+			conn, resp, dialErr := websocket.DefaultDialer.Dial(wsURL(srv.URL), header)
+			err := <-errs
+			if test.expectedError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectedError)
+				c.Assert(errgo.Cause(err), qt.Equals, wstransport.ErrOriginNotAllowed)
+				c.Assert(dialErr, qt.Not(qt.IsNil))
+				c.Assert(resp.StatusCode, qt.Equals, http.StatusForbidden)
+				return
+			}
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(dialErr, qt.Equals, nil)
+			conn.Close()
+		})
+	}
+}
+
+var originAllowedTests = []struct {
+	origin   string
+	patterns []string
+	expected bool
+}{{
+	origin:   "https://example.com",
+	patterns: []string{"example.com"},
+	expected: true,
+}, {
+	origin:   "https://Example.COM",
+	patterns: []string{"example.com"},
+	expected: true,
+}, {
+	origin:   "https://example.com:8080",
+	patterns: []string{"example.com"},
+	expected: true,
+}, {
+	origin:   "https://shell.example.com",
+	patterns: []string{"example.com"},
+}, {
+	origin:   "https://shell.example.com",
+	patterns: []string{"jujucharms.com", "*.example.com"},
+	expected: true,
+}, {
+	origin:   "https://example.com.bad-wolf.com",
+	patterns: []string{"example.com*"},
+	expected: true,
+}, {
+	origin:   "https://example.com.bad-wolf.com",
+	patterns: []string{"example.com", "*.example.com"},
+}, {
+	origin:   "https://example.com:8080",
+	patterns: []string{"example.com:8080"},
+	expected: true,
+}, {
+	origin:   "https://example.com:8081",
+	patterns: []string{"example.com:8080"},
+}, {
+	origin:   "https://shell.example.com",
+	patterns: []string{"https://*.example.com"},
+	expected: true,
+}, {
+	origin:   "http://shell.example.com",
+	patterns: []string{"https://*.example.com"},
+}, {
+	origin:   "https://anything.com",
+	patterns: []string{"*"},
+	expected: true,
+}, {
+	origin:   "null",
+	patterns: []string{"*"},
+}, {
+	origin:   "https://example.com",
+	patterns: []string{"[bad"},
+}}
+
+func TestOriginAllowed(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range originAllowedTests {
+		c.Run(test.origin, func(c *qt.C) {
+			c.Assert(wstransport.OriginAllowed(test.origin, test.patterns), qt.Equals, test.expected)
+		})
+	}
+}
+
 // wsURL returns a WebSocket URL from the given HTTP URL.
 func wsURL(u string) string {
 	return strings.Replace(u, "http://", "ws://", 1)
@@ -87,7 +209,7 @@ func wsHandler(f func(conn wstransport.Conn)) http.Handler {
 // upgrade upgrades the given HTTP request and returns the resulting WebSocket
 // connection.
 func upgrade(w http.ResponseWriter, req *http.Request) wstransport.Conn {
-	conn, err := wstransport.Upgrade(w, req)
+	conn, err := wstransport.Upgrade(w, req, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -4,6 +4,7 @@
 package jujushell
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -12,43 +13,274 @@ import (
 	"github.com/juju/jujushell/internal/api"
 )
 
-// NewServer returns a new handler that handles juju shell requests.
-func NewServer(p Params) (http.Handler, error) {
+// NewServer returns a new server that handles juju shell requests.
+func NewServer(p Params) (*Server, error) {
 	mux := http.NewServeMux()
-	err := api.Register(mux, api.JujuParams{
-		Addrs: p.JujuAddrs,
-		Cert:  p.JujuCert,
-	}, api.LXDParams{
-		ImageName:     p.ImageName,
-		LXDSocketPath: p.LXDSocketPath,
-		Profiles:      p.Profiles,
-	}, api.SvcParams{
-		AllowedUsers:    p.AllowedUsers,
-		SessionDuration: p.SessionDuration,
-		WelcomeMessage:  p.WelcomeMessage,
-	})
+	controllers := make(map[string]api.ControllerParams, len(p.Controllers))
+	for name, ctrl := range p.Controllers {
+		controllers[name] = api.ControllerParams{
+			Addrs: ctrl.Addrs,
+			Cert:  ctrl.Cert,
+		}
+	}
+	if len(controllers) == 0 {
+		controllers[defaultControllerName] = api.ControllerParams{
+			Addrs: p.JujuAddrs,
+			Cert:  p.JujuCert,
+		}
+	}
+	lxd, svc := apiParams(p)
+	s, err := api.Register(mux, api.JujuParams{
+		Controllers:         controllers,
+		LoginAllControllers: p.LoginAllControllers,
+	}, lxd, svc)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return mux, nil
+	return &Server{
+		Handler: mux,
+		svc:     s,
+	}, nil
+}
+
+// Server is an http.Handler serving juju shell requests.
+type Server struct {
+	http.Handler
+	svc *api.Service
+}
+
+// Reload applies the given parameters to the running server, without
+// affecting existing sessions. Only the LXD image name, profiles, image
+// rules, flavours and resource limits, the allowed users, the session, login,
+// lockout and container limits, the welcome message and the session duration
+// are applied: changes to other parameters require a restart.
+func (s *Server) Reload(p Params) {
+	s.svc.Reload(apiParams(p))
+}
+
+// Shutdown gracefully shuts down the server. New shell sessions are refused,
+// and users with a live connection are notified that the server is shutting
+// down. Then Shutdown waits for live connections to be closed by clients, or
+// for their shell sessions to end, until the given context is done. At that
+// point, remaining connections are forcibly closed and an error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.svc.Shutdown(ctx); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// apiParams returns the API LXD and service parameters from the given server
+// parameters.
+func apiParams(p Params) (api.LXDParams, api.SvcParams) {
+	flavours := make(map[string]api.Flavour, len(p.Flavours))
+	for name, f := range p.Flavours {
+		flavours[name] = api.Flavour{
+			ImageName: f.ImageName,
+			Limits:    lxdLimits(f.Limits),
+			Profiles:  f.Profiles,
+			Users:     f.Users,
+		}
+	}
+	imageRules := make([]api.ImageRule, len(p.ImageRules))
+	for i, r := range p.ImageRules {
+		imageRules[i] = api.ImageRule{
+			Users:     r.Users,
+			ImageName: r.ImageName,
+			Profiles:  r.Profiles,
+		}
+	}
+	userLimits := make(map[string]api.Limits, len(p.UserLimits))
+	for user, l := range p.UserLimits {
+		userLimits[user] = lxdLimits(l)
+	}
+	lxd := api.LXDParams{
+		Flavours:       flavours,
+		HomeVolumePool: p.HomeVolumePool,
+		ImageName:      p.ImageName,
+		ImageRules:     imageRules,
+		Limits:         lxdLimits(p.Limits),
+		LXDSocketPath:  p.LXDSocketPath,
+		PoolSize:       p.PoolSize,
+		PreservedFiles: p.PreservedFiles,
+		Profiles:       p.Profiles,
+		UserLimits:     userLimits,
+	}
+	svc := api.SvcParams{
+		AdminUsers:         p.AdminUsers,
+		AllowedOrigins:     p.AllowedOrigins,
+		AllowedUsers:       p.AllowedUsers,
+		ContainerExpiry:    p.ContainerExpiry,
+		LockoutDuration:    p.LockoutDuration,
+		LockoutThreshold:   p.LockoutThreshold,
+		LoginRateLimit:     p.LoginRateLimit,
+		MaxContainers:      p.MaxContainers,
+		MaxSessionsPerAddr: p.MaxSessionsPerAddr,
+		MaxSessionsPerUser: p.MaxSessionsPerUser,
+		RecordDir:          p.RecordDir,
+		RecordInput:        p.RecordInput,
+		RecordRetention:    p.RecordRetention,
+		ResumeDuration:     p.ResumeDuration,
+		SessionDuration:    p.SessionDuration,
+		StartQueueSize:     p.StartQueueSize,
+		WelcomeMessage:     p.WelcomeMessage,
+	}
+	return lxd, svc
 }
 
 // Params holds parameters for running the server.
 type Params struct {
+	// AdminUsers holds a list of names of users allowed to use the admin API.
+	AdminUsers []string
+	// AllowedOrigins holds the patterns of origins allowed to open WebSocket
+	// connections. All origins are allowed if the list is empty.
+	AllowedOrigins []string
 	// AllowedUsers holds a list of names of users allowed to use the service.
 	AllowedUsers []string
+	// ContainerExpiry holds the time duration of inactivity before deleting
+	// stopped containers. A zero value means that containers are never
+	// deleted.
+	ContainerExpiry time.Duration
+	// Controllers holds the Juju controllers users can log into, keyed by
+	// controller name. If empty, a single controller is used, as specified
+	// by JujuAddrs and JujuCert.
+	Controllers map[string]Controller
+	// Flavours holds the environments users can choose from when starting a
+	// session, keyed by name.
+	Flavours map[string]Flavour
+	// HomeVolumePool optionally holds the LXD storage pool where persistent
+	// per-user volumes, mounted in the home directory, are created. No files
+	// are persisted if empty.
+	HomeVolumePool string
 	// ImageName holds the name of the LXD image to use to create containers.
 	ImageName string
-	// JujuAddrs holds the addresses of the current Juju controller.
+	// ImageRules holds rules selecting the image and profiles for specific
+	// users, in order of precedence.
+	ImageRules []ImageRule
+	// JujuAddrs holds the addresses of the Juju controller, when only one
+	// controller is used.
 	JujuAddrs []string
 	// JujuCert holds the controller CA certificate in PEM format.
 	JujuCert string
+	// Limits holds the resource limits applied to new containers.
+	Limits Limits
+	// LockoutDuration holds the time duration for which users and remote
+	// hosts are locked out after too many failed login attempts.
+	LockoutDuration time.Duration
+	// LockoutThreshold holds the number of consecutive failed login attempts
+	// after which users and remote hosts are locked out. A zero value means
+	// that lockouts are disabled.
+	LockoutThreshold int
+	// LoginAllControllers holds whether users are also logged into all the
+	// other controllers with the same credentials.
+	LoginAllControllers bool
+	// LoginRateLimit holds the maximum number of login attempts per minute
+	// from the same remote host. A zero value means no limit.
+	LoginRateLimit int
 	// LXDSocketPath holds the path to the LXD unix socket.
 	LXDSocketPath string
+	// MaxContainers holds the maximum number of user containers running at
+	// the same time. Further container starts are queued. A zero value means
+	// no limit.
+	MaxContainers int
+	// MaxSessionsPerAddr holds the maximum number of simultaneous WebSocket
+	// sessions from the same remote host. A zero value means no limit.
+	MaxSessionsPerAddr int
+	// MaxSessionsPerUser holds the maximum number of simultaneous WebSocket
+	// sessions of the same user. A zero value means no limit.
+	MaxSessionsPerUser int
+	// PoolSize holds the number of pre-warmed containers kept ready to be
+	// assigned to new users. A zero value disables the pool.
+	PoolSize int
+	// PreservedFiles holds the paths of user files, relative to the home
+	// directory, preserved when containers are recreated after an image
+	// change.
+	PreservedFiles []string
 	// Profiles holds the LXD profiles to use when launching containers.
 	Profiles []string
+	// RecordDir optionally holds the directory where shell sessions are
+	// recorded. Sessions are not recorded if empty.
+	RecordDir string
+	// RecordInput holds whether to also record the terminal input.
+	RecordInput bool
+	// RecordRetention holds the time duration after which session recordings
+	// are removed. A zero value means that recordings are never removed.
+	RecordRetention time.Duration
+	// ResumeDuration holds the time duration in which a disconnected session
+	// can be resumed. A zero value means that sessions cannot be resumed.
+	ResumeDuration time.Duration
 	// SessionDuration holds time duration before expiring container sessions.
 	SessionDuration time.Duration
+	// StartQueueSize holds the maximum number of container starts waiting in
+	// the queue when MaxContainers is reached. Further starts are refused.
+	StartQueueSize int
+	// UserLimits holds per-user resource limits, overriding the global ones.
+	UserLimits map[string]Limits
 	// WelcomeMessage optionally holds an initial welcome message for users.
 	WelcomeMessage string
 }
+
+// Controller holds the addresses and certificate of a Juju controller.
+type Controller struct {
+	// Addrs holds the addresses of the Juju controller.
+	Addrs []string
+	// Cert optionally holds the controller CA certificate in PEM format.
+	Cert string
+}
+
+// Flavour holds an environment users can choose when starting a session.
+type Flavour struct {
+	// ImageName optionally holds the name of the LXD image to use. The image
+	// otherwise selected for the user is used if empty.
+	ImageName string
+	// Limits optionally holds resource limits overriding the ones otherwise
+	// applied to the user's container.
+	Limits Limits
+	// Profiles optionally holds the LXD profiles to use. The profiles
+	// otherwise selected for the user are used if empty.
+	Profiles []string
+	// Users optionally holds the names of the users allowed to choose the
+	// flavour. Names can include "*" wildcards. All users are allowed if
+	// empty.
+	Users []string
+}
+
+// ImageRule holds the LXD image and profiles used for specific users.
+type ImageRule struct {
+	// Users holds the names of the users the rule applies to. Names can
+	// include "*" wildcards.
+	Users []string
+	// ImageName optionally holds the name of the LXD image to use. The
+	// global image is used if empty.
+	ImageName string
+	// Profiles optionally holds the LXD profiles to use. The global profiles
+	// are used if empty.
+	Profiles []string
+}
+
+// Limits holds resource limits for containers. Empty values mean that no
+// limits are set.
+type Limits struct {
+	// CPU holds the number of CPUs or the CPU set available to containers.
+	CPU string
+	// Memory holds the memory limit.
+	Memory string
+	// Processes holds the maximum number of processes in containers.
+	Processes int
+	// Disk holds the size of the container root disk.
+	Disk string
+}
+
+// defaultControllerName holds the name assigned locally to the Juju controller
+// when only one controller is used.
+const defaultControllerName = "ctrl"
+
+// lxdLimits converts the given limits to API container limits.
+func lxdLimits(l Limits) api.Limits {
+	return api.Limits{
+		CPU:       l.CPU,
+		Memory:    l.Memory,
+		Processes: l.Processes,
+		Disk:      l.Disk,
+	}
+}